@@ -0,0 +1,275 @@
+package agent
+
+import (
+	"bytes"
+	"expvar"
+	"sync"
+	"time"
+
+	. "github.com/frankhang/doppler/config"
+	"github.com/frankhang/doppler/telemetry"
+)
+
+const (
+	dropReasonQueueFull   = "queue_full"
+	dropReasonRateLimited = "rate_limited"
+	dropReasonParseError  = "parse_error"
+
+	// the source of the messages of the sources beyond max_sources
+	otherSources = "other"
+	// the source of the messages of the unidentified clients
+	unknownSource = "unknown"
+)
+
+var (
+	dropExpvars = expvar.NewMap("agent-drops")
+
+	tlmDropped = telemetry.NewCounter("agent", "dropped_messages",
+		[]string{"reason", "source"}, "Count of messages dropped by reason and source")
+	tlmPriorityPackets = telemetry.NewCounter("agent", "priority_packets",
+		[]string{"state"}, "Count of service check packets sent on the priority lane")
+)
+
+// admission decides which of the messages received enter the intake queue.
+// The messages of each source are rate limited by a token bucket, the service
+// checks aren't, and skip the queue through the priority lane if enabled.
+// The messages dropped on the way are counted by reason and source.
+type admission struct {
+	rate         float64 // tokens per second, 0 disables the rate limiting
+	burst        float64
+	maxSources   int
+	ttl          time.Duration
+	dropWhenFull bool
+	packetPool   *PacketPool
+	priorityOut  chan Packets // nil when there is no priority lane
+
+	sources   map[string]*source
+	other     *source // shared by the sources beyond maxSources
+	lastSweep time.Time
+	lock      sync.Mutex
+}
+
+// source is a client tracked by the admission, with its token bucket
+type source struct {
+	tokens float64
+	last   time.Time // of the last refill
+	seen   time.Time
+}
+
+func newAdmission(c Admission, packetPool *PacketPool) *admission {
+	a := &admission{
+		rate:         c.RateLimit,
+		burst:        float64(c.Burst),
+		maxSources:   c.MaxSources,
+		ttl:          time.Duration(c.SourceTTL) * time.Second,
+		dropWhenFull: c.DropWhenFull,
+		packetPool:   packetPool,
+		sources:      make(map[string]*source),
+	}
+	if a.burst <= 0 {
+		a.burst = a.rate
+	}
+	a.other = &source{tokens: a.burst, last: time.Now()}
+	if c.PriorityQueueSize > 0 {
+		a.priorityOut = make(chan Packets, c.PriorityQueueSize)
+	}
+	return a
+}
+
+// admit returns the messages of contents entering the intake queue, moved in
+// place. The messages over the rate limit of the source are dropped, the
+// service checks are sent on the priority lane, or kept if it is full.
+func (a *admission) admit(name, origin string, contents []byte) []byte {
+	if a == nil || (a.rate == 0 && a.priorityOut == nil) {
+		return contents
+	}
+
+	limited := a.rate > 0 && name != NoSource
+	if !limited && !bytes.Contains(contents, serviceCheckPrefix) {
+		return contents
+	}
+	allowed := 0
+	if limited {
+		// every token taken is used by a message below
+		_, n := countMessages(contents)
+		allowed = a.take(name, n)
+	}
+
+	var priority *Packet
+	priorityLength, n, dropped := 0, 0, 0
+	for rest := contents; len(rest) > 0; {
+		message := rest
+		if i := bytes.IndexByte(rest, messageSeparator); i >= 0 {
+			message, rest = rest[:i], rest[i+1:]
+		} else {
+			rest = nil
+		}
+		if len(message) == 0 {
+			continue
+		}
+
+		if findMessageType(message) == serviceCheckType {
+			if a.priorityOut != nil {
+				if priority == nil {
+					priority = a.packetPool.Get()
+				}
+				if priorityLength+len(message)+1 <= len(priority.buffer) {
+					priorityLength += copy(priority.buffer[priorityLength:], message)
+					priority.buffer[priorityLength] = messageSeparator
+					priorityLength++
+					continue
+				}
+			}
+		} else if limited {
+			if allowed == 0 {
+				dropped++
+				continue
+			}
+			allowed--
+		}
+		// the message is never moved forward, it doesn't overlap the next ones
+		if n > 0 {
+			contents[n] = messageSeparator
+			n++
+		}
+		n += copy(contents[n:], message)
+	}
+
+	if dropped > 0 {
+		a.dropped(dropReasonRateLimited, name, dropped)
+	}
+	if priority == nil {
+		return contents[:n]
+	}
+	if priorityLength == 0 {
+		a.packetPool.Put(priority)
+		return contents[:n]
+	}
+
+	priority.Contents = priority.buffer[:priorityLength]
+	priority.Origin = origin
+	priority.Source = name
+	select {
+	case a.priorityOut <- Packets{priority}:
+		tlmPriorityPackets.Inc("ok")
+	default:
+		// the admitted messages are shorter than contents, the service checks fit
+		tlmPriorityPackets.Inc("full")
+		if n > 0 {
+			contents[n] = messageSeparator
+			n++
+		}
+		n += copy(contents[n:], priority.Contents[:priorityLength-1])
+		a.packetPool.Put(priority)
+	}
+	return contents[:n]
+}
+
+// limiting returns whether the messages are rate limited per source
+func (a *admission) limiting() bool {
+	return a != nil && a.rate > 0
+}
+
+// enqueue sends the packets to the intake queue, blocking while it is full
+// unless dropWhenFull is set. The dropped packets return to the pool.
+func (a *admission) enqueue(out chan Packets, packets Packets) {
+	if a == nil || !a.dropWhenFull {
+		out <- packets
+		return
+	}
+	select {
+	case out <- packets:
+	default:
+		for _, packet := range packets {
+			messages, _ := countMessages(packet.Contents)
+			a.dropped(dropReasonQueueFull, packet.Source, messages)
+			a.packetPool.Put(packet)
+		}
+	}
+}
+
+// dropped counts the messages of the source dropped for the reason
+func (a *admission) dropped(reason, name string, messages int) {
+	dropExpvars.Add(reason, int64(messages))
+	tlmDropped.Add(float64(messages), reason, a.label(name))
+}
+
+// label returns the source label of the drops of the messages from name
+func (a *admission) label(name string) string {
+	if name == NoSource {
+		return unknownSource
+	}
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	if a.lookup(name, time.Now()) == a.other {
+		return otherSources
+	}
+	return name
+}
+
+// take takes at most n tokens from the bucket of the source, it returns the
+// count of tokens taken
+func (a *admission) take(name string, n int) int {
+	now := time.Now()
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	s := a.lookup(name, now)
+	s.tokens += now.Sub(s.last).Seconds() * a.rate
+	if s.tokens > a.burst {
+		s.tokens = a.burst
+	}
+	s.last = now
+
+	taken := int(s.tokens)
+	if taken > n {
+		taken = n
+	}
+	s.tokens -= float64(taken)
+	return taken
+}
+
+// lookup returns the source named name, tracked if there is room. The sources
+// idle for longer than the ttl are forgotten when the room is needed, at most
+// once per second. The lock must be held.
+func (a *admission) lookup(name string, now time.Time) *source {
+	s, ok := a.sources[name]
+	if !ok {
+		if len(a.sources) >= a.maxSources && now.Sub(a.lastSweep) >= time.Second {
+			a.lastSweep = now
+			for key, idle := range a.sources {
+				if now.Sub(idle.seen) > a.ttl {
+					delete(a.sources, key)
+				}
+			}
+		}
+		if len(a.sources) >= a.maxSources {
+			return a.other
+		}
+		s = &source{tokens: a.burst, last: now}
+		a.sources[name] = s
+	}
+	s.seen = now
+	return s
+}
+
+// countMessages returns the count of the non-empty messages in contents, and
+// the count of those which aren't service checks, the rate limited ones
+func countMessages(contents []byte) (messages, limited int) {
+	for rest := contents; len(rest) > 0; {
+		message := rest
+		if i := bytes.IndexByte(rest, messageSeparator); i >= 0 {
+			message, rest = rest[:i], rest[i+1:]
+		} else {
+			rest = nil
+		}
+		if len(message) == 0 {
+			continue
+		}
+		messages++
+		if findMessageType(message) != serviceCheckType {
+			limited++
+		}
+	}
+	return messages, limited
+}
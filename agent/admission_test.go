@@ -0,0 +1,109 @@
+package agent
+
+import (
+	"expvar"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	. "github.com/frankhang/doppler/config"
+)
+
+// droppedCount returns the count of messages dropped for the reason
+func droppedCount(reason string) int64 {
+	if v, ok := dropExpvars.Get(reason).(*expvar.Int); ok {
+		return v.Value()
+	}
+	return 0
+}
+
+func TestCountMessages(t *testing.T) {
+	for _, tc := range []struct {
+		contents string
+		messages int
+		limited  int
+	}{
+		{contents: "", messages: 0, limited: 0},
+		{contents: "a:1|c", messages: 1, limited: 1},
+		{contents: "a:1|c\n", messages: 1, limited: 1},
+		{contents: "a:1|c\n\nb:1|c\n", messages: 2, limited: 2},
+		{contents: "_sc|db|0\na:1|c\n_sc|cache|1", messages: 3, limited: 1},
+	} {
+		messages, limited := countMessages([]byte(tc.contents))
+		assert.Equal(t, tc.messages, messages, "contents %q", tc.contents)
+		assert.Equal(t, tc.limited, limited, "contents %q", tc.contents)
+	}
+}
+
+func TestAdmitRateLimit(t *testing.T) {
+	a := newAdmission(Admission{RateLimit: 0.001, Burst: 3, MaxSources: 10, SourceTTL: 60}, NewPacketPool(64))
+	before := droppedCount(dropReasonRateLimited)
+
+	// the empty message after the trailing separator takes no token
+	assert.Equal(t, "a:1|c\nb:1|c", string(a.admit("10.0.0.1", NoOrigin, []byte("a:1|c\nb:1|c\n"))))
+	assert.Equal(t, "c:1|c\n_sc|db|0", string(a.admit("10.0.0.1", NoOrigin, []byte("c:1|c\nd:1|c\n_sc|db|0\n"))))
+	assert.Equal(t, int64(1), droppedCount(dropReasonRateLimited)-before)
+
+	// the sources have their own bucket, the unidentified clients aren't limited
+	assert.Equal(t, "a:1|c", string(a.admit("10.0.0.2", NoOrigin, []byte("a:1|c"))))
+	assert.Equal(t, "a:1|c\nb:1|c", string(a.admit(NoSource, NoOrigin, []byte("a:1|c\nb:1|c"))))
+}
+
+func TestAdmitPriorityLane(t *testing.T) {
+	pool := NewPacketPool(64)
+	a := newAdmission(Admission{PriorityQueueSize: 1}, pool)
+
+	contents := a.admit("10.0.0.1", "container", []byte("a:1|c\n_sc|db|0\nb:1|c\n_sc|cache|1\n"))
+	assert.Equal(t, "a:1|c\nb:1|c", string(contents))
+	require.Len(t, a.priorityOut, 1)
+	priority := (<-a.priorityOut)[0]
+	assert.Equal(t, "_sc|db|0\n_sc|cache|1\n", string(priority.Contents))
+	assert.Equal(t, "container", priority.Origin)
+	assert.Equal(t, "10.0.0.1", priority.Source)
+
+	// the service checks are kept when the priority lane is full
+	a.priorityOut <- Packets{pool.Get()}
+	contents = a.admit("10.0.0.1", NoOrigin, []byte("_sc|db|0\na:1|c"))
+	assert.Equal(t, "a:1|c\n_sc|db|0", string(contents))
+
+	// without service check, the contents are kept as is
+	assert.Equal(t, "a:1|c\n", string(a.admit("10.0.0.1", NoOrigin, []byte("a:1|c\n"))))
+}
+
+func TestEnqueueDroppedCount(t *testing.T) {
+	pool := NewPacketPool(64)
+	a := newAdmission(Admission{DropWhenFull: true}, pool)
+	out := make(chan Packets, 1)
+	before := droppedCount(dropReasonQueueFull)
+
+	packet := func(contents string) *Packet {
+		p := pool.Get()
+		p.Contents = append(p.buffer[:0], contents...)
+		return p
+	}
+	a.enqueue(out, Packets{packet("a:1|c\n")})
+	// the empty message after a trailing separator isn't counted
+	a.enqueue(out, Packets{packet("a:1|c\nb:1|c\n"), packet("c:1|c")})
+	assert.Len(t, out, 1)
+	assert.Equal(t, int64(3), droppedCount(dropReasonQueueFull)-before)
+}
+
+func TestAdmissionSources(t *testing.T) {
+	a := newAdmission(Admission{RateLimit: 0.001, Burst: 1, MaxSources: 1, SourceTTL: 60}, NewPacketPool(64))
+
+	assert.Equal(t, 1, a.take("10.0.0.1", 2))
+	// the sources beyond max_sources share the bucket of other
+	assert.Equal(t, 1, a.take("10.0.0.2", 2))
+	assert.Equal(t, 0, a.take("10.0.0.3", 2))
+	assert.Equal(t, "10.0.0.1", a.label("10.0.0.1"))
+	assert.Equal(t, otherSources, a.label("10.0.0.2"))
+	assert.Equal(t, unknownSource, a.label(NoSource))
+
+	// an idle source is forgotten when the room is needed
+	a.sources["10.0.0.1"].seen = time.Now().Add(-2 * time.Minute)
+	a.lastSweep = time.Time{}
+	assert.Equal(t, 1, a.take("10.0.0.2", 2))
+	assert.Equal(t, "10.0.0.2", a.label("10.0.0.2"))
+}
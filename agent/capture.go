@@ -0,0 +1,347 @@
+package agent
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"github.com/frankhang/util/errors"
+	"github.com/frankhang/util/logutil"
+	"go.uber.org/zap"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/frankhang/doppler/util/containers"
+)
+
+// A capture file starts with captureMagic and the start time of the capture,
+// in unix nanoseconds as a big endian int64. Each packet follows as:
+//
+//	uvarint  nanoseconds since the start of the capture
+//	uvarint  length of the origin, then the origin
+//	uvarint  length of the contents, then the contents
+const captureMagic = "DOPCAP1\n"
+
+// maxCapturedLength bounds the length of an origin or contents read, the
+// packets are never larger
+const maxCapturedLength = 16 << 20
+
+// errCaptureRunning is returned when a capture is started while another runs
+var errCaptureRunning = errors.New("a capture is already running")
+
+// CaptureStatus is the status of the running or last capture
+type CaptureStatus struct {
+	Running bool      `json:"running"`
+	Path    string    `json:"path,omitempty"`
+	Started time.Time `json:"started,omitempty"`
+	Until   time.Time `json:"until,omitempty"`
+	MaxSize int64     `json:"max_size,omitempty"`
+	Packets int64     `json:"packets"`
+	Bytes   int64     `json:"bytes"`
+	Error   string    `json:"error,omitempty"`
+}
+
+// capture records the packets processed by the workers to a file, until it is
+// stopped, its duration elapsed or its file reached its max size
+type capture struct {
+	running int32 // atomic, 1 until the capture is stopped
+
+	sync.Mutex
+	status CaptureStatus
+	file   *os.File
+	w      *bufio.Writer
+	timer  *time.Timer
+	buf    [binary.MaxVarintLen64]byte // encoding buffer of the lengths
+}
+
+// StartCapture starts capturing the packets received to a new file of dir, for
+// duration or until the file reaches maxSize bytes
+func (s *Server) StartCapture(dir string, duration time.Duration, maxSize int64) (CaptureStatus, error) {
+	s.captureLock.Lock()
+	defer s.captureLock.Unlock()
+
+	if c := s.currentCapture(); c != nil && c.isRunning() {
+		return c.getStatus(), errCaptureRunning
+	}
+
+	if dir == "" {
+		dir = os.TempDir()
+	}
+	now := time.Now()
+	path, file, err := createCaptureFile(dir, now)
+	if err != nil {
+		return CaptureStatus{}, err
+	}
+
+	c := &capture{
+		running: 1,
+		status: CaptureStatus{
+			Running: true,
+			Path:    path,
+			Started: now,
+			Until:   now.Add(duration),
+			MaxSize: maxSize,
+		},
+		file: file,
+		w:    bufio.NewWriter(file),
+	}
+	header := make([]byte, len(captureMagic)+8)
+	copy(header, captureMagic)
+	binary.BigEndian.PutUint64(header[len(captureMagic):], uint64(now.UnixNano()))
+	if err = c.writeBytes(header); err != nil {
+		file.Close()
+		os.Remove(path)
+		return CaptureStatus{}, err
+	}
+	c.timer = time.AfterFunc(duration, func() { c.stop(nil) })
+
+	s.capture.Store(c)
+	logutil.BgLogger().Info("Agent: capture started", zap.String("path", path),
+		zap.Duration("duration", duration), zap.Int64("max_size", maxSize))
+	return c.getStatus(), nil
+}
+
+// createCaptureFile creates the file of a capture started at now, it is
+// suffixed when a capture already started within the same second
+func createCaptureFile(dir string, now time.Time) (string, *os.File, error) {
+	name := "doppler-capture-" + now.Format("20060102-150405")
+	for i := 0; ; i++ {
+		path := filepath.Join(dir, name+".cap")
+		if i > 0 {
+			path = filepath.Join(dir, fmt.Sprintf("%s-%d.cap", name, i))
+		}
+		file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+		if err == nil || !os.IsExist(err) || i == 100 {
+			return path, file, err
+		}
+	}
+}
+
+// StopCapture stops the running capture
+func (s *Server) StopCapture() (CaptureStatus, error) {
+	s.captureLock.Lock()
+	defer s.captureLock.Unlock()
+
+	c := s.currentCapture()
+	if c == nil || !c.isRunning() {
+		return s.CaptureStatus(), errors.New("no capture is running")
+	}
+	c.stop(nil)
+	return c.getStatus(), nil
+}
+
+// CaptureStatus returns the status of the running or last capture
+func (s *Server) CaptureStatus() CaptureStatus {
+	if c := s.currentCapture(); c != nil {
+		return c.getStatus()
+	}
+	return CaptureStatus{}
+}
+
+// currentCapture returns the running or last capture, nil if none
+func (s *Server) currentCapture() *capture {
+	c, _ := s.capture.Load().(*capture)
+	return c
+}
+
+func (c *capture) isRunning() bool {
+	return atomic.LoadInt32(&c.running) == 1
+}
+
+func (c *capture) getStatus() CaptureStatus {
+	c.Lock()
+	defer c.Unlock()
+	return c.status
+}
+
+// write records the packets, the capture is stopped on error or once its
+// file reaches its max size
+func (c *capture) write(packets Packets) {
+	if !c.isRunning() {
+		return
+	}
+	c.Lock()
+	defer c.Unlock()
+	if !c.status.Running {
+		return
+	}
+
+	offset := uint64(time.Since(c.status.Started))
+	for _, packet := range packets {
+		err := c.writeUvarint(offset)
+		if err == nil {
+			err = c.writeUvarint(uint64(len(packet.Origin)))
+		}
+		if err == nil {
+			err = c.writeBytes([]byte(packet.Origin))
+		}
+		if err == nil {
+			err = c.writeUvarint(uint64(len(packet.Contents)))
+		}
+		if err == nil {
+			err = c.writeBytes(packet.Contents)
+		}
+		if err != nil {
+			c.stopLocked(err)
+			return
+		}
+		c.status.Packets++
+		if c.status.MaxSize > 0 && c.status.Bytes >= c.status.MaxSize {
+			c.stopLocked(nil)
+			return
+		}
+	}
+}
+
+func (c *capture) writeUvarint(x uint64) error {
+	n := binary.PutUvarint(c.buf[:], x)
+	return c.writeBytes(c.buf[:n])
+}
+
+func (c *capture) writeBytes(b []byte) error {
+	n, err := c.w.Write(b)
+	c.status.Bytes += int64(n)
+	return err
+}
+
+func (c *capture) stop(err error) {
+	c.Lock()
+	defer c.Unlock()
+	c.stopLocked(err)
+}
+
+// stopLocked flushes and closes the file of the capture, the lock must be held
+func (c *capture) stopLocked(err error) {
+	if !c.status.Running {
+		return
+	}
+	atomic.StoreInt32(&c.running, 0)
+	c.status.Running = false
+	c.timer.Stop()
+
+	if flushErr := c.w.Flush(); err == nil {
+		err = flushErr
+	}
+	if closeErr := c.file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		c.status.Error = err.Error()
+		logutil.BgLogger().Error("Agent: capture failed", zap.String("path", c.status.Path), zap.Error(err))
+		return
+	}
+	logutil.BgLogger().Info("Agent: capture stopped", zap.String("path", c.status.Path),
+		zap.Int64("packets", c.status.Packets), zap.Int64("bytes", c.status.Bytes))
+}
+
+// CapturedPacket is a packet read from a capture file
+type CapturedPacket struct {
+	Offset   time.Duration // since the start of the capture
+	Origin   string
+	Contents []byte
+}
+
+// CaptureReader reads the packets of a capture file
+type CaptureReader struct {
+	Start time.Time
+	r     *bufio.Reader
+}
+
+// NewCaptureReader reads the header of the capture
+func NewCaptureReader(r io.Reader) (*CaptureReader, error) {
+	br := bufio.NewReader(r)
+	header := make([]byte, len(captureMagic)+8)
+	if _, err := io.ReadFull(br, header); err != nil {
+		return nil, fmt.Errorf("invalid capture header: %v", err)
+	}
+	if string(header[:len(captureMagic)]) != captureMagic {
+		return nil, errors.New("not a capture file")
+	}
+	start := int64(binary.BigEndian.Uint64(header[len(captureMagic):]))
+	return &CaptureReader{Start: time.Unix(0, start), r: br}, nil
+}
+
+// Next returns the next packet of the capture, io.EOF at the end
+func (r *CaptureReader) Next() (*CapturedPacket, error) {
+	offset, err := binary.ReadUvarint(r.r)
+	if err != nil {
+		return nil, err
+	}
+	origin, err := r.readBytes()
+	if err != nil {
+		return nil, err
+	}
+	contents, err := r.readBytes()
+	if err != nil {
+		return nil, err
+	}
+	return &CapturedPacket{Offset: time.Duration(offset), Origin: string(origin), Contents: contents}, nil
+}
+
+func (r *CaptureReader) readBytes() ([]byte, error) {
+	length, err := binary.ReadUvarint(r.r)
+	if err != nil {
+		return nil, unexpectedEOF(err)
+	}
+	if length > maxCapturedLength {
+		return nil, fmt.Errorf("invalid capture: %d bytes long packet", length)
+	}
+	b := make([]byte, length)
+	if _, err = io.ReadFull(r.r, b); err != nil {
+		return nil, unexpectedEOF(err)
+	}
+	return b, nil
+}
+
+// unexpectedEOF reports a truncated packet
+func unexpectedEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+// Replay returns the contents of the packet to send back to a server. The
+// origin can't be replayed, the container ID it names is set as the container
+// field of the metrics instead, which the server resolves alike.
+func (p *CapturedPacket) Replay() []byte {
+	containerID := containerIDOf(p.Origin)
+	if containerID == "" {
+		return p.Contents
+	}
+
+	var b bytes.Buffer
+	contents := p.Contents
+	for {
+		message := nextMessage(&contents)
+		if message == nil {
+			break
+		}
+		if b.Len() > 0 {
+			b.WriteByte(messageSeparator)
+		}
+		b.Write(message)
+		if findMessageType(message) == metricSampleType && !hasContainerID(message) {
+			b.WriteString("|c:")
+			b.WriteString(containerID)
+		}
+	}
+	return b.Bytes()
+}
+
+// containerIDOf returns the container ID of an origin, empty if it isn't
+// a container
+func containerIDOf(origin string) string {
+	if len(origin) <= len(containers.ContainerEntityPrefix) || origin[:len(containers.ContainerEntityPrefix)] != containers.ContainerEntityPrefix {
+		return ""
+	}
+	return origin[len(containers.ContainerEntityPrefix):]
+}
+
+func hasContainerID(message []byte) bool {
+	return bytes.Contains(message, append([]byte{'|'}, containerIDFieldPrefix...))
+}
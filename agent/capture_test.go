@@ -0,0 +1,108 @@
+package agent
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCaptureRoundTrip(t *testing.T) {
+	dir, err := ioutil.TempDir("", "doppler-capture")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	s := &Server{}
+
+	status, err := s.StartCapture(dir, time.Minute, 0)
+	require.NoError(t, err)
+	assert.True(t, status.Running)
+
+	_, err = s.StartCapture(dir, time.Minute, 0)
+	assert.Equal(t, errCaptureRunning, err)
+
+	s.currentCapture().write(Packets{
+		{Contents: []byte("a:1|c\nb:2|g"), Origin: NoOrigin},
+		{Contents: []byte("c:3|h"), Origin: "container_id://abcdef"},
+	})
+	status, err = s.StopCapture()
+	require.NoError(t, err)
+	assert.False(t, status.Running)
+	assert.Equal(t, int64(2), status.Packets)
+
+	file, err := os.Open(status.Path)
+	require.NoError(t, err)
+	defer file.Close()
+	info, err := file.Stat()
+	require.NoError(t, err)
+	assert.Equal(t, status.Bytes, info.Size())
+
+	r, err := NewCaptureReader(file)
+	require.NoError(t, err)
+	assert.Equal(t, status.Started.UnixNano(), r.Start.UnixNano())
+
+	packet, err := r.Next()
+	require.NoError(t, err)
+	assert.Equal(t, NoOrigin, packet.Origin)
+	assert.Equal(t, "a:1|c\nb:2|g", string(packet.Contents))
+
+	packet, err = r.Next()
+	require.NoError(t, err)
+	assert.Equal(t, "container_id://abcdef", packet.Origin)
+	assert.Equal(t, "c:3|h|c:abcdef", string(packet.Replay()))
+
+	_, err = r.Next()
+	assert.Equal(t, io.EOF, err)
+}
+
+func TestCaptureFilesWithinASecond(t *testing.T) {
+	dir, err := ioutil.TempDir("", "doppler-capture")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	s := &Server{}
+
+	first, err := s.StartCapture(dir, time.Minute, 0)
+	require.NoError(t, err)
+	_, err = s.StopCapture()
+	require.NoError(t, err)
+
+	second, err := s.StartCapture(dir, time.Minute, 0)
+	require.NoError(t, err)
+	_, err = s.StopCapture()
+	require.NoError(t, err)
+	assert.NotEqual(t, first.Path, second.Path)
+}
+
+func uvarints(values ...uint64) []byte {
+	var b []byte
+	buf := make([]byte, binary.MaxVarintLen64)
+	for _, x := range values {
+		b = append(b, buf[:binary.PutUvarint(buf, x)]...)
+	}
+	return b
+}
+
+func TestCaptureReaderInvalid(t *testing.T) {
+	_, err := NewCaptureReader(bytes.NewReader([]byte("DOPCAP1")))
+	assert.Error(t, err)
+	_, err = NewCaptureReader(bytes.NewReader([]byte("NOTACAP\n12345678")))
+	assert.Error(t, err)
+
+	// a corrupted length doesn't allocate
+	header := append([]byte(captureMagic), make([]byte, 8)...)
+	r, err := NewCaptureReader(bytes.NewReader(append(header, uvarints(0, 1<<40)...)))
+	require.NoError(t, err)
+	_, err = r.Next()
+	assert.Error(t, err)
+
+	// a truncated packet
+	r, err = NewCaptureReader(bytes.NewReader(append(append(header, uvarints(0, 0, 10)...), "abc"...)))
+	require.NoError(t, err)
+	_, err = r.Next()
+	assert.Equal(t, io.ErrUnexpectedEOF, err)
+}
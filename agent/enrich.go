@@ -94,6 +94,7 @@ func enrichMetricSample(metricSample dogstatsdMetricSample, namespace string, na
 		Value:      metricSample.value,
 		SampleRate: metricSample.sampleRate,
 		RawValue:   metricSample.setValue,
+		Timestamp:  float64(metricSample.timestamp),
 	}
 }
 
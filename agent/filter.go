@@ -0,0 +1,226 @@
+package agent
+
+import (
+	"expvar"
+	"fmt"
+	"regexp"
+	"strings"
+
+	. "github.com/frankhang/doppler/config"
+	"github.com/frankhang/doppler/mapper"
+	"github.com/frankhang/doppler/metrics"
+	"github.com/frankhang/doppler/telemetry"
+)
+
+const (
+	filterActionDeny      = "deny"
+	filterActionAllow     = "allow"
+	filterActionStripTags = "strip_tags"
+
+	// the rule counting the metrics dropped because no allow rule matches them
+	allowlistRule = "allowlist"
+)
+
+var (
+	filterExpvars = expvar.NewMap("dogstatsd-filters")
+
+	tlmFiltered = telemetry.NewCounter("dogstatsd", "filtered",
+		[]string{"rule", "action"}, "Count of metrics dropped or stripped by the ingest filters")
+)
+
+// ingestFilters are the filter rules applied in order to the metrics received,
+// once mapped. A deny rule drops the matching metrics, a strip_tags rule
+// removes tags from them. When there are allow rules, the metrics matching
+// none of them are dropped.
+type ingestFilters struct {
+	rules     []*ingestFilter
+	allowlist bool
+}
+
+// ingestFilter is a filter rule, its conditions must all match
+type ingestFilter struct {
+	name      string
+	action    string
+	regex     *regexp.Regexp              // nil matches every name
+	types     map[metrics.MetricType]bool // empty matches every type
+	tags      []tagCondition
+	stripTags map[string]bool
+}
+
+// tagCondition matches a tag by key, and by value if anyValue is false
+type tagCondition struct {
+	key      string
+	value    string
+	anyValue bool
+}
+
+// newIngestFilters compiles the filter rules, nil when there is none
+func newIngestFilters(configs []IngestFilter) (*ingestFilters, error) {
+	if len(configs) == 0 {
+		return nil, nil
+	}
+	filters := &ingestFilters{}
+	for i, c := range configs {
+		rule, err := newIngestFilter(i, c)
+		if err != nil {
+			return nil, err
+		}
+		if rule.action == filterActionAllow {
+			filters.allowlist = true
+		}
+		filters.rules = append(filters.rules, rule)
+	}
+	return filters, nil
+}
+
+func newIngestFilter(i int, c IngestFilter) (*ingestFilter, error) {
+	rule := &ingestFilter{name: c.Name, action: c.Action}
+	if rule.name == "" {
+		rule.name = fmt.Sprintf("filter%d", i)
+	}
+	if rule.name == allowlistRule {
+		return nil, fmt.Errorf("filter %d: the name `%s` is reserved", i, allowlistRule)
+	}
+	if rule.action == "" {
+		rule.action = filterActionDeny
+	}
+
+	switch rule.action {
+	case filterActionDeny, filterActionAllow:
+	case filterActionStripTags:
+		if len(c.StripTags) == 0 {
+			return nil, fmt.Errorf("filter %s: strip_tags is required by the strip_tags action", rule.name)
+		}
+		rule.stripTags = make(map[string]bool, len(c.StripTags))
+		for _, key := range c.StripTags {
+			rule.stripTags[key] = true
+		}
+	default:
+		return nil, fmt.Errorf("filter %s: invalid action `%s`, must be `deny`, `allow` or `strip_tags`", rule.name, rule.action)
+	}
+
+	if c.Match != "" {
+		regex, err := mapper.BuildMatchRegex(c.Match, c.MatchType)
+		if err != nil {
+			return nil, fmt.Errorf("filter %s: %v", rule.name, err)
+		}
+		rule.regex = regex
+	}
+
+	for _, name := range c.Types {
+		mtype, ok := metricTypeNamed(name)
+		if !ok {
+			return nil, fmt.Errorf("filter %s: unknown metric type `%s`", rule.name, name)
+		}
+		if rule.types == nil {
+			rule.types = make(map[metrics.MetricType]bool)
+		}
+		rule.types[mtype] = true
+	}
+
+	for _, tag := range c.Tags {
+		kv := strings.SplitN(tag, ":", 2)
+		if kv[0] == "" {
+			return nil, fmt.Errorf("filter %s: invalid tag `%s`", rule.name, tag)
+		}
+		condition := tagCondition{key: kv[0], anyValue: len(kv) == 1}
+		if !condition.anyValue {
+			condition.value = kv[1]
+		}
+		rule.tags = append(rule.tags, condition)
+	}
+	return rule, nil
+}
+
+// metricTypeNamed returns the type of the metrics as received by dogstatsd
+func metricTypeNamed(name string) (metrics.MetricType, bool) {
+	switch strings.ToLower(name) {
+	case "gauge", "g":
+		return metrics.GaugeType, true
+	case "counter", "count", "c":
+		return metrics.CounterType, true
+	case "histogram", "h", "timing", "ms":
+		return metrics.HistogramType, true
+	case "distribution", "d":
+		return metrics.DistributionType, true
+	case "set", "s":
+		return metrics.SetType, true
+	}
+	return 0, false
+}
+
+// apply returns false if the sample must be dropped, the tags stripped
+// by the rules are removed from the sample
+func (f *ingestFilters) apply(sample *metrics.MetricSample) bool {
+	allowed := !f.allowlist
+	for _, rule := range f.rules {
+		if !rule.matches(sample) {
+			continue
+		}
+		switch rule.action {
+		case filterActionDeny:
+			filtered(rule.name, rule.action)
+			return false
+		case filterActionAllow:
+			allowed = true
+		case filterActionStripTags:
+			if tags, stripped := rule.strip(sample.Tags); stripped {
+				sample.Tags = tags
+				filtered(rule.name, rule.action)
+			}
+		}
+	}
+	if !allowed {
+		filtered(allowlistRule, filterActionDeny)
+	}
+	return allowed
+}
+
+func filtered(rule, action string) {
+	filterExpvars.Add(rule, 1)
+	tlmFiltered.Inc(rule, action)
+}
+
+func (r *ingestFilter) matches(sample *metrics.MetricSample) bool {
+	if r.types != nil && !r.types[sample.Mtype] {
+		return false
+	}
+	if r.regex != nil && !r.regex.MatchString(sample.Name) {
+		return false
+	}
+	for _, condition := range r.tags {
+		if !condition.matches(sample.Tags) {
+			return false
+		}
+	}
+	return true
+}
+
+func (c tagCondition) matches(tags []string) bool {
+	for _, tag := range tags {
+		key, value := splitTag(tag)
+		if key == c.key && (c.anyValue || value == c.value) {
+			return true
+		}
+	}
+	return false
+}
+
+// strip removes the tags whose key is stripped, in place. It returns whether
+// some tags have been removed.
+func (r *ingestFilter) strip(tags []string) ([]string, bool) {
+	kept := tags[:0]
+	for _, tag := range tags {
+		if key, _ := splitTag(tag); !r.stripTags[key] {
+			kept = append(kept, tag)
+		}
+	}
+	return kept, len(kept) < len(tags)
+}
+
+func splitTag(tag string) (string, string) {
+	if i := strings.IndexByte(tag, ':'); i >= 0 {
+		return tag[:i], tag[i+1:]
+	}
+	return tag, ""
+}
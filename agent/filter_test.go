@@ -0,0 +1,158 @@
+package agent
+
+import (
+	"expvar"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	. "github.com/frankhang/doppler/config"
+	"github.com/frankhang/doppler/metrics"
+)
+
+func sample(name string, mtype metrics.MetricType, tags ...string) *metrics.MetricSample {
+	return &metrics.MetricSample{Name: name, Mtype: mtype, Tags: tags}
+}
+
+func filteredCount(rule string) int64 {
+	if count, ok := filterExpvars.Get(rule).(*expvar.Int); ok {
+		return count.Value()
+	}
+	return 0
+}
+
+func TestNewIngestFilters(t *testing.T) {
+	filters, err := newIngestFilters(nil)
+	assert.NoError(t, err)
+	assert.Nil(t, filters)
+
+	for name, c := range map[string]IngestFilter{
+		"reserved name":    {Name: allowlistRule},
+		"invalid action":   {Action: "drop"},
+		"no strip tags":    {Action: filterActionStripTags},
+		"invalid match":    {Match: "a.**"},
+		"invalid regex":    {Match: "a(", MatchType: "regex"},
+		"invalid type":     {Types: []string{"timer"}},
+		"invalid tag":      {Tags: []string{":value"}},
+		"invalid matching": {Match: "a", MatchType: "glob"},
+	} {
+		_, err := newIngestFilters([]IngestFilter{c})
+		assert.Error(t, err, name)
+	}
+
+	filters, err = newIngestFilters([]IngestFilter{{Match: "a"}, {Action: filterActionAllow}})
+	require.NoError(t, err)
+	assert.Equal(t, "filter0", filters.rules[0].name)
+	assert.Equal(t, filterActionDeny, filters.rules[0].action)
+	assert.True(t, filters.allowlist)
+}
+
+func TestIngestFiltersOrder(t *testing.T) {
+	// the first deny rule wins over a later allow rule
+	filters, err := newIngestFilters([]IngestFilter{
+		{Name: "no-debug", Match: "app.debug"},
+		{Name: "app", Action: filterActionAllow, Match: "app.*"},
+	})
+	require.NoError(t, err)
+	assert.False(t, filters.apply(sample("app.debug", metrics.GaugeType)))
+	assert.True(t, filters.apply(sample("app.requests", metrics.GaugeType)))
+
+	// an allowed metric is still dropped by a later deny rule
+	filters, err = newIngestFilters([]IngestFilter{
+		{Name: "app", Action: filterActionAllow, Match: "app.*"},
+		{Name: "no-debug", Match: "app.debug"},
+	})
+	require.NoError(t, err)
+	assert.False(t, filters.apply(sample("app.debug", metrics.GaugeType)))
+}
+
+func TestIngestFiltersAllowlist(t *testing.T) {
+	filters, err := newIngestFilters([]IngestFilter{{Name: "no-debug", Match: "debug.*"}})
+	require.NoError(t, err)
+	// without allow rules, the metrics are kept by default
+	assert.True(t, filters.apply(sample("app.requests", metrics.GaugeType)))
+	assert.False(t, filters.apply(sample("debug.requests", metrics.GaugeType)))
+
+	filters, err = newIngestFilters([]IngestFilter{
+		{Name: "app", Action: filterActionAllow, Match: "app.*"},
+		{Name: "db", Action: filterActionAllow, Match: "db.*"},
+	})
+	require.NoError(t, err)
+	// with allow rules, the metrics are dropped by default
+	dropped := filteredCount(allowlistRule)
+	assert.True(t, filters.apply(sample("app.requests", metrics.GaugeType)))
+	assert.True(t, filters.apply(sample("db.queries", metrics.GaugeType)))
+	assert.False(t, filters.apply(sample("web.requests", metrics.GaugeType)))
+	assert.Equal(t, dropped+1, filteredCount(allowlistRule))
+}
+
+func TestIngestFiltersStripTags(t *testing.T) {
+	filters, err := newIngestFilters([]IngestFilter{
+		{Name: "strip-user", Action: filterActionStripTags, StripTags: []string{"user_id", "session"}},
+		{Name: "no-users", Tags: []string{"user_id"}},
+	})
+	require.NoError(t, err)
+
+	s := sample("app.requests", metrics.CounterType, "user_id:42", "env:prod", "session", "host:a")
+	// the stripped tags don't match the later rules
+	assert.True(t, filters.apply(s))
+	assert.Equal(t, []string{"env:prod", "host:a"}, s.Tags)
+
+	s = sample("app.requests", metrics.CounterType, "env:prod")
+	assert.True(t, filters.apply(s))
+	assert.Equal(t, []string{"env:prod"}, s.Tags)
+}
+
+func TestIngestFiltersConditions(t *testing.T) {
+	filters, err := newIngestFilters([]IngestFilter{{
+		Name:  "no-canary-histograms",
+		Match: "app.*",
+		Types: []string{"histogram", "d"},
+		Tags:  []string{"canary", "env:dev"},
+	}})
+	require.NoError(t, err)
+
+	for _, tc := range []struct {
+		sample *metrics.MetricSample
+		kept   bool
+	}{
+		{sample("app.latency", metrics.HistogramType, "canary:true", "env:dev"), false},
+		{sample("app.latency", metrics.DistributionType, "env:dev", "canary"), false},
+		// every condition must match
+		{sample("app.latency", metrics.GaugeType, "canary:true", "env:dev"), true},
+		{sample("web.latency", metrics.HistogramType, "canary:true", "env:dev"), true},
+		{sample("app.latency", metrics.HistogramType, "env:dev"), true},
+		{sample("app.latency", metrics.HistogramType, "canary", "env:prod"), true},
+		{sample("app.latency", metrics.HistogramType, "canary", "env"), true},
+	} {
+		assert.Equal(t, tc.kept, filters.apply(tc.sample), "%s %v", tc.sample.Name, tc.sample.Tags)
+	}
+}
+
+func TestMetricTypeNamed(t *testing.T) {
+	for name, mtype := range map[string]metrics.MetricType{
+		"gauge": metrics.GaugeType, "Counter": metrics.CounterType, "count": metrics.CounterType,
+		"ms": metrics.HistogramType, "timing": metrics.HistogramType, "d": metrics.DistributionType,
+		"set": metrics.SetType,
+	} {
+		got, ok := metricTypeNamed(name)
+		assert.True(t, ok, name)
+		assert.Equal(t, mtype, got, name)
+	}
+	_, ok := metricTypeNamed("timer")
+	assert.False(t, ok)
+}
+
+func TestNewProcessingInvalidFilter(t *testing.T) {
+	c := DefaultConf
+	c.Filters = []IngestFilter{{Action: "drop"}}
+	p, err := newProcessing(&c)
+	assert.Error(t, err)
+	assert.Nil(t, p)
+
+	c.Filters = []IngestFilter{{Match: "debug.*"}}
+	p, err = newProcessing(&c)
+	require.NoError(t, err)
+	assert.NotNil(t, p.filters)
+}
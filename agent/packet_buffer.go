@@ -19,16 +19,18 @@ type packetBuffer struct {
 	packetLength  int
 	pool          *PacketPool
 	packetsBuffer *packetsBuffer
+	bySource      bool // the packets only hold the messages of a single source
 	flushTimer    *time.Ticker
 	closeChannel  chan struct{}
 	sync.Mutex
 }
 
-func newPacketBuffer(pool *PacketPool, flushTimer time.Duration, packetsBuffer *packetsBuffer) *packetBuffer {
+func newPacketBuffer(pool *PacketPool, flushTimer time.Duration, packetsBuffer *packetsBuffer, bySource bool) *packetBuffer {
 	packetBuffer := &packetBuffer{
 		packet:        pool.Get(),
 		pool:          pool,
 		packetsBuffer: packetsBuffer,
+		bySource:      bySource,
 		flushTimer:    time.NewTicker(flushTimer),
 		closeChannel:  make(chan struct{}),
 	}
@@ -49,8 +51,17 @@ func (p *packetBuffer) flushLoop() {
 	}
 }
 
-func (p *packetBuffer) addMessage(message []byte) {
+// addMessage adds the message of the source. When the packets don't hold
+// the messages of a single source, a packet mixing sources has none.
+func (p *packetBuffer) addMessage(message []byte, source string) {
 	p.Lock()
+	if p.packetLength > 0 && p.packet.Source != source {
+		if p.bySource {
+			p.flush()
+		} else {
+			source = NoSource
+		}
+	}
 	if p.packetLength == 0 {
 		p.packetLength = copy(p.packet.buffer, message)
 	} else if len(p.packet.buffer) >= len(message)+p.packetLength+1 {
@@ -61,6 +72,7 @@ func (p *packetBuffer) addMessage(message []byte) {
 		p.flush()
 		p.packetLength = copy(p.packet.buffer, message)
 	}
+	p.packet.Source = source
 	p.Unlock()
 }
 
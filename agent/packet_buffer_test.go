@@ -0,0 +1,80 @@
+package agent
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	. "github.com/frankhang/doppler/config"
+)
+
+func TestPacketBufferSources(t *testing.T) {
+	for _, tc := range []struct {
+		bySource bool
+		contents []string
+		sources  []string
+	}{
+		{bySource: true, contents: []string{"a:1|c\na:2|c", "b:1|c"}, sources: []string{"10.0.0.1", "10.0.0.2"}},
+		// the drops of a packet mixing sources are not attributed
+		{bySource: false, contents: []string{"a:1|c\na:2|c\nb:1|c"}, sources: []string{NoSource}},
+	} {
+		pool := NewPacketPool(64)
+		packets := newPacketsBuffer(100, time.Hour, make(chan Packets, 1), nil)
+		buffer := newPacketBuffer(pool, time.Hour, packets, tc.bySource)
+
+		buffer.addMessage([]byte("a:1|c"), "10.0.0.1")
+		buffer.addMessage([]byte("a:2|c"), "10.0.0.1")
+		buffer.addMessage([]byte("b:1|c"), "10.0.0.2")
+		buffer.Lock()
+		buffer.flush()
+		buffer.Unlock()
+		buffer.close()
+		packets.close()
+
+		require.Len(t, packets.packets, len(tc.contents))
+		for i, packet := range packets.packets {
+			assert.Equal(t, tc.contents[i], string(packet.Contents))
+			assert.Equal(t, tc.sources[i], packet.Source)
+		}
+	}
+}
+
+func TestPacketBufferFullPacketKeepsSource(t *testing.T) {
+	pool := NewPacketPool(8)
+	packets := newPacketsBuffer(100, time.Hour, make(chan Packets, 1), nil)
+	buffer := newPacketBuffer(pool, time.Hour, packets, true)
+	defer packets.close()
+	defer buffer.close()
+
+	buffer.addMessage([]byte("a:1|c"), "10.0.0.1")
+	buffer.addMessage([]byte("a:2|c"), "10.0.0.1")
+	buffer.Lock()
+	buffer.flush()
+	buffer.Unlock()
+
+	require.Len(t, packets.packets, 2)
+	for _, packet := range packets.packets {
+		assert.Equal(t, "10.0.0.1", packet.Source)
+	}
+}
+
+func TestAdmissionEnqueueDropWhenFull(t *testing.T) {
+	c := DefaultConf.Admission
+	c.DropWhenFull = true
+	pool := NewPacketPool(64)
+	a := newAdmission(c, pool)
+
+	out := make(chan Packets, 1)
+	a.enqueue(out, Packets{pool.Get()})
+
+	dropped := pool.Get()
+	dropped.Contents = append(dropped.buffer[:0], "a:1|c\nb:1|c"...)
+	dropped.Source = "10.0.0.1"
+	a.enqueue(out, Packets{dropped})
+
+	// the dropped packet is back in the pool, reset
+	assert.Len(t, out, 1)
+	assert.Equal(t, NoSource, dropped.Source)
+}
@@ -42,10 +42,11 @@ func (p *PacketPool) Get() *Packet {
 	return p.pool.Get().(*Packet)
 }
 
-// Put resets the Packet origin and puts it back in the pool.
+// Put resets the Packet origin and source and puts it back in the pool.
 func (p *PacketPool) Put(packet *Packet) {
 	if packet.Origin != NoOrigin {
 		packet.Origin = NoOrigin
 	}
+	packet.Source = NoSource
 	p.pool.Put(packet)
 }
@@ -17,15 +17,17 @@ type packetsBuffer struct {
 	flushTimer    *time.Ticker
 	bufferSize    uint
 	outputChannel chan Packets
+	admission     *admission
 	closeChannel  chan struct{}
 	m             sync.Mutex
 }
 
-func newPacketsBuffer(bufferSize uint, flushTimer time.Duration, outputChannel chan Packets) *packetsBuffer {
+func newPacketsBuffer(bufferSize uint, flushTimer time.Duration, outputChannel chan Packets, admission *admission) *packetsBuffer {
 	pb := &packetsBuffer{
 		bufferSize:    bufferSize,
 		flushTimer:    time.NewTicker(flushTimer),
 		outputChannel: outputChannel,
+		admission:     admission,
 		packets:       make(Packets, 0, bufferSize),
 		closeChannel:  make(chan struct{}),
 	}
@@ -57,7 +59,7 @@ func (pb *packetsBuffer) append(packet *Packet) {
 
 func (pb *packetsBuffer) flush() {
 	if len(pb.packets) > 0 {
-		pb.outputChannel <- pb.packets
+		pb.admission.enqueue(pb.outputChannel, pb.packets)
 		pb.packets = make(Packets, 0, pb.bufferSize)
 	}
 }
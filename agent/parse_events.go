@@ -34,6 +34,7 @@ type dogstatsdEvent struct {
 	sourceType     string
 	alertType      alertType
 	tags           []string
+	containerID    string
 }
 
 type eventHeader struct {
@@ -49,6 +50,7 @@ var (
 	eventSourceTypePrefix     = []byte("s:")
 	eventAlertTypePrefix      = []byte("t:")
 	eventTagsPrefix           = []byte("#")
+	eventContainerIDPrefix    = []byte("c:")
 
 	eventPriorityLow    = []byte("low")
 	eventPriorityNormal = []byte("normal")
@@ -143,6 +145,8 @@ func applyEventOptionalField(event dogstatsdEvent, optionalField []byte) (dogsta
 		newEvent.alertType, err = parseEventAlertType(optionalField[len(eventAlertTypePrefix):])
 	case bytes.HasPrefix(optionalField, eventTagsPrefix):
 		newEvent.tags = parseTags(optionalField[len(eventTagsPrefix):])
+	case bytes.HasPrefix(optionalField, eventContainerIDPrefix):
+		newEvent.containerID = string(optionalField[len(eventContainerIDPrefix):])
 	}
 	if err != nil {
 		return event, err
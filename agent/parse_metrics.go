@@ -24,17 +24,22 @@ var (
 	setSymbol          = []byte("s")
 	timingSymbol       = []byte("ms")
 
-	tagsFieldPrefix       = []byte("#")
-	sampleRateFieldPrefix = []byte("@")
+	tagsFieldPrefix        = []byte("#")
+	sampleRateFieldPrefix  = []byte("@")
+	timestampFieldPrefix   = []byte("T")
+	containerIDFieldPrefix = []byte("c:")
 )
 
 type dogstatsdMetricSample struct {
-	name       string
-	value      float64
-	setValue   string
-	metricType metricType
-	sampleRate float64
-	tags       []string
+	name        string
+	value       float64
+	values      []float64 // values of a multi-value message (protocol 1.1), nil otherwise
+	setValue    string
+	metricType  metricType
+	sampleRate  float64
+	tags        []string
+	timestamp   int64  // client timestamp in seconds (protocol 1.3), 0 if none
+	containerID string // client container ID (protocol 1.2), empty if none
 }
 
 // sanity checks a given message against the metric sample format
@@ -43,7 +48,7 @@ func hasMetricSampleFormat(message []byte) bool {
 		return false
 	}
 	separatorCount := bytes.Count(message, fieldSeparator)
-	if separatorCount < 1 || separatorCount > 3 {
+	if separatorCount < 1 || separatorCount > 5 {
 		return false
 	}
 	return true
@@ -84,6 +89,30 @@ func parseMetricSampleSampleRate(rawSampleRate []byte) (float64, error) {
 	return parseFloat64(rawSampleRate)
 }
 
+// parseMetricSampleValues parses the values of a multi-value message,
+// e.g. 1:2:3, into values
+func parseMetricSampleValues(rawValues []byte, values []float64) ([]float64, error) {
+	var rawValue []byte
+	for rawValues != nil {
+		sepIndex := bytes.Index(rawValues, colonSeparator)
+		if sepIndex == -1 {
+			rawValue, rawValues = rawValues, nil
+		} else {
+			rawValue, rawValues = rawValues[:sepIndex], rawValues[sepIndex+1:]
+		}
+		value, err := parseFloat64(rawValue)
+		if err != nil {
+			return nil, fmt.Errorf("could not parse dogstatsd metric value: %v", err)
+		}
+		values = append(values, value)
+	}
+	return values, nil
+}
+
+func parseMetricSampleTimestamp(rawTimestamp []byte) (int64, error) {
+	return parseInt64(rawTimestamp)
+}
+
 func parseMetricSample(message []byte) (dogstatsdMetricSample, error) {
 	// fast path to eliminate most of the gibberish
 	// especially important here since all the unidentified garbage gets
@@ -106,8 +135,15 @@ func parseMetricSample(message []byte) (dogstatsdMetricSample, error) {
 
 	var setValue []byte
 	var value float64
+	var values []float64
 	if metricType == setType {
+		// the members of a set may contain colons
 		setValue = rawValue
+	} else if bytes.Contains(rawValue, colonSeparator) {
+		values, err = parseMetricSampleValues(rawValue, make([]float64, 0, bytes.Count(rawValue, colonSeparator)+1))
+		if err != nil {
+			return dogstatsdMetricSample{}, err
+		}
 	} else {
 		value, err = parseFloat64(rawValue)
 		if err != nil {
@@ -117,6 +153,8 @@ func parseMetricSample(message []byte) (dogstatsdMetricSample, error) {
 
 	sampleRate := 1.0
 	var tags []string
+	var timestamp int64
+	var containerID []byte
 	var optionalField []byte
 	for message != nil {
 		optionalField, message = nextField(message)
@@ -127,15 +165,30 @@ func parseMetricSample(message []byte) (dogstatsdMetricSample, error) {
 			if err != nil {
 				return dogstatsdMetricSample{}, fmt.Errorf("could not parse dogstatsd sample rate %q", optionalField)
 			}
+		} else if bytes.HasPrefix(optionalField, timestampFieldPrefix) {
+			timestamp, err = parseMetricSampleTimestamp(optionalField[len(timestampFieldPrefix):])
+			if err != nil {
+				return dogstatsdMetricSample{}, fmt.Errorf("could not parse dogstatsd timestamp %q", optionalField)
+			}
+		} else if bytes.HasPrefix(optionalField, containerIDFieldPrefix) {
+			containerID = optionalField[len(containerIDFieldPrefix):]
 		}
 	}
 
+	// like the Datadog agent, only gauges and counts keep their timestamp
+	if timestamp < 0 || (metricType != gaugeType && metricType != countType) {
+		timestamp = 0
+	}
+
 	return dogstatsdMetricSample{
-		name:       string(name),
-		value:      value,
-		setValue:   string(setValue),
-		metricType: metricType,
-		sampleRate: sampleRate,
-		tags:       tags,
+		name:        string(name),
+		value:       value,
+		values:      values,
+		setValue:    string(setValue),
+		metricType:  metricType,
+		sampleRate:  sampleRate,
+		tags:        tags,
+		timestamp:   timestamp,
+		containerID: string(containerID),
 	}, nil
 }
@@ -0,0 +1,89 @@
+package agent
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseGauge(t *testing.T) {
+	sample, err := parseMetricSample([]byte("daemon:666|g"))
+
+	require.NoError(t, err)
+	assert.Equal(t, "daemon", sample.name)
+	assert.Equal(t, 666.0, sample.value)
+	assert.Nil(t, sample.values)
+	assert.Equal(t, gaugeType, sample.metricType)
+	assert.Equal(t, 1.0, sample.sampleRate)
+	assert.Zero(t, sample.timestamp)
+	assert.Empty(t, sample.containerID)
+}
+
+func TestParseMultiValue(t *testing.T) {
+	sample, err := parseMetricSample([]byte("daemon:1:2.5:-3|h|@0.5|#sometag:val"))
+
+	require.NoError(t, err)
+	assert.Equal(t, "daemon", sample.name)
+	assert.Equal(t, []float64{1, 2.5, -3}, sample.values)
+	assert.Equal(t, histogramType, sample.metricType)
+	assert.Equal(t, 0.5, sample.sampleRate)
+	assert.Equal(t, []string{"sometag:val"}, sample.tags)
+
+	_, err = parseMetricSample([]byte("daemon:1::2|h"))
+	assert.Error(t, err)
+	_, err = parseMetricSample([]byte("daemon:1:abc|d"))
+	assert.Error(t, err)
+}
+
+func TestParseSetKeepsColons(t *testing.T) {
+	sample, err := parseMetricSample([]byte("daemon:a:b|s"))
+
+	require.NoError(t, err)
+	assert.Equal(t, "a:b", sample.setValue)
+	assert.Nil(t, sample.values)
+}
+
+func TestParseTimestamp(t *testing.T) {
+	sample, err := parseMetricSample([]byte("daemon:666|g|#sometag:val|T1657100430"))
+	require.NoError(t, err)
+	assert.Equal(t, int64(1657100430), sample.timestamp)
+	assert.Equal(t, []string{"sometag:val"}, sample.tags)
+
+	sample, err = parseMetricSample([]byte("daemon:666|c|T1657100430"))
+	require.NoError(t, err)
+	assert.Equal(t, int64(1657100430), sample.timestamp)
+
+	// only gauges and counts keep their timestamp
+	sample, err = parseMetricSample([]byte("daemon:666|h|T1657100430"))
+	require.NoError(t, err)
+	assert.Zero(t, sample.timestamp)
+
+	sample, err = parseMetricSample([]byte("daemon:666|g|T-1"))
+	require.NoError(t, err)
+	assert.Zero(t, sample.timestamp)
+
+	_, err = parseMetricSample([]byte("daemon:666|g|Tabc"))
+	assert.Error(t, err)
+}
+
+func TestParseContainerID(t *testing.T) {
+	sample, err := parseMetricSample([]byte("daemon:666|g|@0.5|#sometag:val|c:abcdef123456"))
+
+	require.NoError(t, err)
+	assert.Equal(t, "abcdef123456", sample.containerID)
+	assert.Equal(t, 0.5, sample.sampleRate)
+	assert.Equal(t, []string{"sometag:val"}, sample.tags)
+}
+
+func TestParseAllFields(t *testing.T) {
+	sample, err := parseMetricSample([]byte("daemon:1:2|c|@0.1|#a:b,c|T1657100430|c:abcdef"))
+
+	require.NoError(t, err)
+	assert.Equal(t, []float64{1, 2}, sample.values)
+	assert.Equal(t, countType, sample.metricType)
+	assert.Equal(t, 0.1, sample.sampleRate)
+	assert.Equal(t, []string{"a:b", "c"}, sample.tags)
+	assert.Equal(t, int64(1657100430), sample.timestamp)
+	assert.Equal(t, "abcdef", sample.containerID)
+}
@@ -19,12 +19,13 @@ const (
 )
 
 type dogstatsdServiceCheck struct {
-	name      string
-	status    serviceCheckStatus
-	timestamp int64
-	hostname  string
-	message   string
-	tags      []string
+	name        string
+	status      serviceCheckStatus
+	timestamp   int64
+	hostname    string
+	message     string
+	tags        []string
+	containerID string
 }
 
 var (
@@ -33,10 +34,11 @@ var (
 	rawServiceCheckStatusCritical = []byte("2")
 	rawServiceCheckStatusUnknown  = []byte("3")
 
-	serviceCheckTimestampPrefix = []byte("d:")
-	serviceCheckHostnamePrefix  = []byte("h:")
-	serviceCheckMessagePrefix   = []byte("m:")
-	serviceCheckTagsPrefix      = []byte("#")
+	serviceCheckTimestampPrefix   = []byte("d:")
+	serviceCheckHostnamePrefix    = []byte("h:")
+	serviceCheckMessagePrefix     = []byte("m:")
+	serviceCheckTagsPrefix        = []byte("#")
+	serviceCheckContainerIDPrefix = []byte("c:")
 )
 
 // sanity checks a given message against the metric sample format
@@ -89,6 +91,8 @@ func applyServiceCheckOptionalField(serviceCheck dogstatsdServiceCheck, optional
 		newServiceCheck.hostname = string(optionalField[len(serviceCheckHostnamePrefix):])
 	case bytes.HasPrefix(optionalField, serviceCheckTagsPrefix):
 		newServiceCheck.tags = parseTags(optionalField[len(serviceCheckTagsPrefix):])
+	case bytes.HasPrefix(optionalField, serviceCheckContainerIDPrefix):
+		newServiceCheck.containerID = string(optionalField[len(serviceCheckContainerIDPrefix):])
 	case bytes.HasPrefix(optionalField, serviceCheckMessagePrefix):
 		newServiceCheck.message = string(optionalField[len(serviceCheckMessagePrefix):])
 	}
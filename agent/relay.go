@@ -0,0 +1,401 @@
+package agent
+
+import (
+	"expvar"
+	"fmt"
+	"github.com/frankhang/util/errors"
+	"github.com/frankhang/util/logutil"
+	"go.uber.org/zap"
+	"hash/fnv"
+	"net"
+	"net/url"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	. "github.com/frankhang/doppler/config"
+	"github.com/frankhang/doppler/telemetry"
+)
+
+const (
+	relayModeShard  = "shard"
+	relayModeFanout = "fanout"
+)
+
+var (
+	relayExpvars      = expvar.NewMap("agent-relay")
+	relayLines        = expvar.Int{}
+	relayLinesDropped = expvar.Int{}
+	relayFailovers    = expvar.Int{}
+
+	tlmRelayLines = telemetry.NewCounter("agent", "relay_lines",
+		[]string{"upstream", "state"}, "Count of lines relayed or dropped by upstream")
+	tlmRelayFailovers = telemetry.NewCounter("agent", "relay_failovers",
+		[]string{"upstream"}, "Count of lines relayed to another upstream than their shard")
+	tlmRelayUpstreamHealthy = telemetry.NewGauge("agent", "relay_upstream_healthy",
+		[]string{"upstream"}, "Whether the relay upstream is healthy")
+
+	// errRelayed is returned for the messages relayed and not processed locally
+	errRelayed = errors.New("message relayed")
+)
+
+func init() {
+	relayExpvars.Set("Lines", &relayLines)
+	relayExpvars.Set("LinesDropped", &relayLinesDropped)
+	relayExpvars.Set("Failovers", &relayFailovers)
+}
+
+// relay relays the received messages to upstream statsd servers, after they
+// are parsed. In shard mode, a metric is relayed to the upstream chosen by
+// consistent hashing of its name and tags, or to the next healthy one on the
+// hash ring. In fanout mode, every message is relayed to every healthy upstream.
+type relay struct {
+	mode      string
+	local     bool // the relayed messages are also processed locally
+	upstreams []*upstream
+	ring      []ringPoint // sorted by hash
+
+	stopChan chan struct{}
+	wg       sync.WaitGroup
+}
+
+// ringPoint is a virtual node of an upstream on the hash ring
+type ringPoint struct {
+	hash     uint64
+	upstream *upstream
+}
+
+// upstream is a statsd server the messages are relayed to. The lines are
+// written by a single goroutine, in packets for the datagram networks.
+type upstream struct {
+	address       string // as configured, e.g. tcp://host:8125
+	network       string
+	addr          string
+	queue         chan []byte
+	healthy       int32 // atomic, 1 when the upstream is reachable
+	checked       bool  // the health is checked, a failed write makes the upstream unhealthy until then
+	maxPacketSize int
+	flushInterval time.Duration
+	timeout       time.Duration
+	conn          net.Conn
+}
+
+// newRelay returns the relay configured by c, nil when there is no upstream
+func newRelay(c Relay) (*relay, error) {
+	if len(c.Upstreams) == 0 {
+		return nil, nil
+	}
+	mode := c.Mode
+	if mode == "" {
+		mode = relayModeShard
+	}
+	if mode != relayModeShard && mode != relayModeFanout {
+		return nil, fmt.Errorf("invalid relay mode `%s`, expected shard or fanout", c.Mode)
+	}
+
+	r := &relay{mode: mode, local: c.Local, stopChan: make(chan struct{})}
+	for _, address := range c.Upstreams {
+		network, addr, err := parseUpstream(address)
+		if err != nil {
+			return nil, err
+		}
+		r.upstreams = append(r.upstreams, &upstream{
+			address:       address,
+			network:       network,
+			addr:          addr,
+			queue:         make(chan []byte, c.QueueSize),
+			healthy:       1,
+			maxPacketSize: c.MaxPacketSize,
+			flushInterval: time.Duration(c.FlushInterval) * time.Millisecond,
+			timeout:       time.Duration(c.Timeout) * time.Millisecond,
+		})
+	}
+
+	replicas := c.Replicas
+	if replicas <= 0 {
+		replicas = 1
+	}
+	for _, u := range r.upstreams {
+		for i := 0; i < replicas; i++ {
+			h := fnv.New64a()
+			h.Write([]byte(u.address + "#" + strconv.Itoa(i)))
+			r.ring = append(r.ring, ringPoint{hash: h.Sum64(), upstream: u})
+		}
+	}
+	sort.Slice(r.ring, func(i, j int) bool { return r.ring[i].hash < r.ring[j].hash })
+	return r, nil
+}
+
+// parseUpstream returns the network and the address of an upstream written
+// udp://host:port, tcp://host:port, unix:///path or unixgram:///path
+func parseUpstream(address string) (string, string, error) {
+	u, err := url.Parse(address)
+	if err != nil {
+		return "", "", fmt.Errorf("invalid relay upstream `%s`: %v", address, err)
+	}
+	switch u.Scheme {
+	case "udp", "tcp":
+		if u.Host == "" {
+			return "", "", fmt.Errorf("invalid relay upstream `%s`: missing host", address)
+		}
+		return u.Scheme, u.Host, nil
+	case "unix", "unixgram":
+		if u.Path == "" {
+			return "", "", fmt.Errorf("invalid relay upstream `%s`: missing path", address)
+		}
+		return u.Scheme, u.Path, nil
+	default:
+		return "", "", fmt.Errorf("invalid relay upstream `%s`: expected udp, tcp, unix or unixgram scheme", address)
+	}
+}
+
+// start starts writing to the upstreams and checking their health
+func (r *relay) start(healthCheckInterval time.Duration) {
+	for _, u := range r.upstreams {
+		tlmRelayUpstreamHealthy.Set(1, u.address)
+		u.checked = healthCheckInterval > 0
+		r.wg.Add(1)
+		go u.run(r.stopChan, &r.wg)
+		if healthCheckInterval > 0 {
+			r.wg.Add(1)
+			go u.checkHealth(healthCheckInterval, r.stopChan, &r.wg)
+		}
+	}
+	logutil.BgLogger().Info("Agent: relaying", zap.String("mode", r.mode), zap.Strings("upstreams", r.addresses()))
+}
+
+// stop stops the relay, the queued lines are written
+func (r *relay) stop() {
+	close(r.stopChan)
+	r.wg.Wait()
+}
+
+func (r *relay) addresses() []string {
+	addresses := make([]string, 0, len(r.upstreams))
+	for _, u := range r.upstreams {
+		addresses = append(addresses, u.address)
+	}
+	return addresses
+}
+
+// relayMetric relays the message of a metric, sharded by its name and tags.
+// The tags are sorted in place.
+func (r *relay) relayMetric(name string, tags []string, message []byte) {
+	if r.mode == relayModeFanout {
+		r.fanout(message)
+		return
+	}
+	sort.Strings(tags)
+	h := fnv.New64a()
+	h.Write([]byte(name))
+	for _, tag := range tags {
+		h.Write([]byte{','})
+		h.Write([]byte(tag))
+	}
+	r.shard(h.Sum64(), message)
+}
+
+// relayMessage relays an event or a service check, sharded by key
+func (r *relay) relayMessage(key string, message []byte) {
+	if r.mode == relayModeFanout {
+		r.fanout(message)
+		return
+	}
+	h := fnv.New64a()
+	h.Write([]byte(key))
+	r.shard(h.Sum64(), message)
+}
+
+// shard relays the message to the first healthy upstream of the ring from hash
+func (r *relay) shard(hash uint64, message []byte) {
+	i := sort.Search(len(r.ring), func(i int) bool { return r.ring[i].hash >= hash })
+	var owner *upstream
+	for n := 0; n < len(r.ring); n++ {
+		u := r.ring[(i+n)%len(r.ring)].upstream
+		if owner == nil {
+			owner = u
+		}
+		if u.isHealthy() {
+			if u != owner {
+				relayFailovers.Add(1)
+				tlmRelayFailovers.Inc(owner.address)
+			}
+			u.send(message)
+			return
+		}
+	}
+	relayLinesDropped.Add(1)
+	tlmRelayLines.Inc("none", "no_healthy_upstream")
+}
+
+func (r *relay) fanout(message []byte) {
+	for _, u := range r.upstreams {
+		if u.isHealthy() {
+			u.send(message)
+		} else {
+			relayLinesDropped.Add(1)
+			tlmRelayLines.Inc(u.address, "unhealthy")
+		}
+	}
+}
+
+func (u *upstream) isHealthy() bool {
+	return atomic.LoadInt32(&u.healthy) == 1
+}
+
+func (u *upstream) setHealthy(healthy bool) {
+	var value int32
+	if healthy {
+		value = 1
+	}
+	if atomic.SwapInt32(&u.healthy, value) != value {
+		if healthy {
+			logutil.BgLogger().Info("Agent: relay upstream is healthy", zap.String("upstream", u.address))
+		} else {
+			logutil.BgLogger().Warn("Agent: relay upstream is unhealthy", zap.String("upstream", u.address))
+		}
+	}
+	tlmRelayUpstreamHealthy.Set(float64(value), u.address)
+}
+
+// send queues a copy of the message, the packet it belongs to is reused
+func (u *upstream) send(message []byte) {
+	line := make([]byte, len(message))
+	copy(line, message)
+	select {
+	case u.queue <- line:
+	default:
+		relayLinesDropped.Add(1)
+		tlmRelayLines.Inc(u.address, "queue_full")
+	}
+}
+
+func (u *upstream) datagram() bool {
+	return u.network == "udp" || u.network == "unixgram"
+}
+
+// run writes the queued lines until the relay is stopped. The lines are
+// batched in packets of at most maxPacketSize bytes.
+func (u *upstream) run(stop chan struct{}, wg *sync.WaitGroup) {
+	defer wg.Done()
+
+	buf := make([]byte, 0, u.maxPacketSize)
+	lines := 0
+	ticker := time.NewTicker(u.flushInterval)
+	defer ticker.Stop()
+
+	flush := func() {
+		if lines > 0 {
+			u.write(buf, lines)
+			buf, lines = buf[:0], 0
+		}
+	}
+	add := func(line []byte) {
+		if lines > 0 && len(buf)+len(line)+1 > u.maxPacketSize {
+			flush()
+		}
+		buf = append(buf, line...)
+		buf = append(buf, '\n')
+		lines++
+	}
+
+	for {
+		select {
+		case <-stop:
+			for {
+				select {
+				case line := <-u.queue:
+					add(line)
+				default:
+					flush()
+					if u.conn != nil {
+						u.conn.Close()
+					}
+					return
+				}
+			}
+		case line := <-u.queue:
+			add(line)
+		case <-ticker.C:
+			flush()
+		}
+	}
+}
+
+// write writes a packet of lines, connecting first if needed. The lines
+// are dropped on error, and the upstream is unhealthy until it is checked.
+// Without health checks, the next packet connects again.
+func (u *upstream) write(packet []byte, lines int) {
+	if u.conn == nil {
+		conn, err := net.DialTimeout(u.network, u.addr, u.timeout)
+		if err != nil {
+			u.drop(lines, err)
+			return
+		}
+		u.conn = conn
+	}
+
+	if !u.datagram() {
+		u.conn.SetWriteDeadline(time.Now().Add(u.timeout))
+	}
+	if _, err := u.conn.Write(packet); err != nil {
+		u.conn.Close()
+		u.conn = nil
+		u.drop(lines, err)
+		return
+	}
+	relayLines.Add(int64(lines))
+	tlmRelayLines.Add(float64(lines), u.address, "sent")
+}
+
+func (u *upstream) drop(lines int, err error) {
+	logutil.BgLogger().Warn("Agent: relaying failed", zap.String("upstream", u.address), zap.Int("lines", lines), zap.Error(err))
+	relayLinesDropped.Add(int64(lines))
+	tlmRelayLines.Add(float64(lines), u.address, "error")
+	if u.checked {
+		u.setHealthy(false)
+	}
+}
+
+// checkHealth checks the upstream every interval until the relay is stopped
+func (u *upstream) checkHealth(interval time.Duration, stop chan struct{}, wg *sync.WaitGroup) {
+	defer wg.Done()
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			u.setHealthy(u.probe() == nil)
+		}
+	}
+}
+
+// probe connects to the upstream. A datagram upstream is sent an empty
+// datagram: the servers ignore it, but an unreachable port is reported.
+func (u *upstream) probe() error {
+	conn, err := net.DialTimeout(u.network, u.addr, u.timeout)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if !u.datagram() {
+		return nil
+	}
+
+	if _, err = conn.Write(nil); err != nil {
+		return err
+	}
+	conn.SetReadDeadline(time.Now().Add(u.timeout))
+	if _, err = conn.Read(make([]byte, 1)); err != nil {
+		if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+			return nil
+		}
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,220 @@
+package agent
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	. "github.com/frankhang/doppler/config"
+)
+
+func testRelayConfig(upstreams ...string) Relay {
+	c := DefaultConf.Relay
+	c.Upstreams = upstreams
+	return c
+}
+
+// relayed returns the upstream each line has been queued to
+func relayed(r *relay) map[string]string {
+	lines := make(map[string]string)
+	for _, u := range r.upstreams {
+		for len(u.queue) > 0 {
+			lines[string(<-u.queue)] = u.address
+		}
+	}
+	return lines
+}
+
+func TestParseUpstream(t *testing.T) {
+	for _, tc := range []struct {
+		address string
+		network string
+		addr    string
+		err     bool
+	}{
+		{address: "udp://10.0.0.1:8125", network: "udp", addr: "10.0.0.1:8125"},
+		{address: "tcp://statsd:8125", network: "tcp", addr: "statsd:8125"},
+		{address: "unix:///var/run/statsd.sock", network: "unix", addr: "/var/run/statsd.sock"},
+		{address: "unixgram:///var/run/statsd.sock", network: "unixgram", addr: "/var/run/statsd.sock"},
+		{address: "udp://", err: true},
+		{address: "unix://", err: true},
+		{address: "http://statsd:8125", err: true},
+		{address: "10.0.0.1:8125", err: true},
+		{address: "udp://%zz", err: true},
+	} {
+		t.Run(tc.address, func(t *testing.T) {
+			network, addr, err := parseUpstream(tc.address)
+			if tc.err {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tc.network, network)
+			assert.Equal(t, tc.addr, addr)
+		})
+	}
+}
+
+func TestNewRelay(t *testing.T) {
+	r, err := newRelay(testRelayConfig())
+	assert.NoError(t, err)
+	assert.Nil(t, r)
+
+	c := testRelayConfig("udp://10.0.0.1:8125", "udp://10.0.0.2:8125")
+	c.Mode = "broadcast"
+	_, err = newRelay(c)
+	assert.Error(t, err)
+
+	_, err = newRelay(testRelayConfig("udp://10.0.0.1:8125", "ftp://10.0.0.2"))
+	assert.Error(t, err)
+
+	c = testRelayConfig("udp://10.0.0.1:8125", "udp://10.0.0.2:8125")
+	c.Mode = ""
+	r, err = newRelay(c)
+	require.NoError(t, err)
+	assert.Equal(t, relayModeShard, r.mode)
+	assert.Len(t, r.ring, 2*c.Replicas)
+}
+
+func TestRelayShardPlacement(t *testing.T) {
+	r, err := newRelay(testRelayConfig("udp://10.0.0.1:8125", "udp://10.0.0.2:8125", "udp://10.0.0.3:8125"))
+	require.NoError(t, err)
+
+	for i := 0; i < 300; i++ {
+		name := fmt.Sprintf("metric.%d", i)
+		r.relayMetric(name, []string{"b:2", "a:1"}, []byte(name+":1|c|#b:2,a:1"))
+	}
+	lines := relayed(r)
+	require.Len(t, lines, 300)
+
+	perUpstream := make(map[string]int)
+	for _, address := range lines {
+		perUpstream[address]++
+	}
+	// every upstream owns a share of the metrics
+	assert.Len(t, perUpstream, 3)
+	for _, n := range perUpstream {
+		assert.True(t, n > 30, "unbalanced ring: %v", perUpstream)
+	}
+
+	// the tags order doesn't matter
+	r.relayMetric("metric.0", []string{"a:1", "b:2"}, []byte("again"))
+	assert.Equal(t, lines["metric.0:1|c|#b:2,a:1"], relayed(r)["again"])
+}
+
+func TestRelayShardStability(t *testing.T) {
+	addresses := []string{"udp://10.0.0.1:8125", "udp://10.0.0.2:8125"}
+	before, err := newRelay(testRelayConfig(addresses...))
+	require.NoError(t, err)
+	after, err := newRelay(testRelayConfig(append(addresses, "udp://10.0.0.3:8125")...))
+	require.NoError(t, err)
+
+	moved := 0
+	for i := 0; i < 300; i++ {
+		name := fmt.Sprintf("metric.%d", i)
+		before.relayMetric(name, nil, []byte(name))
+		after.relayMetric(name, nil, []byte(name))
+	}
+	placedBefore, placedAfter := relayed(before), relayed(after)
+	for line, address := range placedAfter {
+		if placedBefore[line] != address {
+			// a metric only moves to the new upstream
+			assert.Equal(t, "udp://10.0.0.3:8125", address)
+			moved++
+		}
+	}
+	assert.True(t, moved > 0 && moved < 200, "moved %d metrics of 300", moved)
+}
+
+func TestRelayFailover(t *testing.T) {
+	r, err := newRelay(testRelayConfig("udp://10.0.0.1:8125", "udp://10.0.0.2:8125"))
+	require.NoError(t, err)
+
+	r.relayMetric("metric", nil, []byte("first"))
+	owner := relayed(r)["first"]
+
+	for _, u := range r.upstreams {
+		if u.address == owner {
+			u.setHealthy(false)
+		}
+	}
+	failovers := relayFailovers.Value()
+	r.relayMetric("metric", nil, []byte("second"))
+	other := relayed(r)["second"]
+	assert.NotEmpty(t, other)
+	assert.NotEqual(t, owner, other)
+	assert.Equal(t, failovers+1, relayFailovers.Value())
+
+	// no healthy upstream, the line is dropped
+	for _, u := range r.upstreams {
+		u.setHealthy(false)
+	}
+	dropped := relayLinesDropped.Value()
+	r.relayMetric("metric", nil, []byte("third"))
+	assert.Empty(t, relayed(r))
+	assert.Equal(t, dropped+1, relayLinesDropped.Value())
+}
+
+func TestRelayFanout(t *testing.T) {
+	c := testRelayConfig("udp://10.0.0.1:8125", "udp://10.0.0.2:8125", "udp://10.0.0.3:8125")
+	c.Mode = relayModeFanout
+	r, err := newRelay(c)
+	require.NoError(t, err)
+
+	r.upstreams[2].setHealthy(false)
+	dropped := relayLinesDropped.Value()
+	r.relayMetric("metric", nil, []byte("metric:1|c"))
+	r.relayMessage("check", []byte("_sc|check|0"))
+
+	for i, u := range r.upstreams {
+		if i == 2 {
+			assert.Len(t, u.queue, 0)
+			continue
+		}
+		require.Len(t, u.queue, 2)
+		assert.Equal(t, "metric:1|c", string(<-u.queue))
+		assert.Equal(t, "_sc|check|0", string(<-u.queue))
+	}
+	assert.Equal(t, dropped+2, relayLinesDropped.Value())
+}
+
+func TestUpstreamDropHealth(t *testing.T) {
+	r, err := newRelay(testRelayConfig("udp://10.0.0.1:8125"))
+	require.NoError(t, err)
+	u := r.upstreams[0]
+
+	// without health checks, nothing would make the upstream healthy again
+	u.drop(1, errors.New("refused"))
+	assert.True(t, u.isHealthy())
+
+	u.checked = true
+	u.drop(1, errors.New("refused"))
+	assert.False(t, u.isHealthy())
+}
+
+func TestRelayWritesPackets(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer conn.Close()
+
+	c := testRelayConfig("udp://" + conn.LocalAddr().String())
+	c.FlushInterval = 60000 // the lines are flushed together on stop
+	r, err := newRelay(c)
+	require.NoError(t, err)
+	r.start(0)
+
+	r.relayMetric("a", nil, []byte("a:1|c"))
+	r.relayMetric("b", nil, []byte("b:2|g"))
+	r.stop()
+
+	buf := make([]byte, 1024)
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	n, _, err := conn.ReadFrom(buf)
+	require.NoError(t, err)
+	assert.Equal(t, "a:1|c\nb:2|g\n", string(buf[:n]))
+}
@@ -0,0 +1,69 @@
+package agent
+
+import (
+	"io"
+	"net"
+	"time"
+)
+
+// ReplayStats are the counts of a replay
+type ReplayStats struct {
+	Packets  int64
+	Bytes    int64
+	Errors   int64
+	Duration time.Duration
+}
+
+// Replay sends the packets of the capture to the statsd server at address,
+// written udp://host:port, tcp://host:port, unix:///path or unixgram:///path.
+// The packets are sent at their original pace divided by speed, 0 sends them
+// as fast as possible. The packets are separated by newlines on the stream
+// networks.
+func Replay(r *CaptureReader, address string, speed float64) (ReplayStats, error) {
+	var stats ReplayStats
+	network, addr, err := parseUpstream(address)
+	if err != nil {
+		return stats, err
+	}
+	conn, err := net.Dial(network, addr)
+	if err != nil {
+		return stats, err
+	}
+	defer conn.Close()
+	stream := network == "tcp" || network == "unix"
+
+	start := time.Now()
+	for {
+		packet, err := r.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			stats.Duration = time.Since(start)
+			return stats, err
+		}
+
+		if speed > 0 {
+			if wait := time.Duration(float64(packet.Offset)/speed) - time.Since(start); wait > 0 {
+				time.Sleep(wait)
+			}
+		}
+		contents := packet.Replay()
+		if stream {
+			contents = append(contents, messageSeparator)
+		}
+		if _, err = conn.Write(contents); err != nil {
+			// the server may not be ready yet on the datagram networks
+			if stream {
+				stats.Duration = time.Since(start)
+				return stats, err
+			}
+			stats.Errors++
+			continue
+		}
+		stats.Packets++
+		stats.Bytes += int64(len(contents))
+	}
+	stats.Duration = time.Since(start)
+	return stats, nil
+}
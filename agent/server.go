@@ -18,8 +18,10 @@ import (
 	"net"
 	"runtime"
 	"sort"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	. "github.com/frankhang/doppler/config"
@@ -29,6 +31,7 @@ import (
 	"github.com/frankhang/doppler/tagger"
 	"github.com/frankhang/doppler/telemetry"
 	"github.com/frankhang/doppler/util"
+	"github.com/frankhang/doppler/util/containers"
 
 	l "github.com/sirupsen/logrus"
 )
@@ -45,6 +48,9 @@ var (
 
 	tlmProcessed = telemetry.NewCounter("dogstatsd", "processed",
 		[]string{"message_type", "state"}, "Count of service checks/events/metrics processed by dogstatsd")
+
+	// errMetricDropped is returned for the metrics dropped by a mapping
+	errMetricDropped = errors.New("metric dropped by mapping")
 )
 
 func init() {
@@ -58,27 +64,46 @@ func init() {
 
 // Server represent a Dogstatsd server
 type Server struct {
-	listeners             []StatsdListener
-	packetsIn             chan Packets
-	samplePool            *metrics.MetricSamplePool
-	samplesOut            chan<- []metrics.MetricSample
-	eventsOut             chan<- []*metrics.Event
-	servicesCheckOut      chan<- []*metrics.ServiceCheck
-	Statistics            *util.Stats
-	Started               bool
-	packetPool            *PacketPool
-	stopChan              chan bool
-	health                *health.Handle
+	listeners         []StatsdListener
+	packetsIn         chan Packets
+	priorityIn        chan Packets // service checks, nil when there is no priority lane
+	admission         *admission
+	samplePool        *metrics.MetricSamplePool
+	samplesOut        chan<- []metrics.MetricSample
+	eventsOut         chan<- []*metrics.Event
+	servicesCheckOut  chan<- []*metrics.ServiceCheck
+	Statistics        *util.Stats
+	Started           bool
+	packetPool        *PacketPool
+	stopChan          chan bool
+	health            *health.Handle
+	defaultHostname   string
+	histToDist        bool
+	histToDistPrefix  string
+	debugMetricsStats int32 // atomic, 1 when the metrics statistics are stored
+	metricsStats      map[string]metricStat
+	statsLock         sync.Mutex
+	processing        atomic.Value // *processing, swapped on reload
+	forward           atomic.Value // *forwardTarget, nil when not forwarding
+	relay             *relay       // nil when not relaying
+	capture           atomic.Value // *capture, the running or last capture
+	captureLock       sync.Mutex
+	reloadLock        sync.Mutex
+}
+
+// processing holds the settings of the parsing that can be reloaded
+type processing struct {
 	metricPrefix          string
 	metricPrefixBlacklist []string
-	defaultHostname       string
-	histToDist            bool
-	histToDistPrefix      string
 	extraTags             []string
-	debugMetricsStats     bool
-	metricsStats          map[string]metricStat
-	statsLock             sync.Mutex
 	mapper                *mapper.MetricMapper
+	filters               *ingestFilters // nil when there is no filter rule
+}
+
+// forwardTarget is the statsd server the received packets are forwarded to
+type forwardTarget struct {
+	address string
+	conn    net.Conn
 }
 
 // metricStat holds how many times a metric has been
@@ -101,46 +126,60 @@ func NewServer(samplePool *metrics.MetricSamplePool, samplesOut chan<- []metrics
 		dogstatsdExpvars.Set("PacketsLastSecond", &dogstatsdPacketsLastSec)
 	}
 
-	var metricsStats bool
+	var metricsStats int32
 	if Cfg.MetricsStatsEnable {
 		logutil.BgLogger().Info("Agent: metrics statistics will be stored")
-		metricsStats = true
+		metricsStats = 1
 	}
 
 	packetsChannel := make(chan Packets, Cfg.AgentQueueSize)
-	packetPool := NewPacketPool(Cfg.AgentBufferSize)
-	tmpListeners := make([]StatsdListener, 0, 2)
-
-	//socketPath := config.Datadog.GetString("dogstatsd_socket")
-	//if len(socketPath) > 0 {
-	//	unixListener, err := NewUDSListener(packetsChannel, packetPool)
-	//	if err != nil {
-	//		log.Errorf(err.Error())
-	//	} else {
-	//		tmpListeners = append(tmpListeners, unixListener)
-	//	}
-	//}
+	// the tcp lines can't be larger than a packet
+	bufferSize := Cfg.AgentBufferSize
+	if Cfg.AgentTCPPort > 0 && Cfg.AgentTCPMaxLineSize > bufferSize {
+		bufferSize = Cfg.AgentTCPMaxLineSize
+	}
+	packetPool := NewPacketPool(bufferSize)
+	admission := newAdmission(Cfg.Admission, packetPool)
+	tmpListeners := make([]StatsdListener, 0, 4)
+
+	if len(Cfg.AgentSocket) > 0 {
+		unixListener, err := NewUDSListener(packetsChannel, packetPool, admission)
+		if err != nil {
+			logutil.BgLogger().Error("Agent: unable to start unix socket listener", zap.Error(err))
+		} else {
+			tmpListeners = append(tmpListeners, unixListener)
+		}
+	}
+	if len(Cfg.AgentStreamSocket) > 0 {
+		unixStreamListener, err := NewUDSStreamListener(packetsChannel, packetPool, admission)
+		if err != nil {
+			logutil.BgLogger().Error("Agent: unable to start unix stream socket listener", zap.Error(err))
+		} else {
+			tmpListeners = append(tmpListeners, unixStreamListener)
+		}
+	}
 	if Cfg.Port > 0 {
-		udpListener, err := NewUDPListener(packetsChannel, packetPool)
+		udpListener, err := NewUDPListener(packetsChannel, packetPool, admission)
 		if err != nil {
 			return nil, errors.Trace(err)
 		} else {
 			tmpListeners = append(tmpListeners, udpListener)
 		}
 	}
+	if Cfg.AgentTCPPort > 0 {
+		tcpListener, err := NewTCPListener(packetsChannel, packetPool, admission)
+		if err != nil {
+			logutil.BgLogger().Error("Agent: unable to start tcp listener", zap.Error(err))
+		} else {
+			tmpListeners = append(tmpListeners, tcpListener)
+		}
+	}
 
 	if len(tmpListeners) == 0 {
-		err := fmt.Errorf("listening on neither udp nor socket, please check your configuration")
+		err := fmt.Errorf("listening on neither udp, tcp nor socket, please check your configuration")
 		return nil, errors.Trace(err)
 	}
 
-	// check configuration for custom namespace
-	metricPrefix := Cfg.MetricNamespace
-	if metricPrefix != "" && !strings.HasSuffix(metricPrefix, ".") {
-		metricPrefix = metricPrefix + "."
-	}
-	metricPrefixBlacklist := Cfg.MetricNamespaceBlacklist
-
 	defaultHostname, err := util.GetHostname()
 	if err != nil {
 		return nil, errors.Trace(err)
@@ -149,63 +188,140 @@ func NewServer(samplePool *metrics.MetricSamplePool, samplesOut chan<- []metrics
 	histToDist := Cfg.HistogramCopyToDistribution
 	histToDistPrefix := Cfg.HistogramCopyToDistributionPrefix
 
-	extraTags := Cfg.AgentTags
-
 	s := &Server{
-		Started:               true,
-		Statistics:            stats,
-		samplePool:            samplePool,
-		packetsIn:             packetsChannel,
-		samplesOut:            samplesOut,
-		eventsOut:             eventsOut,
-		servicesCheckOut:      servicesCheckOut,
-		listeners:             tmpListeners,
-		packetPool:            packetPool,
-		stopChan:              make(chan bool),
-		health:                health.Register("agent-main"),
-		metricPrefix:          metricPrefix,
-		metricPrefixBlacklist: metricPrefixBlacklist,
-		defaultHostname:       defaultHostname,
-		histToDist:            histToDist,
-		histToDistPrefix:      histToDistPrefix,
-		extraTags:             extraTags,
-		debugMetricsStats:     metricsStats,
-		metricsStats:          make(map[string]metricStat),
+		Started:           true,
+		Statistics:        stats,
+		samplePool:        samplePool,
+		packetsIn:         packetsChannel,
+		priorityIn:        admission.priorityOut,
+		admission:         admission,
+		samplesOut:        samplesOut,
+		eventsOut:         eventsOut,
+		servicesCheckOut:  servicesCheckOut,
+		listeners:         tmpListeners,
+		packetPool:        packetPool,
+		stopChan:          make(chan bool),
+		health:            health.Register("agent-main"),
+		defaultHostname:   defaultHostname,
+		histToDist:        histToDist,
+		histToDistPrefix:  histToDistPrefix,
+		debugMetricsStats: metricsStats,
+		metricsStats:      make(map[string]metricStat),
 	}
 
-	forwardHost := Cfg.ForwardHost
-	forwardPort := Cfg.ForwardPort
+	p, err := newProcessing(Cfg)
+	if p == nil {
+		// an invalid filter would let through the metrics it must drop
+		return nil, errors.Trace(err)
+	}
+	if err != nil {
+		logutil.BgLogger().Warn("Could not create metric mapper", zap.Error(err))
+	}
+	s.processing.Store(p)
 
-	if forwardHost != "" && forwardPort != 0 {
+	target, err := dialForward(forwardAddress(Cfg))
+	if err != nil {
+		logutil.BgLogger().Warn("Could not connect to statsd forward host", zap.Error(err))
+	}
+	s.forward.Store(target)
 
-		forwardAddress := fmt.Sprintf("%s:%d", forwardHost, forwardPort)
+	if s.relay, err = newRelay(Cfg.Relay); err != nil {
+		return nil, errors.Trace(err)
+	}
+	if s.relay != nil {
+		s.relay.start(time.Duration(Cfg.Relay.HealthCheckInterval) * time.Second)
+	}
 
-		con, err := net.Dial("udp", forwardAddress)
+	s.handleMessages()
+	return s, nil
+}
 
+// newProcessing reads the settings of the parsing from the config. On a mapper
+// error, the returned processing is usable but doesn't map the metrics. On a
+// filter error, no processing is returned.
+func newProcessing(c *Config) (*processing, error) {
+	// check configuration for custom namespace
+	metricPrefix := c.MetricNamespace
+	if metricPrefix != "" && !strings.HasSuffix(metricPrefix, ".") {
+		metricPrefix = metricPrefix + "."
+	}
+
+	p := &processing{
+		metricPrefix:          metricPrefix,
+		metricPrefixBlacklist: c.MetricNamespaceBlacklist,
+		extraTags:             c.AgentTags,
+	}
+	filters, err := newIngestFilters(c.Filters)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	p.filters = filters
+	if len(c.MapperProfiles) != 0 {
+		mapperInstance, err := mapper.NewMetricMapper(c.MapperProfiles, c.CacheSize)
 		if err != nil {
-			logutil.BgLogger().Warn("Could not connect to statsd forward host", zap.Error(err))
-		} else {
-			s.packetsIn = make(chan Packets, Cfg.AgentQueueSize)
-			go s.forwarder(con, packetsChannel)
+			return p, errors.Trace(err)
 		}
+		p.mapper = mapperInstance
 	}
+	return p, nil
+}
 
-	s.handleMessages()
+// forwardAddress returns the address of the forward host, empty when not forwarding
+func forwardAddress(c *Config) string {
+	if c.ForwardHost == "" || c.ForwardPort == 0 {
+		return ""
+	}
+	return net.JoinHostPort(c.ForwardHost, strconv.Itoa(c.ForwardPort))
+}
+
+func dialForward(address string) (*forwardTarget, error) {
+	if address == "" {
+		return nil, nil
+	}
+	conn, err := net.Dial("udp", address)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	return &forwardTarget{address: address, conn: conn}, nil
+}
 
-	cacheSize := Cfg.CacheSize
+// PrepareReload reads the mapper, the extra tags, the namespace and the forward
+// target from c, without restarting the listeners. The returned func swaps them
+// in, once the settings of the other components are valid too. Nothing is
+// swapped when an error is returned.
+func (s *Server) PrepareReload(c *Config) (func(), error) {
+	s.reloadLock.Lock()
+	defer s.reloadLock.Unlock()
 
-	mappings, err := GetDogstatsdMappingProfiles()
+	p, err := newProcessing(c)
 	if err != nil {
-		logutil.BgLogger().Warn("Could not parse mapping profiles", zap.Error(err))
-	} else if len(mappings) != 0 {
-		mapperInstance, err := mapper.NewMetricMapper(mappings, cacheSize)
-		if err != nil {
-			logutil.BgLogger().Warn("Could not create metric mapper", zap.Error(err))
-		} else {
-			s.mapper = mapperInstance
+		return nil, err
+	}
+
+	current := s.forwardTarget()
+	target := current
+	if address := forwardAddress(c); current == nil || current.address != address {
+		if target, err = dialForward(address); err != nil {
+			return nil, err
 		}
 	}
-	return s, nil
+
+	return func() {
+		s.reloadLock.Lock()
+		defer s.reloadLock.Unlock()
+
+		s.processing.Store(p)
+		if target != current {
+			s.forward.Store(target)
+			if current != nil {
+				current.conn.Close()
+			}
+		}
+	}, nil
+}
+
+func (s *Server) forwardTarget() *forwardTarget {
+	return s.forward.Load().(*forwardTarget)
 }
 
 func (s *Server) handleMessages() {
@@ -230,37 +346,55 @@ func (s *Server) handleMessages() {
 	}
 }
 
-func (s *Server) forwarder(fcon net.Conn, packetsChannel chan Packets) {
-	for {
-		select {
-		case <-s.stopChan:
-			return
-		case packets := <-packetsChannel:
-			for _, packet := range packets {
-				_, err := fcon.Write(packet.Contents)
+// forwardPackets writes the packets to the forward target, before they are parsed
+func (s *Server) forwardPackets(packets Packets) {
+	target := s.forwardTarget()
+	if target == nil {
+		return
+	}
+	for _, packet := range packets {
+		_, err := target.conn.Write(packet.Contents)
 
-				if err != nil {
-					logutil.BgLogger().Warn("Forwarding packet failed", zap.Error(err))
-				}
-			}
-			s.packetsIn <- packets
+		if err != nil {
+			logutil.BgLogger().Warn("Forwarding packet failed", zap.Error(err))
 		}
 	}
 }
 
 func (s *Server) worker() {
 	batcher := newBatcher(s.samplePool, s.samplesOut, s.eventsOut, s.servicesCheckOut)
+	// the samples of a message, reused from one message to another
+	samples := make([]metrics.MetricSample, 0, 16)
 	for {
+		// the service checks of the priority lane are processed first
+		select {
+		case packets := <-s.priorityIn:
+			samples = s.handlePackets(batcher, packets, samples)
+			continue
+		default:
+		}
+
 		select {
 		case <-s.stopChan:
 			return
 		case <-s.health.C:
+		case packets := <-s.priorityIn:
+			samples = s.handlePackets(batcher, packets, samples)
 		case packets := <-s.packetsIn:
-			s.parsePackets(batcher, packets)
+			samples = s.handlePackets(batcher, packets, samples)
 		}
 	}
 }
 
+// handlePackets captures, forwards and parses the packets
+func (s *Server) handlePackets(batcher *batcher, packets Packets, samples []metrics.MetricSample) []metrics.MetricSample {
+	if c := s.currentCapture(); c != nil {
+		c.write(packets)
+	}
+	s.forwardPackets(packets)
+	return s.parsePackets(batcher, packets, samples)
+}
+
 func nextMessage(packet *[]byte) (message []byte) {
 	if len(*packet) == 0 {
 		return nil
@@ -278,7 +412,10 @@ func nextMessage(packet *[]byte) (message []byte) {
 
 
 
-func (s *Server) parsePackets(batcher *batcher, packets []*Packet) {
+// parsePackets parses the packets into the batcher, samples is a buffer
+// returned to be reused
+func (s *Server) parsePackets(batcher *batcher, packets []*Packet, samples []metrics.MetricSample) []metrics.MetricSample {
+	p := s.processing.Load().(*processing)
 	for _, packet := range packets {
 		originTags := findOriginTags(packet.Origin)
 		if l.GetLevel() >= l.DebugLevel {
@@ -302,88 +439,164 @@ func (s *Server) parsePackets(batcher *batcher, packets []*Packet) {
 
 			switch messageType {
 			case serviceCheckType:
-				serviceCheck, err := s.parseServiceCheckMessage(message)
+				serviceCheck, err := s.parseServiceCheckMessage(p, message, originTags)
+				if err == errRelayed {
+					continue
+				}
 				if err != nil {
 					logutil.BgLogger().Error("Agent: error parsing service check", zap.Error(err))
+					s.admission.dropped(dropReasonParseError, packet.Source, 1)
 					continue
 				}
-				serviceCheck.Tags = append(serviceCheck.Tags, originTags...)
 				batcher.appendServiceCheck(serviceCheck)
 			case eventType:
-				event, err := s.parseEventMessage(message)
+				event, err := s.parseEventMessage(p, message, originTags)
+				if err == errRelayed {
+					continue
+				}
 				if err != nil {
 					logutil.BgLogger().Error("Agent: error parsing event", zap.Error(err))
+					s.admission.dropped(dropReasonParseError, packet.Source, 1)
 					continue
 				}
-				event.Tags = append(event.Tags, originTags...)
 				batcher.appendEvent(event)
 			case metricSampleType:
-				sample, err := s.parseMetricMessage(message)
+				var err error
+				samples, err = s.parseMetricMessage(p, samples[:0], message, originTags)
+				if err == errMetricDropped || err == errRelayed {
+					continue
+				}
 				if err != nil {
 					logutil.BgLogger().Error("Agent: error parsing metrics", zap.Error(err))
+					s.admission.dropped(dropReasonParseError, packet.Source, 1)
 					continue
 				}
-				if s.debugMetricsStats {
-					s.storeMetricStats(sample.Name)
-				}
-				sample.Tags = append(sample.Tags, originTags...)
-				batcher.appendSample(sample)
-				if s.histToDist && sample.Mtype == metrics.HistogramType {
-					distSample := sample.Copy()
-					distSample.Name = s.histToDistPrefix + distSample.Name
-					distSample.Mtype = metrics.DistributionType
-					batcher.appendSample(*distSample)
+				for _, sample := range samples {
+					if p.filters != nil && !p.filters.apply(&sample) {
+						continue
+					}
+					if atomic.LoadInt32(&s.debugMetricsStats) == 1 {
+						s.storeMetricStats(sample.Name)
+					}
+					batcher.appendSample(sample)
+					if s.histToDist && sample.Mtype == metrics.HistogramType {
+						distSample := sample.Copy()
+						distSample.Name = s.histToDistPrefix + distSample.Name
+						distSample.Mtype = metrics.DistributionType
+						batcher.appendSample(*distSample)
+					}
 				}
 			}
 		}
 	}
 	batcher.flush()
+	return samples
 }
 
-func (s *Server) parseMetricMessage(message []byte) (metrics.MetricSample, error) {
+// parseMetricMessage appends the samples of the message to samples, one per
+// value of a multi-value message
+func (s *Server) parseMetricMessage(p *processing, samples []metrics.MetricSample, message []byte, originTags []string) ([]metrics.MetricSample, error) {
 	sample, err := parseMetricSample(message)
 	if err != nil {
 		dogstatsdMetricParseErrors.Add(1)
 		tlmProcessed.Inc("metrics", "error")
-		return metrics.MetricSample{}, err
+		return samples, err
 	}
-	if s.mapper != nil && len(sample.tags) == 0 {
-		mapResult := s.mapper.Map(sample.name)
-		if mapResult != nil {
-			sample.name = mapResult.Name
-			sample.tags = append(sample.tags, mapResult.Tags...)
+	// the message is relayed as received: the mappings and the ingest
+	// filters apply to the local processing only
+	if s.relay != nil {
+		s.relay.relayMetric(sample.name, sample.tags, message)
+		if !s.relay.local {
+			tlmProcessed.Inc("metrics", "relayed")
+			return samples, errRelayed
 		}
 	}
-	metricSample := enrichMetricSample(sample, s.metricPrefix, s.metricPrefixBlacklist, s.defaultHostname)
-	metricSample.Tags = append(metricSample.Tags, s.extraTags...)
+	var export *mapper.ExportMeta
+	if p.mapper != nil {
+		if mapResult := p.mapper.Map(sample.name); mapResult != nil {
+			if len(sample.tags) == 0 {
+				if mapResult.Drop {
+					tlmProcessed.Inc("metrics", "dropped")
+					return samples, errMetricDropped
+				}
+				sample.name = mapResult.Name
+				sample.tags = append(sample.tags, mapResult.Tags...)
+				export = mapResult.Export
+			}
+			// a tagged metric keeps its name, only the tag actions apply
+			sample.tags = mapResult.MapTags(sample.tags)
+		}
+	}
+	metricSample := enrichMetricSample(sample, p.metricPrefix, p.metricPrefixBlacklist, s.defaultHostname)
+	metricSample.Export = export
+	metricSample.Tags = append(metricSample.Tags, p.extraTags...)
+	metricSample.Tags = append(metricSample.Tags, clientOriginTags(originTags, sample.containerID)...)
 	dogstatsdMetricPackets.Add(1)
 	tlmProcessed.Inc("metrics", "ok")
-	return metricSample, nil
+
+	if sample.values == nil {
+		return append(samples, metricSample), nil
+	}
+	for i, value := range sample.values {
+		valueSample := metricSample
+		valueSample.Value = value
+		if i > 0 {
+			// the tags are sorted in place downstream
+			valueSample.Tags = append([]string(nil), metricSample.Tags...)
+		}
+		samples = append(samples, valueSample)
+	}
+	return samples, nil
 }
 
-func (s *Server) parseEventMessage(message []byte) (*metrics.Event, error) {
+// clientOriginTags returns the origin tags of the packet, or the tags of the
+// container ID sent by the client when the origin of the packet is unknown
+func clientOriginTags(originTags []string, containerID string) []string {
+	if len(originTags) > 0 || containerID == "" {
+		return originTags
+	}
+	return findOriginTags(containers.BuildTaggerEntityName(containerID))
+}
+
+func (s *Server) parseEventMessage(p *processing, message []byte, originTags []string) (*metrics.Event, error) {
 	sample, err := parseEvent(message)
 	if err != nil {
 		dogstatsdEventParseErrors.Add(1)
 		tlmProcessed.Inc("events", "error")
 		return nil, err
 	}
+	if s.relay != nil {
+		s.relay.relayMessage("_e:"+sample.title, message)
+		if !s.relay.local {
+			tlmProcessed.Inc("events", "relayed")
+			return nil, errRelayed
+		}
+	}
 	event := enrichEvent(sample, s.defaultHostname)
-	event.Tags = append(event.Tags, s.extraTags...)
+	event.Tags = append(event.Tags, p.extraTags...)
+	event.Tags = append(event.Tags, clientOriginTags(originTags, sample.containerID)...)
 	tlmProcessed.Inc("events", "ok")
 	dogstatsdEventPackets.Add(1)
 	return event, nil
 }
 
-func (s *Server) parseServiceCheckMessage(message []byte) (*metrics.ServiceCheck, error) {
+func (s *Server) parseServiceCheckMessage(p *processing, message []byte, originTags []string) (*metrics.ServiceCheck, error) {
 	sample, err := parseServiceCheck(message)
 	if err != nil {
 		dogstatsdServiceCheckParseErrors.Add(1)
 		tlmProcessed.Inc("service_checks", "error")
 		return nil, err
 	}
+	if s.relay != nil {
+		s.relay.relayMessage("_sc:"+sample.name, message)
+		if !s.relay.local {
+			tlmProcessed.Inc("service_checks", "relayed")
+			return nil, errRelayed
+		}
+	}
 	serviceCheck := enrichServiceCheck(sample, s.defaultHostname)
-	serviceCheck.Tags = append(serviceCheck.Tags, s.extraTags...)
+	serviceCheck.Tags = append(serviceCheck.Tags, p.extraTags...)
+	serviceCheck.Tags = append(serviceCheck.Tags, clientOriginTags(originTags, sample.containerID)...)
 	dogstatsdServiceCheckPackets.Add(1)
 	tlmProcessed.Inc("service_checks", "ok")
 	return serviceCheck, nil
@@ -411,6 +624,12 @@ func (s *Server) Stop() {
 	if s.Statistics != nil {
 		s.Statistics.Stop()
 	}
+	if s.relay != nil {
+		s.relay.stop()
+	}
+	if c := s.currentCapture(); c != nil {
+		c.stop(nil)
+	}
 	s.health.Deregister()
 	s.Started = false
 }
@@ -425,6 +644,26 @@ func (s *Server) storeMetricStats(name string) {
 	s.metricsStats[name] = ms
 }
 
+// EnableMetricsStats starts storing the metrics statistics
+func (s *Server) EnableMetricsStats() {
+	atomic.StoreInt32(&s.debugMetricsStats, 1)
+	logutil.BgLogger().Info("Agent: metrics statistics will be stored")
+}
+
+// DisableMetricsStats stops storing the metrics statistics and clears them
+func (s *Server) DisableMetricsStats() {
+	atomic.StoreInt32(&s.debugMetricsStats, 0)
+	s.statsLock.Lock()
+	s.metricsStats = make(map[string]metricStat)
+	s.statsLock.Unlock()
+	logutil.BgLogger().Info("Agent: metrics statistics disabled")
+}
+
+// MetricsStatsEnabled returns whether the metrics statistics are stored
+func (s *Server) MetricsStatsEnabled() bool {
+	return atomic.LoadInt32(&s.debugMetricsStats) == 1
+}
+
 // GetJSONDebugStats returns jsonified debug statistics.
 func (s *Server) GetJSONDebugStats() ([]byte, error) {
 	s.statsLock.Lock()
@@ -0,0 +1,114 @@
+package agent
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	. "github.com/frankhang/doppler/config"
+	"github.com/frankhang/doppler/mapper"
+)
+
+func TestParseMetricMessageMapping(t *testing.T) {
+	c := DefaultConf
+	c.MapperProfiles = []MappingProfile{{
+		Name:   "jobs",
+		Prefix: "jobs.",
+		Mappings: []MetricMapping{
+			{Match: "jobs.debug.*", Name: "jobs.debug", Drop: true},
+			{
+				Match:      "jobs.*.duration",
+				Name:       "jobs.duration",
+				Tags:       map[string]string{"job": "$1"},
+				DropTags:   []string{"pod"},
+				RenameTags: map[string]string{"svc": "service"},
+				Type:       mapper.ExportTypeSummary,
+			},
+		},
+	}}
+	p, err := newProcessing(&c)
+	require.NoError(t, err)
+	s := &Server{}
+
+	for _, tc := range []struct {
+		name    string
+		message string
+		dropped bool
+		metric  string
+		tags    []string
+		export  bool
+	}{
+		{name: "renamed", message: "jobs.backup.duration:1|h", metric: "jobs.duration", tags: []string{"job:backup"}, export: true},
+		{name: "dropped", message: "jobs.debug.x:1|c", dropped: true},
+		{
+			name:    "tagged keeps its name",
+			message: "jobs.backup.duration:1|h|#pod:a,svc:b,env:prod",
+			metric:  "jobs.backup.duration",
+			tags:    []string{"service:b", "env:prod"},
+		},
+		{name: "tagged not dropped", message: "jobs.debug.x:1|c|#env:prod", metric: "jobs.debug.x", tags: []string{"env:prod"}},
+		{name: "not mapped", message: "other:1|c", metric: "other"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			samples, err := s.parseMetricMessage(p, nil, []byte(tc.message), nil)
+			if tc.dropped {
+				assert.Equal(t, errMetricDropped, err)
+				assert.Empty(t, samples)
+				return
+			}
+			require.NoError(t, err)
+			require.Len(t, samples, 1)
+			assert.Equal(t, tc.metric, samples[0].Name)
+			assert.ElementsMatch(t, tc.tags, samples[0].Tags)
+			// the export meta travels with the sample
+			assert.Equal(t, tc.export, samples[0].Export != nil)
+		})
+	}
+}
+
+func TestPrepareReload(t *testing.T) {
+	c := DefaultConf
+	p, err := newProcessing(&c)
+	require.NoError(t, err)
+	s := &Server{}
+	s.processing.Store(p)
+	s.forward.Store((*forwardTarget)(nil))
+
+	// nothing is swapped on error
+	invalid := DefaultConf
+	invalid.Filters = []IngestFilter{{Match: "(", MatchType: "regex"}}
+	_, err = s.PrepareReload(&invalid)
+	assert.Error(t, err)
+
+	next := DefaultConf
+	next.MetricNamespace = "app"
+	next.ForwardHost, next.ForwardPort = "127.0.0.1", 8125
+	apply, err := s.PrepareReload(&next)
+	require.NoError(t, err)
+	// nor before the swap is applied
+	assert.True(t, p == s.processing.Load().(*processing))
+	assert.Nil(t, s.forwardTarget())
+
+	apply()
+	assert.Equal(t, "app.", s.processing.Load().(*processing).metricPrefix)
+	require.NotNil(t, s.forwardTarget())
+	assert.Equal(t, "127.0.0.1:8125", s.forwardTarget().address)
+	s.forwardTarget().conn.Close()
+}
+
+func TestParseMetricMessageRelayedBeforeFilters(t *testing.T) {
+	c := DefaultConf
+	c.Filters = []IngestFilter{{Match: "debug.*"}}
+	p, err := newProcessing(&c)
+	require.NoError(t, err)
+	r, err := newRelay(testRelayConfig("udp://10.0.0.1:8125"))
+	require.NoError(t, err)
+	s := &Server{relay: r}
+
+	// the filters apply to the local processing only
+	message := "debug.requests:1|c|#env:dev"
+	_, err = s.parseMetricMessage(p, nil, []byte(message), nil)
+	assert.Equal(t, errRelayed, err)
+	assert.Equal(t, map[string]string{message: "udp://10.0.0.1:8125"}, relayed(r))
+}
@@ -0,0 +1,141 @@
+package agent
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"time"
+)
+
+// streamReader splits the byte stream of a connection into newline framed
+// packets. Each packet only holds complete messages, a trailing partial
+// message is carried over to the next packet.
+// A message longer than maxLineSize (or than the packet buffer) can't be
+// framed and is dropped.
+type streamReader struct {
+	conn          net.Conn
+	origin        string
+	source        string
+	packetPool    *PacketPool
+	packetsBuffer *packetsBuffer
+	admission     *admission
+	maxLineSize   int           // 0 means the packet buffer size
+	idleTimeout   time.Duration // 0 means no timeout
+
+	onRead func(n int)
+	onDrop func()
+}
+
+// run reads the connection until it is closed, idles out or fails.
+// A final message not terminated by a newline is submitted when the
+// peer closes the connection, it is dropped on any other error.
+func (r *streamReader) run() error {
+	packet := r.packetPool.Get()
+	length := 0
+	discarding := false
+
+	for {
+		if r.idleTimeout > 0 {
+			r.conn.SetReadDeadline(time.Now().Add(r.idleTimeout))
+		}
+		n, err := r.conn.Read(packet.buffer[length:])
+		if n > 0 {
+			if r.onRead != nil {
+				r.onRead(n)
+			}
+
+			start := length
+			length += n
+
+			if discarding {
+				// skip the remaining of an oversized message
+				i := bytes.IndexByte(packet.buffer[start:length], messageSeparator)
+				if i < 0 {
+					length = 0
+				} else {
+					length = copy(packet.buffer, packet.buffer[start+i+1:length])
+					discarding = false
+				}
+			}
+
+			if i := bytes.LastIndexByte(packet.buffer[:length], messageSeparator); i >= 0 {
+				next := r.packetPool.Get()
+				remaining := copy(next.buffer, packet.buffer[i+1:length])
+				if r.maxLineSize > 0 {
+					i = r.dropLongLines(packet.buffer[:i])
+				}
+				r.submit(packet, i)
+				packet = next
+				length = remaining
+			}
+
+			// what is left in the buffer is a single partial message
+			if length == len(packet.buffer) || r.lineTooLong(length) {
+				if r.onDrop != nil {
+					r.onDrop()
+				}
+				length = 0
+				discarding = true
+			}
+		}
+
+		if err != nil {
+			if err == io.EOF && length > 0 && !discarding {
+				r.submit(packet, length)
+			} else {
+				r.packetPool.Put(packet)
+			}
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+	}
+}
+
+func (r *streamReader) lineTooLong(length int) bool {
+	return r.maxLineSize > 0 && length > r.maxLineSize
+}
+
+// dropLongLines removes in place the complete messages exceeding maxLineSize
+// and returns the new length of the buffer.
+func (r *streamReader) dropLongLines(buffer []byte) int {
+	n := 0
+	for rest := buffer; len(rest) > 0; {
+		line := rest
+		if i := bytes.IndexByte(rest, messageSeparator); i >= 0 {
+			line, rest = rest[:i+1], rest[i+1:]
+		} else {
+			rest = nil
+		}
+		if r.lineTooLong(len(bytes.TrimSuffix(line, []byte{messageSeparator}))) {
+			if r.onDrop != nil {
+				r.onDrop()
+			}
+			continue
+		}
+		n += copy(buffer[n:], line)
+	}
+	// the last message kept might have been followed by a dropped one
+	if n > 0 && buffer[n-1] == messageSeparator {
+		n--
+	}
+	return n
+}
+
+func (r *streamReader) submit(packet *Packet, length int) {
+	packet.Contents = r.admission.admit(r.source, r.origin, packet.buffer[:length])
+	if len(packet.Contents) == 0 {
+		r.packetPool.Put(packet)
+		return
+	}
+	packet.Origin = r.origin
+	packet.Source = r.source
+	r.packetsBuffer.append(packet)
+}
+
+// isTimeout returns true if err is a network timeout
+func isTimeout(err error) bool {
+	netErr, ok := err.(net.Error)
+	return ok && netErr.Timeout()
+}
@@ -0,0 +1,144 @@
+package agent
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newTestStreamReader returns a reader of one end of a pipe, each packet it
+// submits is flushed to the returned channel
+func newTestStreamReader(bufferSize int) (*streamReader, net.Conn, chan Packets) {
+	server, client := net.Pipe()
+	out := make(chan Packets, 100)
+	r := &streamReader{
+		conn:          server,
+		source:        "10.0.0.1",
+		packetPool:    NewPacketPool(bufferSize),
+		packetsBuffer: newPacketsBuffer(1, time.Hour, out, nil),
+	}
+	return r, client, out
+}
+
+// streamContents returns the contents of the packets received on out
+func streamContents(out chan Packets) []string {
+	var contents []string
+	for {
+		select {
+		case packets := <-out:
+			for _, packet := range packets {
+				contents = append(contents, string(packet.Contents))
+			}
+		default:
+			return contents
+		}
+	}
+}
+
+func TestStreamReaderFraming(t *testing.T) {
+	for _, tc := range []struct {
+		name        string
+		writes      []string
+		bufferSize  int
+		maxLineSize int
+		expected    []string
+		drops       int
+	}{
+		{
+			name:     "complete messages",
+			writes:   []string{"a:1|c\nb:1|c\n"},
+			expected: []string{"a:1|c\nb:1|c"},
+		},
+		{
+			name:     "message split across reads",
+			writes:   []string{"a:1|c\nb:", "1|c\n"},
+			expected: []string{"a:1|c", "b:1|c"},
+		},
+		{
+			name:     "final message submitted on close",
+			writes:   []string{"a:1|c\nb:1|c"},
+			expected: []string{"a:1|c", "b:1|c"},
+		},
+		{
+			name:        "long complete message dropped",
+			writes:      []string{"a:1|c\nlong.metric:1|c\nb:1|c\n"},
+			maxLineSize: 8,
+			expected:    []string{"a:1|c\nb:1|c"},
+			drops:       1,
+		},
+		{
+			name:        "long partial message discarded up to its end",
+			writes:      []string{"long.met", "ric:1|c\nb:1|c\n"},
+			maxLineSize: 6,
+			expected:    []string{"b:1|c"},
+			drops:       1,
+		},
+		{
+			name:       "message larger than the buffer discarded",
+			writes:     []string{"long.metric", ":1|c\nb:1|c\n"},
+			bufferSize: 11,
+			expected:   []string{"b:1|c"},
+			drops:      1,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			bufferSize := tc.bufferSize
+			if bufferSize == 0 {
+				bufferSize = 64
+			}
+			r, client, out := newTestStreamReader(bufferSize)
+			defer r.packetsBuffer.close()
+			r.maxLineSize = tc.maxLineSize
+			drops := 0
+			r.onDrop = func() { drops++ }
+
+			done := make(chan error)
+			go func() { done <- r.run() }()
+			for _, write := range tc.writes {
+				_, err := client.Write([]byte(write))
+				require.NoError(t, err)
+			}
+			client.Close()
+
+			assert.NoError(t, <-done)
+			assert.Equal(t, tc.expected, streamContents(out))
+			assert.Equal(t, tc.drops, drops)
+		})
+	}
+}
+
+func TestStreamReaderIdleTimeoutDropsPartialMessage(t *testing.T) {
+	r, client, out := newTestStreamReader(64)
+	defer r.packetsBuffer.close()
+	defer client.Close()
+	r.idleTimeout = 10 * time.Millisecond
+
+	done := make(chan error)
+	go func() { done <- r.run() }()
+	_, err := client.Write([]byte("a:1|c\nb:1"))
+	require.NoError(t, err)
+
+	err = <-done
+	assert.True(t, isTimeout(err))
+	assert.Equal(t, []string{"a:1|c"}, streamContents(out))
+}
+
+func TestStreamReaderSource(t *testing.T) {
+	r, client, out := newTestStreamReader(64)
+	defer r.packetsBuffer.close()
+	r.origin = "container_id://abc"
+
+	go func() {
+		client.Write([]byte("a:1|c\n"))
+		client.Close()
+	}()
+	require.NoError(t, r.run())
+
+	packets := <-out
+	require.Len(t, packets, 1)
+	assert.Equal(t, "container_id://abc", packets[0].Origin)
+	assert.Equal(t, "10.0.0.1", packets[0].Source)
+}
@@ -0,0 +1,220 @@
+package agent
+
+import (
+	"expvar"
+	"fmt"
+	"github.com/frankhang/util/errors"
+	"github.com/frankhang/util/logutil"
+	"go.uber.org/zap"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	. "github.com/frankhang/doppler/config"
+	"github.com/frankhang/doppler/telemetry"
+)
+
+var (
+	tcpExpvars             = expvar.NewMap("agent-tcp")
+	tcpPacketReadingErrors = expvar.Int{}
+	tcpPackets             = expvar.Int{}
+	tcpBytes               = expvar.Int{}
+	tcpConnections         = expvar.Int{}
+	tcpRejectedConnections = expvar.Int{}
+	tcpIdleTimeouts        = expvar.Int{}
+	tcpLinesTooLong        = expvar.Int{}
+
+	tlmTCPPackets = telemetry.NewCounter("agent", "tcp_packets",
+		[]string{"state"}, "Agent TCP reads count")
+	tlmTCPPacketsBytes = telemetry.NewCounter("agent", "tcp_packets_bytes",
+		[]string{}, "Agent TCP bytes count")
+	tlmTCPConnections = telemetry.NewGauge("agent", "tcp_connections",
+		[]string{}, "Agent TCP open connections")
+	tlmTCPConnectionsClosed = telemetry.NewCounter("agent", "tcp_connections_closed",
+		[]string{"reason"}, "Agent TCP connections closed count")
+)
+
+func init() {
+	tcpExpvars.Set("PacketReadingErrors", &tcpPacketReadingErrors)
+	tcpExpvars.Set("Packets", &tcpPackets)
+	tcpExpvars.Set("Bytes", &tcpBytes)
+	tcpExpvars.Set("Connections", &tcpConnections)
+	tcpExpvars.Set("RejectedConnections", &tcpRejectedConnections)
+	tcpExpvars.Set("IdleTimeouts", &tcpIdleTimeouts)
+	tcpExpvars.Set("LinesTooLong", &tcpLinesTooLong)
+}
+
+// TCPListener implements the StatsdListener interface for TCP protocol.
+// Clients send newline separated messages over long lived connections,
+// each connection is read by its own goroutine into its own packet buffer.
+// Origin detection is not implemented for TCP, the messages are rate limited
+// by client IP.
+type TCPListener struct {
+	listener      net.Listener
+	packetsBuffer *packetsBuffer
+	packetPool    *PacketPool
+	admission     *admission
+
+	maxConnections int
+	idleTimeout    time.Duration
+	maxLineSize    int
+
+	conns     map[net.Conn]struct{}
+	connsLock sync.Mutex
+}
+
+// NewTCPListener returns an idle TCP Statsd listener, the packets of the pool
+// must hold agent_tcp_max_line_size bytes
+func NewTCPListener(packetOut chan Packets, packetPool *PacketPool, admission *admission) (*TCPListener, error) {
+	var url string
+
+	if Cfg.AgentNonLocalTraffic {
+		// Listen to all network interfaces
+		url = fmt.Sprintf(":%d", Cfg.AgentTCPPort)
+	} else {
+		url = net.JoinHostPort(Cfg.Host, strconv.Itoa(Cfg.AgentTCPPort))
+	}
+
+	listener, err := net.Listen("tcp", url)
+	if err != nil {
+		err := fmt.Errorf("can't listen: %s", err)
+		return nil, errors.Trace(err)
+	}
+
+	flushTimeout := time.Duration(Cfg.AgentPacketBufferFlushTimeout) * time.Millisecond
+
+	l := &TCPListener{
+		listener:       listener,
+		packetPool:     packetPool,
+		admission:      admission,
+		packetsBuffer:  newPacketsBuffer(uint(Cfg.AgentPacketBufferSize), flushTimeout, packetOut, admission),
+		maxConnections: Cfg.AgentTCPMaxConnections,
+		idleTimeout:    time.Duration(Cfg.AgentTCPIdleTimeout) * time.Second,
+		maxLineSize:    Cfg.AgentTCPMaxLineSize,
+		conns:          make(map[net.Conn]struct{}),
+	}
+	logutil.BgLogger().Info("agent-tcp: successfully initialized", zap.String("addr", listener.Addr().String()))
+	return l, nil
+}
+
+// Listen runs the accept loop. Should be called in its own goroutine
+func (l *TCPListener) Listen() {
+	logutil.BgLogger().Info("agent-tcp: starting to listen...", zap.String("addr", l.listener.Addr().String()))
+	for {
+		conn, err := l.listener.Accept()
+		if err != nil {
+			// listener has been closed
+			if strings.HasSuffix(err.Error(), " use of closed network connection") {
+				return
+			}
+			logutil.BgLogger().Error("agent-tcp: error accepting connection", zap.Error(err))
+			continue
+		}
+
+		if !l.track(conn) {
+			logutil.BgLogger().Warn("agent-tcp: too many connections, rejecting",
+				zap.String("remote", conn.RemoteAddr().String()), zap.Int("limit", l.maxConnections))
+			tcpRejectedConnections.Add(1)
+			tlmTCPConnectionsClosed.Inc("rejected")
+			conn.Close()
+			continue
+		}
+		go l.handleConnection(conn)
+	}
+}
+
+// track registers a new connection, it returns false if the connection
+// limit is reached.
+func (l *TCPListener) track(conn net.Conn) bool {
+	l.connsLock.Lock()
+	defer l.connsLock.Unlock()
+	if l.maxConnections > 0 && len(l.conns) >= l.maxConnections {
+		return false
+	}
+	l.conns[conn] = struct{}{}
+	tcpConnections.Add(1)
+	tlmTCPConnections.Inc()
+	return true
+}
+
+func (l *TCPListener) untrack(conn net.Conn) {
+	l.connsLock.Lock()
+	defer l.connsLock.Unlock()
+	if _, ok := l.conns[conn]; ok {
+		delete(l.conns, conn)
+		tcpConnections.Add(-1)
+		tlmTCPConnections.Dec()
+	}
+}
+
+func (l *TCPListener) handleConnection(conn net.Conn) {
+	defer func() {
+		l.untrack(conn)
+		conn.Close()
+	}()
+
+	if tcpConn, ok := conn.(*net.TCPConn); ok && Cfg.Performance.TCPKeepAlive {
+		tcpConn.SetKeepAlive(true)
+	}
+
+	reader := &streamReader{
+		conn:          conn,
+		origin:        NoOrigin,
+		source:        remoteIP(conn),
+		packetPool:    l.packetPool,
+		packetsBuffer: l.packetsBuffer,
+		admission:     l.admission,
+		maxLineSize:   l.maxLineSize,
+		idleTimeout:   l.idleTimeout,
+		onRead: func(n int) {
+			tcpPackets.Add(1)
+			tcpBytes.Add(int64(n))
+			tlmTCPPackets.Inc("ok")
+			tlmTCPPacketsBytes.Add(float64(n))
+		},
+		onDrop: func() {
+			tcpLinesTooLong.Add(1)
+			tlmTCPPackets.Inc("line_too_long")
+		},
+	}
+
+	err := reader.run()
+	switch {
+	case err == nil:
+		tlmTCPConnectionsClosed.Inc("eof")
+	case isTimeout(err):
+		logutil.BgLogger().Debug("agent-tcp: closing idle connection", zap.String("remote", conn.RemoteAddr().String()))
+		tcpIdleTimeouts.Add(1)
+		tlmTCPConnectionsClosed.Inc("idle")
+	case strings.HasSuffix(err.Error(), " use of closed network connection"):
+		tlmTCPConnectionsClosed.Inc("stopped")
+	default:
+		logutil.BgLogger().Error("agent-tcp: error reading connection", zap.String("remote", conn.RemoteAddr().String()), zap.Error(err))
+		tcpPacketReadingErrors.Add(1)
+		tlmTCPPackets.Inc("error")
+		tlmTCPConnectionsClosed.Inc("error")
+	}
+}
+
+// remoteIP returns the IP of the client of the connection
+func remoteIP(conn net.Conn) string {
+	if addr, ok := conn.RemoteAddr().(*net.TCPAddr); ok {
+		return addr.IP.String()
+	}
+	return NoSource
+}
+
+// Stop closes the TCP listener and all its open connections
+func (l *TCPListener) Stop() {
+	l.listener.Close()
+
+	l.connsLock.Lock()
+	for conn := range l.conns {
+		conn.Close()
+	}
+	l.connsLock.Unlock()
+
+	l.packetsBuffer.close()
+}
@@ -0,0 +1,83 @@
+package agent
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	. "github.com/frankhang/doppler/config"
+)
+
+// newTestTCPListener returns a running listener on a random local port
+func newTestTCPListener(t *testing.T, maxConnections int) (*TCPListener, chan Packets) {
+	conf := DefaultConf
+	conf.Host = "127.0.0.1"
+	conf.AgentTCPPort = 0
+	conf.AgentTCPMaxConnections = maxConnections
+	conf.AgentTCPMaxLineSize = 16
+	conf.AgentPacketBufferSize = 1
+	Cfg = &conf
+
+	out := make(chan Packets, 10)
+	l, err := NewTCPListener(out, NewPacketPool(64), nil)
+	require.NoError(t, err)
+	go l.Listen()
+	return l, out
+}
+
+func TestTCPListener(t *testing.T) {
+	l, out := newTestTCPListener(t, 0)
+	defer l.Stop()
+
+	conn, err := net.Dial("tcp", l.listener.Addr().String())
+	require.NoError(t, err)
+	_, err = conn.Write([]byte("a:1|c\nthis.metric.is.too.long:1|c\nb:1"))
+	require.NoError(t, err)
+	conn.Close()
+
+	expected := "a:1|c\nb:1"
+	assert.Equal(t, expected, receiveContents(t, out, expected))
+}
+
+func TestTCPListenerMaxConnections(t *testing.T) {
+	l, out := newTestTCPListener(t, 1)
+	defer l.Stop()
+
+	first, err := net.Dial("tcp", l.listener.Addr().String())
+	require.NoError(t, err)
+	defer first.Close()
+	_, err = first.Write([]byte("a:1|c\n"))
+	require.NoError(t, err)
+	select {
+	case <-out:
+	case <-time.After(2 * time.Second):
+		require.FailNow(t, "timeout waiting for the first connection")
+	}
+
+	// the second connection is closed right away
+	second, err := net.Dial("tcp", l.listener.Addr().String())
+	require.NoError(t, err)
+	defer second.Close()
+	second.SetReadDeadline(time.Now().Add(2 * time.Second))
+	_, err = second.Read(make([]byte, 1))
+	assert.Error(t, err)
+	assert.False(t, isTimeout(err))
+}
+
+func TestRemoteIP(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer listener.Close()
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+	assert.Equal(t, "127.0.0.1", remoteIP(conn))
+
+	server, client := net.Pipe()
+	defer server.Close()
+	defer client.Close()
+	assert.Equal(t, NoSource, remoteIP(server))
+}
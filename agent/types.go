@@ -15,6 +15,7 @@ type Packet struct {
 	Contents []byte // Contents, might contain several messages
 	buffer   []byte // Underlying buffer for data read
 	Origin   string // Origin container if identified
+	Source   string // Client the messages come from, for the drop accounting
 }
 
 // Packets is a slice of packet pointers
@@ -28,3 +29,7 @@ type StatsdListener interface {
 
 // NoOrigin is returned if origin detection is off or failed.
 const NoOrigin = ""
+
+// NoSource is the source of the messages of an unidentified client, they
+// aren't rate limited.
+const NoSource = ""
@@ -6,6 +6,7 @@
 package agent
 
 import (
+	"context"
 	"expvar"
 	"fmt"
 	"github.com/frankhang/util/errors"
@@ -14,6 +15,7 @@ import (
 	"net"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	. "github.com/frankhang/doppler/config"
@@ -40,19 +42,29 @@ func init() {
 
 // UDPListener implements the StatsdListener interface for UDP protocol.
 // It listens to a given UDP address and sends back packets ready to be
-// processed.
-// Origin detection is not implemented for UDP.
+// processed. On linux, several SO_REUSEPORT sockets may share the address,
+// each read by its own goroutine, with batched reads.
+// Origin detection is not implemented for UDP, the messages are rate limited
+// by client IP.
 type UDPListener struct {
-	conn          net.PacketConn
+	sockets       []*udpSocket
 	packetsBuffer *packetsBuffer
-	packetBuffer  *packetBuffer
-	buffer        []byte
+	packetPool    *PacketPool
+	admission     *admission
+	batchSize     int // datagrams per read, 1 reads them one by one
+	stopChan      chan struct{}
+}
+
+// udpSocket is a socket of the listener, with its own reading buffers
+type udpSocket struct {
+	conn         *net.UDPConn
+	packetBuffer *packetBuffer
+	buffer       []byte
+	stats        *udpSocketStats // nil when the kernel stats are unavailable
 }
 
 // NewUDPListener returns an idle UDP Statsd listener
-func NewUDPListener(packetOut chan Packets, packetPool *PacketPool) (*UDPListener, error) {
-	var conn net.PacketConn
-	var err error
+func NewUDPListener(packetOut chan Packets, packetPool *PacketPool, admission *admission) (*UDPListener, error) {
 	var url string
 
 	if Cfg.AgentNonLocalTraffic{
@@ -62,44 +74,104 @@ func NewUDPListener(packetOut chan Packets, packetPool *PacketPool) (*UDPListene
 		url = net.JoinHostPort(Cfg.Host, strconv.Itoa(int(Cfg.Port)))
 	}
 
-	conn, err = net.ListenPacket("udp", url)
-
-	if err != nil {
-		err := fmt.Errorf("can't listen: %s", err)
-		return nil, errors.Trace(err)
+	sockets, batchSize := Cfg.AgentUDPSockets, Cfg.AgentUDPBatchSize
+	if sockets < 1 {
+		sockets = 1
 	}
-
-	if rcvbuf := Cfg.AgentSoRcvbuf; rcvbuf != 0 {
-		if err := conn.(*net.UDPConn).SetReadBuffer(rcvbuf); err != nil {
-			err := fmt.Errorf("could not set socket rcvbuf: %s", err)
-			return nil, errors.Trace(err)
-		}
+	if batchSize < 1 {
+		batchSize = 1
+	}
+	if sockets > 1 && !reusePortSupported {
+		logutil.BgLogger().Warn("agent-udp: SO_REUSEPORT is not supported on this platform, using a single socket")
+		sockets = 1
+	}
+	if batchSize > 1 && !batchReadSupported {
+		logutil.BgLogger().Warn("agent-udp: batched reads are not supported on this platform, reading datagrams one by one")
+		batchSize = 1
 	}
 
 	bufferSize := Cfg.AgentBufferSize
 	packetsBufferSize := Cfg.AgentPacketBufferSize
 	flushTimeout := time.Duration(Cfg.AgentPacketBufferFlushTimeout) * time.Millisecond
 
-	buffer := make([]byte, bufferSize)
-	packetsBuffer := newPacketsBuffer(uint(packetsBufferSize), flushTimeout, packetOut)
-	packetBuffer := newPacketBuffer(packetPool, flushTimeout, packetsBuffer)
-
 	listener := &UDPListener{
-		conn:          conn,
-		packetsBuffer: packetsBuffer,
-		packetBuffer:  packetBuffer,
-		buffer:        buffer,
+		packetsBuffer: newPacketsBuffer(uint(packetsBufferSize), flushTimeout, packetOut, admission),
+		packetPool:    packetPool,
+		admission:     admission,
+		batchSize:     batchSize,
+		stopChan:      make(chan struct{}),
+	}
+	for i := 0; i < sockets; i++ {
+		conn, err := listenUDP(url, sockets > 1)
+		if err != nil {
+			listener.closeSockets()
+			return nil, errors.Trace(err)
+		}
+		// the next sockets share the port picked for the first one
+		url = conn.LocalAddr().String()
+
+		socket := &udpSocket{conn: conn}
+		listener.sockets = append(listener.sockets, socket)
+		if rcvbuf := Cfg.AgentSoRcvbuf; rcvbuf != 0 {
+			if err := conn.SetReadBuffer(rcvbuf); err != nil {
+				listener.closeSockets()
+				err := fmt.Errorf("could not set socket rcvbuf: %s", err)
+				return nil, errors.Trace(err)
+			}
+		}
+		if batchSize == 1 {
+			socket.buffer = make([]byte, bufferSize)
+			socket.packetBuffer = newPacketBuffer(packetPool, flushTimeout, listener.packetsBuffer, admission.limiting())
+		}
+		socket.stats = newUDPSocketStats(i, conn)
 	}
-	logutil.BgLogger().Info("agent-udp: successfully initialized", zap.String("addr", conn.LocalAddr().String()))
+
+	logutil.BgLogger().Info("agent-udp: successfully initialized", zap.String("addr", url),
+		zap.Int("sockets", sockets), zap.Int("batch_size", batchSize))
 	return listener, nil
 }
 
-// Listen runs the intake loop. Should be called in its own goroutine
+// listenUDP opens a socket listening to url, with SO_REUSEPORT if reusePort
+func listenUDP(url string, reusePort bool) (*net.UDPConn, error) {
+	lc := net.ListenConfig{}
+	if reusePort {
+		lc.Control = setReusePort
+	}
+	conn, err := lc.ListenPacket(context.Background(), "udp", url)
+	if err != nil {
+		return nil, fmt.Errorf("can't listen: %s", err)
+	}
+	return conn.(*net.UDPConn), nil
+}
+
+// Listen runs the intake loop of every socket. Should be called in its own goroutine
 func (l *UDPListener) Listen() {
-	logutil.BgLogger().Info("agent-udp: starting to listen...", zap.String("addr", l.conn.LocalAddr().String()))
+	logutil.BgLogger().Info("agent-udp: starting to listen...", zap.String("addr", l.sockets[0].conn.LocalAddr().String()))
+
+	if l.sockets[0].stats != nil {
+		go l.updateSocketStats()
+	}
+
+	var wg sync.WaitGroup
+	for _, socket := range l.sockets {
+		wg.Add(1)
+		go func(socket *udpSocket) {
+			defer wg.Done()
+			if l.batchSize > 1 {
+				l.readBatches(socket)
+			} else {
+				l.read(socket)
+			}
+		}(socket)
+	}
+	wg.Wait()
+}
+
+// read reads the datagrams of the socket one by one until it is closed
+func (l *UDPListener) read(socket *udpSocket) {
 	for {
 		udpPackets.Add(1)
-		n, _, err := l.conn.ReadFrom(l.buffer)
+		n, addr, err := socket.conn.ReadFrom(socket.buffer)
 		if err != nil {
 			// connection has been closed
 			if strings.HasSuffix(err.Error(), " use of closed network connection") {
@@ -114,14 +186,63 @@ func (l *UDPListener) Listen() {
 		tlmUDPPackets.Inc("ok")
 		udpBytes.Add(int64(n))
 
+		source := NoSource
+		if udpAddr, ok := addr.(*net.UDPAddr); ok {
+			source = udpAddr.IP.String()
+		}
+		contents := l.admission.admit(source, NoOrigin, socket.buffer[:n])
+		if len(contents) == 0 {
+			continue
+		}
+
 		// packetBuffer merges multiple packets together and sends them when its buffer is full
-		l.packetBuffer.addMessage(l.buffer[:n])
+		socket.packetBuffer.addMessage(contents, source)
 	}
 }
 
-// Stop closes the UDP connection and stops listening
+// submit sends a datagram read in a batch, each datagram is a packet
+func (l *UDPListener) submit(packet *Packet, n int, source string) {
+	udpPackets.Add(1)
+	tlmUDPPackets.Inc("ok")
+	udpBytes.Add(int64(n))
+
+	packet.Source = source
+	packet.Contents = l.admission.admit(source, NoOrigin, packet.buffer[:n])
+	if len(packet.Contents) == 0 {
+		l.packetPool.Put(packet)
+		return
+	}
+	l.packetsBuffer.append(packet)
+}
+
+// updateSocketStats reads the kernel stats of the sockets until the listener is stopped
+func (l *UDPListener) updateSocketStats() {
+	ticker := time.NewTicker(udpSocketStatsInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-l.stopChan:
+			return
+		case <-ticker.C:
+			readUDPSocketStats(l.sockets)
+		}
+	}
+}
+
+func (l *UDPListener) closeSockets() {
+	for _, socket := range l.sockets {
+		socket.conn.Close()
+	}
+}
+
+// Stop closes the UDP connections and stops listening
 func (l *UDPListener) Stop() {
-	l.packetBuffer.close()
+	close(l.stopChan)
+	for _, socket := range l.sockets {
+		if socket.packetBuffer != nil {
+			socket.packetBuffer.close()
+		}
+	}
 	l.packetsBuffer.close()
-	l.conn.Close()
+	l.closeSockets()
 }
@@ -0,0 +1,211 @@
+// +build linux
+
+package agent
+
+import (
+	"bufio"
+	"expvar"
+	"github.com/frankhang/util/logutil"
+	"go.uber.org/zap"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+
+	"github.com/frankhang/doppler/telemetry"
+)
+
+const (
+	reusePortSupported = true
+	batchReadSupported = true
+
+	udpSocketStatsInterval = 10 * time.Second
+)
+
+var (
+	udpSocketExpvars = expvar.NewMap("agent-udp-sockets")
+
+	tlmUDPSocketDrops = telemetry.NewGauge("agent", "udp_socket_drops",
+		[]string{"socket"}, "Datagrams dropped by the kernel on the socket, as reported by /proc/net/udp")
+	tlmUDPSocketRxQueue = telemetry.NewGauge("agent", "udp_socket_rx_queue",
+		[]string{"socket"}, "Bytes waiting in the receive buffer of the socket, as reported by /proc/net/udp")
+)
+
+// udpSocketStats are the kernel stats of a socket, found by inode in /proc/net/udp
+type udpSocketStats struct {
+	name    string
+	inode   uint64
+	drops   expvar.Int
+	rxQueue expvar.Int
+}
+
+// mmsghdr is the struct mmsghdr of recvmmsg, its padding matches the C one
+type mmsghdr struct {
+	hdr syscall.Msghdr
+	len uint32
+}
+
+// setReusePort sets SO_REUSEPORT on the socket before it is bound
+func setReusePort(network, address string, c syscall.RawConn) error {
+	var sockErr error
+	err := c.Control(func(fd uintptr) {
+		sockErr = unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_REUSEPORT, 1)
+	})
+	if err != nil {
+		return err
+	}
+	return sockErr
+}
+
+// readBatches reads the datagrams of the socket with recvmmsg, directly into
+// packets of the pool, until the socket is closed
+func (l *UDPListener) readBatches(socket *udpSocket) {
+	rawConn, err := socket.conn.SyscallConn()
+	if err != nil {
+		logutil.BgLogger().Error("agent-udp: batched reads unavailable", zap.Error(err))
+		return
+	}
+
+	packets := make([]*Packet, l.batchSize)
+	names := make([]syscall.RawSockaddrInet6, l.batchSize) // large enough for both families
+	iovecs := make([]syscall.Iovec, l.batchSize)
+	hdrs := make([]mmsghdr, l.batchSize)
+
+	for {
+		for i := range hdrs {
+			if packets[i] == nil {
+				packets[i] = l.packetPool.Get()
+				iovecs[i].Base = &packets[i].buffer[0]
+				iovecs[i].SetLen(len(packets[i].buffer))
+			}
+			hdrs[i].hdr.Name = (*byte)(unsafe.Pointer(&names[i]))
+			hdrs[i].hdr.Namelen = syscall.SizeofSockaddrInet6
+			hdrs[i].hdr.Iov = &iovecs[i]
+			hdrs[i].hdr.Iovlen = 1
+		}
+
+		var count int
+		var errno syscall.Errno
+		err = rawConn.Read(func(fd uintptr) bool {
+			r, _, e := syscall.Syscall6(syscall.SYS_RECVMMSG, fd, uintptr(unsafe.Pointer(&hdrs[0])),
+				uintptr(len(hdrs)), syscall.MSG_DONTWAIT, 0, 0)
+			if e == syscall.EAGAIN || e == syscall.EWOULDBLOCK {
+				// wait for the socket to be readable
+				return false
+			}
+			count, errno = int(r), e
+			return true
+		})
+		if err == nil && errno != 0 {
+			err = errno
+		}
+		if err != nil {
+			// connection has been closed
+			if strings.HasSuffix(err.Error(), " use of closed network connection") {
+				return
+			}
+
+			logutil.BgLogger().Error("agent-udp: error reading packets", zap.Error(err))
+			udpPacketReadingErrors.Add(1)
+			tlmUDPPackets.Inc("error")
+			continue
+		}
+
+		for i := 0; i < count; i++ {
+			packet := packets[i]
+			packets[i] = nil
+			l.submit(packet, int(hdrs[i].len), sockaddrIP(&names[i]))
+		}
+	}
+}
+
+// sockaddrIP returns the IP of a raw socket address, as printed by net.IP
+func sockaddrIP(name *syscall.RawSockaddrInet6) string {
+	switch name.Family {
+	case syscall.AF_INET:
+		addr := (*syscall.RawSockaddrInet4)(unsafe.Pointer(name))
+		return net.IP(addr.Addr[:]).String()
+	case syscall.AF_INET6:
+		return net.IP(name.Addr[:]).String()
+	}
+	return NoSource
+}
+
+// newUDPSocketStats returns the stats of the socket, nil if its inode is unknown
+func newUDPSocketStats(i int, conn *net.UDPConn) *udpSocketStats {
+	rawConn, err := conn.SyscallConn()
+	if err != nil {
+		return nil
+	}
+	var stat unix.Stat_t
+	var statErr error
+	if err = rawConn.Control(func(fd uintptr) { statErr = unix.Fstat(int(fd), &stat) }); err != nil || statErr != nil {
+		return nil
+	}
+
+	stats := &udpSocketStats{name: strconv.Itoa(i), inode: stat.Ino}
+	m := new(expvar.Map).Init()
+	m.Set("Drops", &stats.drops)
+	m.Set("RxQueue", &stats.rxQueue)
+	udpSocketExpvars.Set(stats.name, m)
+	return stats
+}
+
+// readUDPSocketStats updates the stats of the sockets from /proc/net/udp and udp6
+func readUDPSocketStats(sockets []*udpSocket) {
+	byInode := make(map[uint64]*udpSocketStats, len(sockets))
+	for _, socket := range sockets {
+		if socket.stats != nil {
+			byInode[socket.stats.inode] = socket.stats
+		}
+	}
+	for _, path := range []string{"/proc/net/udp", "/proc/net/udp6"} {
+		f, err := os.Open(path)
+		if err != nil {
+			continue
+		}
+		parseProcNetUDP(f, byInode)
+		f.Close()
+	}
+}
+
+// parseProcNetUDP updates the stats of the sockets listed in a /proc/net/udp
+// file, whose columns are:
+//
+//	sl local_address rem_address st tx_queue:rx_queue tr:tm->when retrnsmt uid timeout inode ref pointer drops
+func parseProcNetUDP(r io.Reader, byInode map[uint64]*udpSocketStats) {
+	scanner := bufio.NewScanner(r)
+	// skip the header
+	scanner.Scan()
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 13 {
+			continue
+		}
+		inode, err := strconv.ParseUint(fields[9], 10, 64)
+		if err != nil {
+			continue
+		}
+		stats, ok := byInode[inode]
+		if !ok {
+			continue
+		}
+
+		if queues := strings.SplitN(fields[4], ":", 2); len(queues) == 2 {
+			if rxQueue, err := strconv.ParseInt(queues[1], 16, 64); err == nil {
+				stats.rxQueue.Set(rxQueue)
+				tlmUDPSocketRxQueue.Set(float64(rxQueue), stats.name)
+			}
+		}
+		if drops, err := strconv.ParseInt(fields[12], 10, 64); err == nil {
+			stats.drops.Set(drops)
+			tlmUDPSocketDrops.Set(float64(drops), stats.name)
+		}
+	}
+}
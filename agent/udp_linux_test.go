@@ -0,0 +1,74 @@
+// +build linux
+
+package agent
+
+import (
+	"strings"
+	"syscall"
+	"testing"
+	"unsafe"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseProcNetUDP(t *testing.T) {
+	for name, tc := range map[string]struct {
+		contents string
+		rxQueue  int64
+		drops    int64
+	}{
+		"ipv4": {
+			contents: `   sl  local_address rem_address   st tx_queue rx_queue tr tm->when retrnsmt   uid  timeout inode ref pointer drops
+  123: 00000000:1FBD 00000000:0000 07 00000000:00000A00 00:00000000 00000000     0        0 4242 2 0000000000000000 17
+  124: 0100007F:0035 00000000:0000 07 00000000:000000FF 00:00000000 00000000   101        0 1111 2 0000000000000000 99
+`,
+			rxQueue: 0xA00,
+			drops:   17,
+		},
+		"ipv6": {
+			contents: `  sl  local_address                         remote_address                        st tx_queue rx_queue tr tm->when retrnsmt   uid  timeout inode ref pointer drops
+  456: 00000000000000000000000000000000:1FBD 00000000000000000000000000000000:0000 07 00000000:00000100 00:00000000 00000000     0        0 4242 2 0000000000000000 3
+`,
+			rxQueue: 0x100,
+			drops:   3,
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			stats := &udpSocketStats{name: "0", inode: 4242}
+			parseProcNetUDP(strings.NewReader(tc.contents), map[uint64]*udpSocketStats{4242: stats})
+			assert.Equal(t, tc.rxQueue, stats.rxQueue.Value())
+			assert.Equal(t, tc.drops, stats.drops.Value())
+		})
+	}
+}
+
+func TestParseProcNetUDPSkipsInvalidLines(t *testing.T) {
+	stats := &udpSocketStats{name: "0", inode: 4242}
+	parseProcNetUDP(strings.NewReader(`   sl  local_address rem_address   st tx_queue rx_queue tr tm->when retrnsmt   uid  timeout inode ref pointer drops
+  123: 00000000:1FBD 00000000:0000 07 00000000:00000A00
+  124: 00000000:1FBD 00000000:0000 07 00000000:00000A00 00:00000000 00000000     0        0 inode 2 0000000000000000 17
+  125: 00000000:1FBD 00000000:0000 07 00000000:zz 00:00000000 00000000     0        0 4242 2 0000000000000000 5
+`), map[uint64]*udpSocketStats{4242: stats})
+
+	// only the drops of the last line are valid
+	assert.Equal(t, int64(0), stats.rxQueue.Value())
+	assert.Equal(t, int64(5), stats.drops.Value())
+}
+
+func TestSockaddrIP(t *testing.T) {
+	var name syscall.RawSockaddrInet6
+	ipv4 := (*syscall.RawSockaddrInet4)(unsafe.Pointer(&name))
+	ipv4.Family = syscall.AF_INET
+	ipv4.Addr = [4]byte{10, 0, 0, 1}
+	assert.Equal(t, "10.0.0.1", sockaddrIP(&name))
+
+	name = syscall.RawSockaddrInet6{Family: syscall.AF_INET6}
+	name.Addr = [16]byte{0x20, 0x01, 0x0d, 0xb8, 15: 1}
+	assert.Equal(t, "2001:db8::1", sockaddrIP(&name))
+
+	name.Addr = [16]byte{10: 0xff, 11: 0xff, 12: 192, 13: 168, 14: 0, 15: 1}
+	assert.Equal(t, "192.168.0.1", sockaddrIP(&name))
+
+	name = syscall.RawSockaddrInet6{Family: syscall.AF_UNIX}
+	assert.Equal(t, NoSource, sockaddrIP(&name))
+}
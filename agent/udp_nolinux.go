@@ -0,0 +1,35 @@
+// +build !linux
+
+package agent
+
+import (
+	"errors"
+	"net"
+	"syscall"
+	"time"
+)
+
+const (
+	reusePortSupported = false
+	batchReadSupported = false
+
+	udpSocketStatsInterval = 10 * time.Second
+)
+
+// udpSocketStats are the kernel stats of a socket, only available on linux
+type udpSocketStats struct{}
+
+func setReusePort(network, address string, c syscall.RawConn) error {
+	return errors.New("SO_REUSEPORT is only supported on linux")
+}
+
+// readBatches reads the datagrams one by one, recvmmsg is only available on linux
+func (l *UDPListener) readBatches(socket *udpSocket) {
+	l.read(socket)
+}
+
+func newUDPSocketStats(i int, conn *net.UDPConn) *udpSocketStats {
+	return nil
+}
+
+func readUDPSocketStats(sockets []*udpSocket) {}
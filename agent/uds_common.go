@@ -0,0 +1,210 @@
+// Unless explicitly stated otherwise all files in this repository are licensed
+// under the Apache License Version 2.0.
+// This product includes software developed at Datadog (https://www.datadoghq.com/).
+// Copyright 2016-2020 Datadog, Inc.
+
+package agent
+
+import (
+	"expvar"
+	"fmt"
+	"github.com/frankhang/util/errors"
+	"github.com/frankhang/util/logutil"
+	"go.uber.org/zap"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	. "github.com/frankhang/doppler/config"
+	"github.com/frankhang/doppler/telemetry"
+)
+
+var (
+	udsExpvars               = expvar.NewMap("agent-uds")
+	udsOriginDetectionErrors = expvar.Int{}
+	udsPacketReadingErrors   = expvar.Int{}
+	udsPackets               = expvar.Int{}
+	udsBytes                 = expvar.Int{}
+
+	tlmUDSPackets = telemetry.NewCounter("agent", "uds_packets",
+		[]string{"state"}, "Agent UDS packets count")
+	tlmUDSOriginDetectionError = telemetry.NewCounter("agent", "uds_origin_detection_error",
+		nil, "Agent UDS origin detection error count")
+	tlmUDSPacketsBytes = telemetry.NewCounter("agent", "uds_packets_bytes",
+		nil, "Agent UDS packets bytes count")
+)
+
+func init() {
+	udsExpvars.Set("OriginDetectionErrors", &udsOriginDetectionErrors)
+	udsExpvars.Set("PacketReadingErrors", &udsPacketReadingErrors)
+	udsExpvars.Set("Packets", &udsPackets)
+	udsExpvars.Set("Bytes", &udsBytes)
+}
+
+// UDSListener implements the StatsdListener interface for Unix Domain
+// Socket datagram protocol. It listens to a given socket path and sends
+// back packets ready to be processed.
+// Origin detection relies on SO_PASSCRED and is only available on Linux.
+type UDSListener struct {
+	conn            *net.UnixConn
+	socketPath      string
+	packetsBuffer   *packetsBuffer
+	packetPool      *PacketPool
+	admission       *admission
+	oobPool         *sync.Pool // For origin detection ancillary data
+	OriginDetection bool
+}
+
+// NewUDSListener returns an idle UDS Statsd listener
+func NewUDSListener(packetOut chan Packets, packetPool *PacketPool, admission *admission) (*UDSListener, error) {
+	socketPath := Cfg.AgentSocket
+	originDetection := Cfg.AgentOriginDetection
+
+	address, err := net.ResolveUnixAddr("unixgram", socketPath)
+	if err != nil {
+		err = fmt.Errorf("agent-uds: can't ResolveUnixAddr: %v", err)
+		return nil, errors.Trace(err)
+	}
+	if err = removeStaleSocket(socketPath); err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	conn, err := net.ListenUnixgram("unixgram", address)
+	if err != nil {
+		err = fmt.Errorf("can't listen: %s", err)
+		return nil, errors.Trace(err)
+	}
+	if err = os.Chmod(socketPath, 0722); err != nil {
+		err = fmt.Errorf("can't set the socket at write only: %s", err)
+		return nil, errors.Trace(err)
+	}
+
+	if originDetection {
+		if err = enableUDSPassCred(conn); err != nil {
+			logutil.BgLogger().Error("agent-uds: error enabling origin detection", zap.Error(err))
+			originDetection = false
+		} else {
+			logutil.BgLogger().Debug("agent-uds: enabling origin detection", zap.String("addr", conn.LocalAddr().String()))
+		}
+	}
+
+	if rcvbuf := Cfg.AgentSoRcvbuf; rcvbuf != 0 {
+		if err := conn.SetReadBuffer(rcvbuf); err != nil {
+			err = fmt.Errorf("could not set socket rcvbuf: %s", err)
+			return nil, errors.Trace(err)
+		}
+	}
+
+	flushTimeout := time.Duration(Cfg.AgentPacketBufferFlushTimeout) * time.Millisecond
+
+	listener := &UDSListener{
+		OriginDetection: originDetection,
+		socketPath:      socketPath,
+		packetPool:      packetPool,
+		admission:       admission,
+		conn:            conn,
+		packetsBuffer:   newPacketsBuffer(uint(Cfg.AgentPacketBufferSize), flushTimeout, packetOut, admission),
+	}
+
+	// Init the oob buffer pool if origin detection is enabled
+	if originDetection {
+		listener.oobPool = &sync.Pool{
+			New: func() interface{} {
+				return make([]byte, getUDSAncillarySize())
+			},
+		}
+	}
+
+	logutil.BgLogger().Info("agent-uds: successfully initialized", zap.String("addr", conn.LocalAddr().String()))
+	return listener, nil
+}
+
+// Listen runs the intake loop. Should be called in its own goroutine
+func (l *UDSListener) Listen() {
+	logutil.BgLogger().Info("agent-uds: starting to listen...", zap.String("addr", l.conn.LocalAddr().String()))
+	for {
+		var n int
+		var err error
+		packet := l.packetPool.Get()
+		udsPackets.Add(1)
+		if l.OriginDetection {
+			// Read datagram + credentials in ancillary data
+			oob := l.oobPool.Get().([]byte)
+			var oobn int
+			n, oobn, _, _, err = l.conn.ReadMsgUnix(packet.buffer, oob)
+			// Extract container id from credentials
+			if err == nil {
+				container, taggingErr := processUDSOrigin(oob[:oobn])
+				if taggingErr != nil {
+					logutil.BgLogger().Warn("agent-uds: error processing origin, data will not be tagged", zap.Error(taggingErr))
+					udsOriginDetectionErrors.Add(1)
+					tlmUDSOriginDetectionError.Inc()
+				} else {
+					packet.Origin = container
+				}
+			}
+			// Return the buffer back to the pool for reuse
+			l.oobPool.Put(oob)
+		} else {
+			// Read only datagram contents with no credentials
+			n, _, err = l.conn.ReadFromUnix(packet.buffer)
+		}
+
+		if err != nil {
+			l.packetPool.Put(packet)
+			// connection has been closed
+			if strings.HasSuffix(err.Error(), " use of closed network connection") {
+				return
+			}
+
+			logutil.BgLogger().Error("agent-uds: error reading packet", zap.Error(err))
+			udsPacketReadingErrors.Add(1)
+			tlmUDSPackets.Inc("error")
+			continue
+		}
+		tlmUDSPackets.Inc("ok")
+
+		udsBytes.Add(int64(n))
+		tlmUDSPacketsBytes.Add(float64(n))
+		// the messages are rate limited by origin container, when detected
+		packet.Source = packet.Origin
+		packet.Contents = l.admission.admit(packet.Source, packet.Origin, packet.buffer[:n])
+		if len(packet.Contents) == 0 {
+			l.packetPool.Put(packet)
+			continue
+		}
+
+		// packetsBuffer handles the forwarding of the packets to the agent server intake channel
+		l.packetsBuffer.append(packet)
+	}
+}
+
+// Stop closes the UDS connection and stops listening
+func (l *UDSListener) Stop() {
+	l.packetsBuffer.close()
+	l.conn.Close()
+
+	// Socket cleanup on exit
+	if err := os.Remove(l.socketPath); err != nil {
+		logutil.BgLogger().Info("agent-uds: error removing socket file", zap.Error(err))
+	}
+}
+
+// removeStaleSocket removes a socket file left behind by a previous run,
+// refusing to touch the path if it is not a UNIX socket.
+func removeStaleSocket(socketPath string) error {
+	fileInfo, err := os.Stat(socketPath)
+	if err != nil {
+		// Nothing to clean up
+		return nil
+	}
+	if fileInfo.Mode()&os.ModeSocket == 0 {
+		return fmt.Errorf("agent-uds: cannot reuse %s socket path: path already exists and is not a UNIX socket", socketPath)
+	}
+	if err = os.Remove(socketPath); err != nil {
+		return fmt.Errorf("agent-uds: cannot remove stale UNIX socket: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,94 @@
+package agent
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	. "github.com/frankhang/doppler/config"
+)
+
+// testSocketPath returns the path of a socket in a new temporary directory
+func testSocketPath(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "agent-uds")
+	require.NoError(t, err)
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	return filepath.Join(dir, "agent.socket")
+}
+
+// receiveContents returns the messages received on out once they are as long
+// as expected, the stream listeners might split them differently in packets
+func receiveContents(t *testing.T, out chan Packets, expected string) string {
+	var contents []string
+	for len(strings.Join(contents, "\n")) < len(expected) {
+		select {
+		case packets := <-out:
+			for _, packet := range packets {
+				contents = append(contents, string(packet.Contents))
+			}
+		case <-time.After(2 * time.Second):
+			require.FailNow(t, "timeout waiting for the packets", "received %v", contents)
+		}
+	}
+	return strings.Join(contents, "\n")
+}
+
+func TestUDSListener(t *testing.T) {
+	conf := DefaultConf
+	conf.AgentSocket = testSocketPath(t)
+	conf.AgentOriginDetection = false
+	conf.AgentPacketBufferSize = 1
+	Cfg = &conf
+
+	out := make(chan Packets, 10)
+	l, err := NewUDSListener(out, NewPacketPool(64), nil)
+	require.NoError(t, err)
+	go l.Listen()
+
+	info, err := os.Stat(conf.AgentSocket)
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0722), info.Mode().Perm())
+
+	conn, err := net.Dial("unixgram", conf.AgentSocket)
+	require.NoError(t, err)
+	defer conn.Close()
+	_, err = conn.Write([]byte("a:1|c\nb:1|c"))
+	require.NoError(t, err)
+	_, err = conn.Write([]byte("c:1|c"))
+	require.NoError(t, err)
+
+	expected := "a:1|c\nb:1|c\nc:1|c"
+	assert.Equal(t, expected, receiveContents(t, out, expected))
+
+	l.Stop()
+	_, err = os.Stat(conf.AgentSocket)
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestRemoveStaleSocket(t *testing.T) {
+	path := testSocketPath(t)
+
+	// nothing to clean up
+	assert.NoError(t, removeStaleSocket(path))
+
+	listener, err := net.Listen("unix", path)
+	require.NoError(t, err)
+	// keep the socket file around after the close
+	listener.(*net.UnixListener).SetUnlinkOnClose(false)
+	listener.Close()
+	assert.NoError(t, removeStaleSocket(path))
+	_, err = os.Stat(path)
+	assert.True(t, os.IsNotExist(err))
+
+	require.NoError(t, ioutil.WriteFile(path, []byte("data"), 0644))
+	assert.Error(t, removeStaleSocket(path))
+	_, err = os.Stat(path)
+	assert.NoError(t, err)
+}
@@ -0,0 +1,143 @@
+// Unless explicitly stated otherwise all files in this repository are licensed
+// under the Apache License Version 2.0.
+// This product includes software developed at Datadog (https://www.datadoghq.com/).
+// Copyright 2016-2020 Datadog, Inc.
+
+// +build linux
+
+package agent
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"syscall"
+	"time"
+
+	"github.com/frankhang/doppler/util/cache"
+	"github.com/frankhang/doppler/util/containers"
+	cmetrics "github.com/frankhang/doppler/util/containers/metrics"
+)
+
+const (
+	pidToEntityCacheKeyPrefix = "pid_to_entity"
+	pidToEntityCacheDuration  = time.Minute
+)
+
+// errNoContainerMatch is returned when no container ID can be matched
+var errNoContainerMatch = errors.New("cannot match a container ID")
+
+// getUDSAncillarySize gets the needed buffer size to retrieve the ancillary data
+// from the out of band channel. We only get the header + 1 credentials struct
+// and discard any information added by the sender.
+func getUDSAncillarySize() int {
+	return syscall.CmsgSpace(syscall.SizeofUcred)
+}
+
+// enableUDSPassCred enables credential passing from the kernel for origin detection.
+// That flag can be ignored if origin detection is disabled.
+func enableUDSPassCred(conn *net.UnixConn) error {
+	rawconn, err := conn.SyscallConn()
+	if err != nil {
+		return err
+	}
+
+	var sockErr error
+	err = rawconn.Control(func(fd uintptr) {
+		sockErr = syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_PASSCRED, 1)
+	})
+	if err != nil {
+		return err
+	}
+	return sockErr
+}
+
+// processUDSOrigin reads ancillary data to determine a packet's origin,
+// it returns a string identifying the source.
+// PID is added to ancillary data by the Linux kernel if we added the
+// SO_PASSCRED to the socket, see enableUDSPassCred.
+func processUDSOrigin(ancillary []byte) (string, error) {
+	messages, err := syscall.ParseSocketControlMessage(ancillary)
+	if err != nil {
+		return NoOrigin, err
+	}
+	if len(messages) == 0 {
+		return NoOrigin, fmt.Errorf("ancillary data empty")
+	}
+	cred, err := syscall.ParseUnixCredentials(&messages[0])
+	if err != nil {
+		return NoOrigin, err
+	}
+
+	return originForPID(cred.Pid)
+}
+
+// processUDSPeerOrigin reads the credentials of the process connected to a
+// UNIX stream socket (SO_PEERCRED) to determine the connection's origin.
+func processUDSPeerOrigin(conn *net.UnixConn) (string, error) {
+	rawconn, err := conn.SyscallConn()
+	if err != nil {
+		return NoOrigin, err
+	}
+
+	var cred *syscall.Ucred
+	var sockErr error
+	err = rawconn.Control(func(fd uintptr) {
+		cred, sockErr = syscall.GetsockoptUcred(int(fd), syscall.SOL_SOCKET, syscall.SO_PEERCRED)
+	})
+	if err != nil {
+		return NoOrigin, err
+	}
+	if sockErr != nil {
+		return NoOrigin, sockErr
+	}
+
+	return originForPID(cred.Pid)
+}
+
+func originForPID(pid int32) (string, error) {
+	if pid == 0 {
+		return NoOrigin, fmt.Errorf("matched PID for the process is 0, it belongs " +
+			"probably to another namespace. Is the agent in host PID mode?")
+	}
+	return getEntityForPID(pid)
+}
+
+// getEntityForPID returns the container entity name and caches the value for future lookups
+// As the result is cached and the lookup is really fast (parsing local files), it can be
+// called from the intake goroutine.
+func getEntityForPID(pid int32) (string, error) {
+	key := cache.BuildAgentKey(pidToEntityCacheKeyPrefix, strconv.Itoa(int(pid)))
+	if x, found := cache.Cache.Get(key); found {
+		return x.(string), nil
+	}
+
+	entity, err := entityForPID(pid)
+	switch err {
+	case nil:
+		cache.Cache.Set(key, entity, pidToEntityCacheDuration)
+		return entity, nil
+	case errNoContainerMatch:
+		// No runtime detected, cache the `NoOrigin` result
+		cache.Cache.Set(key, NoOrigin, pidToEntityCacheDuration)
+		return NoOrigin, nil
+	default:
+		// Other lookup error, retry next time
+		return NoOrigin, err
+	}
+}
+
+// entityForPID returns the entity ID for a given PID. It can return
+// errNoContainerMatch if no match is found for the PID.
+func entityForPID(pid int32) (string, error) {
+	cID, err := cmetrics.ContainerIDForPID(int(pid))
+	if err != nil {
+		return "", err
+	}
+	if cID == "" {
+		return "", errNoContainerMatch
+	}
+
+	return containers.BuildTaggerEntityName(cID), nil
+}
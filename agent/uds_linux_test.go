@@ -0,0 +1,33 @@
+// +build linux
+
+package agent
+
+import (
+	"syscall"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestProcessUDSOrigin(t *testing.T) {
+	for _, tc := range []struct {
+		name      string
+		ancillary []byte
+		err       string
+	}{
+		{name: "empty", ancillary: nil, err: "ancillary data empty"},
+		{name: "other namespace", ancillary: syscall.UnixCredentials(&syscall.Ucred{Pid: 0}), err: "matched PID for the process is 0"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			origin, err := processUDSOrigin(tc.ancillary)
+			assert.Equal(t, NoOrigin, origin)
+			if assert.Error(t, err) {
+				assert.Contains(t, err.Error(), tc.err)
+			}
+		})
+	}
+}
+
+func TestGetUDSAncillarySize(t *testing.T) {
+	assert.Equal(t, len(syscall.UnixCredentials(&syscall.Ucred{})), getUDSAncillarySize())
+}
@@ -0,0 +1,153 @@
+package agent
+
+import (
+	"fmt"
+	"github.com/frankhang/util/errors"
+	"github.com/frankhang/util/logutil"
+	"go.uber.org/zap"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	. "github.com/frankhang/doppler/config"
+)
+
+// UDSStreamListener implements the StatsdListener interface for Unix Domain
+// Socket stream protocol. Clients send newline separated messages over a
+// long lived connection, the origin is detected once per connection
+// from the peer credentials.
+type UDSStreamListener struct {
+	listener        *net.UnixListener
+	socketPath      string
+	packetsBuffer   *packetsBuffer
+	packetPool      *PacketPool
+	admission       *admission
+	OriginDetection bool
+
+	conns     map[net.Conn]struct{}
+	connsLock sync.Mutex
+}
+
+// NewUDSStreamListener returns an idle UDS stream Statsd listener
+func NewUDSStreamListener(packetOut chan Packets, packetPool *PacketPool, admission *admission) (*UDSStreamListener, error) {
+	socketPath := Cfg.AgentStreamSocket
+
+	address, err := net.ResolveUnixAddr("unix", socketPath)
+	if err != nil {
+		err = fmt.Errorf("agent-uds-stream: can't ResolveUnixAddr: %v", err)
+		return nil, errors.Trace(err)
+	}
+	if err = removeStaleSocket(socketPath); err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	listener, err := net.ListenUnix("unix", address)
+	if err != nil {
+		err = fmt.Errorf("can't listen: %s", err)
+		return nil, errors.Trace(err)
+	}
+	if err = os.Chmod(socketPath, 0722); err != nil {
+		err = fmt.Errorf("can't set the socket at write only: %s", err)
+		return nil, errors.Trace(err)
+	}
+
+	flushTimeout := time.Duration(Cfg.AgentPacketBufferFlushTimeout) * time.Millisecond
+
+	l := &UDSStreamListener{
+		listener:        listener,
+		socketPath:      socketPath,
+		packetPool:      packetPool,
+		admission:       admission,
+		packetsBuffer:   newPacketsBuffer(uint(Cfg.AgentPacketBufferSize), flushTimeout, packetOut, admission),
+		OriginDetection: Cfg.AgentOriginDetection,
+		conns:           make(map[net.Conn]struct{}),
+	}
+
+	logutil.BgLogger().Info("agent-uds-stream: successfully initialized", zap.String("addr", listener.Addr().String()))
+	return l, nil
+}
+
+// Listen runs the accept loop. Should be called in its own goroutine
+func (l *UDSStreamListener) Listen() {
+	logutil.BgLogger().Info("agent-uds-stream: starting to listen...", zap.String("addr", l.listener.Addr().String()))
+	for {
+		conn, err := l.listener.AcceptUnix()
+		if err != nil {
+			// listener has been closed
+			if strings.HasSuffix(err.Error(), " use of closed network connection") {
+				return
+			}
+			logutil.BgLogger().Error("agent-uds-stream: error accepting connection", zap.Error(err))
+			continue
+		}
+		go l.handleConnection(conn)
+	}
+}
+
+func (l *UDSStreamListener) handleConnection(conn *net.UnixConn) {
+	l.connsLock.Lock()
+	l.conns[conn] = struct{}{}
+	l.connsLock.Unlock()
+
+	defer func() {
+		l.connsLock.Lock()
+		delete(l.conns, conn)
+		l.connsLock.Unlock()
+		conn.Close()
+	}()
+
+	origin := NoOrigin
+	if l.OriginDetection {
+		var err error
+		origin, err = processUDSPeerOrigin(conn)
+		if err != nil {
+			logutil.BgLogger().Warn("agent-uds-stream: error processing origin, data will not be tagged", zap.Error(err))
+			udsOriginDetectionErrors.Add(1)
+			tlmUDSOriginDetectionError.Inc()
+		}
+	}
+
+	reader := &streamReader{
+		conn:          conn,
+		origin:        origin,
+		source:        origin,
+		packetPool:    l.packetPool,
+		packetsBuffer: l.packetsBuffer,
+		admission:     l.admission,
+		onRead: func(n int) {
+			udsPackets.Add(1)
+			udsBytes.Add(int64(n))
+			tlmUDSPackets.Inc("ok")
+			tlmUDSPacketsBytes.Add(float64(n))
+		},
+		onDrop: func() {
+			udsPacketReadingErrors.Add(1)
+			tlmUDSPackets.Inc("error")
+		},
+	}
+	if err := reader.run(); err != nil && !strings.HasSuffix(err.Error(), " use of closed network connection") {
+		logutil.BgLogger().Error("agent-uds-stream: error reading connection", zap.Error(err))
+		udsPacketReadingErrors.Add(1)
+		tlmUDSPackets.Inc("error")
+	}
+}
+
+// Stop closes the UDS listener and all its open connections
+func (l *UDSStreamListener) Stop() {
+	l.listener.Close()
+
+	l.connsLock.Lock()
+	for conn := range l.conns {
+		conn.Close()
+	}
+	l.connsLock.Unlock()
+
+	l.packetsBuffer.close()
+
+	// Socket cleanup on exit, the listener might already have removed it
+	if err := os.Remove(l.socketPath); err != nil && !os.IsNotExist(err) {
+		logutil.BgLogger().Info("agent-uds-stream: error removing socket file", zap.Error(err))
+	}
+}
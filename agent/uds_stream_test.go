@@ -0,0 +1,65 @@
+package agent
+
+import (
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	. "github.com/frankhang/doppler/config"
+)
+
+func TestUDSStreamListener(t *testing.T) {
+	conf := DefaultConf
+	conf.AgentStreamSocket = testSocketPath(t)
+	conf.AgentOriginDetection = false
+	conf.AgentPacketBufferSize = 1
+	Cfg = &conf
+
+	out := make(chan Packets, 10)
+	l, err := NewUDSStreamListener(out, NewPacketPool(64), nil)
+	require.NoError(t, err)
+	go l.Listen()
+
+	conn, err := net.Dial("unix", conf.AgentStreamSocket)
+	require.NoError(t, err)
+	_, err = conn.Write([]byte("a:1|c\nb:"))
+	require.NoError(t, err)
+	_, err = conn.Write([]byte("1|c\nc:1|c"))
+	require.NoError(t, err)
+	conn.Close()
+
+	expected := "a:1|c\nb:1|c\nc:1|c"
+	assert.Equal(t, expected, receiveContents(t, out, expected))
+
+	l.Stop()
+	_, err = os.Stat(conf.AgentStreamSocket)
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestUDSStreamListenerStopClosesConnections(t *testing.T) {
+	conf := DefaultConf
+	conf.AgentStreamSocket = testSocketPath(t)
+	conf.AgentOriginDetection = false
+	Cfg = &conf
+
+	l, err := NewUDSStreamListener(make(chan Packets, 10), NewPacketPool(64), nil)
+	require.NoError(t, err)
+	go l.Listen()
+
+	conn, err := net.Dial("unix", conf.AgentStreamSocket)
+	require.NoError(t, err)
+	defer conn.Close()
+	require.Eventually(t, func() bool {
+		l.connsLock.Lock()
+		defer l.connsLock.Unlock()
+		return len(l.conns) == 1
+	}, 2*time.Second, 10*time.Millisecond)
+
+	l.Stop()
+	_, err = conn.Read(make([]byte, 1))
+	assert.Error(t, err)
+}
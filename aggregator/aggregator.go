@@ -106,6 +106,8 @@ var (
 	aggregatorServiceCheck                     = expvar.Int{}
 	aggregatorEvent                            = expvar.Int{}
 	aggregatorHostnameUpdate                   = expvar.Int{}
+	aggregatorExported                         = expvar.Int{}
+	aggregatorExportErrors                     = expvar.Int{}
 
 	tlmFlush = telemetry.NewCounter("aggregator", "flush",
 		[]string{"data_type", "state"}, "Count of flush")
@@ -125,12 +127,14 @@ func init() {
 	newFlushTimeStats("EventFlushTime")
 	newFlushTimeStats("MainFlushTime")
 	newFlushTimeStats("MetricSketchFlushTime")
+	newFlushTimeStats("ExportFlushTime")
 	aggregatorExpvars.Set("Flush", expvar.Func(expStatsMap(flushTimeStats)))
 
 	newFlushCountStats("ServiceChecks")
 	newFlushCountStats("Series")
 	newFlushCountStats("Events")
 	newFlushCountStats("Sketches")
+	newFlushCountStats("Exported")
 	aggregatorExpvars.Set("FlushCount", expvar.Func(expStatsMap(flushCountStats)))
 
 	aggregatorExpvars.Set("SeriesFlushed", &aggregatorSeriesFlushed)
@@ -148,6 +152,8 @@ func init() {
 	aggregatorExpvars.Set("ServiceCheck", &aggregatorServiceCheck)
 	aggregatorExpvars.Set("Event", &aggregatorEvent)
 	aggregatorExpvars.Set("HostnameUpdate", &aggregatorHostnameUpdate)
+	aggregatorExpvars.Set("Exported", &aggregatorExported)
+	aggregatorExpvars.Set("ExportErrors", &aggregatorExportErrors)
 }
 
 // InitAggregator returns the Singleton instance
@@ -196,6 +202,7 @@ type BufferedAggregator struct {
 	checkHistogramBucketIn chan senderHistogramBucket
 
 	statsdSampler      TimeSampler
+	exportAggregation  bool // aggregate dogstatsd samples in statsdSampler before exporting them
 	checkSamplers      map[check.ID]*CheckSampler
 	serviceChecks      metrics.ServiceChecks
 	events             metrics.Events
@@ -213,6 +220,12 @@ type BufferedAggregator struct {
 
 // NewBufferedAggregator instantiates a BufferedAggregator
 func NewBufferedAggregator(s serializer.MetricSerializer, metricPool *metrics.MetricSamplePool, hostname, agentName string, flushInterval time.Duration) *BufferedAggregator {
+	statsdSampler := NewTimeSampler(bucketSize)
+	if Cfg.ExportAggregation {
+		// one bucket per flush: a bucket is exported at the first flush after it is closed
+		statsdSampler = NewTimeSampler(int64(flushInterval / time.Second))
+	}
+
 	aggregator := &BufferedAggregator{
 		metricPool:             metricPool,
 		bufferedMetricIn:       make(chan []metrics.MetricSample, 100),  // TODO make buffer size configurable
@@ -226,7 +239,8 @@ func NewBufferedAggregator(s serializer.MetricSerializer, metricPool *metrics.Me
 		checkMetricIn:          make(chan senderMetricSample, 100),    // TODO make buffer size configurable
 		checkHistogramBucketIn: make(chan senderHistogramBucket, 100), // TODO make buffer size configurable
 
-		statsdSampler:      *NewTimeSampler(bucketSize),
+		statsdSampler:      *statsdSampler,
+		exportAggregation:  Cfg.ExportAggregation,
 		checkSamplers:      make(map[check.ID]*CheckSampler),
 		flushInterval:      flushInterval,
 		serializer:         s,
@@ -357,15 +371,21 @@ func (agg *BufferedAggregator) addServiceCheck(sc metrics.ServiceCheck) {
 	}
 }
 
-// addEvent adds the event to the slice of current events
-func (agg *BufferedAggregator) addEvent(e metrics.Event) {
-	if e.Ts == 0 {
-		e.Ts = time.Now().Unix()
+// addEvent adds the event to the slice of current events, and exports it
+func (agg *BufferedAggregator) addEvent(event metrics.Event) {
+	if event.Ts == 0 {
+		event.Ts = time.Now().Unix()
 	}
-	e.Tags = util.SortUniqInPlace(e.Tags)
+	event.Tags = util.SortUniqInPlace(event.Tags)
+
+	logutil.BgLogger().Debug("addEvent", zap.Reflect("event", event))
+	agg.events = append(agg.events, &event)
 
-	logutil.BgLogger().Debug("addEvent", zap.Reflect("event", e))
-	agg.events = append(agg.events, &e)
+	if err := e.Exporter.ExportEvent(&event); err != nil {
+		err = errors.Trace(err)
+		logutil.BgLogger().Error("addEvent export error", zap.Reflect("event", &event))
+		errors.Log(err)
+	}
 }
 
 // addSample adds the metric sample
@@ -376,7 +396,17 @@ func (agg *BufferedAggregator) addSample(metricSample *metrics.MetricSample, tim
 		logutil.BgLogger().Debug("addSample", zap.Reflect("sample", metricSample))
 	}
 
-	//agg.statsdSampler.addSample(metricSample, timestamp)
+	// sets are exported as they come: their values are exported as labels,
+	// and the samples timestamped by the clients keep their timestamp
+	if agg.exportAggregation && metricSample.Mtype != metrics.SetType && metricSample.Timestamp <= 0 {
+		if metricSample.Mtype == metrics.DistributionType {
+			// distributions are exported as histograms, no need for sketches
+			metricSample.Mtype = metrics.HistogramType
+		}
+		agg.statsdSampler.addSample(metricSample, timestamp)
+		return
+	}
+
 	if err := e.Exporter.ExportMetricSample(metricSample); err!= nil {
 		err = errors.Trace(err)
 		logutil.BgLogger().Error("addSample export error", zap.Reflect("sample", metricSample))
@@ -388,7 +418,12 @@ func (agg *BufferedAggregator) addSample(metricSample *metrics.MetricSample, tim
 // GetSeriesAndSketches grabs all the series & sketches from the queue and clears the queue
 func (agg *BufferedAggregator) GetSeriesAndSketches() (metrics.Series, metrics.SketchSeriesList) {
 	agg.mu.Lock()
-	series, sketches := agg.statsdSampler.flush(timeNowNano())
+	var series metrics.Series
+	var sketches metrics.SketchSeriesList
+	// when aggregating for the exporter, the statsd sampler is flushed by flushToExporter
+	if !agg.exportAggregation {
+		series, sketches = agg.statsdSampler.flush(timeNowNano())
+	}
 
 	for _, checkSampler := range agg.checkSamplers {
 		s, sk := checkSampler.flush()
@@ -509,7 +544,49 @@ func (agg *BufferedAggregator) sendSketches(start time.Time, sketches metrics.Sk
 	}
 }
 
+// flushToExporter exports the samples aggregated in the closed buckets of
+// the statsd sampler, and logs a summary of the flush
+func (agg *BufferedAggregator) flushToExporter(start time.Time) {
+	agg.mu.Lock()
+	samples := agg.statsdSampler.flushWeighted(timeNowNano())
+	contexts := len(agg.statsdSampler.contextResolver.contextsByKey)
+	agg.mu.Unlock()
+
+	var observations float64
+	var errCount int
+	var lastErr error
+	for i := range samples {
+		if err := e.Exporter.ExportWeightedSample(&samples[i].sample, samples[i].weight); err != nil {
+			errCount++
+			lastErr = err
+			continue
+		}
+		observations += samples[i].weight
+	}
+
+	if errCount > 0 {
+		logutil.BgLogger().Warn("Error exporting aggregated samples", zap.Int("errors", errCount), zap.Error(lastErr))
+		aggregatorExportErrors.Add(int64(errCount))
+		tlmFlush.Add(float64(errCount), "exported_samples", stateError)
+	}
+	exported := len(samples) - errCount
+	addFlushTime("ExportFlushTime", int64(time.Since(start)))
+	addFlushCount("Exported", int64(exported))
+	aggregatorExported.Add(int64(exported))
+	tlmFlush.Add(float64(exported), "exported_samples", stateOk)
+
+	logutil.BgLogger().Info("Flushed aggregated samples to the exporter",
+		zap.Int("contexts", contexts),
+		zap.Int("samples", len(samples)),
+		zap.Float64("observations", observations),
+		zap.Int("errors", errCount),
+		zap.Duration("duration", time.Since(start)))
+}
+
 func (agg *BufferedAggregator) flushSeriesAndSketches(start time.Time, waitForSerializer bool) {
+	if agg.exportAggregation {
+		agg.flushToExporter(start)
+	}
 	series, sketches := agg.GetSeriesAndSketches()
 
 	agg.sendSketches(start, sketches, waitForSerializer)
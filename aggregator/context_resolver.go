@@ -9,14 +9,16 @@ import (
 	"fmt"
 
 	"github.com/frankhang/doppler/aggregator/ckey"
+	"github.com/frankhang/doppler/mapper"
 	"github.com/frankhang/doppler/metrics"
 )
 
 // Context holds the elements that form a context, and can be serialized into a context key
 type Context struct {
-	Name string
-	Tags []string
-	Host string
+	Name   string
+	Tags   []string
+	Host   string
+	Export *mapper.ExportMeta // how a mapping exports the metric, nil by default
 }
 
 // ContextResolver allows tracking and expiring contexts
@@ -61,6 +61,8 @@ func (s *TimeSampler) isBucketStillOpen(bucketStartTimestamp, timestamp int64) b
 func (s *TimeSampler) addSample(metricSample *metrics.MetricSample, timestamp float64) {
 	// Keep track of the context
 	contextKey := s.contextResolver.trackContext(metricSample, timestamp)
+	// the latest mapping of the context applies, e.g. after a reload
+	s.contextResolver.contextsByKey[contextKey].Export = metricSample.Export
 	bucketStart := s.calculateBucketStart(timestamp)
 
 	switch metricSample.Mtype {
@@ -194,6 +196,69 @@ func (s *TimeSampler) flush(timestamp float64) (metrics.Series, metrics.SketchSe
 	return series, sketches
 }
 
+// weightedSample is a flushed sample resolved against its context, ready to be
+// exported with its weight
+type weightedSample struct {
+	sample metrics.MetricSample
+	weight float64
+}
+
+// flushWeighted flushes the closed buckets as weighted samples instead of series.
+// It is used when samples are aggregated before being exported: counters are
+// zeroed and contexts expired the same way flush does.
+func (s *TimeSampler) flushWeighted(timestamp float64) []weightedSample {
+	cutoffTime := s.calculateBucketStart(timestamp)
+
+	var samples []weightedSample
+	counterContextsToDelete := map[ckey.ContextKey]struct{}{}
+
+	for bucketTimestamp, contextMetrics := range s.metricsByTimestamp {
+		// disregard when the timestamp is too recent
+		if s.isBucketStillOpen(bucketTimestamp, cutoffTime) {
+			continue
+		}
+
+		s.countersSampleZeroValue(bucketTimestamp, contextMetrics, counterContextsToDelete)
+
+		flushed, errors := contextMetrics.FlushWeighted(float64(bucketTimestamp))
+		for ck, err := range errors {
+			logutil.BgLogger().Info("No value returned for agent metric", zap.Reflect("context", s.contextResolver.contextsByKey[ck]), zap.Error(err))
+		}
+		for _, ws := range flushed {
+			context, ok := s.contextResolver.contextsByKey[ws.ContextKey]
+			if !ok {
+				logutil.BgLogger().Error(fmt.Sprintf("Ignoring all metrics on context key '%v': inconsistent context resolver state: the context is not tracked", ws.ContextKey))
+				continue
+			}
+			samples = append(samples, weightedSample{
+				sample: metrics.MetricSample{
+					Name:       context.Name + ws.NameSuffix,
+					Tags:       context.Tags,
+					Host:       context.Host,
+					Mtype:      ws.Mtype,
+					Value:      ws.Value,
+					SampleRate: 1,
+					Timestamp:  float64(bucketTimestamp),
+					Export:     context.Export,
+				},
+				weight: ws.Weight,
+			})
+		}
+
+		delete(s.metricsByTimestamp, bucketTimestamp)
+	}
+
+	// Delete the contexts associated to an expired counter
+	for context := range counterContextsToDelete {
+		delete(s.counterLastSampledByContext, context)
+	}
+
+	s.contextResolver.expireContexts(timestamp - defaultExpiry)
+	s.lastCutOffTime = cutoffTime
+
+	return samples
+}
+
 // flushContextMetrics flushes the passed contextMetrics, handles its errors, and returns its series
 func (s *TimeSampler) flushContextMetrics(timestamp int64, contextMetrics metrics.ContextMetrics) []*metrics.Serie {
 	series, errors := contextMetrics.Flush(float64(timestamp))
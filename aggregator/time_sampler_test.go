@@ -14,6 +14,8 @@ import (
 	"github.com/stretchr/testify/require"
 
 	"github.com/frankhang/doppler/aggregator/ckey"
+	"github.com/frankhang/doppler/config"
+	"github.com/frankhang/doppler/mapper"
 	"github.com/frankhang/doppler/metrics"
 	"github.com/frankhang/doppler/quantile"
 )
@@ -476,6 +478,28 @@ func TestBucketSamplingWithSketchAndSeries(t *testing.T) {
 	}, sketches[0])
 }
 
+func TestFlushWeightedExportMeta(t *testing.T) {
+	conf := config.DefaultConf
+	config.Cfg = &conf
+	sampler := NewTimeSampler(10)
+	export := &mapper.ExportMeta{Type: mapper.ExportTypeSummary}
+
+	mSample := metrics.MetricSample{
+		Name:       "my.metric.name",
+		Value:      1,
+		Mtype:      metrics.GaugeType,
+		SampleRate: 1,
+	}
+	sampler.addSample(&mSample, 12345.0)
+	// the latest mapping of the context applies
+	mSample.Export = export
+	sampler.addSample(&mSample, 12346.0)
+
+	samples := sampler.flushWeighted(12360.0)
+	require.Len(t, samples, 1)
+	assert.Equal(t, export, samples[0].sample.Export)
+}
+
 func BenchmarkTimeSampler(b *testing.B) {
 	sampler := NewTimeSampler(10)
 	sample := metrics.MetricSample{
@@ -0,0 +1,266 @@
+package admin
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"go.uber.org/zap"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/frankhang/util/logutil"
+
+	"github.com/frankhang/doppler/agent"
+	"github.com/frankhang/doppler/api/security"
+	apiutil "github.com/frankhang/doppler/api/util"
+	"github.com/frankhang/doppler/config"
+)
+
+const defaultTimeout = 10 * time.Second
+
+// Serve configures and starts the https server of the admin API on a local address.
+// Every request must carry the auth token, created next to the config file if needed.
+// It returns an error if the setup failed, or runs the server in a goroutine.
+// Stop the server by cancelling the passed context.
+func Serve(ctx context.Context, host string, port int, statsd *agent.Server) error {
+	if port == 0 {
+		return errors.New("port should be non-zero")
+	}
+	if apiutil.IsForbidden(host) {
+		return fmt.Errorf("the admin API can't listen on `%s`, it must be a local address", host)
+	}
+	if err := apiutil.SetAuthToken(); err != nil {
+		return err
+	}
+
+	tlsConfig, err := selfSignedTLSConfig(host)
+	if err != nil {
+		return err
+	}
+	ln, err := net.Listen("tcp", net.JoinHostPort(host, strconv.Itoa(port)))
+	if err != nil {
+		return err
+	}
+
+	srv := &http.Server{
+		Handler:           NewHandler(statsd),
+		TLSConfig:         tlsConfig,
+		ReadTimeout:       defaultTimeout,
+		ReadHeaderTimeout: defaultTimeout,
+		WriteTimeout:      defaultTimeout,
+	}
+
+	go srv.Serve(tls.NewListener(ln, tlsConfig))
+	go closeOnContext(ctx, srv)
+	return nil
+}
+
+// selfSignedTLSConfig returns a TLS config with a certificate generated for host,
+// the clients don't verify it: the auth token is what authenticates them.
+func selfSignedTLSConfig(host string) (*tls.Config, error) {
+	_, certPEM, key, err := security.GenerateRootCert([]string{host}, 2048)
+	if err != nil {
+		return nil, fmt.Errorf("unable to generate the admin API certificate: %v", err)
+	}
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})
+	pair, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		return nil, fmt.Errorf("invalid admin API key pair: %v", err)
+	}
+	return &tls.Config{Certificates: []tls.Certificate{pair}}, nil
+}
+
+func closeOnContext(ctx context.Context, srv *http.Server) {
+	// Wait for the context to be canceled
+	<-ctx.Done()
+
+	// Shutdown the server, it will close the listener
+	timeout, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	srv.Shutdown(timeout)
+}
+
+// NewHandler returns the handler of the admin API endpoints:
+//
+//	GET  /agent/status                   status of the instance, with its expvars
+//	GET  /agent/config                   effective config, secrets redacted
+//	GET  /agent/metrics-stats            per metric debug statistics
+//	POST /agent/metrics-stats/enable     start storing the statistics
+//	POST /agent/metrics-stats/disable    stop storing and clear the statistics
+//	GET  /agent/capture                  status of the running or last capture
+//	POST /agent/capture/start            start capturing the packets received, for
+//	                                     ?duration= seconds or ?max_size= bytes
+//	POST /agent/capture/stop             stop the running capture
+func NewHandler(statsd *agent.Server) http.Handler {
+	h := &handler{statsd: statsd}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/agent/status", h.validate("GET", h.getStatus))
+	mux.HandleFunc("/agent/config", h.validate("GET", h.getConfig))
+	mux.HandleFunc("/agent/metrics-stats", h.validate("GET", h.getMetricsStats))
+	mux.HandleFunc("/agent/metrics-stats/enable", h.validate("POST", h.enableMetricsStats))
+	mux.HandleFunc("/agent/metrics-stats/disable", h.validate("POST", h.disableMetricsStats))
+	mux.HandleFunc("/agent/capture", h.validate("GET", h.getCapture))
+	mux.HandleFunc("/agent/capture/start", h.validate("POST", h.startCapture))
+	mux.HandleFunc("/agent/capture/stop", h.validate("POST", h.stopCapture))
+	return mux
+}
+
+type handler struct {
+	statsd *agent.Server
+}
+
+// validate wraps an endpoint with the method and auth token checks
+func (h *handler) validate(method string, endpoint http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if err := apiutil.Validate(w, r); err != nil {
+			logutil.BgLogger().Warn("admin: request rejected", zap.String("path", r.URL.Path),
+				zap.String("remote", r.RemoteAddr), zap.Error(err))
+			return
+		}
+		if r.Method != method {
+			w.Header().Set("Allow", method)
+			http.Error(w, fmt.Sprintf("method %s not allowed", r.Method), http.StatusMethodNotAllowed)
+			return
+		}
+		endpoint(w, r)
+	}
+}
+
+func (h *handler) getStatus(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, getStatus())
+}
+
+func (h *handler) getConfig(w http.ResponseWriter, r *http.Request) {
+	conf, err := redactedConfig()
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, conf)
+}
+
+func (h *handler) getMetricsStats(w http.ResponseWriter, r *http.Request) {
+	if h.statsd == nil {
+		writeError(w, errors.New("the statsd server is not running"))
+		return
+	}
+	stats, err := h.statsd.GetJSONDebugStats()
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, map[string]interface{}{
+		"enabled": h.statsd.MetricsStatsEnabled(),
+		"metrics": json.RawMessage(stats),
+	})
+}
+
+func (h *handler) enableMetricsStats(w http.ResponseWriter, r *http.Request) {
+	h.setMetricsStats(w, true)
+}
+
+func (h *handler) disableMetricsStats(w http.ResponseWriter, r *http.Request) {
+	h.setMetricsStats(w, false)
+}
+
+func (h *handler) setMetricsStats(w http.ResponseWriter, enabled bool) {
+	if h.statsd == nil {
+		writeError(w, errors.New("the statsd server is not running"))
+		return
+	}
+	if enabled {
+		h.statsd.EnableMetricsStats()
+	} else {
+		h.statsd.DisableMetricsStats()
+	}
+	writeJSON(w, map[string]bool{"enabled": enabled})
+}
+
+func (h *handler) getCapture(w http.ResponseWriter, r *http.Request) {
+	if h.statsd == nil {
+		writeError(w, errors.New("the statsd server is not running"))
+		return
+	}
+	writeJSON(w, h.statsd.CaptureStatus())
+}
+
+// startCapture starts a capture bounded by the config, for its max duration
+// and size unless lower ones are requested
+func (h *handler) startCapture(w http.ResponseWriter, r *http.Request) {
+	if h.statsd == nil {
+		writeError(w, errors.New("the statsd server is not running"))
+		return
+	}
+	c := config.Cfg.Capture
+	duration, err := boundedParam(r, "duration", int64(c.MaxDuration))
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	maxSize, err := boundedParam(r, "max_size", c.MaxSize)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	status, err := h.statsd.StartCapture(c.Dir, time.Duration(duration)*time.Second, maxSize)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, status)
+}
+
+func (h *handler) stopCapture(w http.ResponseWriter, r *http.Request) {
+	if h.statsd == nil {
+		writeError(w, errors.New("the statsd server is not running"))
+		return
+	}
+	status, err := h.statsd.StopCapture()
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, status)
+}
+
+// boundedParam returns the positive integer query parameter name, max if it
+// is absent or greater
+func boundedParam(r *http.Request, name string, max int64) (int64, error) {
+	param := r.URL.Query().Get(name)
+	if param == "" {
+		return max, nil
+	}
+	value, err := strconv.ParseInt(param, 10, 64)
+	if err != nil || value <= 0 {
+		return 0, fmt.Errorf("invalid %s `%s`, expected a positive integer", name, param)
+	}
+	if value > max {
+		return max, nil
+	}
+	return value, nil
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	body, err := json.Marshal(v)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(body)
+}
+
+func writeError(w http.ResponseWriter, err error) {
+	logutil.BgLogger().Error("admin: request failed", zap.Error(err))
+	body, _ := json.Marshal(map[string]string{"error": err.Error()})
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusInternalServerError)
+	w.Write(body)
+}
@@ -0,0 +1,152 @@
+package admin
+
+import (
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/frankhang/doppler/agent"
+	apiutil "github.com/frankhang/doppler/api/util"
+	"github.com/frankhang/doppler/config"
+)
+
+const testToken = "0123456789abcdef0123456789abcdef"
+
+func TestMain(m *testing.M) {
+	dir, err := ioutil.TempDir("", "admin")
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(dir)
+
+	cfg := config.DefaultConf
+	cfg.ApiKey = "my_api_key"
+	cfg.AdminAuthTokenFile = filepath.Join(dir, "auth_token")
+	cfg.RemoteWrite.Headers = map[string]string{"Authorization": "Basic abc", "X-Scope-OrgID": "doppler"}
+	cfg.EventsLoki.Headers = map[string]string{"Authorization": "Basic abc"}
+	config.Cfg = &cfg
+	config.StoreGlobalConfig(&cfg)
+	if err = ioutil.WriteFile(cfg.AdminAuthTokenFile, []byte(testToken), 0600); err != nil {
+		panic(err)
+	}
+	if err = apiutil.SetAuthToken(); err != nil {
+		panic(err)
+	}
+	os.Exit(m.Run())
+}
+
+func do(t *testing.T, h http.Handler, method, path, token string) (int, map[string]interface{}) {
+	req := httptest.NewRequest(method, path, nil)
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+
+	var body map[string]interface{}
+	if rec.Header().Get("Content-Type") == "application/json" {
+		require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &body))
+	}
+	return rec.Code, body
+}
+
+func TestAuth(t *testing.T) {
+	h := NewHandler(nil)
+
+	code, _ := do(t, h, "GET", "/agent/status", "")
+	assert.Equal(t, http.StatusUnauthorized, code)
+
+	code, _ = do(t, h, "GET", "/agent/status", "wrong")
+	assert.Equal(t, http.StatusForbidden, code)
+
+	code, _ = do(t, h, "POST", "/agent/status", testToken)
+	assert.Equal(t, http.StatusMethodNotAllowed, code)
+
+	code, body := do(t, h, "GET", "/agent/status", testToken)
+	assert.Equal(t, http.StatusOK, code)
+	assert.Contains(t, body, "expvars")
+	assert.Contains(t, body, "pid")
+}
+
+func TestConfigRedacted(t *testing.T) {
+	code, body := do(t, NewHandler(nil), "GET", "/agent/config", testToken)
+	require.Equal(t, http.StatusOK, code)
+
+	assert.Equal(t, redacted, body["api_key"])
+	// the headers may carry credentials, they are never served
+	assert.NotContains(t, body["remote_write"], "headers")
+	assert.NotContains(t, body["events_loki"], "headers")
+	assert.Equal(t, "127.0.0.1", body["admin_host"])
+}
+
+func TestMetricsStatsToggle(t *testing.T) {
+	statsd := &agent.Server{}
+	h := NewHandler(statsd)
+
+	code, body := do(t, h, "POST", "/agent/metrics-stats/enable", testToken)
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, true, body["enabled"])
+	assert.True(t, statsd.MetricsStatsEnabled())
+
+	code, body = do(t, h, "GET", "/agent/metrics-stats", testToken)
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, true, body["enabled"])
+
+	code, _ = do(t, h, "POST", "/agent/metrics-stats/disable", testToken)
+	assert.Equal(t, http.StatusOK, code)
+	assert.False(t, statsd.MetricsStatsEnabled())
+
+	code, _ = do(t, NewHandler(nil), "GET", "/agent/metrics-stats", testToken)
+	assert.Equal(t, http.StatusInternalServerError, code)
+}
+
+func TestCapture(t *testing.T) {
+	dir, err := ioutil.TempDir("", "capture")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	config.Cfg.Capture.Dir = dir
+	defer func() { config.Cfg.Capture.Dir = "" }()
+
+	h := NewHandler(&agent.Server{})
+
+	code, body := do(t, h, "GET", "/agent/capture", testToken)
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, false, body["running"])
+
+	code, _ = do(t, h, "POST", "/agent/capture/stop", testToken)
+	assert.Equal(t, http.StatusInternalServerError, code)
+
+	code, _ = do(t, h, "POST", "/agent/capture/start?duration=soon", testToken)
+	assert.Equal(t, http.StatusInternalServerError, code)
+
+	code, body = do(t, h, "POST", "/agent/capture/start?duration=60&max_size=1000000000000", testToken)
+	require.Equal(t, http.StatusOK, code)
+	assert.Equal(t, true, body["running"])
+	assert.Equal(t, float64(config.Cfg.Capture.MaxSize), body["max_size"])
+	path := body["path"].(string)
+	assert.Equal(t, dir, filepath.Dir(path))
+
+	code, body = do(t, h, "POST", "/agent/capture/start", testToken)
+	assert.Equal(t, http.StatusInternalServerError, code)
+	assert.Equal(t, "a capture is already running", body["error"])
+
+	code, body = do(t, h, "POST", "/agent/capture/stop", testToken)
+	require.Equal(t, http.StatusOK, code)
+	assert.Equal(t, false, body["running"])
+
+	f, err := os.Open(path)
+	require.NoError(t, err)
+	defer f.Close()
+	r, err := agent.NewCaptureReader(f)
+	require.NoError(t, err)
+	_, err = r.Next()
+	assert.Equal(t, io.EOF, err)
+}
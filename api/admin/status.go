@@ -0,0 +1,103 @@
+package admin
+
+import (
+	"encoding/json"
+	"expvar"
+	"os"
+	"regexp"
+	"runtime"
+	"time"
+
+	"github.com/frankhang/doppler/config"
+	"github.com/frankhang/doppler/status/health"
+	"github.com/frankhang/doppler/util"
+	"github.com/frankhang/doppler/version"
+)
+
+const (
+	timeFormat = "2006-01-02 15:04:05.000000 MST"
+	redacted   = "********"
+)
+
+var (
+	startTime = time.Now()
+
+	// expvars of the go runtime, not of doppler
+	skippedExpvars = map[string]bool{"cmdline": true, "memstats": true}
+
+	// config keys whose values are secrets
+	secretKey = regexp.MustCompile(`(?i)(api_?key|password|passwd|secret|token|authorization|credential)`)
+)
+
+// getStatus returns the status of the instance, with the expvars of
+// its components (agent, aggregator, forwarder...)
+func getStatus() map[string]interface{} {
+	stats := make(map[string]interface{})
+
+	stats["version"] = version.AgentVersion
+	stats["pid"] = os.Getpid()
+	stats["go_version"] = runtime.Version()
+	stats["build_arch"] = runtime.GOARCH
+	stats["agent_start"] = startTime.Format(timeFormat)
+	stats["uptime"] = time.Since(startTime).Round(time.Second).String()
+	stats["time"] = time.Now().Format(timeFormat)
+
+	if hostname, err := util.GetHostname(); err == nil {
+		stats["hostname"] = hostname
+	} else {
+		stats["hostname"] = map[string]string{"error": err.Error()}
+	}
+
+	if h, err := health.GetStatusNonBlocking(); err == nil {
+		stats["health"] = h
+	} else {
+		stats["health"] = map[string]string{"error": err.Error()}
+	}
+
+	expvars := make(map[string]interface{})
+	expvar.Do(func(kv expvar.KeyValue) {
+		if skippedExpvars[kv.Key] {
+			return
+		}
+		var value interface{}
+		if err := json.Unmarshal([]byte(kv.Value.String()), &value); err != nil {
+			value = kv.Value.String()
+		}
+		expvars[kv.Key] = value
+	})
+	stats["expvars"] = expvars
+
+	return stats
+}
+
+// redactedConfig returns the effective config, reloaded items included, with
+// the values of the secret keys redacted
+func redactedConfig() (map[string]interface{}, error) {
+	body, err := json.Marshal(config.GetGlobalConfig())
+	if err != nil {
+		return nil, err
+	}
+	var conf map[string]interface{}
+	if err = json.Unmarshal(body, &conf); err != nil {
+		return nil, err
+	}
+	redact(conf)
+	return conf, nil
+}
+
+func redact(value interface{}) {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		for key, child := range v {
+			if s, ok := child.(string); ok && s != "" && secretKey.MatchString(key) {
+				v[key] = redacted
+				continue
+			}
+			redact(child)
+		}
+	case []interface{}:
+		for _, child := range v {
+			redact(child)
+		}
+	}
+}
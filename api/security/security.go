@@ -108,6 +108,12 @@ func GenerateRootCert(hosts []string, bits int) (
 
 // GetAuthTokenFilepath returns the path to the auth_token file.
 func GetAuthTokenFilepath() string {
+	if config.Cfg != nil && config.Cfg.AdminAuthTokenFile != "" {
+		return config.Cfg.AdminAuthTokenFile
+	}
+	if config.Datadog == nil {
+		return authTokenName
+	}
 	if config.Datadog.GetString("auth_token_file_path") != "" {
 		return config.Datadog.GetString("auth_token_file_path")
 	}
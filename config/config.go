@@ -16,12 +16,53 @@ type Config struct {
 	InventoriesEnabled bool `toml:"inventories_enabled" json:"inventories_enabled"`
 	MetricsStatsEnable bool `toml:"metrics_stats_enable" json:"metrics_stats_enable"`
 
+	ConfigReloadInterval int `toml:"config_reload_interval" json:"config_reload_interval"` //s, 0 disables watching the config file
+
+	AdminHost          string `toml:"admin_host" json:"admin_host"`                       //local address of the admin API
+	AdminPort          int    `toml:"admin_port" json:"admin_port"`                       //0 to disable
+	AdminAuthTokenFile string `toml:"admin_auth_token_file" json:"admin_auth_token_file"` //default next to the config file
+
+	ExportAggregation         bool `toml:"export_aggregation" json:"export_aggregation"`                   //aggregate samples before exporting them
+	ExportAggregationInterval int  `toml:"export_aggregation_interval" json:"export_aggregation_interval"` //s
+	ExportLegacySampleRate    bool `toml:"export_legacy_sample_rate" json:"export_legacy_sample_rate"`     //export the sample rate as a _rate_ label instead of scaling values
+
+	ExportLabelReconciliation bool `toml:"export_label_reconciliation" json:"export_label_reconciliation"` //merge the label sets of a metric name
+
+	ExportMaxSeriesPerMetric int    `toml:"export_max_series_per_metric" json:"export_max_series_per_metric"` //0 means unlimited
+	ExportMaxSeries          int    `toml:"export_max_series" json:"export_max_series"`                       //0 means unlimited
+	ExportSeriesOverflow     string `toml:"export_series_overflow" json:"export_series_overflow"`             //drop or other
+	ExportSeriesTTL          int    `toml:"export_series_ttl" json:"export_series_ttl"`                       //s, 0 means never
+
+	ExportHistograms []HistogramProfile `toml:"export_histograms" json:"export_histograms"` //first matching profile applies
+
+	ExportOpenMetrics   bool     `toml:"export_open_metrics" json:"export_open_metrics"`     //negotiate the OpenMetrics format on scrape
+	ExportCreatedSeries bool     `toml:"export_created_series" json:"export_created_series"` //add _created series in OpenMetrics
+	ExportExemplarTags  []string `toml:"export_exemplar_tags" json:"export_exemplar_tags"`   //tags exported as exemplar labels instead of series labels
+
+	ExportServiceCheckTTL int `toml:"export_service_check_ttl" json:"export_service_check_ttl"` //s, 0 means never
+
+	RemoteWrite RemoteWrite `toml:"remote_write" json:"remote_write"`
+	EventsLoki  Loki        `toml:"events_loki" json:"events_loki"` //forward the events as log lines
+
+	MapperProfiles []MappingProfile `toml:"mapper_profiles" json:"mapper_profiles"`
+	Filters        []IngestFilter   `toml:"filters" json:"filters"` //applied in order to the mapped metrics
+
 	MetricNamespace          string   `toml:"metric_namespac" json:"metric_namespace"`
 	MetricNamespaceBlacklist []string `toml:"metric_namespace_blacklist" json:"metric_namespace_blacklist"`
 	ForwardHost              string   `toml:"forward_host" json:"forward_host"`
 	ForwardPort              int      `toml:"forward_port" json:"forward_port"`
 	CacheSize                int      `toml:"cache_size" json:"cache_size"`
 
+	Relay Relay `toml:"relay" json:"relay"`
+
+	Admission Admission `toml:"admission" json:"admission"`
+
+	Capture Capture `toml:"capture" json:"capture"`
+
+	Logs Logs `toml:"logs" json:"logs"` //collect logs and push them to Loki
+
+	DiskBuffer DiskBuffer `toml:"disk_buffer" json:"disk_buffer"` //keep the payloads of the logs and the forwarder on disk during the outages
+
 	HistogramCopyToDistribution       bool   `toml:"histogram_copy_to_distribution" json:"histogram_copy_to_distribution"`
 	HistogramCopyToDistributionPrefix string `toml:"histogram_copy_to_distribution_prefix" json:"histogram_copy_to_distribution_prefix"`
 
@@ -34,6 +75,17 @@ type Config struct {
 	AgentOriginDetection          bool `toml:"agent_origin_detection" json:"agent_origin_detection"`
 	AgentExpirySeconds            int  `toml:"agent_expiry_seconds" json:"agent_expiry_seconds"`
 
+	AgentUDPSockets   int `toml:"agent_udp_sockets" json:"agent_udp_sockets"`       //SO_REUSEPORT sockets sharing the udp port, linux only
+	AgentUDPBatchSize int `toml:"agent_udp_batch_size" json:"agent_udp_batch_size"` //datagrams per read with recvmmsg, 1 disables the batched reads, linux only
+
+	AgentSocket       string `toml:"agent_socket" json:"agent_socket"`               //unixgram socket path
+	AgentStreamSocket string `toml:"agent_stream_socket" json:"agent_stream_socket"` //unix stream socket path
+
+	AgentTCPPort           int `toml:"agent_tcp_port" json:"agent_tcp_port"`
+	AgentTCPMaxConnections int `toml:"agent_tcp_max_connections" json:"agent_tcp_max_connections"`
+	AgentTCPIdleTimeout    int `toml:"agent_tcp_idle_timeout" json:"agent_tcp_idle_timeout"` //s
+	AgentTCPMaxLineSize    int `toml:"agent_tcp_max_line_size" json:"agent_tcp_max_line_size"`
+
 	AgentStatsEnable bool `toml:"agent_stats_enable" json:"agent_stats_enable"`
 	AgentStatsBuffer int  `toml:"agent_stats_buffer" json:"agent_stats_buffer"`
 
@@ -73,14 +125,248 @@ type MetadataProviders struct {
 	Interval time.Duration `toml:"interval" json:"interval"`
 }
 
+// HistogramProfile configures how the histograms whose exported name
+// matches Match are exported
+type HistogramProfile struct {
+	Match     string `toml:"match" json:"match"`
+	MatchType string `toml:"match_type" json:"match_type"` //wildcard (default) or regex
+	Type      string `toml:"type" json:"type"`             //histogram (default) or summary
+
+	Buckets            []float64           `toml:"buckets" json:"buckets"`
+	ExponentialBuckets *ExponentialBuckets `toml:"exponential_buckets" json:"exponential_buckets"`
+	LinearBuckets      *LinearBuckets      `toml:"linear_buckets" json:"linear_buckets"`
+
+	NativeBucketFactor float64 `toml:"native_bucket_factor" json:"native_bucket_factor"` //> 1 enables native histograms
+	NativeMaxBuckets   uint32  `toml:"native_max_buckets" json:"native_max_buckets"`
+
+	Objectives map[string]float64 `toml:"objectives" json:"objectives"` //quantile -> allowed error
+	MaxAge     int                `toml:"max_age" json:"max_age"`       //s
+}
+
+// ExponentialBuckets helps unmarshalling `exponential_buckets` histogram profile param
+type ExponentialBuckets struct {
+	Start  float64 `toml:"start" json:"start"`
+	Factor float64 `toml:"factor" json:"factor"`
+	Count  int     `toml:"count" json:"count"`
+}
+
+// LinearBuckets helps unmarshalling `linear_buckets` histogram profile param
+type LinearBuckets struct {
+	Start float64 `toml:"start" json:"start"`
+	Width float64 `toml:"width" json:"width"`
+	Count int     `toml:"count" json:"count"`
+}
+
+// RemoteWrite configures pushing the exported series to a Prometheus remote write endpoint
+type RemoteWrite struct {
+	URL               string `toml:"url" json:"url"`           //empty to disable
+	Interval          int    `toml:"interval" json:"interval"` //s
+	Timeout           int    `toml:"timeout" json:"timeout"`   //s
+	Shards            int    `toml:"shards" json:"shards"`
+	QueueCapacity     int    `toml:"queue_capacity" json:"queue_capacity"` //series per shard
+	MaxSamplesPerSend int    `toml:"max_samples_per_send" json:"max_samples_per_send"`
+	BatchSendDeadline int    `toml:"batch_send_deadline" json:"batch_send_deadline"` //ms
+	MaxRetries        int    `toml:"max_retries" json:"max_retries"`
+	MinBackoff        int    `toml:"min_backoff" json:"min_backoff"` //ms
+	MaxBackoff        int    `toml:"max_backoff" json:"max_backoff"` //ms
+
+	Headers           map[string]string `toml:"headers" json:"-"`
+	BasicAuthUser     string            `toml:"basic_auth_user" json:"basic_auth_user"`
+	BasicAuthPassword string            `toml:"basic_auth_password" json:"-"`
+	BearerToken       string            `toml:"bearer_token" json:"-"`
+}
+
+// IngestFilter is a filter rule of the metrics received, its conditions must all match
+type IngestFilter struct {
+	Name      string   `toml:"name" json:"name"`             //of the rule in the dropped counts
+	Action    string   `toml:"action" json:"action"`         //deny (default), allow or strip_tags
+	Match     string   `toml:"match" json:"match"`           //metric name, empty matches every name
+	MatchType string   `toml:"match_type" json:"match_type"` //wildcard (default) or regex
+	Types     []string `toml:"types" json:"types"`           //gauge, counter, histogram, distribution or set, empty matches every type
+	Tags      []string `toml:"tags" json:"tags"`             //key or key:value, the metric must have them all
+	StripTags []string `toml:"strip_tags" json:"strip_tags"` //tag keys removed by strip_tags
+}
+
+// Relay configures relaying the parsed messages to upstream statsd servers
+type Relay struct {
+	Upstreams           []string `toml:"upstreams" json:"upstreams"` //udp://, tcp://, unix:// or unixgram:// addresses, empty to disable
+	Mode                string   `toml:"mode" json:"mode"`           //shard (default) or fanout
+	Local               bool     `toml:"local" json:"local"`         //also process the relayed messages
+	Replicas            int      `toml:"replicas" json:"replicas"`   //virtual nodes per upstream on the hash ring
+	QueueSize           int      `toml:"queue_size" json:"queue_size"`
+	MaxPacketSize       int      `toml:"max_packet_size" json:"max_packet_size"`
+	FlushInterval       int      `toml:"flush_interval" json:"flush_interval"`               //ms
+	Timeout             int      `toml:"timeout" json:"timeout"`                             //ms, of the connections, writes and health checks
+	HealthCheckInterval int      `toml:"health_check_interval" json:"health_check_interval"` //s, 0 disables the health checks
+}
+
+// Admission configures the rate limiting of the messages received per source,
+// a source being the origin container when detected, else the client IP
+type Admission struct {
+	RateLimit         float64 `toml:"rate_limit" json:"rate_limit"`                   //messages per second per source, 0 disables the rate limiting
+	Burst             int     `toml:"burst" json:"burst"`                             //messages, 0 means rate_limit
+	MaxSources        int     `toml:"max_sources" json:"max_sources"`                 //sources tracked, the others share the source "other"
+	SourceTTL         int     `toml:"source_ttl" json:"source_ttl"`                   //s, a source idle for longer is forgotten
+	PriorityQueueSize int     `toml:"priority_queue_size" json:"priority_queue_size"` //packets of service checks, 0 disables the priority lane
+	DropWhenFull      bool    `toml:"drop_when_full" json:"drop_when_full"`           //drop the packets when the queue is full instead of blocking the listeners
+}
+
+// Capture bounds the captures of the packets received, started from the admin API
+type Capture struct {
+	Dir         string `toml:"dir" json:"dir"`                   //of the capture files, empty for the temporary directory
+	MaxDuration int    `toml:"max_duration" json:"max_duration"` //s, also the duration of the captures by default
+	MaxSize     int64  `toml:"max_size" json:"max_size"`         //bytes of a capture file, also its size by default
+}
+
+// Logs configures the logs agent, which tails the files, listens on the ports
+// and reads the journal of its sources and pushes their lines to Loki, to
+// Kafka or to both
+type Logs struct {
+	Enabled         bool   `toml:"enabled" json:"enabled"`
+	RunPath         string `toml:"run_path" json:"run_path"` //where the offsets of the sources are kept
+	OpenFilesLimit  int    `toml:"open_files_limit" json:"open_files_limit"`
+	FrameSize       int    `toml:"frame_size" json:"frame_size"`               //max size of the lines of the tcp and udp sources
+	BatchWait       int    `toml:"batch_wait" json:"batch_wait"`               //s, in [1, 10]
+	StopGracePeriod int    `toml:"stop_grace_period" json:"stop_grace_period"` //s
+
+	ContainerCollectAll  bool `toml:"container_collect_all" json:"container_collect_all"`   //collect all the containers, not only those of the docker sources
+	K8sContainerUseFile  bool `toml:"k8s_container_use_file" json:"k8s_container_use_file"` //read the containers from /var/log/pods before docker
+	TaggerWarmupDuration int  `toml:"tagger_warmup_duration" json:"tagger_warmup_duration"` //s, before the tags of a container are first read
+
+	Loki            LogsLoki            `toml:"loki" json:"loki"`
+	Kafka           LogsKafka           `toml:"kafka" json:"kafka"`
+	Sources         []LogSource         `toml:"sources" json:"sources"`
+	ProcessingRules []LogProcessingRule `toml:"processing_rules" json:"processing_rules"` //applied to the lines of every source
+}
+
+// LogsLoki is the Loki the logs are pushed to, in batches
+type LogsLoki struct {
+	URL              string            `toml:"url" json:"url"`
+	TenantID         string            `toml:"tenant_id" json:"tenant_id"`     //sent as X-Scope-OrgID
+	Compression      string            `toml:"compression" json:"compression"` //gzip, snappy or none
+	CompressionLevel int               `toml:"compression_level" json:"compression_level"`
+	Headers          map[string]string `toml:"headers" json:"-"`
+	Labels           map[string]string `toml:"labels" json:"labels"` //added to every stream
+}
+
+// LogsKafka is the Kafka topic the logs are produced to, in batches, instead
+// of Loki or along with it
+type LogsKafka struct {
+	Brokers          []string `toml:"brokers" json:"brokers"` //empty to disable
+	Topic            string   `toml:"topic" json:"topic"`
+	PartitionBy      string   `toml:"partition_by" json:"partition_by"`           //source, service or a tag key like host, random partitions when empty
+	Acks             string   `toml:"acks" json:"acks"`                           //none, leader or all
+	Compression      string   `toml:"compression" json:"compression"`             //gzip, snappy, lz4, zstd or none
+	CompressionLevel int      `toml:"compression_level" json:"compression_level"` //0 for the default of the codec
+	Version          string   `toml:"version" json:"version"`                     //of the brokers, 1.0.0 when empty, zstd needs 2.1.0
+	ClientID         string   `toml:"client_id" json:"client_id"`
+	Timeout          int      `toml:"timeout" json:"timeout"` //s
+
+	TLS           bool   `toml:"tls" json:"tls"`
+	TLSCA         string `toml:"tls_ca" json:"tls_ca"` //the system pool when empty
+	TLSCert       string `toml:"tls_cert" json:"tls_cert"`
+	TLSKey        string `toml:"tls_key" json:"tls_key"`
+	TLSSkipVerify bool   `toml:"tls_skip_verify" json:"tls_skip_verify"`
+
+	SASLMechanism string `toml:"sasl_mechanism" json:"sasl_mechanism"` //PLAIN, SCRAM-SHA-256 or SCRAM-SHA-512, empty to disable
+	SASLUsername  string `toml:"sasl_username" json:"sasl_username"`
+	SASLPassword  string `toml:"sasl_password" json:"-"`
+}
+
+// LogSource is a source of logs, a file, a tcp or udp port or the journal
+type LogSource struct {
+	Name string `toml:"name" json:"name"`
+	Type string `toml:"type" json:"type"` //file, tcp, udp or journald
+
+	Path         string   `toml:"path" json:"path"`                   //file, journald
+	Port         int      `toml:"port" json:"port"`                   //tcp, udp
+	IncludeUnits []string `toml:"include_units" json:"include_units"` //journald
+	ExcludeUnits []string `toml:"exclude_units" json:"exclude_units"` //journald
+
+	Service        string   `toml:"service" json:"service"`
+	Source         string   `toml:"source" json:"source"`
+	SourceCategory string   `toml:"source_category" json:"source_category"`
+	Tags           []string `toml:"tags" json:"tags"` //key:value tags are stream labels
+
+	Parser          LogParser           `toml:"parser" json:"parser"` //file, tcp, udp
+	ProcessingRules []LogProcessingRule `toml:"processing_rules" json:"processing_rules"`
+}
+
+// LogParser parses the lines of a source into a message, a status, a timestamp
+// and attributes. The fields are dotted paths, e.g. http.status, the usual
+// names are tried when they are empty: timestamp, time, ts, level, status,
+// severity, message and msg.
+type LogParser struct {
+	Type            string            `toml:"type" json:"type"`         //json, logfmt or grok
+	Pattern         string            `toml:"pattern" json:"pattern"`   //grok, e.g. %{IP:client} %{WORD:method}
+	Patterns        map[string]string `toml:"patterns" json:"patterns"` //grok, custom patterns by name
+	TimestampField  string            `toml:"timestamp_field" json:"timestamp_field"`
+	TimestampFormat string            `toml:"timestamp_format" json:"timestamp_format"` //rfc3339, unix, unix_ms, unix_ns or a go layout, guessed when empty
+	StatusField     string            `toml:"status_field" json:"status_field"`
+	MessageField    string            `toml:"message_field" json:"message_field"` //the whole line is the message when there is none
+	Attributes      []string          `toml:"attributes" json:"attributes"`       //all the other fields when empty
+}
+
+// LogProcessingRule excludes or includes the lines matching its pattern,
+// masks the sequences matching it or extracts a metric from the lines
+type LogProcessingRule struct {
+	Type               string        `toml:"type" json:"type"` //exclude_at_match, include_at_match, mask_sequences or extract_metric
+	Name               string        `toml:"name" json:"name"`
+	Pattern            string        `toml:"pattern" json:"pattern"`
+	ReplacePlaceholder string        `toml:"replace_placeholder" json:"replace_placeholder"` //mask_sequences
+	Metric             LogMetricRule `toml:"metric" json:"metric"`                           //extract_metric
+}
+
+// LogMetricRule is the metric an extract_metric rule emits for the lines it
+// matches. The value and the tags are named captures of the pattern, or the
+// paths of fields, e.g. request.status, when the lines are parsed as json.
+type LogMetricRule struct {
+	Name  string   `toml:"name" json:"name"`
+	Type  string   `toml:"type" json:"type"`   //counter, gauge or histogram
+	Value string   `toml:"value" json:"value"` //a counter counts the lines when empty
+	Tags  []string `toml:"tags" json:"tags"`   //all the other captures of the pattern when empty
+	JSON  bool     `toml:"json" json:"json"`   //parse the lines as json, the pattern only filters them
+}
+
+// DiskBuffer configures the queues the logs pipelines and the forwarder write
+// their payloads ahead to, drained in order once their destination is back
+type DiskBuffer struct {
+	Path        string `toml:"path" json:"path"`                 //empty to disable, a queue per pipeline and per domain below
+	MaxSize     int64  `toml:"max_size" json:"max_size"`         //bytes of a queue, its oldest payloads are dropped beyond
+	MaxAge      int    `toml:"max_age" json:"max_age"`           //s, the older payloads are dropped, 0 keeps them
+	SegmentSize int64  `toml:"segment_size" json:"segment_size"` //bytes of the files of a queue
+}
+
+// Loki configures pushing log lines to the push API of Loki
+type Loki struct {
+	URL           string `toml:"url" json:"url"`             //empty to disable
+	TenantID      string `toml:"tenant_id" json:"tenant_id"` //sent as X-Scope-OrgID
+	Timeout       int    `toml:"timeout" json:"timeout"`     //s
+	QueueCapacity int    `toml:"queue_capacity" json:"queue_capacity"`
+	BatchSize     int    `toml:"batch_size" json:"batch_size"`
+	BatchWait     int    `toml:"batch_wait" json:"batch_wait"` //ms
+	MaxRetries    int    `toml:"max_retries" json:"max_retries"`
+	MinBackoff    int    `toml:"min_backoff" json:"min_backoff"` //ms
+	MaxBackoff    int    `toml:"max_backoff" json:"max_backoff"` //ms
+
+	Headers           map[string]string `toml:"headers" json:"-"`
+	BasicAuthUser     string            `toml:"basic_auth_user" json:"basic_auth_user"`
+	BasicAuthPassword string            `toml:"basic_auth_password" json:"-"`
+	BearerToken       string            `toml:"bearer_token" json:"-"`
+}
+
 var (
-	Cfg         *Config
+	Cfg         *Config // the config of the startup, GetGlobalConfig returns the reloaded one
 	GlobalConf  = atomic.Value{}
 	DefaultConf = Config{
 		Config: config.DefaultConf,
 
 		PromScrapePort:0,
 		HealthPort: 0,
+		AdminHost:  "127.0.0.1",
+
+		ConfigReloadInterval: 10,
+		CacheSize:            1000, //of the metric mapper
 
 		HistogramCopyToDistribution:   false,
 		AgentBufferSize:               8192,
@@ -89,6 +375,78 @@ var (
 		AgentQueueSize:                1024,
 		AgentExpirySeconds:            300,
 
+		AgentUDPSockets:   1,
+		AgentUDPBatchSize: 1,
+
+		AgentTCPMaxConnections: 1024,
+		AgentTCPIdleTimeout:    300,
+		AgentTCPMaxLineSize:    8192,
+
+		ExportAggregationInterval: 10,
+		ExportSeriesOverflow:      "drop",
+		ExportServiceCheckTTL:     300,
+
+		RemoteWrite: RemoteWrite{
+			Interval:          15,
+			Timeout:           30,
+			Shards:            4,
+			QueueCapacity:     10000,
+			MaxSamplesPerSend: 2000,
+			BatchSendDeadline: 5000,
+			MaxRetries:        10,
+			MinBackoff:        30,
+			MaxBackoff:        5000,
+		},
+		Relay: Relay{
+			Mode:                "shard",
+			Replicas:            100,
+			QueueSize:           10000,
+			MaxPacketSize:       1432,
+			FlushInterval:       100,
+			Timeout:             1000,
+			HealthCheckInterval: 5,
+		},
+		Admission: Admission{
+			MaxSources:        1000,
+			SourceTTL:         300,
+			PriorityQueueSize: 64,
+		},
+		Capture: Capture{
+			MaxDuration: 300,
+			MaxSize:     100 << 20,
+		},
+		Logs: Logs{
+			RunPath:         "/tmp/doppler-logs",
+			OpenFilesLimit:  100,
+			FrameSize:       9000,
+			BatchWait:       5,
+			StopGracePeriod: 30,
+			Loki: LogsLoki{
+				Compression:      "gzip",
+				CompressionLevel: 6,
+			},
+			Kafka: LogsKafka{
+				Topic:       "logs",
+				Acks:        "all",
+				Compression: "snappy",
+				ClientID:    "doppler",
+				Timeout:     10,
+			},
+		},
+		DiskBuffer: DiskBuffer{
+			MaxSize:     1 << 30,
+			MaxAge:      86400,
+			SegmentSize: 16 << 20,
+		},
+		EventsLoki: Loki{
+			Timeout:       10,
+			QueueCapacity: 10000,
+			BatchSize:     1000,
+			BatchWait:     1000,
+			MaxRetries:    10,
+			MinBackoff:    500,
+			MaxBackoff:    30000,
+		},
 
 		ForwarderNumWorkers:        1,
 		ForwarderRetryQueueMaxSize: 30,
@@ -98,7 +456,15 @@ var (
 		AggregatorStopTimeout:            2,
 	}
 
-	HotReloadConfigItems = []string{"Performance.MaxProcs", "Performance.MaxMemory", "OOMAction", "MemQuotaQuery"}
+	// HotReloadConfigItems lists the field paths of the items reloaded at runtime
+	HotReloadConfigItems = []string{
+		"MapperProfiles", "CacheSize", "Filters",
+		"AgentTags", "MetricNamespace", "MetricNamespaceBlacklist",
+		"Config.Log.Level",
+		"ExportMaxSeriesPerMetric", "ExportMaxSeries", "ExportSeriesOverflow", "ExportSeriesTTL",
+		"ForwardHost", "ForwardPort",
+		"ConfigReloadInterval",
+	}
 
 	DeprecatedConfig = map[string]struct{}{
 		"pessimistic-txn.ttl": {},
@@ -88,17 +88,36 @@ type Proxy struct {
 
 // MappingProfile represent a group of mappings
 type MappingProfile struct {
-	Name     string          `mapstructure:"name"`
-	Prefix   string          `mapstructure:"prefix"`
-	Mappings []MetricMapping `mapstructure:"mappings"`
+	Name     string          `mapstructure:"name" toml:"name"`
+	Prefix   string          `mapstructure:"prefix" toml:"prefix"`
+	Mappings []MetricMapping `mapstructure:"mappings" toml:"mappings"`
 }
 
 // MetricMapping represent one mapping rule
 type MetricMapping struct {
-	Match     string            `mapstructure:"match"`
-	MatchType string            `mapstructure:"match_type"`
-	Name      string            `mapstructure:"name"`
-	Tags      map[string]string `mapstructure:"tags"`
+	Match     string            `mapstructure:"match" toml:"match"`
+	MatchType string            `mapstructure:"match_type" toml:"match_type"`
+	Name      string            `mapstructure:"name" toml:"name"`
+	Tags      map[string]string `mapstructure:"tags" toml:"tags"`
+
+	// Actions
+	Drop        bool              `mapstructure:"drop" toml:"drop"`                 // drop the matching metrics
+	DropTags    []string          `mapstructure:"drop_tags" toml:"drop_tags"`       // tag names to remove
+	RenameTags  map[string]string `mapstructure:"rename_tags" toml:"rename_tags"`   // tag name -> new tag name
+	RewriteTags []TagRewrite      `mapstructure:"rewrite_tags" toml:"rewrite_tags"` // applied after renaming
+
+	// Export
+	Type    string    `mapstructure:"type" toml:"type"` // prometheus type: gauge, counter, histogram or summary
+	Help    string    `mapstructure:"help" toml:"help"`
+	Buckets []float64 `mapstructure:"buckets" toml:"buckets"`
+}
+
+// TagRewrite replaces the value of a tag with the expansion of Replacement
+// when it matches Regex
+type TagRewrite struct {
+	Tag         string `mapstructure:"tag" toml:"tag"`
+	Regex       string `mapstructure:"regex" toml:"regex"`
+	Replacement string `mapstructure:"replacement" toml:"replacement"`
 }
 
 func init() {
@@ -300,7 +319,10 @@ func setNumWorkers(config Config) {
 
 // GetDogstatsdMappingProfiles returns mapping profiles used in DogStatsD mapper
 func GetDogstatsdMappingProfiles() ([]MappingProfile, error) {
-	return nil, nil
+	if Cfg == nil {
+		return nil, nil
+	}
+	return Cfg.MapperProfiles, nil
 }
 
 func getDogstatsdMappingProfilesConfig(config Config) ([]MappingProfile, error) {
@@ -0,0 +1,84 @@
+package config
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+// NewDefaultConfig returns a copy of the default config
+func NewDefaultConfig() *Config {
+	conf := DefaultConf
+	return &conf
+}
+
+// StoreGlobalConfig stores the config returned by GetGlobalConfig
+func StoreGlobalConfig(c *Config) {
+	GlobalConf.Store(c)
+}
+
+// CollectsDiff returns the items which differ between the new config nc and
+// the config c, by field path (e.g. `Config.Log.Level`): {new value, old value}
+func CollectsDiff(nc, c *Config) map[string][]interface{} {
+	diff := make(map[string][]interface{})
+	collectsDiff(reflect.ValueOf(*nc), reflect.ValueOf(*c), "", diff)
+	return diff
+}
+
+func collectsDiff(v1, v2 reflect.Value, fieldPath string, diff map[string][]interface{}) {
+	if v1.Kind() != reflect.Struct {
+		if !reflect.DeepEqual(v1.Interface(), v2.Interface()) {
+			diff[fieldPath] = []interface{}{v1.Interface(), v2.Interface()}
+		}
+		return
+	}
+
+	t := v1.Type()
+	for i := 0; i < v1.NumField(); i++ {
+		field := t.Field(i)
+		if field.PkgPath != "" { // unexported
+			continue
+		}
+		p := field.Name
+		if fieldPath != "" {
+			p = fieldPath + "." + p
+		}
+		collectsDiff(v1.Field(i), v2.Field(i), p, diff)
+	}
+}
+
+// CheckHotReload returns an error listing the changed items which can't be
+// reloaded at runtime
+func CheckHotReload(diff map[string][]interface{}) error {
+	supported := make(map[string]bool, len(HotReloadConfigItems))
+	for _, item := range HotReloadConfigItems {
+		supported[item] = true
+	}
+
+	var unsupported []string
+	for item := range diff {
+		if !supported[item] {
+			unsupported = append(unsupported, item)
+		}
+	}
+	if len(unsupported) > 0 {
+		sort.Strings(unsupported)
+		return fmt.Errorf("reloading config %v is not supported, restart to apply them. Only %v are supported",
+			unsupported, HotReloadConfigItems)
+	}
+	return nil
+}
+
+// CopyItems copies the items from the config src to the config dst, by field path
+func CopyItems(dst, src *Config, items []string) {
+	for _, item := range items {
+		d, s := reflect.ValueOf(dst).Elem(), reflect.ValueOf(src).Elem()
+		for _, name := range strings.Split(item, ".") {
+			d, s = d.FieldByName(name), s.FieldByName(name)
+		}
+		if d.IsValid() {
+			d.Set(s)
+		}
+	}
+}
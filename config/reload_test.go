@@ -0,0 +1,45 @@
+package config
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCollectsDiff(t *testing.T) {
+	c := NewDefaultConfig()
+	nc := NewDefaultConfig()
+	assert.Empty(t, CollectsDiff(nc, c))
+
+	nc.Log.Level = "debug"
+	nc.ExportMaxSeries = 10
+	nc.AgentTags = []string{"env:prod"}
+	assert.Equal(t, map[string][]interface{}{
+		"Config.Log.Level": {"debug", c.Log.Level},
+		"ExportMaxSeries":  {10, 0},
+		"AgentTags":        {[]string{"env:prod"}, c.AgentTags},
+	}, CollectsDiff(nc, c))
+}
+
+func TestCheckHotReload(t *testing.T) {
+	assert.NoError(t, CheckHotReload(map[string][]interface{}{"Config.Log.Level": nil, "ExportMaxSeries": nil}))
+
+	err := CheckHotReload(map[string][]interface{}{"Config.Log.Level": nil, "Port": nil, "AdminPort": nil})
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "reloading config [AdminPort Port] is not supported")
+	}
+}
+
+func TestCopyItems(t *testing.T) {
+	dst := NewDefaultConfig()
+	src := NewDefaultConfig()
+	src.Log.Level = "debug"
+	src.ExportMaxSeries = 10
+	src.ForwardHost = "statsd"
+
+	CopyItems(dst, src, []string{"Config.Log.Level", "ExportMaxSeries", "Unknown"})
+	assert.Equal(t, "debug", dst.Log.Level)
+	assert.Equal(t, 10, dst.ExportMaxSeries)
+	// the items not listed are kept
+	assert.Equal(t, DefaultConf.ForwardHost, dst.ForwardHost)
+}
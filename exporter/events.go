@@ -0,0 +1,70 @@
+package exporter
+
+import (
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/frankhang/doppler/exporter/loki"
+	"github.com/frankhang/doppler/metrics"
+)
+
+const eventsName = "dogstatsd_events_total"
+
+func newEventsCounter() *prometheus.CounterVec {
+	return prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: eventsName,
+			Help: "Count of the events received, by alert type, priority and source",
+		},
+		[]string{"alert_type", "priority", "source"})
+}
+
+// ForwardEvents forwards the events as log lines to Loki, it must be called
+// before exporting
+func (e *PromExporter) ForwardEvents(client *loki.Client) {
+	e.eventsLoki = client
+}
+
+// ExportEvent counts the event, and forwards it to Loki if enabled
+func (e *PromExporter) ExportEvent(ev *metrics.Event) error {
+	e.events.WithLabelValues(labelValue(string(ev.AlertType)), labelValue(string(ev.Priority)),
+		labelValue(ev.SourceTypeName)).Inc()
+
+	if e.eventsLoki != nil {
+		e.eventsLoki.Send(eventEntry(ev))
+	}
+	return nil
+}
+
+// eventEntry returns the log line of the event, the event as json in a
+// stream of the alert type and priority
+func eventEntry(ev *metrics.Event) loki.Entry {
+	labels := map[string]string{
+		"job":        "doppler",
+		"kind":       "event",
+		"alert_type": labelValue(string(ev.AlertType)),
+		"priority":   labelValue(string(ev.Priority)),
+	}
+	if ev.SourceTypeName != "" {
+		labels["source"] = ev.SourceTypeName
+	}
+	if host := strings.TrimSpace(ev.Host); host != "" {
+		labels["host"] = host
+	}
+
+	ts := time.Now()
+	if ev.Ts > 0 {
+		ts = time.Unix(ev.Ts, 0)
+	}
+	return loki.Entry{Labels: labels, Timestamp: ts, Line: ev.String()}
+}
+
+func labelValue(value string) string {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return blankStr
+	}
+	return value
+}
@@ -0,0 +1,71 @@
+package exporter
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/frankhang/doppler/metrics"
+)
+
+func TestExportEvent(t *testing.T) {
+	e := newTestExporter(t)
+
+	require.NoError(t, e.ExportEvent(&metrics.Event{
+		Title: "deploy", AlertType: metrics.EventAlertTypeInfo, Priority: metrics.EventPriorityLow, SourceTypeName: "jenkins",
+	}))
+	require.NoError(t, e.ExportEvent(&metrics.Event{Title: "deploy", AlertType: metrics.EventAlertTypeInfo, Priority: metrics.EventPriorityLow, SourceTypeName: "jenkins"}))
+	require.NoError(t, e.ExportEvent(&metrics.Event{Title: "oom"}))
+
+	families, err := e.Gatherer().Gather()
+	require.NoError(t, err)
+	counts := make(map[string]float64)
+	for _, mf := range families {
+		if mf.GetName() != eventsName {
+			continue
+		}
+		for _, m := range mf.GetMetric() {
+			labels := gatheredLabels(m)
+			counts[labels["alert_type"]+","+labels["priority"]+","+labels["source"]] = m.GetCounter().GetValue()
+		}
+	}
+	assert.Equal(t, map[string]float64{
+		"info,low,jenkins": 2,
+		"nil,nil,nil":      1,
+	}, counts)
+}
+
+func TestEventEntry(t *testing.T) {
+	ev := &metrics.Event{
+		Title:          "deploy",
+		Text:           "v1.2.0",
+		Ts:             1657100430,
+		Host:           " web-1 ",
+		AlertType:      metrics.EventAlertTypeSuccess,
+		Priority:       metrics.EventPriorityNormal,
+		SourceTypeName: "jenkins",
+	}
+	entry := eventEntry(ev)
+	assert.Equal(t, map[string]string{
+		"job":        "doppler",
+		"kind":       "event",
+		"alert_type": "success",
+		"priority":   "normal",
+		"source":     "jenkins",
+		"host":       "web-1",
+	}, entry.Labels)
+	assert.Equal(t, time.Unix(1657100430, 0), entry.Timestamp)
+
+	var line metrics.Event
+	require.NoError(t, json.Unmarshal([]byte(entry.Line), &line))
+	assert.Equal(t, *ev, line)
+
+	// without source, host nor timestamp
+	start := time.Now()
+	entry = eventEntry(&metrics.Event{Title: "oom"})
+	assert.Equal(t, map[string]string{"job": "doppler", "kind": "event", "alert_type": blankStr, "priority": blankStr}, entry.Labels)
+	assert.False(t, entry.Timestamp.Before(start))
+}
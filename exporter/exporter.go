@@ -5,8 +5,12 @@ import (
 	"github.com/frankhang/util/errors"
 	"github.com/frankhang/util/logutil"
 	"go.uber.org/zap"
+	"sync"
+	"sync/atomic"
 	"time"
 
+	. "github.com/frankhang/doppler/config"
+	"github.com/frankhang/doppler/exporter/loki"
 	"github.com/frankhang/doppler/metrics"
 	//"github.com/prometheus/client_golang/prometheus"
 	//c "github.com/allegro/bigcache"
@@ -15,7 +19,7 @@ import (
 
 	"github.com/prometheus/client_golang/prometheus"
 	//"github.com/prometheus/client_golang/prometheus/promhttp"
-
+	"github.com/prometheus/common/model"
 )
 
 var (
@@ -23,25 +27,137 @@ var (
 )
 
 type PromExporter struct {
-	cache c.Cache
+	cache    c.Cache
+	registry *prometheus.Registry //of the exported metrics only
 	//cache sync.Map
 	bucketsForMilliseconds []float64
+	histogramProfiles      []*histogramProfile
+	reconcileLabels        bool //keep a union label schema per metric name
+	reconciled             *reconciledCollector
+	series                 atomic.Value      //*seriesLimiter, nil when series are neither limited nor expired
+	seriesLock             sync.Mutex        //serializes the changes of the series limits
+	timestamps             *clientTimestamps //last timestamps sent by the clients per series
+	fractions              *observationFractions
+	serviceChecks          *serviceCheckCollector
+	events                 *prometheus.CounterVec
+	eventsLoki             *loki.Client //nil if the events are not forwarded
+	stopChan               chan struct{}
+	openMetrics            bool
+	createdSeries          bool
 }
 
-func NewPromExporter() *PromExporter {
-	cache := c.New(
-		c.WithExpireAfterAccess(60*time.Minute),
-		c.WithRemovalListener(onRemoval),
-	)
+func NewPromExporter() (*PromExporter, error) {
+	profiles, err := newHistogramProfiles(Cfg.ExportHistograms)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	for _, tag := range Cfg.ExportExemplarTags {
+		if !model.LabelName(tag).IsValid() {
+			return nil, errors.Trace(fmt.Errorf("invalid exemplar tag `%s`", tag))
+		}
+	}
 
 	exporter := &PromExporter{
-		cache:                  cache,
+		registry:               prometheus.NewRegistry(),
 		bucketsForMilliseconds: prometheus.ExponentialBuckets(0.1, 1.6, 32),
+		histogramProfiles:      profiles,
+		reconcileLabels:        Cfg.ExportLabelReconciliation,
+		stopChan:               make(chan struct{}),
+		openMetrics:            Cfg.ExportOpenMetrics,
+		createdSeries:          Cfg.ExportCreatedSeries,
+		timestamps:             newClientTimestamps(),
+		fractions:              newObservationFractions(),
+		serviceChecks:          newServiceCheckCollector(time.Duration(Cfg.ExportServiceCheckTTL) * time.Second),
+		events:                 newEventsCounter(),
+	}
+
+	exporter.cache = c.New(
+		c.WithExpireAfterAccess(60*time.Minute),
+		c.WithRemovalListener(exporter.onRemoval),
+	)
+
+	if exporter.reconcileLabels {
+		exporter.reconciled = newReconciledCollector(exporter.registry)
+		if err = exporter.registry.Register(exporter.reconciled); err != nil {
+			return nil, errors.Trace(err)
+		}
+	}
+
+	if err = exporter.serviceChecks.register(exporter.registry); err != nil {
+		return nil, errors.Trace(err)
+	}
+	if err = exporter.registry.Register(exporter.events); err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	exporter.series.Store((*seriesLimiter)(nil))
+	ttl := time.Duration(Cfg.ExportSeriesTTL) * time.Second
+	if err = exporter.SetSeriesLimits(Cfg.ExportMaxSeriesPerMetric, Cfg.ExportMaxSeries, Cfg.ExportSeriesOverflow, ttl); err != nil {
+		return nil, errors.Trace(err)
 	}
-	return exporter
+	return exporter, nil
 }
 
-func onRemoval(key c.Key, value c.Value) {
+// Stop stops expiring the series
+func (e *PromExporter) Stop() {
+	close(e.stopChan)
+}
+
+// limiter returns the series limiter, nil when series are neither limited nor expired
+func (e *PromExporter) limiter() *seriesLimiter {
+	return e.series.Load().(*seriesLimiter)
+}
+
+// SetSeriesLimits sets the series limits and ttl, 0 meaning unlimited or never
+// expired. It may be called while exporting: the series exported before the
+// limits were first set are counted when they are updated.
+func (e *PromExporter) SetSeriesLimits(maxPerMetric, maxTotal int, overflow string, ttl time.Duration) error {
+	e.seriesLock.Lock()
+	defer e.seriesLock.Unlock()
+
+	current := e.limiter()
+	if maxPerMetric <= 0 && maxTotal <= 0 && ttl <= 0 {
+		if _, err := validOverflow(overflow); err != nil {
+			return err
+		}
+		if current != nil {
+			e.series.Store((*seriesLimiter)(nil))
+			current.Lock()
+			current.stopExpiring()
+			tlmSeries.Sub(float64(current.total))
+			current.Unlock()
+		}
+		return nil
+	}
+
+	if current != nil {
+		return current.setLimits(maxPerMetric, maxTotal, overflow, ttl, e.stopChan)
+	}
+	limiter, err := newSeriesLimiter(maxPerMetric, maxTotal, overflow, ttl)
+	if err != nil {
+		return err
+	}
+	limiter.Lock()
+	limiter.startExpiring(e.stopChan)
+	limiter.Unlock()
+	e.series.Store(limiter)
+	return nil
+}
+
+func (e *PromExporter) onRemoval(key c.Key, value c.Value) {
+
+	if schema, ok := value.(*labelSchema); ok {
+		e.reconciled.remove(schema)
+		if series := e.limiter(); series != nil {
+			schema.Lock()
+			series.forget(schema.metric.Name, schema.collector)
+			for _, previous := range schema.previous {
+				series.forget(schema.metric.Name, previous.collector)
+			}
+			schema.Unlock()
+		}
+		return
+	}
 
 	var collector prometheus.Collector
 	var ok bool
@@ -50,8 +166,13 @@ func onRemoval(key c.Key, value c.Value) {
 		return
 	}
 
-	removed := prometheus.Unregister(collector)
+	removed := e.registry.Unregister(collector)
 	logutil.BgLogger().Debug("onRemoval", zap.Bool("removed", removed))
+	if series := e.limiter(); series != nil {
+		if k, ok := key.(string); ok {
+			series.forget(metricNameOfKey(k), collector)
+		}
+	}
 }
 
 func (e *PromExporter) loadMetric(key c.Key) (value c.Value, err error) {
@@ -63,45 +184,11 @@ func (e *PromExporter) loadMetric(key c.Key) (value c.Value, err error) {
 	}
 
 	var collector prometheus.Collector
-	switch pm.Symbol {
-	case GaugeSymbol:
-		collector = prometheus.NewGaugeVec(
-			prometheus.GaugeOpts{
-				Name: pm.Name,
-				Help: pm.Name,
-			},
-			pm.LabelNames)
-
-		err = prometheus.Register(collector)
-
-	case CountSymbol:
-		collector = prometheus.NewCounterVec(
-			prometheus.CounterOpts{
-				Name: pm.Name,
-				Help: pm.Name,
-			},
-			pm.LabelNames)
-		err = prometheus.Register(collector)
-	case HistogramSymbol:
-		collector = prometheus.NewHistogramVec(
-			prometheus.HistogramOpts{
-				Name:    pm.Name,
-				Help:    pm.Name,
-				Buckets: e.bucketsForMilliseconds,
-			},
-			pm.LabelNames)
-		err = prometheus.Register(collector)
-	case SummarySymbol:
-		collector = prometheus.NewSummaryVec(
-			prometheus.SummaryOpts{
-				Name: pm.Name,
-				Help: pm.Name,
-			},
-			pm.LabelNames)
-		err = prometheus.Register(collector)
-	default:
-		err = errors.New(fmt.Sprintf("loadMetric: Unsupported symbol, %s", pm))
+	if collector, err = e.newCollector(pm); err != nil {
+		err = errors.Trace(err)
+		return
 	}
+	err = e.registry.Register(collector)
 
 	if err == nil { //register successfully
 		value = collector
@@ -122,6 +209,43 @@ func (e *PromExporter) loadMetric(key c.Key) (value c.Value, err error) {
 	return
 }
 
+// newCollector creates the unregistered collector of the metric
+func (e *PromExporter) newCollector(pm *PromMetric) (collector prometheus.Collector, err error) {
+	symbol := pm.Symbol
+	var profile *histogramProfile
+	if symbol == HistogramSymbol || symbol == SummarySymbol {
+		// the type chosen by a mapping wins over the profile
+		if profile = e.histogramProfile(pm.Name); profile != nil && (pm.export == nil || pm.export.Type == "") {
+			symbol = profile.symbol
+		}
+	}
+
+	switch symbol {
+	case GaugeSymbol:
+		collector = prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: pm.Name,
+				Help: pm.help(),
+			},
+			pm.LabelNames)
+	case CountSymbol:
+		collector = prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: pm.Name,
+				Help: pm.help(),
+			},
+			pm.LabelNames)
+	case HistogramSymbol:
+		collector = newWeightedHistogramVec(e.histogramOpts(pm, profile), pm.LabelNames)
+	case SummarySymbol:
+		collector = newWeightedSummaryVec(e.summaryOpts(pm, profile), pm.LabelNames)
+	default:
+		err = errors.New(fmt.Sprintf("newCollector: Unsupported symbol, %s", pm))
+	}
+
+	return
+}
+
 func (e *PromExporter) export(ps *PromSample) (err error) {
 	if ps == nil {
 		return
@@ -129,24 +253,63 @@ func (e *PromExporter) export(ps *PromSample) (err error) {
 	var value interface{}
 	var ok bool
 
+	if e.reconcileLabels {
+		return e.exportReconciled(ps)
+	}
+
 	key := ps.metric.String()
 	if value, ok = e.cache.GetIfPresent(key); !ok {
 		if value, err = e.loadMetric(ps.metric); err != nil {
+			tlmLabelConflicts.Inc("register")
 			err = errors.Trace(err)
 			return
 		}
 		e.cache.Put(key, value)
 	}
 
+	return e.observe(value.(prometheus.Collector), ps.metric.Name, ps.metric.LabelNames, ps.LableValues, ps)
+}
+
+// observe records the value of the sample within the series limits,
+// a sample dropped by the limits is only counted by telemetry
+func (e *PromExporter) observe(collector prometheus.Collector, name string, labelNames, labelValues []string, ps *PromSample) error {
+	if series := e.limiter(); series != nil {
+		var ok bool
+		if labelValues, ok = series.admit(collector, name, labelValues); !ok {
+			return nil
+		}
+	}
+	var n uint64
+	if _, ok := collector.(*weightedVec); ok {
+		n = uint64(e.fractions.observations(name, labelNames, labelValues, ps.Weight))
+	}
+	if err := observe(collector, labelValues, ps, n); err != nil {
+		return err
+	}
+	e.timestamps.record(name, labelNames, labelValues, ps.Timestamp)
+	return nil
+}
+
+// observe records the value of the sample in the child of the collector
+// identified by labelValues, a histogram or summary value stands for n
+// occurrences
+func observe(value interface{}, labelValues []string, ps *PromSample, n uint64) (err error) {
 	switch collector := value.(type) {
 	case *prometheus.GaugeVec:
-		collector.WithLabelValues(ps.LableValues...).Set(ps.Value)
+		collector.WithLabelValues(labelValues...).Set(ps.Value)
 	case *prometheus.CounterVec:
-		collector.WithLabelValues(ps.LableValues...).Add(ps.Value)
-	case *prometheus.HistogramVec:
-		collector.WithLabelValues(ps.LableValues...).Observe(ps.Value)
-	case *prometheus.SummaryVec:
-		collector.WithLabelValues(ps.LableValues...).Observe(ps.Value)
+		if ps.Value < 0 {
+			// a counter can't decrease, e.g. a gauge mapped as a counter
+			return errors.New(fmt.Sprintf("export: negative value %v for counter %s", ps.Value, ps.metric.Name))
+		}
+		counter := collector.WithLabelValues(labelValues...)
+		if ps.Exemplar != nil {
+			counter.(prometheus.ExemplarAdder).AddWithExemplar(ps.Value*ps.Weight, ps.Exemplar)
+		} else {
+			counter.Add(ps.Value * ps.Weight)
+		}
+	case *weightedVec:
+		err = collector.observe(labelValues, ps.Value, n, ps.Exemplar)
 	default:
 		err = errors.New("export: Unexcepted collector type")
 
@@ -158,12 +321,24 @@ func (e *PromExporter) export(ps *PromSample) (err error) {
 func (e *PromExporter) ExportMetricSample(sample *metrics.MetricSample) error {
 
 	ps := NewPromSample(sample)
-
+	if sample.Timestamp > 0 {
+		// sent by the client, the series is exposed with it
+		ps.Timestamp = int64(sample.Timestamp * 1000)
+	}
 	return e.export(ps)
 }
 
-func (e *PromExporter) ExportServiceCheck(sc *metrics.ServiceCheck) error {
+// ExportWeightedSample exports a sample aggregated by the aggregator,
+// standing for weight occurrences of its value
+func (e *PromExporter) ExportWeightedSample(sample *metrics.MetricSample, weight float64) error {
 
-	ps := NewPromSampleFromServiceCheck(sc)
+	ps := NewPromSample(sample)
+	ps.Weight = weight
 	return e.export(ps)
 }
+
+// ExportServiceCheck records the status of the service check
+func (e *PromExporter) ExportServiceCheck(sc *metrics.ServiceCheck) error {
+	e.serviceChecks.update(sc)
+	return nil
+}
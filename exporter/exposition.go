@@ -0,0 +1,133 @@
+package exporter
+
+import (
+	"compress/gzip"
+	"github.com/frankhang/util/logutil"
+	"go.uber.org/zap"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+
+	"github.com/frankhang/doppler/telemetry"
+)
+
+var (
+	tlmScrapes = telemetry.NewCounter("exporter", "scrapes",
+		[]string{"format"}, "Count of scrapes of the exported metrics by exposition format")
+	tlmExemplarsDropped = telemetry.NewCounter("exporter", "exemplars_dropped",
+		[]string{}, "Count of exemplars dropped because their labels are too long")
+)
+
+// Gatherer returns the gatherer of the exported metrics, without doppler's
+// own telemetry. The series last sampled with a client timestamp carry it.
+func (e *PromExporter) Gatherer() prometheus.Gatherer {
+	return prometheus.GathererFunc(func() ([]*dto.MetricFamily, error) {
+		start := time.Now()
+		families, err := e.registry.Gather()
+		e.timestamps.apply(families, start)
+		return families, err
+	})
+}
+
+// Handler serves the exported metrics. When OpenMetrics is enabled and
+// negotiated, counters, histograms and summaries carry their exemplars and
+// _created series.
+func (e *PromExporter) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		families, err := e.Gatherer().Gather()
+		if err != nil {
+			if len(families) == 0 {
+				http.Error(w, "An error has occurred while serving metrics:\n\n"+err.Error(), http.StatusInternalServerError)
+				return
+			}
+			// the families gathered without error are still served
+			logutil.BgLogger().Warn("Handler: error gathering metrics", zap.Error(err))
+		}
+
+		var format expfmt.Format
+		var options []expfmt.EncoderOption
+		if e.openMetrics {
+			format = expfmt.NegotiateIncludingOpenMetrics(r.Header)
+			if e.createdSeries {
+				options = append(options, expfmt.WithCreatedLines())
+			}
+		} else {
+			format = expfmt.Negotiate(r.Header)
+		}
+		tlmScrapes.Inc(formatName(format))
+		w.Header().Set("Content-Type", string(format))
+
+		out := io.Writer(w)
+		if gzipAccepted(r.Header) {
+			w.Header().Set("Content-Encoding", "gzip")
+			gz := gzip.NewWriter(w)
+			defer gz.Close()
+			out = gz
+		}
+
+		enc := expfmt.NewEncoder(out, format, options...)
+		for _, mf := range families {
+			if err = enc.Encode(mf); err != nil {
+				logutil.BgLogger().Error("Handler: error encoding metric family", zap.String("name", mf.GetName()), zap.Error(err))
+				return
+			}
+		}
+		// writes the final # EOF of OpenMetrics
+		if closer, ok := enc.(expfmt.Closer); ok {
+			if err = closer.Close(); err != nil {
+				logutil.BgLogger().Error("Handler: error closing encoder", zap.Error(err))
+			}
+		}
+	})
+}
+
+func formatName(format expfmt.Format) string {
+	switch format.FormatType() {
+	case expfmt.TypeOpenMetrics:
+		return "openmetrics"
+	case expfmt.TypeTextPlain:
+		return "text"
+	default:
+		return "protobuf"
+	}
+}
+
+func gzipAccepted(header http.Header) bool {
+	for _, part := range strings.Split(header.Get("Accept-Encoding"), ",") {
+		part = strings.TrimSpace(part)
+		if part == "gzip" || strings.HasPrefix(part, "gzip;") {
+			return true
+		}
+	}
+	return false
+}
+
+// isExemplarTag returns whether a tag is exported as an exemplar label
+// instead of a series label
+func isExemplarTag(name string, exemplarTags []string) bool {
+	for _, tag := range exemplarTags {
+		if name == tag {
+			return true
+		}
+	}
+	return false
+}
+
+// validExemplar returns whether the exemplar labels fit in the limit of
+// the exposition formats, an invalid exemplar would panic when recorded
+func validExemplar(exemplar prometheus.Labels) bool {
+	runes := 0
+	for name, value := range exemplar {
+		if !utf8.ValidString(value) {
+			return false
+		}
+		runes += utf8.RuneCountInString(name) + utf8.RuneCountInString(value)
+	}
+	return runes <= prometheus.ExemplarMaxRunes
+}
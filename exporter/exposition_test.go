@@ -0,0 +1,156 @@
+package exporter
+
+import (
+	"compress/gzip"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	. "github.com/frankhang/doppler/config"
+	"github.com/frankhang/doppler/metrics"
+)
+
+const (
+	acceptOpenMetrics = "application/openmetrics-text;version=1.0.0,text/plain;version=0.0.4;q=0.5"
+	acceptText        = "text/plain;version=0.0.4"
+)
+
+// scrape returns the response of the handler of an exporter with a
+// counter carrying an exemplar
+func scrape(t *testing.T, openMetrics, createdSeries bool, header http.Header) *http.Response {
+	conf := DefaultConf
+	conf.ExportOpenMetrics = openMetrics
+	conf.ExportCreatedSeries = createdSeries
+	conf.ExportExemplarTags = []string{"trace_id"}
+	Cfg = &conf
+
+	e, err := NewPromExporter()
+	require.NoError(t, err)
+	t.Cleanup(e.Stop)
+	require.NoError(t, e.ExportMetricSample(&metrics.MetricSample{
+		Name: "requests_total", Value: 1, Mtype: metrics.CountType, Tags: []string{"host:a", "trace_id:abc"}, SampleRate: 1,
+	}))
+
+	r := httptest.NewRequest("GET", "/metrics", nil)
+	r.Header = header
+	w := httptest.NewRecorder()
+	e.Handler().ServeHTTP(w, r)
+	return w.Result()
+}
+
+func TestHandlerNegotiation(t *testing.T) {
+	for _, tc := range []struct {
+		name          string
+		openMetrics   bool
+		createdSeries bool
+		accept        string
+		contentType   string
+		contains      []string
+		excludes      []string
+	}{
+		{
+			name:        "text by default",
+			contentType: "text/plain; version=0.0.4",
+			contains:    []string{"# TYPE requests_total counter", `requests_total{host="a"} 1`},
+			excludes:    []string{"trace_id", "# EOF"},
+		},
+		{
+			name:        "openmetrics disabled",
+			accept:      acceptOpenMetrics,
+			contentType: "text/plain; version=0.0.4",
+			excludes:    []string{"trace_id", "# EOF"},
+		},
+		{
+			name:        "openmetrics not accepted",
+			openMetrics: true,
+			accept:      acceptText,
+			contentType: "text/plain; version=0.0.4",
+			excludes:    []string{"trace_id", "# EOF"},
+		},
+		{
+			name:        "openmetrics",
+			openMetrics: true,
+			accept:      acceptOpenMetrics,
+			contentType: "application/openmetrics-text; version=1.0.0",
+			contains:    []string{`requests_total{host="a"} 1.0 # {trace_id="abc"} 1.0`, "# EOF"},
+			excludes:    []string{"requests_created"},
+		},
+		{
+			name:          "openmetrics created series",
+			openMetrics:   true,
+			createdSeries: true,
+			accept:        acceptOpenMetrics,
+			contentType:   "application/openmetrics-text; version=1.0.0",
+			contains:      []string{`requests_created{host="a"}`, "# EOF"},
+		},
+		{
+			name:          "created series without openmetrics",
+			createdSeries: true,
+			accept:        acceptOpenMetrics,
+			contentType:   "text/plain; version=0.0.4",
+			excludes:      []string{"requests_created"},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			header := http.Header{}
+			if tc.accept != "" {
+				header.Set("Accept", tc.accept)
+			}
+			resp := scrape(t, tc.openMetrics, tc.createdSeries, header)
+			defer resp.Body.Close()
+			body, err := ioutil.ReadAll(resp.Body)
+			require.NoError(t, err)
+
+			assert.Equal(t, http.StatusOK, resp.StatusCode)
+			// the charset and escaping parameters depend on the version of expfmt
+			assert.True(t, strings.HasPrefix(resp.Header.Get("Content-Type"), tc.contentType), resp.Header.Get("Content-Type"))
+			for _, s := range tc.contains {
+				assert.Contains(t, string(body), s)
+			}
+			for _, s := range tc.excludes {
+				assert.NotContains(t, string(body), s)
+			}
+		})
+	}
+}
+
+func TestHandlerGzip(t *testing.T) {
+	header := http.Header{}
+	header.Set("Accept", acceptOpenMetrics)
+	header.Set("Accept-Encoding", "deflate, gzip;q=0.9")
+	resp := scrape(t, true, false, header)
+	defer resp.Body.Close()
+
+	assert.Equal(t, "gzip", resp.Header.Get("Content-Encoding"))
+	gz, err := gzip.NewReader(resp.Body)
+	require.NoError(t, err)
+	body, err := ioutil.ReadAll(gz)
+	require.NoError(t, err)
+	assert.True(t, strings.HasSuffix(string(body), "# EOF\n"))
+}
+
+func TestGzipAccepted(t *testing.T) {
+	for accept, expected := range map[string]bool{
+		"":                 false,
+		"gzip":             true,
+		"deflate, gzip":    true,
+		"gzip;q=0.5":       true,
+		"x-gzip, identity": false,
+	} {
+		header := http.Header{}
+		header.Set("Accept-Encoding", accept)
+		assert.Equal(t, expected, gzipAccepted(header), "accept %q", accept)
+	}
+}
+
+func TestValidExemplar(t *testing.T) {
+	assert.True(t, validExemplar(prometheus.Labels{"trace_id": "abc"}))
+	assert.False(t, validExemplar(prometheus.Labels{"trace_id": "\xff"}))
+	assert.False(t, validExemplar(prometheus.Labels{"trace_id": strings.Repeat("a", prometheus.ExemplarMaxRunes)}))
+}
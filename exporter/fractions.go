@@ -0,0 +1,68 @@
+package exporter
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+// fractionTTL is how long the fraction of a series not sampled anymore is kept
+const fractionTTL = 10 * time.Minute
+
+// fraction is the part of the weights of a series not counted yet
+type fraction struct {
+	carry float64
+	seen  time.Time
+}
+
+// observationFractions carries per series the fractional weights of the
+// histogram and summary samples, so that a rate of 0.3 counts 10 occurrences
+// every 3 samples instead of 3 per sample.
+type observationFractions struct {
+	sync.Mutex
+	fractions map[string]fraction
+	swept     time.Time
+}
+
+func newObservationFractions() *observationFractions {
+	return &observationFractions{fractions: make(map[string]fraction), swept: time.Now()}
+}
+
+// observations returns how many occurrences the value of a sample of weight
+// counts for, the series are only tracked for fractional weights
+func (f *observationFractions) observations(name string, labelNames, labelValues []string, weight float64) int {
+	whole, frac := math.Modf(weight)
+	if frac == 0 {
+		if whole < 1 {
+			return 1
+		}
+		return int(whole)
+	}
+
+	now := time.Now()
+	key := seriesKey(name, labelNames, labelValues)
+
+	f.Lock()
+	defer f.Unlock()
+
+	carry := f.fractions[key].carry + frac
+	if carry >= 1 {
+		whole++
+		carry--
+	}
+	f.fractions[key] = fraction{carry: carry, seen: now}
+
+	if now.Sub(f.swept) > fractionTTL {
+		for key, fraction := range f.fractions {
+			if now.Sub(fraction.seen) > fractionTTL {
+				delete(f.fractions, key)
+			}
+		}
+		f.swept = now
+	}
+
+	if whole < 1 {
+		return 0
+	}
+	return int(whole)
+}
@@ -0,0 +1,28 @@
+package exporter
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestObservationFractions(t *testing.T) {
+	f := newObservationFractions()
+	labelNames, labelValues := []string{"host"}, []string{"a"}
+
+	// a rate of 0.3 stands for 10 occurrences every 3 samples
+	total := 0
+	for i := 0; i < 300; i++ {
+		total += f.observations("latency", labelNames, labelValues, 1/0.3)
+	}
+	assert.InDelta(t, 1000, total, 1)
+
+	// the series carry their own fractions
+	assert.Equal(t, 1, f.observations("latency", labelNames, []string{"b"}, 1.5))
+	assert.Equal(t, 2, f.observations("latency", labelNames, []string{"b"}, 1.5))
+
+	// whole weights are not tracked
+	assert.Equal(t, 4, f.observations("size", labelNames, labelValues, 4))
+	assert.Equal(t, 1, f.observations("size", labelNames, labelValues, 0))
+	assert.Len(t, f.fractions, 2)
+}
@@ -0,0 +1,150 @@
+package exporter
+
+import (
+	"fmt"
+	"github.com/frankhang/util/errors"
+	"regexp"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	. "github.com/frankhang/doppler/config"
+	"github.com/frankhang/doppler/mapper"
+)
+
+const (
+	histogramProfileType = "histogram"
+	summaryProfileType   = "summary"
+)
+
+// histogramProfile is the compiled form of a HistogramProfile
+type histogramProfile struct {
+	regex  *regexp.Regexp
+	symbol byte
+
+	buckets            []float64
+	nativeBucketFactor float64
+	nativeMaxBuckets   uint32
+
+	objectives map[float64]float64
+	maxAge     time.Duration
+}
+
+// newHistogramProfiles validates and compiles the configured histogram profiles
+func newHistogramProfiles(configProfiles []HistogramProfile) ([]*histogramProfile, error) {
+	var profiles []*histogramProfile
+	for i, cp := range configProfiles {
+		if cp.Match == "" {
+			return nil, errors.Trace(fmt.Errorf("histogram profile %d: match is required", i))
+		}
+		regex, err := mapper.BuildMatchRegex(cp.Match, cp.MatchType)
+		if err != nil {
+			return nil, errors.Trace(fmt.Errorf("histogram profile %d: %v", i, err))
+		}
+
+		p := &histogramProfile{
+			regex:              regex,
+			nativeBucketFactor: cp.NativeBucketFactor,
+			nativeMaxBuckets:   cp.NativeMaxBuckets,
+			maxAge:             time.Duration(cp.MaxAge) * time.Second,
+		}
+
+		switch cp.Type {
+		case "", histogramProfileType:
+			p.symbol = HistogramSymbol
+		case summaryProfileType:
+			p.symbol = SummarySymbol
+		default:
+			return nil, errors.Trace(fmt.Errorf("histogram profile %d: invalid type `%s`, must be `histogram` or `summary`", i, cp.Type))
+		}
+
+		if cp.NativeBucketFactor != 0 && cp.NativeBucketFactor <= 1 {
+			return nil, errors.Trace(fmt.Errorf("histogram profile %d: native_bucket_factor must be greater than 1", i))
+		}
+
+		switch {
+		case len(cp.Buckets) > 0:
+			p.buckets = cp.Buckets
+		case cp.ExponentialBuckets != nil:
+			b := cp.ExponentialBuckets
+			if b.Count < 1 || b.Start <= 0 || b.Factor <= 1 {
+				return nil, errors.Trace(fmt.Errorf("histogram profile %d: invalid exponential_buckets", i))
+			}
+			p.buckets = prometheus.ExponentialBuckets(b.Start, b.Factor, b.Count)
+		case cp.LinearBuckets != nil:
+			b := cp.LinearBuckets
+			if b.Count < 1 {
+				return nil, errors.Trace(fmt.Errorf("histogram profile %d: invalid linear_buckets", i))
+			}
+			p.buckets = prometheus.LinearBuckets(b.Start, b.Width, b.Count)
+		}
+		for j := 1; j < len(p.buckets); j++ {
+			if p.buckets[j] <= p.buckets[j-1] {
+				return nil, errors.Trace(fmt.Errorf("histogram profile %d: buckets must be in increasing order", i))
+			}
+		}
+
+		if len(cp.Objectives) > 0 {
+			p.objectives = make(map[float64]float64, len(cp.Objectives))
+			for q, e := range cp.Objectives {
+				quantile, err := strconv.ParseFloat(q, 64)
+				if err != nil || quantile < 0 || quantile > 1 {
+					return nil, errors.Trace(fmt.Errorf("histogram profile %d: invalid objective quantile `%s`", i, q))
+				}
+				p.objectives[quantile] = e
+			}
+		}
+
+		profiles = append(profiles, p)
+	}
+	return profiles, nil
+}
+
+// histogramProfile returns the first profile matching the metric name, nil if none does
+func (e *PromExporter) histogramProfile(name string) *histogramProfile {
+	for _, p := range e.histogramProfiles {
+		if p.regex.MatchString(name) {
+			return p
+		}
+	}
+	return nil
+}
+
+// histogramOpts returns the options of a histogram, the profile may be nil
+func (e *PromExporter) histogramOpts(pm *PromMetric, p *histogramProfile) prometheus.HistogramOpts {
+	opts := prometheus.HistogramOpts{
+		Name:    pm.Name,
+		Help:    pm.help(),
+		Buckets: e.bucketsForMilliseconds,
+	}
+	if p != nil {
+		if len(p.buckets) > 0 {
+			opts.Buckets = p.buckets
+		}
+		if p.nativeBucketFactor > 1 {
+			opts.NativeHistogramBucketFactor = p.nativeBucketFactor
+			opts.NativeHistogramMaxBucketNumber = p.nativeMaxBuckets
+			opts.NativeHistogramMinResetDuration = time.Hour
+		}
+	}
+	// the buckets of a mapping win over the profile
+	if pm.export != nil && len(pm.export.Buckets) > 0 {
+		opts.Buckets = pm.export.Buckets
+	}
+	return opts
+}
+
+// summaryOpts returns the options of a summary, the profile may be nil
+func (e *PromExporter) summaryOpts(pm *PromMetric, p *histogramProfile) prometheus.SummaryOpts {
+	opts := prometheus.SummaryOpts{
+		Name: pm.Name,
+		Help: pm.help(),
+	}
+	if p == nil {
+		return opts
+	}
+	opts.Objectives = p.objectives
+	opts.MaxAge = p.maxAge
+	return opts
+}
@@ -0,0 +1,112 @@
+package exporter
+
+import (
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	. "github.com/frankhang/doppler/config"
+	"github.com/frankhang/doppler/mapper"
+)
+
+func TestNewHistogramProfilesErrors(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		profile HistogramProfile
+		err     string
+	}{
+		{name: "no match", profile: HistogramProfile{}, err: "match is required"},
+		{name: "invalid match type", profile: HistogramProfile{Match: "a", MatchType: "glob"}, err: "invalid match type"},
+		{name: "invalid type", profile: HistogramProfile{Match: "a", Type: "gauge"}, err: "invalid type `gauge`"},
+		{name: "native factor", profile: HistogramProfile{Match: "a", NativeBucketFactor: 1}, err: "native_bucket_factor"},
+		{name: "exponential buckets", profile: HistogramProfile{Match: "a", ExponentialBuckets: &ExponentialBuckets{Start: 0, Factor: 2, Count: 3}}, err: "invalid exponential_buckets"},
+		{name: "linear buckets", profile: HistogramProfile{Match: "a", LinearBuckets: &LinearBuckets{Start: 0, Width: 1, Count: 0}}, err: "invalid linear_buckets"},
+		{name: "decreasing buckets", profile: HistogramProfile{Match: "a", Buckets: []float64{1, 1}}, err: "increasing order"},
+		{name: "invalid quantile", profile: HistogramProfile{Match: "a", Type: "summary", Objectives: map[string]float64{"1.5": 0.01}}, err: "invalid objective quantile `1.5`"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := newHistogramProfiles([]HistogramProfile{tc.profile})
+			if assert.Error(t, err) {
+				assert.Contains(t, err.Error(), tc.err)
+			}
+		})
+	}
+}
+
+func TestHistogramProfileBuckets(t *testing.T) {
+	profiles, err := newHistogramProfiles([]HistogramProfile{
+		{Match: "http_*", Buckets: []float64{0.1, 1, 10}},
+		{Match: "db_.*_seconds", MatchType: "regex", ExponentialBuckets: &ExponentialBuckets{Start: 1, Factor: 2, Count: 3}},
+		{Match: "queue_*", LinearBuckets: &LinearBuckets{Start: 10, Width: 5, Count: 3}},
+		{Match: "http_*", Buckets: []float64{5}}, // shadowed by the first profile
+		{Match: "rpc_*", NativeBucketFactor: 1.1, NativeMaxBuckets: 100},
+	})
+	require.NoError(t, err)
+	e := &PromExporter{bucketsForMilliseconds: []float64{1, 2}, histogramProfiles: profiles}
+
+	for _, tc := range []struct {
+		name    string
+		metric  *PromMetric
+		buckets []float64
+		native  float64
+	}{
+		{name: "explicit", metric: &PromMetric{Name: "http_latency"}, buckets: []float64{0.1, 1, 10}},
+		{name: "exponential", metric: &PromMetric{Name: "db_query_seconds"}, buckets: []float64{1, 2, 4}},
+		{name: "linear", metric: &PromMetric{Name: "queue_size"}, buckets: []float64{10, 15, 20}},
+		{name: "no profile", metric: &PromMetric{Name: "latency"}, buckets: []float64{1, 2}},
+		{name: "native", metric: &PromMetric{Name: "rpc_latency"}, buckets: []float64{1, 2}, native: 1.1},
+		{
+			name:    "mapping buckets",
+			metric:  &PromMetric{Name: "http_latency", export: &mapper.ExportMeta{Buckets: []float64{3}}},
+			buckets: []float64{3},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			opts := e.histogramOpts(tc.metric, e.histogramProfile(tc.metric.Name))
+			assert.Equal(t, tc.buckets, opts.Buckets)
+			assert.Equal(t, tc.native, opts.NativeHistogramBucketFactor)
+			if tc.native > 0 {
+				assert.Equal(t, uint32(100), opts.NativeHistogramMaxBucketNumber)
+				assert.Equal(t, time.Hour, opts.NativeHistogramMinResetDuration)
+			}
+		})
+	}
+}
+
+func TestHistogramProfileSummary(t *testing.T) {
+	profiles, err := newHistogramProfiles([]HistogramProfile{
+		{Match: "rpc_*", Type: "summary", Objectives: map[string]float64{"0.5": 0.05, "0.99": 0.001}, MaxAge: 60},
+	})
+	require.NoError(t, err)
+	e := &PromExporter{bucketsForMilliseconds: []float64{1, 2}, histogramProfiles: profiles}
+
+	for _, tc := range []struct {
+		name   string
+		metric *PromMetric
+		symbol byte
+	}{
+		{name: "profile type", metric: &PromMetric{Name: "rpc_latency", Symbol: HistogramSymbol}, symbol: SummarySymbol},
+		{name: "no profile", metric: &PromMetric{Name: "latency", Symbol: HistogramSymbol}, symbol: HistogramSymbol},
+		{
+			name:   "mapping type wins",
+			metric: &PromMetric{Name: "rpc_latency", Symbol: HistogramSymbol, export: &mapper.ExportMeta{Type: mapper.ExportTypeHistogram}},
+			symbol: HistogramSymbol,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			collector, err := e.newCollector(tc.metric)
+			require.NoError(t, err)
+			v := collector.(*weightedVec)
+			_, summary := v.newSeries().(*weightedSummary)
+			assert.Equal(t, tc.symbol == SummarySymbol, summary)
+		})
+	}
+
+	opts := e.summaryOpts(&PromMetric{Name: "rpc_latency"}, e.histogramProfile("rpc_latency"))
+	assert.Equal(t, map[float64]float64{0.5: 0.05, 0.99: 0.001}, opts.Objectives)
+	assert.Equal(t, time.Minute, opts.MaxAge)
+	assert.Equal(t, prometheus.SummaryOpts{Name: "latency", Help: "latency"}, e.summaryOpts(&PromMetric{Name: "latency"}, nil))
+}
@@ -0,0 +1,275 @@
+package exporter
+
+import (
+	"fmt"
+	"github.com/frankhang/util/errors"
+	"github.com/frankhang/util/logutil"
+	"go.uber.org/zap"
+	"sort"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+
+	"github.com/frankhang/doppler/telemetry"
+)
+
+var (
+	tlmLabelSchemaChanges = telemetry.NewCounter("exporter", "label_schema_changes",
+		[]string{}, "Count of metrics whose label schema grew")
+	tlmLabelConflicts = telemetry.NewCounter("exporter", "label_conflicts",
+		[]string{"reason"}, "Count of samples dropped because their metric conflicts with a registered one")
+)
+
+// labelSchema is the union of the label names seen for a metric name,
+// with the collector holding its series. A sample missing some labels of
+// the schema has them filled with empty values.
+type labelSchema struct {
+	sync.Mutex
+	metric    *PromMetric
+	index     map[string]int // position of each label name in metric.LabelNames
+	collector prometheus.Collector
+	guard     *nameGuard
+	previous  []*labelSchema // the schemas before the metric grew, oldest first
+}
+
+func newLabelSchema(pm *PromMetric, collector prometheus.Collector) *labelSchema {
+	schema := &labelSchema{
+		metric:    pm,
+		index:     make(map[string]int, len(pm.LabelNames)),
+		collector: collector,
+	}
+	for i, name := range pm.LabelNames {
+		schema.index[name] = i
+	}
+	return schema
+}
+
+// labelValues returns the values of the sample ordered by the schema,
+// and false if the sample has labels unknown to the schema
+func (s *labelSchema) labelValues(ps *PromSample) ([]string, bool) {
+	values := make([]string, len(s.metric.LabelNames))
+	for i, name := range ps.metric.LabelNames {
+		j, ok := s.index[name]
+		if !ok {
+			return nil, false
+		}
+		values[j] = ps.LableValues[i]
+	}
+	return values, true
+}
+
+// layer returns the schema holding the series of the sample, the oldest one
+// knowing all its labels, and the values of the sample ordered by it
+func (s *labelSchema) layer(ps *PromSample) (*labelSchema, []string, bool) {
+	for _, previous := range s.previous {
+		if values, ok := previous.labelValues(ps); ok {
+			return previous, values, true
+		}
+	}
+	values, ok := s.labelValues(ps)
+	return s, values, ok
+}
+
+// collectors returns the collectors of the series of every schema of the metric
+func (s *labelSchema) collectors() []prometheus.Collector {
+	collectors := []prometheus.Collector{s.collector}
+	for _, previous := range s.previous {
+		var blank []string
+		for _, name := range s.metric.LabelNames {
+			if _, ok := previous.index[name]; !ok {
+				blank = append(blank, name)
+			}
+		}
+		collectors = append(collectors, &blankLabels{collector: previous.collector, names: blank})
+	}
+	return collectors
+}
+
+// grow returns the metric with the labels of the sample added to the schema
+func (s *labelSchema) grow(ps *PromSample) *PromMetric {
+	pm := &PromMetric{
+		Symbol:     s.metric.Symbol,
+		Name:       s.metric.Name,
+		LabelNames: append([]string(nil), s.metric.LabelNames...),
+		export:     s.metric.export,
+	}
+	for _, name := range ps.metric.LabelNames {
+		if _, ok := s.index[name]; !ok {
+			pm.LabelNames = append(pm.LabelNames, name)
+		}
+	}
+	pm.GenerateKey()
+	return pm
+}
+
+// blankLabels collects the series of a collector with empty values for the
+// labels it doesn't know, they are consistent with the series of its metric.
+type blankLabels struct {
+	collector prometheus.Collector
+	names     []string
+}
+
+func (b *blankLabels) Describe(ch chan<- *prometheus.Desc) {}
+
+func (b *blankLabels) Collect(ch chan<- prometheus.Metric) {
+	metrics := make(chan prometheus.Metric)
+	go func() {
+		b.collector.Collect(metrics)
+		close(metrics)
+	}()
+	for metric := range metrics {
+		ch <- &blankLabelsMetric{Metric: metric, names: b.names}
+	}
+}
+
+type blankLabelsMetric struct {
+	prometheus.Metric
+	names []string
+}
+
+func (m *blankLabelsMetric) Write(out *dto.Metric) error {
+	if err := m.Metric.Write(out); err != nil {
+		return err
+	}
+	for _, name := range m.names {
+		name, blank := name, ""
+		out.Label = append(out.Label, &dto.LabelPair{Name: &name, Value: &blank})
+	}
+	sort.Slice(out.Label, func(i, j int) bool { return out.Label[i].GetName() < out.Label[j].GetName() })
+	return nil
+}
+
+// nameGuard reserves a metric name in the registry so that a checked
+// collector can't be registered with the same name, it collects nothing.
+type nameGuard struct {
+	desc *prometheus.Desc
+}
+
+func (g *nameGuard) Describe(ch chan<- *prometheus.Desc) { ch <- g.desc }
+func (g *nameGuard) Collect(ch chan<- prometheus.Metric) {}
+
+// reconciledCollector collects the metrics exported with a union label schema.
+// It is registered unchecked: the registry doesn't allow the label names
+// of a checked collector to change during the life of the program.
+type reconciledCollector struct {
+	sync.RWMutex
+	registry *prometheus.Registry    // where the name guards are registered
+	schemas  map[string]*labelSchema // by metric name
+}
+
+func newReconciledCollector(registry *prometheus.Registry) *reconciledCollector {
+	return &reconciledCollector{registry: registry, schemas: make(map[string]*labelSchema)}
+}
+
+// Describe sends nothing, which makes the collector unchecked
+func (r *reconciledCollector) Describe(ch chan<- *prometheus.Desc) {}
+
+func (r *reconciledCollector) Collect(ch chan<- prometheus.Metric) {
+	r.RLock()
+	collectors := make([]prometheus.Collector, 0, len(r.schemas))
+	for _, schema := range r.schemas {
+		schema.Lock()
+		collectors = append(collectors, schema.collectors()...)
+		schema.Unlock()
+	}
+	r.RUnlock()
+
+	for _, collector := range collectors {
+		collector.Collect(ch)
+	}
+}
+
+// getOrCreate returns the schema of the metric name, it is created from the
+// metric if needed. The boolean is true if the schema has been created.
+func (r *reconciledCollector) getOrCreate(pm *PromMetric, newCollector func(*PromMetric) (prometheus.Collector, error)) (*labelSchema, bool, error) {
+	r.RLock()
+	schema, ok := r.schemas[pm.Name]
+	r.RUnlock()
+	if ok {
+		return schema, false, nil
+	}
+
+	r.Lock()
+	defer r.Unlock()
+	if schema, ok = r.schemas[pm.Name]; ok {
+		return schema, false, nil
+	}
+
+	collector, err := newCollector(pm)
+	if err != nil {
+		return nil, false, errors.Trace(err)
+	}
+	guard := &nameGuard{desc: prometheus.NewDesc(pm.Name, pm.Name, nil, nil)}
+	if err = r.registry.Register(guard); err != nil {
+		return nil, false, errors.Trace(err)
+	}
+
+	schema = newLabelSchema(pm, collector)
+	schema.guard = guard
+	r.schemas[pm.Name] = schema
+	return schema, true, nil
+}
+
+func (r *reconciledCollector) remove(schema *labelSchema) {
+	r.Lock()
+	if r.schemas[schema.metric.Name] == schema {
+		delete(r.schemas, schema.metric.Name)
+	}
+	r.Unlock()
+
+	removed := r.registry.Unregister(schema.guard)
+	logutil.BgLogger().Debug("onRemoval", zap.String("metric", schema.metric.Name), zap.Bool("removed", removed))
+}
+
+// exportReconciled exports the sample into the collector of its metric name.
+// When the sample brings new label names, a collector with the union of the
+// label names is added: the series exported so far keep their values in the
+// previous collectors, with the new labels empty.
+func (e *PromExporter) exportReconciled(ps *PromSample) error {
+	// the cache only tracks the accesses to expire the schemas
+	key := "r|" + ps.metric.Name
+	e.cache.GetIfPresent(key)
+
+	schema, created, err := e.reconciled.getOrCreate(ps.metric, e.newCollector)
+	if err != nil {
+		logutil.BgLogger().Error("exportReconciled: register error", zap.Error(err))
+		tlmLabelConflicts.Inc("register")
+		return errors.Trace(err)
+	}
+	if created {
+		e.cache.Put(key, schema)
+	}
+
+	schema.Lock()
+	defer schema.Unlock()
+
+	if schema.metric.Symbol != ps.metric.Symbol {
+		tlmLabelConflicts.Inc("type")
+		return errors.Trace(fmt.Errorf("exportReconciled: metric %s is exported with symbol %c, not %c",
+			ps.metric.Name, schema.metric.Symbol, ps.metric.Symbol))
+	}
+
+	layer, values, ok := schema.layer(ps)
+	if !ok {
+		pm := schema.grow(ps)
+		collector, err := e.newCollector(pm)
+		if err != nil {
+			tlmLabelConflicts.Inc("schema_grow")
+			return errors.Trace(err)
+		}
+
+		logutil.BgLogger().Info("exportReconciled: label schema changed",
+			zap.String("metric", pm.Name), zap.Strings("labels", pm.LabelNames))
+		tlmLabelSchemaChanges.Inc()
+
+		previous := &labelSchema{metric: schema.metric, index: schema.index, collector: schema.collector}
+		grown := newLabelSchema(pm, collector)
+		schema.metric, schema.index, schema.collector = grown.metric, grown.index, grown.collector
+		schema.previous = append(schema.previous, previous)
+		layer = schema
+		values, _ = schema.labelValues(ps)
+	}
+
+	return e.observe(layer.collector, ps.metric.Name, layer.metric.LabelNames, values, ps)
+}
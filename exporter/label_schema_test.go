@@ -0,0 +1,63 @@
+package exporter
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	. "github.com/frankhang/doppler/config"
+	"github.com/frankhang/doppler/metrics"
+)
+
+func newTestExporter(t *testing.T) *PromExporter {
+	conf := DefaultConf
+	conf.ExportLabelReconciliation = true
+	Cfg = &conf
+
+	e, err := NewPromExporter()
+	require.NoError(t, err)
+	t.Cleanup(e.Stop)
+	return e
+}
+
+// counterValues returns the values of the series of a counter by their labels
+func counterValues(t *testing.T, e *PromExporter, name string) map[string]float64 {
+	families, err := e.Gatherer().Gather()
+	require.NoError(t, err)
+
+	values := make(map[string]float64)
+	for _, mf := range families {
+		if mf.GetName() != name {
+			continue
+		}
+		for _, m := range mf.GetMetric() {
+			labels := ""
+			for _, label := range m.GetLabel() {
+				labels += label.GetName() + "=" + label.GetValue() + ","
+			}
+			values[labels] = m.GetCounter().GetValue()
+		}
+	}
+	return values
+}
+
+func TestLabelSchemaGrowthKeepsSeries(t *testing.T) {
+	e := newTestExporter(t)
+
+	count := func(tags ...string) {
+		require.NoError(t, e.ExportMetricSample(&metrics.MetricSample{
+			Name: "requests", Value: 1, Mtype: metrics.CountType, Tags: tags, SampleRate: 1,
+		}))
+	}
+	count("host:a")
+	count("host:a")
+	// the schema grows with the region label
+	count("host:a", "region:eu")
+	count("host:a")
+
+	assert.Equal(t, map[string]float64{
+		"host=a,region=,":   3,
+		"host=a,region=eu,": 1,
+	}, counterValues(t, e, "requests"))
+}
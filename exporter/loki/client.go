@@ -0,0 +1,280 @@
+package loki
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"github.com/frankhang/util/errors"
+	"github.com/frankhang/util/logutil"
+	"go.uber.org/zap"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/frankhang/doppler/telemetry"
+)
+
+var (
+	tlmEntries = telemetry.NewCounter("loki", "entries",
+		[]string{"client", "state"}, "Count of log lines sent or dropped by the Loki clients")
+	tlmRequests = telemetry.NewCounter("loki", "requests",
+		[]string{"client", "status"}, "Count of Loki push requests by response status")
+	tlmRetries = telemetry.NewCounter("loki", "retries",
+		[]string{"client"}, "Count of Loki push requests retried")
+)
+
+// Options configures a Client
+type Options struct {
+	Name          string // of the client in the telemetry
+	URL           string // of the push API, e.g. http://loki:3100/loki/api/v1/push
+	TenantID      string // sent as X-Scope-OrgID, empty if none
+	Timeout       time.Duration
+	QueueCapacity int // lines are dropped when it is full
+	BatchSize     int // max lines per request
+	BatchWait     time.Duration
+	MaxRetries    int
+	MinBackoff    time.Duration
+	MaxBackoff    time.Duration
+
+	Headers           map[string]string
+	BasicAuthUser     string
+	BasicAuthPassword string
+	BearerToken       string
+}
+
+func (o *Options) setDefaults() {
+	if o.Name == "" {
+		o.Name = "loki"
+	}
+	if o.Timeout <= 0 {
+		o.Timeout = 10 * time.Second
+	}
+	if o.QueueCapacity <= 0 {
+		o.QueueCapacity = 10000
+	}
+	if o.BatchSize <= 0 {
+		o.BatchSize = 1000
+	}
+	if o.BatchWait <= 0 {
+		o.BatchWait = time.Second
+	}
+	if o.MinBackoff <= 0 {
+		o.MinBackoff = 500 * time.Millisecond
+	}
+	if o.MaxBackoff < o.MinBackoff {
+		o.MaxBackoff = o.MinBackoff
+	}
+}
+
+// Entry is a log line of the stream identified by its labels
+type Entry struct {
+	Labels    map[string]string
+	Timestamp time.Time
+	Line      string
+}
+
+// Client pushes log lines to the push API of Loki, in batches of
+// streams. The lines are queued by Send and sent in order by a single
+// goroutine, a batch is retried with an exponential backoff.
+type Client struct {
+	opts   Options
+	pusher *Pusher
+	queue  chan Entry
+
+	stopChan chan struct{}
+	wg       sync.WaitGroup
+}
+
+// NewClient returns an idle Loki client
+func NewClient(opts Options) (*Client, error) {
+	if opts.URL == "" {
+		return nil, errors.Trace(fmt.Errorf("loki: url is required"))
+	}
+	opts.setDefaults()
+
+	return &Client{
+		opts:     opts,
+		pusher:   NewPusher(opts.Name, opts.URL, opts.header(), opts.Timeout),
+		queue:    make(chan Entry, opts.QueueCapacity),
+		stopChan: make(chan struct{}),
+	}, nil
+}
+
+// Start starts sending the queued lines
+func (c *Client) Start() {
+	logutil.BgLogger().Info("loki: starting", zap.String("client", c.opts.Name), zap.String("url", c.opts.URL))
+	c.wg.Add(1)
+	go c.run()
+}
+
+// Stop stops the client, the queued lines are sent without retry
+func (c *Client) Stop() {
+	close(c.stopChan)
+	c.wg.Wait()
+}
+
+// Send queues the line, it returns false if the line is dropped because
+// the queue is full
+func (c *Client) Send(entry Entry) bool {
+	select {
+	case c.queue <- entry:
+		return true
+	default:
+		tlmEntries.Inc(c.opts.Name, "queue_full")
+		return false
+	}
+}
+
+// run batches the queued lines and sends them until the client is stopped
+func (c *Client) run() {
+	defer c.wg.Done()
+
+	batch := make([]Entry, 0, c.opts.BatchSize)
+	timer := time.NewTimer(c.opts.BatchWait)
+	defer timer.Stop()
+
+	flush := func() {
+		if len(batch) > 0 {
+			c.send(batch)
+			batch = batch[:0]
+		}
+	}
+
+	for {
+		select {
+		case <-c.stopChan:
+			for {
+				select {
+				case entry := <-c.queue:
+					batch = append(batch, entry)
+					if len(batch) >= c.opts.BatchSize {
+						flush()
+					}
+				default:
+					flush()
+					return
+				}
+			}
+		case entry := <-c.queue:
+			batch = append(batch, entry)
+			if len(batch) >= c.opts.BatchSize {
+				flush()
+			}
+		case <-timer.C:
+			flush()
+			timer.Reset(c.opts.BatchWait)
+		}
+	}
+}
+
+// pushRequest is the json body of the push API
+type pushRequest struct {
+	Streams []*stream `json:"streams"`
+}
+
+type stream struct {
+	Stream map[string]string `json:"stream"`
+	Values [][2]string       `json:"values"` // unix nanoseconds, line
+}
+
+// streamKey identifies a stream by its labels sorted by name
+func streamKey(labels map[string]string) string {
+	pairs := make([]string, 0, len(labels))
+	for name, value := range labels {
+		pairs = append(pairs, name+"="+value)
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, "\xff")
+}
+
+// Encode returns the json body of the push request of the batch, the lines
+// grouped by stream
+func Encode(batch []Entry) ([]byte, error) {
+	req := pushRequest{}
+	streams := make(map[string]*stream)
+	for _, entry := range batch {
+		key := streamKey(entry.Labels)
+		s, ok := streams[key]
+		if !ok {
+			s = &stream{Stream: entry.Labels}
+			streams[key] = s
+			req.Streams = append(req.Streams, s)
+		}
+		s.Values = append(s.Values, [2]string{strconv.FormatInt(entry.Timestamp.UnixNano(), 10), entry.Line})
+	}
+	return json.Marshal(req)
+}
+
+// send pushes a batch, retrying with an exponential backoff on network
+// errors, 5xx and 429 responses. Other responses drop the batch.
+func (c *Client) send(batch []Entry) {
+	entries := float64(len(batch))
+	body, err := Encode(batch)
+	if err != nil {
+		logutil.BgLogger().Error("loki: unable to encode lines", zap.String("client", c.opts.Name), zap.Error(err))
+		tlmEntries.Add(entries, c.opts.Name, "rejected")
+		return
+	}
+
+	backoff := c.opts.MinBackoff
+	for attempt := 0; ; attempt++ {
+		retryable, err := c.post(body)
+		if err == nil {
+			tlmEntries.Add(entries, c.opts.Name, "sent")
+			return
+		}
+
+		if !retryable {
+			logutil.BgLogger().Error("loki: lines rejected", zap.String("client", c.opts.Name), zap.Int("lines", len(batch)), zap.Error(err))
+			tlmEntries.Add(entries, c.opts.Name, "rejected")
+			return
+		}
+		if attempt >= c.opts.MaxRetries {
+			logutil.BgLogger().Error("loki: too many retries, dropping lines", zap.String("client", c.opts.Name), zap.Int("lines", len(batch)), zap.Error(err))
+			tlmEntries.Add(entries, c.opts.Name, "retries_exhausted")
+			return
+		}
+
+		logutil.BgLogger().Warn("loki: error sending lines, retrying", zap.String("client", c.opts.Name), zap.Duration("backoff", backoff), zap.Error(err))
+		tlmRetries.Inc(c.opts.Name)
+		select {
+		case <-c.stopChan:
+			tlmEntries.Add(entries, c.opts.Name, "stopped")
+			return
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+		if backoff > c.opts.MaxBackoff {
+			backoff = c.opts.MaxBackoff
+		}
+	}
+}
+
+// post sends one request, it returns whether a failed request can be retried
+func (c *Client) post(body []byte) (bool, error) {
+	return c.pusher.Push(context.Background(), body)
+}
+
+// header returns the header of the push requests of the client
+func (o *Options) header() http.Header {
+	header := http.Header{}
+	header.Set("Content-Type", "application/json")
+	header.Set("User-Agent", "doppler")
+	if o.TenantID != "" {
+		header.Set("X-Scope-OrgID", o.TenantID)
+	}
+	for k, v := range o.Headers {
+		header.Set(k, v)
+	}
+	if o.BasicAuthUser != "" {
+		credentials := base64.StdEncoding.EncodeToString([]byte(o.BasicAuthUser + ":" + o.BasicAuthPassword))
+		header.Set("Authorization", "Basic "+credentials)
+	} else if o.BearerToken != "" {
+		header.Set("Authorization", "Bearer "+o.BearerToken)
+	}
+	return header
+}
@@ -0,0 +1,182 @@
+package loki
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// standIn is a Loki push endpoint recording the streams it receives
+type standIn struct {
+	sync.Mutex
+	statuses []int // status of the successive responses, 204 once exhausted
+	requests int
+	streams  []*stream
+	headers  http.Header
+}
+
+func (s *standIn) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.Lock()
+	defer s.Unlock()
+
+	s.requests++
+	s.headers = r.Header
+	if len(s.statuses) > 0 {
+		status := s.statuses[0]
+		s.statuses = s.statuses[1:]
+		if status != http.StatusNoContent {
+			w.WriteHeader(status)
+			return
+		}
+	}
+
+	var req pushRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	s.streams = append(s.streams, req.Streams...)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// received returns the count of requests and the lines received per stream
+func (s *standIn) received() (int, map[string][]string) {
+	s.Lock()
+	defer s.Unlock()
+
+	lines := make(map[string][]string)
+	for _, st := range s.streams {
+		key := streamKey(st.Stream)
+		for _, value := range st.Values {
+			lines[key] = append(lines[key], value[1])
+		}
+	}
+	return s.requests, lines
+}
+
+func newTestClient(t *testing.T, url string, opts Options) *Client {
+	opts.URL = url
+	opts.BatchWait = time.Hour
+	opts.MinBackoff = time.Millisecond
+	opts.MaxBackoff = 2 * time.Millisecond
+	c, err := NewClient(opts)
+	require.NoError(t, err)
+	return c
+}
+
+func testEntries() []Entry {
+	ts := time.Unix(1700000000, 0)
+	return []Entry{
+		{Labels: map[string]string{"kind": "event", "alert_type": "error"}, Timestamp: ts, Line: "a"},
+		{Labels: map[string]string{"kind": "event", "alert_type": "info"}, Timestamp: ts, Line: "b"},
+		{Labels: map[string]string{"alert_type": "error", "kind": "event"}, Timestamp: ts, Line: "c"},
+	}
+}
+
+func TestClientPushesStreams(t *testing.T) {
+	endpoint := &standIn{}
+	srv := httptest.NewServer(endpoint)
+	defer srv.Close()
+
+	c := newTestClient(t, srv.URL, Options{BatchSize: 2, TenantID: "doppler", BearerToken: "secret"})
+	c.Start()
+	for _, entry := range testEntries() {
+		assert.True(t, c.Send(entry))
+	}
+	c.Stop()
+
+	requests, lines := endpoint.received()
+	assert.Equal(t, 2, requests)
+	assert.Equal(t, map[string][]string{
+		"alert_type=error\xffkind=event": {"a", "c"},
+		"alert_type=info\xffkind=event":  {"b"},
+	}, lines)
+	assert.Equal(t, "doppler", endpoint.headers.Get("X-Scope-OrgID"))
+	assert.Equal(t, "Bearer secret", endpoint.headers.Get("Authorization"))
+	assert.Equal(t, "application/json", endpoint.headers.Get("Content-Type"))
+}
+
+func TestClientEncodesTimestamps(t *testing.T) {
+	body, err := Encode(testEntries()[:1])
+	require.NoError(t, err)
+	assert.JSONEq(t, `{"streams":[{"stream":{"kind":"event","alert_type":"error"},"values":[["1700000000000000000","a"]]}]}`, string(body))
+}
+
+func TestEncodeProto(t *testing.T) {
+	body := EncodeProto(testEntries())
+
+	// the streams, as labels and count of entries
+	streams := make(map[string]int)
+	for len(body) > 0 {
+		_, _, n := protowire.ConsumeTag(body)
+		stream, m := protowire.ConsumeBytes(body[n:])
+		require.True(t, m > 0)
+		body = body[n+m:]
+
+		var labels string
+		for len(stream) > 0 {
+			num, _, n := protowire.ConsumeTag(stream)
+			value, m := protowire.ConsumeBytes(stream[n:])
+			require.True(t, m > 0)
+			stream = stream[n+m:]
+			if num == 1 {
+				labels = string(value)
+			} else {
+				streams[labels]++
+			}
+		}
+	}
+	assert.Equal(t, map[string]int{
+		`{alert_type="error", kind="event"}`: 2,
+		`{alert_type="info", kind="event"}`:  1,
+	}, streams)
+}
+
+func TestClientRetries(t *testing.T) {
+	endpoint := &standIn{statuses: []int{http.StatusServiceUnavailable, http.StatusTooManyRequests}}
+	srv := httptest.NewServer(endpoint)
+	defer srv.Close()
+
+	c := newTestClient(t, srv.URL, Options{MaxRetries: 3})
+	c.send(testEntries())
+
+	requests, lines := endpoint.received()
+	assert.Equal(t, 3, requests)
+	assert.Len(t, lines, 2)
+}
+
+func TestClientGivesUp(t *testing.T) {
+	endpoint := &standIn{statuses: []int{http.StatusBadRequest, http.StatusInternalServerError, http.StatusInternalServerError}}
+	srv := httptest.NewServer(endpoint)
+	defer srv.Close()
+
+	// not retried
+	c := newTestClient(t, srv.URL, Options{MaxRetries: 1})
+	c.send(testEntries())
+	requests, _ := endpoint.received()
+	assert.Equal(t, 1, requests)
+
+	// retried once
+	c.send(testEntries())
+	requests, lines := endpoint.received()
+	assert.Equal(t, 3, requests)
+	assert.Len(t, lines, 0)
+}
+
+func TestClientBoundedQueue(t *testing.T) {
+	c := newTestClient(t, "http://127.0.0.1:0", Options{QueueCapacity: 2})
+
+	// the client is not running, the queue fills up
+	for _, entry := range testEntries() {
+		c.Send(entry)
+	}
+	assert.Equal(t, 2, len(c.queue))
+	assert.False(t, c.Send(testEntries()[0]))
+}
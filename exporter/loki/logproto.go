@@ -0,0 +1,87 @@
+package loki
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// The protobuf push request follows the logproto messages of Loki, only the
+// fields doppler sends are implemented:
+//
+//	message PushRequest   { repeated StreamAdapter streams = 1; }
+//	message StreamAdapter { string labels = 1; repeated EntryAdapter entries = 2; }
+//	message EntryAdapter  { google.protobuf.Timestamp timestamp = 1; string line = 2; }
+//	message Timestamp     { int64 seconds = 1; int32 nanos = 2; }
+//
+// The request is sent snappy compressed, as application/x-protobuf.
+
+// EncodeProto returns the protobuf body of the push request of the batch,
+// the lines grouped by stream
+func EncodeProto(batch []Entry) []byte {
+	var keys []string
+	labels := make(map[string]string)
+	entries := make(map[string][]byte)
+	for _, entry := range batch {
+		key := streamKey(entry.Labels)
+		if _, ok := entries[key]; !ok {
+			keys = append(keys, key)
+			labels[key] = labelsString(entry.Labels)
+		}
+		entries[key] = appendEntry(entries[key], entry)
+	}
+
+	var b []byte
+	for _, key := range keys {
+		var sb []byte
+		sb = protowire.AppendTag(sb, 1, protowire.BytesType)
+		sb = protowire.AppendString(sb, labels[key])
+		sb = append(sb, entries[key]...)
+
+		b = protowire.AppendTag(b, 1, protowire.BytesType)
+		b = protowire.AppendBytes(b, sb)
+	}
+	return b
+}
+
+// appendEntry appends the EntryAdapter field of a stream
+func appendEntry(b []byte, entry Entry) []byte {
+	var tb []byte
+	tb = protowire.AppendTag(tb, 1, protowire.VarintType)
+	tb = protowire.AppendVarint(tb, uint64(entry.Timestamp.Unix()))
+	tb = protowire.AppendTag(tb, 2, protowire.VarintType)
+	tb = protowire.AppendVarint(tb, uint64(entry.Timestamp.Nanosecond()))
+
+	var eb []byte
+	eb = protowire.AppendTag(eb, 1, protowire.BytesType)
+	eb = protowire.AppendBytes(eb, tb)
+	eb = protowire.AppendTag(eb, 2, protowire.BytesType)
+	eb = protowire.AppendString(eb, entry.Line)
+
+	b = protowire.AppendTag(b, 2, protowire.BytesType)
+	return protowire.AppendBytes(b, eb)
+}
+
+// labelsString returns the labels written as a selector, e.g. {job="doppler"}
+func labelsString(labels map[string]string) string {
+	names := make([]string, 0, len(labels))
+	for name := range labels {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var b strings.Builder
+	b.WriteByte('{')
+	for i, name := range names {
+		if i > 0 {
+			b.WriteString(", ")
+		}
+		b.WriteString(name)
+		b.WriteByte('=')
+		b.WriteString(strconv.Quote(labels[name]))
+	}
+	b.WriteByte('}')
+	return b.String()
+}
@@ -0,0 +1,65 @@
+package loki
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/frankhang/util/errors"
+)
+
+// Pusher posts the encoded push requests to the push API of Loki. It is
+// shared by the Client and the destinations of the logs agent, the bodies
+// are encoded and compressed by the caller.
+type Pusher struct {
+	name   string
+	url    string
+	header http.Header
+	client *http.Client
+}
+
+// NewPusher returns a pusher to the url, the requests carry the header and
+// are counted in the telemetry of the named client
+func NewPusher(name, url string, header http.Header, timeout time.Duration) *Pusher {
+	return &Pusher{
+		name:   name,
+		url:    url,
+		header: header,
+		client: &http.Client{Timeout: timeout},
+	}
+}
+
+// Push posts the body, it returns whether a failed push can be retried
+func (p *Pusher) Push(ctx context.Context, body []byte) (bool, error) {
+	req, err := http.NewRequest("POST", p.url, bytes.NewReader(body))
+	if err != nil {
+		return false, errors.Trace(err)
+	}
+	for k, v := range p.header {
+		req.Header[k] = v
+	}
+	req = req.WithContext(ctx)
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		tlmRequests.Inc(p.name, "error")
+		return ctx.Err() == nil, errors.Trace(err)
+	}
+	defer resp.Body.Close()
+	tlmRequests.Inc(p.name, strconv.Itoa(resp.StatusCode))
+
+	if resp.StatusCode/100 == 2 {
+		io.Copy(ioutil.Discard, resp.Body)
+		return false, nil
+	}
+
+	msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 512))
+	err = errors.Trace(fmt.Errorf("server returned HTTP status %s: %s", resp.Status, bytes.TrimSpace(msg)))
+	retryable := resp.StatusCode/100 == 5 || resp.StatusCode == http.StatusTooManyRequests
+	return retryable, err
+}
@@ -1,7 +1,11 @@
 package exporter
 
 import (
+	"strings"
+
 	"github.com/frankhang/util/hack"
+
+	"github.com/frankhang/doppler/mapper"
 )
 
 const (
@@ -19,9 +23,19 @@ type PromMetric struct {
 
 	LabelNames []string
 
+	export *mapper.ExportMeta //set by a mapping, nil if none
+
 	//collector prometheus.Collector
 }
 
+// help returns the help text of the metric
+func (pm *PromMetric) help() string {
+	if pm.export != nil && pm.export.Help != "" {
+		return pm.export.Help
+	}
+	return pm.Name
+}
+
 func (pm *PromMetric) GenerateKey() {
 
 	buf := make([]byte, 0, 64)
@@ -41,6 +55,14 @@ func (pm *PromMetric) GenerateKey() {
 	pm.k = hack.String(buf)
 }
 
+// metricNameOfKey returns the metric name of a key generated by GenerateKey
+func metricNameOfKey(key string) string {
+	parts := strings.SplitN(key, "|", 3)
+	if len(parts) < 2 {
+		return ""
+	}
+	return parts[1]
+}
 
 func (pm *PromMetric) String() string {
 	return pm.k
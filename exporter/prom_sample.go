@@ -1,13 +1,16 @@
 package exporter
 
 import (
-	"bytes"
 	"fmt"
+	"github.com/frankhang/doppler/mapper"
 	"github.com/frankhang/doppler/metrics"
 	"github.com/frankhang/doppler/util"
-	"github.com/frankhang/util/hack"
 
 	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	. "github.com/frankhang/doppler/config"
 )
 
 const (
@@ -17,17 +20,43 @@ const (
 type PromSample struct {
 	metric      *PromMetric
 	Value       float64
+	Weight      float64 //number of occurrences the value stands for
 	LableValues []string
+	Exemplar    prometheus.Labels //trace of the value, nil if none
+	Timestamp   int64             //milliseconds since epoch sent by the client, 0 if none
 }
 
 func NewPromSample(s *metrics.MetricSample) *PromSample {
 	pm := &PromMetric{}
-	ps := &PromSample{metric: pm}
+	ps := &PromSample{metric: pm, Weight: 1}
 
 	pm.Symbol = getMetricSymbol(s)
 	pm.Name = normalize(s.Name)
 	ps.Value = s.Value
 
+	// a mapping may choose the prometheus type
+	if pm.export = s.Export; pm.export != nil {
+		switch pm.export.Type {
+		case mapper.ExportTypeGauge:
+			pm.Symbol = GaugeSymbol
+		case mapper.ExportTypeCounter:
+			pm.Symbol = CountSymbol
+		case mapper.ExportTypeHistogram:
+			pm.Symbol = HistogramSymbol
+		case mapper.ExportTypeSummary:
+			pm.Symbol = SummarySymbol
+		}
+	}
+
+	// a sampled counter or histogram value stands for 1/rate occurrences,
+	// a set member is counted once whatever the rate
+	if !Cfg.ExportLegacySampleRate && s.Mtype != metrics.SetType && s.SampleRate > 0 && s.SampleRate < 1 {
+		switch pm.Symbol {
+		case CountSymbol, HistogramSymbol, SummarySymbol:
+			ps.Weight = 1 / s.SampleRate
+		}
+	}
+
 	tags := make([]string, 0, len(s.Tags)+3)
 	tags = append(tags, s.Tags...)
 
@@ -43,7 +72,9 @@ func NewPromSample(s *metrics.MetricSample) *PromSample {
 	if host != "" {
 		tags = append(tags, fmt.Sprintf("_agent_:%s", host))
 	}
-	tags = append(tags, fmt.Sprintf("_rate_:%.3f", s.SampleRate))
+	if Cfg.ExportLegacySampleRate {
+		tags = append(tags, fmt.Sprintf("_rate_:%.3f", s.SampleRate))
+	}
 
 	if len(tags) > 0 {
 		var method, path string
@@ -64,6 +95,15 @@ func NewPromSample(s *metrics.MetricSample) *PromSample {
 			if len(tagName) == 0 {
 				continue
 			}
+			if isExemplarTag(tagName, Cfg.ExportExemplarTags) {
+				if len(tagValue) > 0 {
+					if ps.Exemplar == nil {
+						ps.Exemplar = prometheus.Labels{}
+					}
+					ps.Exemplar[tagName] = tagValue
+				}
+				continue
+			}
 			if len(tagValue) == 0 {
 				tagValue = blankStr
 			}
@@ -82,64 +122,9 @@ func NewPromSample(s *metrics.MetricSample) *PromSample {
 			ps.LableValues = append(ps.LableValues, fmt.Sprintf("%s %s", method, path))
 		}
 	}
-	pm.GenerateKey()
-
-	return ps
-
-}
-
-func NewPromSampleFromServiceCheck(sc *metrics.ServiceCheck) *PromSample {
-	pm := &PromMetric{}
-	ps := &PromSample{metric: pm}
-
-	metricName, labelValue := generateMetricWithLabel(sc.CheckName)
-
-	pm.Symbol = CountSymbol
-	pm.Name = metricName
-	ps.Value = float64(sc.Status)
-
-	switch sc.Status {
-	case metrics.ServiceCheckOK:
-		ps.Value = 1
-	default:
-		//return nil
-		ps.Value = 0
-	}
-
-	tags := make([]string, 0, len(sc.Tags)+2)
-	tags = append(tags, sc.Tags...)
-	tags = append(tags, fmt.Sprintf("_service_:%s", labelValue))
-
-	host := strings.TrimSpace(sc.Host) //host of client
-	if host != "" {
-		tags = append(tags, fmt.Sprintf("hostname:%s", host))
-	}
-
-	if len(tags) > 0 {
-		//sort.Strings(tags)
-		tags = util.SortUniqInPlace(tags)
-		for _, tag := range tags {
-			tagPair := strings.Split(tag, ":")
-			if len(tagPair) != 2 {
-				continue
-			}
-			//tagName := strings.TrimSpace(tagPair[0])
-			tagName := normalize(tagPair[0])
-			tagValue := strings.TrimSpace(tagPair[1])
-			//if len(tagName) == 0 || len(tagValue) == 0 {
-			//	continue
-			//}
-
-			if len(tagName) == 0 {
-				continue
-			}
-			if len(tagValue) == 0 {
-				tagValue = blankStr
-			}
-			pm.LabelNames = append(pm.LabelNames, tagName)
-			ps.LableValues = append(ps.LableValues, tagValue)
-
-		}
+	if ps.Exemplar != nil && !validExemplar(ps.Exemplar) {
+		tlmExemplarsDropped.Inc()
+		ps.Exemplar = nil
 	}
 	pm.GenerateKey()
 
@@ -147,42 +132,6 @@ func NewPromSampleFromServiceCheck(sc *metrics.ServiceCheck) *PromSample {
 
 }
 
-func generateMetricWithLabel(checkName string) (string, string) {
-	s1, s2 := split(checkName)
-
-	if s1 == "datadog" {
-		s1 = "doppler"
-	}
-	if len(s2) == 0 { //only has s1
-		//return fmt.Sprintf("_sc_%s", s1), s1
-		return "_sc_", s1
-	}
-
-	if len(s1) == 0 { //only has s2
-		//return fmt.Sprintf("_sc_%s", s2), s2
-		return "_sc_", s2
-	}
-	//has s1 and s2
-
-	return fmt.Sprintf("_sc_%s", s1), s2
-
-}
-
-func split(s string) (string, string) {
-	s = normalize(s)
-	if len(s) == 0 {
-		return "", ""
-	}
-	cn := hack.Slice(s)
-	i := bytes.IndexByte(cn, '_')
-	if i < 0 {
-		return s, ""
-	}
-
-	return hack.String(cn[:i]), hack.String(cn[i+1:])
-
-}
-
 func normalize(s string) string {
 	t := strings.ReplaceAll(s, ".", "_")
 	return strings.TrimSpace(t)
@@ -0,0 +1,92 @@
+package remotewrite
+
+import (
+	"math"
+	"sort"
+	"strconv"
+
+	dto "github.com/prometheus/client_model/go"
+)
+
+const nameLabel = "__name__"
+
+// toTimeSeries flattens the gathered metric families into series the way
+// Prometheus would have scraped them: histograms and summaries are split
+// into their _bucket/quantile, _sum and _count series.
+// Native histogram buckets are not sent.
+func toTimeSeries(families []*dto.MetricFamily, timestamp int64) []TimeSeries {
+	var series []TimeSeries
+	for _, mf := range families {
+		name := mf.GetName()
+		for _, m := range mf.GetMetric() {
+			ts := timestamp
+			if m.TimestampMs != nil {
+				ts = m.GetTimestampMs()
+			}
+			add := func(suffix string, value float64, extra ...Label) {
+				series = append(series, TimeSeries{
+					Labels:  labels(name+suffix, m.GetLabel(), extra...),
+					Samples: []Sample{{Value: value, Timestamp: ts}},
+				})
+			}
+
+			switch mf.GetType() {
+			case dto.MetricType_COUNTER:
+				add("", m.GetCounter().GetValue())
+			case dto.MetricType_GAUGE:
+				add("", m.GetGauge().GetValue())
+			case dto.MetricType_UNTYPED:
+				add("", m.GetUntyped().GetValue())
+			case dto.MetricType_SUMMARY:
+				s := m.GetSummary()
+				for _, q := range s.GetQuantile() {
+					add("", q.GetValue(), Label{"quantile", formatFloat(q.GetQuantile())})
+				}
+				add("_sum", s.GetSampleSum())
+				add("_count", float64(s.GetSampleCount()))
+			case dto.MetricType_HISTOGRAM, dto.MetricType_GAUGE_HISTOGRAM:
+				h := m.GetHistogram()
+				infSeen := false
+				for _, b := range h.GetBucket() {
+					if math.IsInf(b.GetUpperBound(), +1) {
+						infSeen = true
+					}
+					add("_bucket", float64(b.GetCumulativeCount()), Label{"le", formatFloat(b.GetUpperBound())})
+				}
+				if !infSeen {
+					add("_bucket", float64(h.GetSampleCount()), Label{"le", "+Inf"})
+				}
+				add("_sum", h.GetSampleSum())
+				add("_count", float64(h.GetSampleCount()))
+			}
+		}
+	}
+	return series
+}
+
+// labels returns the sorted labels of a series, including its name
+func labels(name string, pairs []*dto.LabelPair, extra ...Label) []Label {
+	result := make([]Label, 0, len(pairs)+len(extra)+1)
+	result = append(result, Label{nameLabel, name})
+	for _, p := range pairs {
+		// an empty label is the same as a missing one
+		if p.GetValue() == "" {
+			continue
+		}
+		result = append(result, Label{p.GetName(), p.GetValue()})
+	}
+	result = append(result, extra...)
+	sort.Slice(result, func(i, j int) bool { return result[i].Name < result[j].Name })
+	return result
+}
+
+func formatFloat(f float64) string {
+	switch {
+	case math.IsInf(f, +1):
+		return "+Inf"
+	case math.IsInf(f, -1):
+		return "-Inf"
+	default:
+		return strconv.FormatFloat(f, 'g', -1, 64)
+	}
+}
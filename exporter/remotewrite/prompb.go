@@ -0,0 +1,73 @@
+package remotewrite
+
+import (
+	"math"
+
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// The types below follow the prompb messages of the Prometheus remote write
+// protocol (version 0.1.0), only the fields doppler sends are implemented:
+//
+//	message WriteRequest { repeated TimeSeries timeseries = 1; }
+//	message TimeSeries   { repeated Label labels = 1; repeated Sample samples = 2; }
+//	message Label        { string name = 1; string value = 2; }
+//	message Sample       { double value = 1; int64 timestamp = 2; }
+
+// WriteRequest is a batch of time series sent in one request
+type WriteRequest struct {
+	Timeseries []TimeSeries
+}
+
+// TimeSeries is a series identified by its labels, with its samples
+type TimeSeries struct {
+	Labels  []Label
+	Samples []Sample
+}
+
+// Label is a label pair, the metric name is the __name__ label
+type Label struct {
+	Name  string
+	Value string
+}
+
+// Sample is a value at a timestamp in milliseconds
+type Sample struct {
+	Value     float64
+	Timestamp int64
+}
+
+// Marshal returns the protobuf encoding of the request
+func (r *WriteRequest) Marshal() []byte {
+	var b []byte
+	for i := range r.Timeseries {
+		b = protowire.AppendTag(b, 1, protowire.BytesType)
+		b = protowire.AppendBytes(b, r.Timeseries[i].marshal())
+	}
+	return b
+}
+
+func (ts *TimeSeries) marshal() []byte {
+	var b []byte
+	for _, l := range ts.Labels {
+		var lb []byte
+		lb = protowire.AppendTag(lb, 1, protowire.BytesType)
+		lb = protowire.AppendString(lb, l.Name)
+		lb = protowire.AppendTag(lb, 2, protowire.BytesType)
+		lb = protowire.AppendString(lb, l.Value)
+
+		b = protowire.AppendTag(b, 1, protowire.BytesType)
+		b = protowire.AppendBytes(b, lb)
+	}
+	for _, s := range ts.Samples {
+		var sb []byte
+		sb = protowire.AppendTag(sb, 1, protowire.Fixed64Type)
+		sb = protowire.AppendFixed64(sb, math.Float64bits(s.Value))
+		sb = protowire.AppendTag(sb, 2, protowire.VarintType)
+		sb = protowire.AppendVarint(sb, uint64(s.Timestamp))
+
+		b = protowire.AppendTag(b, 2, protowire.BytesType)
+		b = protowire.AppendBytes(b, sb)
+	}
+	return b
+}
@@ -0,0 +1,315 @@
+package remotewrite
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/frankhang/util/errors"
+	"github.com/frankhang/util/logutil"
+	"go.uber.org/zap"
+	"hash/fnv"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/golang/snappy"
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/frankhang/doppler/telemetry"
+)
+
+var (
+	tlmSamples = telemetry.NewCounter("remote_write", "samples",
+		[]string{"state"}, "Count of samples sent or dropped by remote write")
+	tlmRequests = telemetry.NewCounter("remote_write", "requests",
+		[]string{"status"}, "Count of remote write requests by response status")
+	tlmRetries = telemetry.NewCounter("remote_write", "retries",
+		[]string{}, "Count of remote write requests retried")
+	tlmQueueLength = telemetry.NewGauge("remote_write", "queue_length",
+		[]string{}, "Count of series waiting to be sent")
+)
+
+// Options configures a Sender
+type Options struct {
+	URL               string
+	Interval          time.Duration // series are gathered and queued every interval
+	Timeout           time.Duration // of one request
+	Shards            int           // number of concurrent senders
+	QueueCapacity     int           // per shard, series are dropped when it is full
+	MaxSamplesPerSend int
+	BatchSendDeadline time.Duration // max time a series waits in a partial batch
+	MaxRetries        int
+	MinBackoff        time.Duration
+	MaxBackoff        time.Duration
+
+	Headers           map[string]string
+	BasicAuthUser     string
+	BasicAuthPassword string
+	BearerToken       string
+}
+
+func (o *Options) setDefaults() {
+	if o.Interval <= 0 {
+		o.Interval = 15 * time.Second
+	}
+	if o.Timeout <= 0 {
+		o.Timeout = 30 * time.Second
+	}
+	if o.Shards <= 0 {
+		o.Shards = 1
+	}
+	if o.QueueCapacity <= 0 {
+		o.QueueCapacity = 10000
+	}
+	if o.MaxSamplesPerSend <= 0 {
+		o.MaxSamplesPerSend = 2000
+	}
+	if o.BatchSendDeadline <= 0 {
+		o.BatchSendDeadline = 5 * time.Second
+	}
+	if o.MinBackoff <= 0 {
+		o.MinBackoff = 30 * time.Millisecond
+	}
+	if o.MaxBackoff < o.MinBackoff {
+		o.MaxBackoff = o.MinBackoff
+	}
+}
+
+// Sender periodically gathers the exported series and pushes them to a
+// Prometheus remote write endpoint (Cortex, Mimir, VictoriaMetrics...).
+// Series are sharded by their labels, so that the samples of a series are
+// always sent in order by the same shard.
+type Sender struct {
+	opts     Options
+	gatherer prometheus.Gatherer
+	client   *http.Client
+	shards   []*shard
+
+	stopChan chan struct{}
+	wg       sync.WaitGroup
+}
+
+type shard struct {
+	sender *Sender
+	queue  chan TimeSeries
+}
+
+// NewSender returns an idle remote write Sender of the series of gatherer
+func NewSender(gatherer prometheus.Gatherer, opts Options) (*Sender, error) {
+	if opts.URL == "" {
+		return nil, errors.Trace(fmt.Errorf("remote_write: url is required"))
+	}
+	opts.setDefaults()
+
+	s := &Sender{
+		opts:     opts,
+		gatherer: gatherer,
+		client:   &http.Client{Timeout: opts.Timeout},
+		stopChan: make(chan struct{}),
+	}
+	for i := 0; i < opts.Shards; i++ {
+		s.shards = append(s.shards, &shard{
+			sender: s,
+			queue:  make(chan TimeSeries, opts.QueueCapacity),
+		})
+	}
+	return s, nil
+}
+
+// Start starts gathering and sending the series
+func (s *Sender) Start() {
+	logutil.BgLogger().Info("remote_write: starting", zap.String("url", s.opts.URL),
+		zap.Int("shards", len(s.shards)), zap.Duration("interval", s.opts.Interval))
+
+	for _, sh := range s.shards {
+		s.wg.Add(1)
+		go sh.run()
+	}
+
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		ticker := time.NewTicker(s.opts.Interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-s.stopChan:
+				return
+			case <-ticker.C:
+				s.Collect()
+			}
+		}
+	}()
+}
+
+// Stop stops the sender, the queued series are sent without retry
+func (s *Sender) Stop() {
+	close(s.stopChan)
+	s.wg.Wait()
+}
+
+// Collect gathers the series once and queues them
+func (s *Sender) Collect() {
+	families, err := s.gatherer.Gather()
+	if err != nil {
+		// the families gathered without error are still sent
+		logutil.BgLogger().Warn("remote_write: error gathering metrics", zap.Error(err))
+	}
+
+	timestamp := time.Now().UnixNano() / int64(time.Millisecond)
+	dropped := 0
+	for _, ts := range toTimeSeries(families, timestamp) {
+		sh := s.shards[shardOf(ts.Labels, len(s.shards))]
+		select {
+		case sh.queue <- ts:
+		default:
+			dropped++
+		}
+	}
+	if dropped > 0 {
+		logutil.BgLogger().Warn("remote_write: queue full, dropping samples", zap.Int("dropped", dropped))
+		tlmSamples.Add(float64(dropped), "queue_full")
+	}
+
+	queued := 0
+	for _, sh := range s.shards {
+		queued += len(sh.queue)
+	}
+	tlmQueueLength.Set(float64(queued))
+}
+
+// shardOf hashes the labels of a series to pick its shard
+func shardOf(labels []Label, shards int) int {
+	h := fnv.New32a()
+	for _, l := range labels {
+		h.Write([]byte(l.Name))
+		h.Write([]byte{0xff})
+		h.Write([]byte(l.Value))
+		h.Write([]byte{0xff})
+	}
+	return int(h.Sum32() % uint32(shards))
+}
+
+// run batches the queued series and sends them until the sender is stopped
+func (sh *shard) run() {
+	defer sh.sender.wg.Done()
+
+	opts := sh.sender.opts
+	batch := make([]TimeSeries, 0, opts.MaxSamplesPerSend)
+	timer := time.NewTimer(opts.BatchSendDeadline)
+	defer timer.Stop()
+
+	flush := func() {
+		if len(batch) > 0 {
+			sh.sender.send(batch)
+			batch = batch[:0]
+		}
+	}
+
+	for {
+		select {
+		case <-sh.sender.stopChan:
+			for {
+				select {
+				case ts := <-sh.queue:
+					batch = append(batch, ts)
+					if len(batch) >= opts.MaxSamplesPerSend {
+						flush()
+					}
+				default:
+					flush()
+					return
+				}
+			}
+		case ts := <-sh.queue:
+			batch = append(batch, ts)
+			if len(batch) >= opts.MaxSamplesPerSend {
+				flush()
+			}
+		case <-timer.C:
+			flush()
+			timer.Reset(opts.BatchSendDeadline)
+		}
+	}
+}
+
+// send pushes a batch, retrying with an exponential backoff on network
+// errors, 5xx and 429 responses. Other responses drop the batch.
+func (s *Sender) send(batch []TimeSeries) {
+	req := WriteRequest{Timeseries: batch}
+	body := snappy.Encode(nil, req.Marshal())
+	samples := float64(len(batch))
+
+	backoff := s.opts.MinBackoff
+	for attempt := 0; ; attempt++ {
+		retryable, err := s.post(body)
+		if err == nil {
+			tlmSamples.Add(samples, "sent")
+			return
+		}
+
+		if !retryable {
+			logutil.BgLogger().Error("remote_write: samples rejected", zap.Int("samples", len(batch)), zap.Error(err))
+			tlmSamples.Add(samples, "rejected")
+			return
+		}
+		if attempt >= s.opts.MaxRetries {
+			logutil.BgLogger().Error("remote_write: too many retries, dropping samples", zap.Int("samples", len(batch)), zap.Error(err))
+			tlmSamples.Add(samples, "retries_exhausted")
+			return
+		}
+
+		logutil.BgLogger().Warn("remote_write: error sending samples, retrying", zap.Duration("backoff", backoff), zap.Error(err))
+		tlmRetries.Inc()
+		select {
+		case <-s.stopChan:
+			tlmSamples.Add(samples, "stopped")
+			return
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+		if backoff > s.opts.MaxBackoff {
+			backoff = s.opts.MaxBackoff
+		}
+	}
+}
+
+// post sends one request, it returns whether a failed request can be retried
+func (s *Sender) post(body []byte) (bool, error) {
+	req, err := http.NewRequest("POST", s.opts.URL, bytes.NewReader(body))
+	if err != nil {
+		return false, errors.Trace(err)
+	}
+	req.Header.Set("Content-Encoding", "snappy")
+	req.Header.Set("Content-Type", "application/x-protobuf")
+	req.Header.Set("User-Agent", "doppler")
+	req.Header.Set("X-Prometheus-Remote-Write-Version", "0.1.0")
+	for k, v := range s.opts.Headers {
+		req.Header.Set(k, v)
+	}
+	if s.opts.BasicAuthUser != "" {
+		req.SetBasicAuth(s.opts.BasicAuthUser, s.opts.BasicAuthPassword)
+	} else if s.opts.BearerToken != "" {
+		req.Header.Set("Authorization", "Bearer "+s.opts.BearerToken)
+	}
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		tlmRequests.Inc("error")
+		return true, errors.Trace(err)
+	}
+	defer resp.Body.Close()
+	tlmRequests.Inc(strconv.Itoa(resp.StatusCode))
+
+	if resp.StatusCode/100 == 2 {
+		io.Copy(ioutil.Discard, resp.Body)
+		return false, nil
+	}
+
+	msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 512))
+	err = errors.Trace(fmt.Errorf("server returned HTTP status %s: %s", resp.Status, bytes.TrimSpace(msg)))
+	retryable := resp.StatusCode/100 == 5 || resp.StatusCode == http.StatusTooManyRequests
+	return retryable, err
+}
@@ -0,0 +1,207 @@
+package remotewrite
+
+import (
+	"io/ioutil"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/golang/snappy"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// standIn is a remote write endpoint recording the series it receives
+type standIn struct {
+	sync.Mutex
+	statuses []int // status of the successive responses, 204 once exhausted
+	requests int
+	series   []TimeSeries
+	headers  http.Header
+}
+
+func (s *standIn) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.Lock()
+	defer s.Unlock()
+
+	s.requests++
+	s.headers = r.Header
+	if len(s.statuses) > 0 {
+		status := s.statuses[0]
+		s.statuses = s.statuses[1:]
+		if status != http.StatusNoContent {
+			w.WriteHeader(status)
+			return
+		}
+	}
+
+	compressed, _ := ioutil.ReadAll(r.Body)
+	body, err := snappy.Decode(nil, compressed)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	s.series = append(s.series, unmarshalWriteRequest(body)...)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *standIn) received() (int, map[string]float64) {
+	s.Lock()
+	defer s.Unlock()
+
+	values := make(map[string]float64)
+	for _, ts := range s.series {
+		key := ""
+		for _, l := range ts.Labels {
+			key += l.Name + "=" + l.Value + ","
+		}
+		values[key] = ts.Samples[0].Value
+	}
+	return s.requests, values
+}
+
+func unmarshalWriteRequest(b []byte) []TimeSeries {
+	var series []TimeSeries
+	forEachField(b, func(num protowire.Number, v []byte, _ uint64) {
+		var ts TimeSeries
+		forEachField(v, func(num protowire.Number, v []byte, _ uint64) {
+			switch num {
+			case 1:
+				var l Label
+				forEachField(v, func(num protowire.Number, v []byte, _ uint64) {
+					if num == 1 {
+						l.Name = string(v)
+					} else {
+						l.Value = string(v)
+					}
+				})
+				ts.Labels = append(ts.Labels, l)
+			case 2:
+				var s Sample
+				forEachField(v, func(num protowire.Number, _ []byte, n uint64) {
+					if num == 1 {
+						s.Value = math.Float64frombits(n)
+					} else {
+						s.Timestamp = int64(n)
+					}
+				})
+				ts.Samples = append(ts.Samples, s)
+			}
+		})
+		series = append(series, ts)
+	})
+	return series
+}
+
+func forEachField(b []byte, f func(num protowire.Number, v []byte, n uint64)) {
+	for len(b) > 0 {
+		num, typ, l := protowire.ConsumeTag(b)
+		b = b[l:]
+		switch typ {
+		case protowire.BytesType:
+			v, l := protowire.ConsumeBytes(b)
+			f(num, v, 0)
+			b = b[l:]
+		case protowire.Fixed64Type:
+			n, l := protowire.ConsumeFixed64(b)
+			f(num, nil, n)
+			b = b[l:]
+		case protowire.VarintType:
+			n, l := protowire.ConsumeVarint(b)
+			f(num, nil, n)
+			b = b[l:]
+		default:
+			panic("unexpected wire type")
+		}
+	}
+}
+
+func newTestRegistry() *prometheus.Registry {
+	registry := prometheus.NewRegistry()
+	counter := prometheus.NewCounterVec(prometheus.CounterOpts{Name: "requests"}, []string{"path"})
+	counter.WithLabelValues("/a").Add(3)
+	histogram := prometheus.NewHistogram(prometheus.HistogramOpts{Name: "latency", Buckets: []float64{1, 2}})
+	histogram.Observe(1.5)
+	registry.MustRegister(counter, histogram)
+	return registry
+}
+
+func newTestSender(t *testing.T, url string, opts Options) *Sender {
+	opts.URL = url
+	opts.Interval = time.Hour
+	opts.MinBackoff = time.Millisecond
+	opts.MaxBackoff = 2 * time.Millisecond
+	s, err := NewSender(newTestRegistry(), opts)
+	require.NoError(t, err)
+	return s
+}
+
+func TestSenderPushesSeries(t *testing.T) {
+	endpoint := &standIn{}
+	srv := httptest.NewServer(endpoint)
+	defer srv.Close()
+
+	s := newTestSender(t, srv.URL, Options{Shards: 2, BearerToken: "secret"})
+	s.Start()
+	s.Collect()
+	s.Stop()
+
+	_, values := endpoint.received()
+	assert.Equal(t, map[string]float64{
+		"__name__=requests,path=/a,":       3,
+		"__name__=latency_bucket,le=1,":    0,
+		"__name__=latency_bucket,le=2,":    1,
+		"__name__=latency_bucket,le=+Inf,": 1,
+		"__name__=latency_sum,":            1.5,
+		"__name__=latency_count,":          1,
+	}, values)
+	assert.Equal(t, "snappy", endpoint.headers.Get("Content-Encoding"))
+	assert.Equal(t, "0.1.0", endpoint.headers.Get("X-Prometheus-Remote-Write-Version"))
+	assert.Equal(t, "Bearer secret", endpoint.headers.Get("Authorization"))
+}
+
+func TestSenderRetries(t *testing.T) {
+	endpoint := &standIn{statuses: []int{http.StatusServiceUnavailable, http.StatusTooManyRequests}}
+	srv := httptest.NewServer(endpoint)
+	defer srv.Close()
+
+	s := newTestSender(t, srv.URL, Options{MaxRetries: 3})
+	families, err := newTestRegistry().Gather()
+	require.NoError(t, err)
+	s.send(toTimeSeries(families, 0))
+
+	requests, values := endpoint.received()
+	assert.Equal(t, 3, requests)
+	assert.Len(t, values, 6)
+}
+
+func TestSenderGivesUp(t *testing.T) {
+	endpoint := &standIn{statuses: []int{http.StatusBadRequest, http.StatusInternalServerError, http.StatusInternalServerError}}
+	srv := httptest.NewServer(endpoint)
+	defer srv.Close()
+
+	// not retried
+	s := newTestSender(t, srv.URL, Options{MaxRetries: 1})
+	s.send(toTimeSeries(nil, 0))
+	requests, _ := endpoint.received()
+	assert.Equal(t, 1, requests)
+
+	// retried once
+	s.send(toTimeSeries(nil, 0))
+	requests, values := endpoint.received()
+	assert.Equal(t, 3, requests)
+	assert.Len(t, values, 0)
+}
+
+func TestSenderBoundedQueue(t *testing.T) {
+	s := newTestSender(t, "http://127.0.0.1:0", Options{QueueCapacity: 2})
+
+	// the shard is not running, the queue fills up
+	s.Collect()
+	assert.Equal(t, 2, len(s.shards[0].queue))
+}
@@ -0,0 +1,265 @@
+package exporter
+
+import (
+	"fmt"
+	"github.com/frankhang/util/errors"
+	"github.com/frankhang/util/logutil"
+	"go.uber.org/zap"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/frankhang/doppler/telemetry"
+)
+
+const (
+	overflowDrop  = "drop"
+	overflowOther = "other"
+
+	overflowLabelValue = "other"
+)
+
+var (
+	tlmSeriesLimitHits = telemetry.NewCounter("exporter", "series_limit_hits",
+		[]string{"scope", "action"}, "Count of samples of a new series over a series limit")
+	tlmSeries = telemetry.NewGauge("exporter", "series",
+		[]string{}, "Count of series tracked by the exporter")
+	tlmSeriesExpired = telemetry.NewCounter("exporter", "series_expired",
+		[]string{}, "Count of series deleted after their TTL")
+)
+
+// deleter is implemented by every prometheus vec
+type deleter interface {
+	DeleteLabelValues(lvs ...string) bool
+}
+
+// seriesOfMetric holds the series of a metric name, they may belong to
+// several collectors when its label schema grew
+type seriesOfMetric struct {
+	series map[seriesRef]*seriesEntry
+}
+
+// seriesRef identifies a series by its collector and label values
+type seriesRef struct {
+	collector prometheus.Collector
+	key       string
+}
+
+type seriesEntry struct {
+	labelValues []string
+	lastSeen    time.Time
+}
+
+// seriesLimiter caps the number of series of each metric and of the whole
+// exporter, and deletes the series not updated for ttl.
+type seriesLimiter struct {
+	sync.Mutex
+	maxPerMetric int    // 0 means unlimited
+	maxTotal     int    // 0 means unlimited
+	overflow     string // drop or other
+	ttl          time.Duration
+	quit         chan struct{} //closed to stop expiring the series, nil when not expiring
+
+	metrics map[string]*seriesOfMetric // by metric name
+	total   int
+}
+
+// CheckSeriesOverflow returns an error if overflow is not a valid series overflow action
+func CheckSeriesOverflow(overflow string) error {
+	_, err := validOverflow(overflow)
+	return err
+}
+
+func validOverflow(overflow string) (string, error) {
+	switch overflow {
+	case "":
+		return overflowDrop, nil
+	case overflowDrop, overflowOther:
+		return overflow, nil
+	default:
+		return "", errors.Trace(fmt.Errorf("invalid series overflow `%s`, must be `drop` or `other`", overflow))
+	}
+}
+
+func newSeriesLimiter(maxPerMetric, maxTotal int, overflow string, ttl time.Duration) (*seriesLimiter, error) {
+	overflow, err := validOverflow(overflow)
+	if err != nil {
+		return nil, err
+	}
+
+	return &seriesLimiter{
+		maxPerMetric: maxPerMetric,
+		maxTotal:     maxTotal,
+		overflow:     overflow,
+		ttl:          ttl,
+		metrics:      make(map[string]*seriesOfMetric),
+	}, nil
+}
+
+// admit returns the label values under which the sample must be recorded,
+// and false if the sample must be dropped.
+func (l *seriesLimiter) admit(collector prometheus.Collector, name string, labelValues []string) ([]string, bool) {
+	ref := seriesRef{collector: collector, key: strings.Join(labelValues, "\xff")}
+	now := time.Now()
+
+	l.Lock()
+	defer l.Unlock()
+
+	m, ok := l.metrics[name]
+	if !ok {
+		m = &seriesOfMetric{series: make(map[seriesRef]*seriesEntry)}
+		l.metrics[name] = m
+	}
+	if entry, ok := m.series[ref]; ok {
+		entry.lastSeen = now
+		return entry.labelValues, true
+	}
+
+	scope := ""
+	if l.maxPerMetric > 0 && len(m.series) >= l.maxPerMetric {
+		scope = "metric"
+	} else if l.maxTotal > 0 && l.total >= l.maxTotal {
+		scope = "global"
+	}
+
+	if scope != "" {
+		tlmSeriesLimitHits.Inc(scope, l.overflow)
+		if l.overflow == overflowDrop {
+			return nil, false
+		}
+		// aggregate into a single series whose labels are all "other",
+		// it is allowed over the limit
+		labelValues = make([]string, len(labelValues))
+		for i := range labelValues {
+			labelValues[i] = overflowLabelValue
+		}
+		ref.key = strings.Join(labelValues, "\xff")
+		if entry, ok := m.series[ref]; ok {
+			entry.lastSeen = now
+			return entry.labelValues, true
+		}
+	} else {
+		labelValues = append([]string(nil), labelValues...)
+	}
+
+	m.series[ref] = &seriesEntry{labelValues: labelValues, lastSeen: now}
+	l.total++
+	tlmSeries.Inc()
+	return labelValues, true
+}
+
+// forget stops tracking the series of a collector of the metric name that is
+// not exported anymore
+func (l *seriesLimiter) forget(name string, collector prometheus.Collector) {
+	l.Lock()
+	defer l.Unlock()
+
+	m, ok := l.metrics[name]
+	if !ok {
+		return
+	}
+	forgotten := 0
+	for ref := range m.series {
+		if ref.collector == collector {
+			delete(m.series, ref)
+			forgotten++
+		}
+	}
+	if len(m.series) == 0 {
+		delete(l.metrics, name)
+	}
+	l.total -= forgotten
+	tlmSeries.Sub(float64(forgotten))
+}
+
+// setLimits changes the limits at runtime. The series already over the new
+// limits are kept, the new series are refused until enough of them expire.
+func (l *seriesLimiter) setLimits(maxPerMetric, maxTotal int, overflow string, ttl time.Duration, stop chan struct{}) error {
+	overflow, err := validOverflow(overflow)
+	if err != nil {
+		return err
+	}
+
+	l.Lock()
+	defer l.Unlock()
+
+	l.maxPerMetric, l.maxTotal, l.overflow = maxPerMetric, maxTotal, overflow
+	if ttl != l.ttl {
+		l.ttl = ttl
+		l.stopExpiring()
+		l.startExpiring(stop)
+	}
+	return nil
+}
+
+// startExpiring expires the series until stop is closed or the expiration is
+// stopped, if the series have a ttl. Must be called with the lock held
+func (l *seriesLimiter) startExpiring(stop chan struct{}) {
+	if l.ttl <= 0 {
+		return
+	}
+	l.quit = make(chan struct{})
+	go l.run(stop, l.quit, l.ttl)
+}
+
+// stopExpiring must be called with the lock held
+func (l *seriesLimiter) stopExpiring() {
+	if l.quit != nil {
+		close(l.quit)
+		l.quit = nil
+	}
+}
+
+// expire deletes the series not updated since the ttl from their collector
+func (l *seriesLimiter) expire() {
+	expired := 0
+
+	l.Lock()
+	deadline := time.Now().Add(-l.ttl)
+	for name, m := range l.metrics {
+		for ref, entry := range m.series {
+			if entry.lastSeen.After(deadline) {
+				continue
+			}
+			if d, ok := ref.collector.(deleter); ok {
+				d.DeleteLabelValues(entry.labelValues...)
+			}
+			delete(m.series, ref)
+			expired++
+		}
+		if len(m.series) == 0 {
+			delete(l.metrics, name)
+		}
+	}
+	l.total -= expired
+	l.Unlock()
+
+	if expired > 0 {
+		tlmSeries.Sub(float64(expired))
+		tlmSeriesExpired.Add(float64(expired))
+		logutil.BgLogger().Debug("seriesLimiter: expired series", zap.Int("count", expired))
+	}
+}
+
+// run expires the series until stop or quit is closed. Should be called in its own goroutine
+func (l *seriesLimiter) run(stop, quit chan struct{}, ttl time.Duration) {
+	interval := ttl / 2
+	if interval > time.Minute {
+		interval = time.Minute
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-quit:
+			return
+		case <-ticker.C:
+			l.expire()
+		}
+	}
+}
@@ -0,0 +1,135 @@
+package exporter
+
+import (
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/frankhang/doppler/metrics"
+)
+
+// collectedSeries returns the number of series of a collector
+func collectedSeries(collector prometheus.Collector) int {
+	ch := make(chan prometheus.Metric, 100)
+	collector.Collect(ch)
+	close(ch)
+	return len(ch)
+}
+
+func TestSeriesLimiterAdmit(t *testing.T) {
+	for _, tc := range []struct {
+		name         string
+		maxPerMetric int
+		maxTotal     int
+		overflow     string
+		admitted     []string // label value admitted for a, b, c of requests then d of errors, "" if dropped
+	}{
+		{name: "unlimited", admitted: []string{"a", "b", "c", "d"}},
+		{name: "per metric drop", maxPerMetric: 2, admitted: []string{"a", "b", "", "d"}},
+		{name: "per metric other", maxPerMetric: 2, overflow: overflowOther, admitted: []string{"a", "b", "other", "d"}},
+		{name: "global drop", maxTotal: 2, admitted: []string{"a", "b", "", ""}},
+		{name: "global other", maxTotal: 3, overflow: overflowOther, admitted: []string{"a", "b", "c", "other"}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			l, err := newSeriesLimiter(tc.maxPerMetric, tc.maxTotal, tc.overflow, 0)
+			require.NoError(t, err)
+			requests := prometheus.NewCounterVec(prometheus.CounterOpts{Name: "requests"}, []string{"host"})
+			errors := prometheus.NewCounterVec(prometheus.CounterOpts{Name: "errors"}, []string{"host"})
+
+			var admitted []string
+			for i, host := range []string{"a", "b", "c", "d"} {
+				collector, name := prometheus.Collector(requests), "requests"
+				if i == 3 {
+					collector, name = errors, "errors"
+				}
+				labelValues, ok := l.admit(collector, name, []string{host})
+				if !ok {
+					admitted = append(admitted, "")
+					continue
+				}
+				admitted = append(admitted, labelValues[0])
+			}
+			assert.Equal(t, tc.admitted, admitted)
+
+			// a series already admitted is always admitted again
+			labelValues, ok := l.admit(requests, "requests", []string{"a"})
+			assert.True(t, ok)
+			assert.Equal(t, []string{"a"}, labelValues)
+		})
+	}
+
+	_, err := newSeriesLimiter(1, 0, "block", 0)
+	assert.Error(t, err)
+	assert.NoError(t, CheckSeriesOverflow(""))
+	assert.Error(t, CheckSeriesOverflow("block"))
+}
+
+func TestSeriesLimiterCountsByMetricName(t *testing.T) {
+	l, err := newSeriesLimiter(2, 0, overflowDrop, 0)
+	require.NoError(t, err)
+	before := prometheus.NewCounterVec(prometheus.CounterOpts{Name: "requests"}, []string{"host"})
+	grown := prometheus.NewCounterVec(prometheus.CounterOpts{Name: "requests"}, []string{"host", "region"})
+
+	_, ok := l.admit(before, "requests", []string{"a"})
+	assert.True(t, ok)
+	_, ok = l.admit(grown, "requests", []string{"b", "eu"})
+	assert.True(t, ok)
+	// the collector of the grown schema shares the limit of the metric
+	_, ok = l.admit(grown, "requests", []string{"c", "eu"})
+	assert.False(t, ok)
+
+	// forgetting a collector frees its series only
+	l.forget("requests", before)
+	assert.Equal(t, 1, l.total)
+	_, ok = l.admit(grown, "requests", []string{"c", "eu"})
+	assert.True(t, ok)
+	_, ok = l.admit(grown, "requests", []string{"d", "eu"})
+	assert.False(t, ok)
+}
+
+func TestSeriesLimiterExpire(t *testing.T) {
+	l, err := newSeriesLimiter(0, 0, overflowDrop, time.Minute)
+	require.NoError(t, err)
+	requests := prometheus.NewCounterVec(prometheus.CounterOpts{Name: "requests"}, []string{"host"})
+
+	for _, host := range []string{"a", "b"} {
+		labelValues, ok := l.admit(requests, "requests", []string{host})
+		require.True(t, ok)
+		requests.WithLabelValues(labelValues...).Inc()
+	}
+	l.metrics["requests"].series[seriesRef{collector: requests, key: "a"}].lastSeen = time.Now().Add(-2 * time.Minute)
+
+	l.expire()
+	assert.Equal(t, 1, l.total)
+	assert.Equal(t, 1, collectedSeries(requests))
+
+	l.metrics["requests"].series[seriesRef{collector: requests, key: "b"}].lastSeen = time.Now().Add(-2 * time.Minute)
+	l.expire()
+	assert.Equal(t, 0, l.total)
+	assert.Empty(t, l.metrics)
+	assert.Equal(t, 0, collectedSeries(requests))
+}
+
+func TestSeriesLimitSchemaGrowth(t *testing.T) {
+	e := newTestExporter(t)
+	require.NoError(t, e.SetSeriesLimits(2, 0, overflowDrop, 0))
+
+	count := func(tags ...string) {
+		require.NoError(t, e.ExportMetricSample(&metrics.MetricSample{
+			Name: "requests", Value: 1, Mtype: metrics.CountType, Tags: tags, SampleRate: 1,
+		}))
+	}
+	count("host:a")
+	count("host:b")
+	// the growth of the schema doesn't reset the count of the series
+	count("host:c", "region:eu")
+	count("host:a")
+
+	assert.Equal(t, map[string]float64{
+		"host=a,region=,": 2,
+		"host=b,region=,": 1,
+	}, counterValues(t, e, "requests"))
+}
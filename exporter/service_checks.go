@@ -0,0 +1,172 @@
+package exporter
+
+import (
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/model"
+
+	"github.com/frankhang/doppler/metrics"
+	"github.com/frankhang/doppler/telemetry"
+)
+
+const (
+	serviceCheckStatusName     = "dogstatsd_service_check_status"
+	serviceCheckTransitionName = "dogstatsd_service_check_last_transition_timestamp_seconds"
+)
+
+var (
+	tlmServiceChecks = telemetry.NewGauge("exporter", "service_checks",
+		[]string{}, "Count of service checks exported")
+	tlmServiceChecksExpired = telemetry.NewCounter("exporter", "service_checks_expired",
+		[]string{}, "Count of service checks not reported within their ttl")
+)
+
+// serviceCheckState is the last status reported for a check and tag set
+type serviceCheckState struct {
+	status      metrics.ServiceCheckStatus
+	transition  time.Time // when the status last changed
+	seen        time.Time // when the status was last reported
+	labelValues []string
+	statusDesc  *prometheus.Desc
+	transDesc   *prometheus.Desc
+}
+
+// serviceCheckCollector exports a gauge per check and tag set, carrying the
+// status as a label, and the time of the last status change. A check not
+// reported within the ttl is not exported anymore.
+// It is registered unchecked: the tags of the checks differ.
+type serviceCheckCollector struct {
+	sync.Mutex
+	ttl    time.Duration // 0 means never
+	checks map[string]*serviceCheckState
+	guards []*nameGuard
+}
+
+func newServiceCheckCollector(ttl time.Duration) *serviceCheckCollector {
+	return &serviceCheckCollector{
+		ttl:    ttl,
+		checks: make(map[string]*serviceCheckState),
+		guards: []*nameGuard{
+			{desc: prometheus.NewDesc(serviceCheckStatusName, serviceCheckStatusName, nil, nil)},
+			{desc: prometheus.NewDesc(serviceCheckTransitionName, serviceCheckTransitionName, nil, nil)},
+		},
+	}
+}
+
+// register registers the collector, and guards its metric names against the
+// dogstatsd metrics
+func (c *serviceCheckCollector) register(registry *prometheus.Registry) error {
+	for _, guard := range c.guards {
+		if err := registry.Register(guard); err != nil {
+			return err
+		}
+	}
+	return registry.Register(c)
+}
+
+// Describe sends nothing, which makes the collector unchecked
+func (c *serviceCheckCollector) Describe(ch chan<- *prometheus.Desc) {}
+
+func (c *serviceCheckCollector) Collect(ch chan<- prometheus.Metric) {
+	c.Lock()
+	defer c.Unlock()
+
+	now := time.Now()
+	for key, state := range c.checks {
+		if c.ttl > 0 && now.Sub(state.seen) > c.ttl {
+			delete(c.checks, key)
+			tlmServiceChecks.Dec()
+			tlmServiceChecksExpired.Inc()
+			continue
+		}
+		statusValues := append(append(make([]string, 0, len(state.labelValues)+1), state.labelValues...), statusLabel(state.status))
+		ch <- prometheus.MustNewConstMetric(state.statusDesc, prometheus.GaugeValue, 1, statusValues...)
+		ch <- prometheus.MustNewConstMetric(state.transDesc, prometheus.GaugeValue,
+			float64(state.transition.UnixNano())/float64(time.Second), state.labelValues...)
+	}
+}
+
+// update records the status of the service check
+func (c *serviceCheckCollector) update(sc *metrics.ServiceCheck) {
+	tags := make([]string, 0, len(sc.Tags)+1)
+	tags = append(tags, sc.Tags...)
+	if host := strings.TrimSpace(sc.Host); host != "" {
+		tags = append(tags, "hostname:"+host)
+	}
+	labelNames, labelValues := tagLabels(tags, "check", "status")
+	labelNames = append([]string{"check"}, labelNames...)
+	labelValues = append([]string{checkName(sc.CheckName)}, labelValues...)
+
+	ts := time.Now()
+	if sc.Ts > 0 {
+		ts = time.Unix(sc.Ts, 0)
+	}
+	key := seriesKey(serviceCheckStatusName, labelNames, labelValues)
+
+	c.Lock()
+	defer c.Unlock()
+
+	state, ok := c.checks[key]
+	if !ok {
+		state = &serviceCheckState{
+			status:      sc.Status,
+			transition:  ts,
+			labelValues: labelValues,
+			statusDesc: prometheus.NewDesc(serviceCheckStatusName, "Status of the service check, as the status label",
+				append(append(make([]string, 0, len(labelNames)+1), labelNames...), "status"), nil),
+			transDesc: prometheus.NewDesc(serviceCheckTransitionName, "Time of the last status change of the service check",
+				labelNames, nil),
+		}
+		c.checks[key] = state
+		tlmServiceChecks.Inc()
+	} else if state.status != sc.Status {
+		state.status = sc.Status
+		state.transition = ts
+	}
+	state.seen = time.Now()
+}
+
+// tagLabels returns the labels of the tags, the tags which aren't valid
+// label names or which are named like a reserved label are skipped
+func tagLabels(tags []string, reserved ...string) ([]string, []string) {
+	names := make([]string, 0, len(tags))
+	values := make([]string, 0, len(tags))
+	seen := make(map[string]bool, len(tags)+len(reserved))
+	for _, name := range reserved {
+		seen[name] = true
+	}
+	for _, tag := range tags {
+		tagPair := strings.SplitN(tag, ":", 2)
+		if len(tagPair) != 2 {
+			continue
+		}
+		tagName := normalize(tagPair[0])
+		tagValue := strings.TrimSpace(tagPair[1])
+		if seen[tagName] || !model.LabelName(tagName).IsValid() {
+			continue
+		}
+		if len(tagValue) == 0 {
+			tagValue = blankStr
+		}
+		seen[tagName] = true
+		names = append(names, tagName)
+		values = append(values, tagValue)
+	}
+	return names, values
+}
+
+// checkName returns the name of the check, the checks of the agent itself
+// are named after doppler
+func checkName(name string) string {
+	if strings.HasPrefix(name, "datadog.") {
+		return "doppler." + strings.TrimPrefix(name, "datadog.")
+	}
+	return name
+}
+
+func statusLabel(status metrics.ServiceCheckStatus) string {
+	return strings.ToLower(status.String())
+}
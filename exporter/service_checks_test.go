@@ -0,0 +1,107 @@
+package exporter
+
+import (
+	"testing"
+	"time"
+
+	dto "github.com/prometheus/client_model/go"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/frankhang/doppler/metrics"
+)
+
+// gatheredLabels returns the labels of a series as name=value pairs
+func gatheredLabels(m *dto.Metric) map[string]string {
+	labels := make(map[string]string)
+	for _, label := range m.GetLabel() {
+		labels[label.GetName()] = label.GetValue()
+	}
+	return labels
+}
+
+// serviceCheckSeries returns the gathered series of the service checks by name
+func serviceCheckSeries(t *testing.T, e *PromExporter) map[string][]*dto.Metric {
+	families, err := e.Gatherer().Gather()
+	require.NoError(t, err)
+
+	series := make(map[string][]*dto.Metric)
+	for _, mf := range families {
+		if mf.GetName() == serviceCheckStatusName || mf.GetName() == serviceCheckTransitionName {
+			series[mf.GetName()] = mf.GetMetric()
+		}
+	}
+	return series
+}
+
+func TestExportServiceCheck(t *testing.T) {
+	e := newTestExporter(t)
+
+	require.NoError(t, e.ExportServiceCheck(&metrics.ServiceCheck{
+		CheckName: "datadog.agent.up",
+		Host:      " web-1 ",
+		Ts:        1657100430,
+		Status:    metrics.ServiceCheckWarning,
+		Tags:      []string{"env:prod", "check:ignored", "status:ignored", "bad-name:x", "empty:", "flag"},
+	}))
+
+	series := serviceCheckSeries(t, e)
+	require.Len(t, series[serviceCheckStatusName], 1)
+	status := series[serviceCheckStatusName][0]
+	// the reserved and invalid label names are skipped
+	assert.Equal(t, map[string]string{
+		"check":    "doppler.agent.up",
+		"status":   "warning",
+		"env":      "prod",
+		"empty":    blankStr,
+		"hostname": "web-1",
+	}, gatheredLabels(status))
+	assert.Equal(t, 1.0, status.GetGauge().GetValue())
+
+	require.Len(t, series[serviceCheckTransitionName], 1)
+	transition := series[serviceCheckTransitionName][0]
+	assert.NotContains(t, gatheredLabels(transition), "status")
+	assert.Equal(t, 1657100430.0, transition.GetGauge().GetValue())
+}
+
+func TestServiceCheckTransition(t *testing.T) {
+	c := newServiceCheckCollector(0)
+	check := func(status metrics.ServiceCheckStatus, ts int64) *serviceCheckState {
+		c.update(&metrics.ServiceCheck{CheckName: "db", Status: status, Ts: ts})
+		require.Len(t, c.checks, 1)
+		for _, state := range c.checks {
+			return state
+		}
+		return nil
+	}
+
+	state := check(metrics.ServiceCheckOK, 100)
+	assert.Equal(t, time.Unix(100, 0), state.transition)
+	// the same status keeps the time of the transition
+	state = check(metrics.ServiceCheckOK, 200)
+	assert.Equal(t, time.Unix(100, 0), state.transition)
+	state = check(metrics.ServiceCheckCritical, 300)
+	assert.Equal(t, metrics.ServiceCheckCritical, state.status)
+	assert.Equal(t, time.Unix(300, 0), state.transition)
+}
+
+func TestServiceCheckExpiry(t *testing.T) {
+	c := newServiceCheckCollector(time.Minute)
+	c.update(&metrics.ServiceCheck{CheckName: "db", Status: metrics.ServiceCheckOK})
+	c.update(&metrics.ServiceCheck{CheckName: "cache", Status: metrics.ServiceCheckOK})
+	for _, state := range c.checks {
+		if state.labelValues[0] == "db" {
+			state.seen = time.Now().Add(-2 * time.Minute)
+		}
+	}
+
+	// a status and a transition series per check reported within the ttl
+	assert.Equal(t, 2, collectedSeries(c))
+	assert.Len(t, c.checks, 1)
+}
+
+func TestTagLabels(t *testing.T) {
+	names, values := tagLabels([]string{"a:1", "a:2", "b.c:3", "d: ", "e", "0f:4", "g:5:6"}, "g")
+	assert.Equal(t, []string{"a", "b_c", "d"}, names)
+	assert.Equal(t, []string{"1", "3", blankStr}, values)
+}
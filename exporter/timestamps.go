@@ -0,0 +1,98 @@
+package exporter
+
+import (
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	dto "github.com/prometheus/client_model/go"
+)
+
+const keySeparator = "\xff"
+
+// clientTimestamp is the last timestamp sent by a client for a series
+type clientTimestamp struct {
+	ms   int64
+	seen time.Time
+}
+
+// clientTimestamps keeps the timestamps sent by the clients (DogStatsD `|T`
+// field) per series, the series are exposed with them. A series sampled
+// later without timestamp is exposed without timestamp again.
+type clientTimestamps struct {
+	sync.Mutex
+	stamps map[string]clientTimestamp
+	held   int64 //len(stamps), read without the lock
+}
+
+func newClientTimestamps() *clientTimestamps {
+	return &clientTimestamps{stamps: make(map[string]clientTimestamp)}
+}
+
+// seriesKey identifies a series by its metric name and label pairs sorted
+// by name, like the gathered metrics. An empty label is the same as no label.
+func seriesKey(name string, labelNames, labelValues []string) string {
+	pairs := make([]string, 0, len(labelNames))
+	for i, labelName := range labelNames {
+		if i < len(labelValues) && labelValues[i] != "" {
+			pairs = append(pairs, labelName+"="+labelValues[i])
+		}
+	}
+	sort.Strings(pairs)
+	return name + keySeparator + strings.Join(pairs, keySeparator)
+}
+
+// record records the timestamp of the series, 0 clearing it
+func (t *clientTimestamps) record(name string, labelNames, labelValues []string, timestampMs int64) {
+	if timestampMs <= 0 && atomic.LoadInt64(&t.held) == 0 {
+		// most clients send no timestamp, there is nothing to clear
+		return
+	}
+
+	t.Lock()
+	defer t.Unlock()
+
+	if timestampMs <= 0 {
+		delete(t.stamps, seriesKey(name, labelNames, labelValues))
+	} else {
+		t.stamps[seriesKey(name, labelNames, labelValues)] = clientTimestamp{ms: timestampMs, seen: time.Now()}
+	}
+	atomic.StoreInt64(&t.held, int64(len(t.stamps)))
+}
+
+// apply sets the timestamps of the gathered series, and forgets the timestamps
+// of the series recorded before start which are not exported anymore
+func (t *clientTimestamps) apply(families []*dto.MetricFamily, start time.Time) {
+	t.Lock()
+	defer t.Unlock()
+
+	if len(t.stamps) == 0 {
+		return
+	}
+	matched := make(map[string]bool, len(t.stamps))
+	for _, mf := range families {
+		for _, m := range mf.GetMetric() {
+			pairs := make([]string, 0, len(m.GetLabel()))
+			for _, label := range m.GetLabel() {
+				if label.GetValue() != "" {
+					pairs = append(pairs, label.GetName()+"="+label.GetValue())
+				}
+			}
+			sort.Strings(pairs)
+			key := mf.GetName() + keySeparator + strings.Join(pairs, keySeparator)
+			if stamp, ok := t.stamps[key]; ok {
+				ms := stamp.ms
+				m.TimestampMs = &ms
+				matched[key] = true
+			}
+		}
+	}
+	for key, stamp := range t.stamps {
+		if !matched[key] && stamp.seen.Before(start) {
+			delete(t.stamps, key)
+		}
+	}
+	atomic.StoreInt64(&t.held, int64(len(t.stamps)))
+}
@@ -0,0 +1,25 @@
+package exporter
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestClientTimestampsRecord(t *testing.T) {
+	stamps := newClientTimestamps()
+	labelNames := []string{"host"}
+
+	stamps.record("requests", labelNames, []string{"a"}, 0)
+	assert.Empty(t, stamps.stamps)
+
+	stamps.record("requests", labelNames, []string{"a"}, 1657100430000)
+	stamps.record("requests", labelNames, []string{"b"}, 1657100430000)
+	assert.Len(t, stamps.stamps, 2)
+	assert.Equal(t, int64(2), stamps.held)
+
+	// a sample without timestamp clears the timestamp of its series
+	stamps.record("requests", labelNames, []string{"a"}, 0)
+	assert.Len(t, stamps.stamps, 1)
+	assert.Equal(t, int64(1), stamps.held)
+}
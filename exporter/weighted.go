@@ -0,0 +1,511 @@
+package exporter
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/beorn7/perks/quantile"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+const (
+	// nativeZeroThreshold is the width of the zero bucket of the native histograms
+	nativeZeroThreshold = prometheus.DefNativeHistogramZeroThreshold
+	// nativeMinSchema is the lowest resolution of the native histograms
+	nativeMinSchema = -4
+)
+
+// nativeBounds are the upper bounds of the fractions of the native buckets
+// of each positive schema, generated the same way as client_golang's
+var nativeBounds = make([][]float64, 9)
+
+func init() {
+	buckets := 1
+	for i := range nativeBounds {
+		bounds := []float64{0.5}
+		factor := math.Exp2(math.Exp2(float64(-i)))
+		for j := 0; j < buckets-1; j++ {
+			if (j+1)%2 == 0 {
+				// the bound of the previous schema is more precise
+				bounds = append(bounds, nativeBounds[i-1][j/2+1])
+			} else {
+				bounds = append(bounds, bounds[j]*factor)
+			}
+		}
+		buckets *= 2
+		nativeBounds[i] = bounds
+	}
+}
+
+// weightedVec is a histogram or summary vec whose observations carry the
+// number of occurrences they stand for. A sampled or aggregated value is
+// recorded once with its weight, instead of being observed weight times.
+type weightedVec struct {
+	desc      *prometheus.Desc
+	labels    int
+	newSeries func() weightedSeries
+
+	lock     sync.RWMutex
+	children map[string]*weightedMetric
+}
+
+// weightedSeries records the weighted observations of a series
+type weightedSeries interface {
+	observe(value float64, weight uint64, exemplar prometheus.Labels)
+	write(out *dto.Metric)
+}
+
+// weightedMetric is a series of a weightedVec, as collected
+type weightedMetric struct {
+	weightedSeries
+	desc       *prometheus.Desc
+	labelPairs []*dto.LabelPair
+}
+
+func (m *weightedMetric) Desc() *prometheus.Desc {
+	return m.desc
+}
+
+func (m *weightedMetric) Write(out *dto.Metric) error {
+	out.Label = m.labelPairs
+	m.write(out)
+	return nil
+}
+
+func newWeightedVec(name, help string, labelNames []string, newSeries func() weightedSeries) *weightedVec {
+	return &weightedVec{
+		desc:      prometheus.NewDesc(name, help, labelNames, nil),
+		labels:    len(labelNames),
+		newSeries: newSeries,
+		children:  make(map[string]*weightedMetric),
+	}
+}
+
+// newWeightedHistogramVec returns a vec of classic histograms, also native
+// if opts has a NativeHistogramBucketFactor
+func newWeightedHistogramVec(opts prometheus.HistogramOpts, labelNames []string) *weightedVec {
+	upperBounds := opts.Buckets
+	if n := len(upperBounds); n > 0 && math.IsInf(upperBounds[n-1], +1) {
+		// the +Inf bucket is implicit
+		upperBounds = upperBounds[:n-1]
+	}
+	return newWeightedVec(opts.Name, opts.Help, labelNames, func() weightedSeries {
+		h := &weightedHistogram{
+			upperBounds: upperBounds,
+			buckets:     make([]uint64, len(upperBounds)+1),
+			exemplars:   make([]*dto.Exemplar, len(upperBounds)+1),
+			created:     time.Now(),
+		}
+		if opts.NativeHistogramBucketFactor > 1 {
+			h.native = true
+			h.initialSchema = nativeSchema(opts.NativeHistogramBucketFactor)
+			h.schema = h.initialSchema
+			h.maxBuckets = opts.NativeHistogramMaxBucketNumber
+			h.resetAfter = opts.NativeHistogramMinResetDuration
+			h.positive = make(map[int]uint64)
+			h.negative = make(map[int]uint64)
+		}
+		return h
+	})
+}
+
+// newWeightedSummaryVec returns a vec of summaries, the quantiles of
+// opts.Objectives are computed over opts.MaxAge
+func newWeightedSummaryVec(opts prometheus.SummaryOpts, labelNames []string) *weightedVec {
+	var objectives []float64
+	for q := range opts.Objectives {
+		objectives = append(objectives, q)
+	}
+	sort.Float64s(objectives)
+
+	maxAge, ageBuckets, bufCap := opts.MaxAge, opts.AgeBuckets, opts.BufCap
+	if maxAge <= 0 {
+		maxAge = prometheus.DefMaxAge
+	}
+	if ageBuckets == 0 {
+		ageBuckets = prometheus.DefAgeBuckets
+	}
+	if bufCap == 0 {
+		bufCap = prometheus.DefBufCap
+	}
+
+	return newWeightedVec(opts.Name, opts.Help, labelNames, func() weightedSeries {
+		now := time.Now()
+		s := &weightedSummary{
+			objectives:     objectives,
+			streamDuration: maxAge / time.Duration(ageBuckets),
+			bufCap:         int(bufCap),
+			created:        now,
+		}
+		if len(objectives) > 0 {
+			s.streams = make([]*quantile.Stream, ageBuckets)
+			for i := range s.streams {
+				s.streams[i] = quantile.NewTargeted(opts.Objectives)
+			}
+			s.headExpires = now.Add(s.streamDuration)
+		}
+		return s
+	})
+}
+
+func (v *weightedVec) Describe(ch chan<- *prometheus.Desc) {
+	ch <- v.desc
+}
+
+func (v *weightedVec) Collect(ch chan<- prometheus.Metric) {
+	v.lock.RLock()
+	defer v.lock.RUnlock()
+	for _, m := range v.children {
+		ch <- m
+	}
+}
+
+// observe records value weight times in the series of labelValues
+func (v *weightedVec) observe(labelValues []string, value float64, weight uint64, exemplar prometheus.Labels) error {
+	if len(labelValues) != v.labels {
+		return fmt.Errorf("%s: expected %d label values but got %d", v.desc, v.labels, len(labelValues))
+	}
+	key := strings.Join(labelValues, "\xff")
+
+	v.lock.RLock()
+	m, ok := v.children[key]
+	v.lock.RUnlock()
+	if !ok {
+		v.lock.Lock()
+		if m, ok = v.children[key]; !ok {
+			m = &weightedMetric{
+				weightedSeries: v.newSeries(),
+				desc:           v.desc,
+				labelPairs:     prometheus.MakeLabelPairs(v.desc, labelValues),
+			}
+			v.children[key] = m
+		}
+		v.lock.Unlock()
+	}
+
+	if weight > 0 {
+		m.observe(value, weight, exemplar)
+	}
+	return nil
+}
+
+// DeleteLabelValues deletes the series of labelValues, it returns true if it existed
+func (v *weightedVec) DeleteLabelValues(labelValues ...string) bool {
+	key := strings.Join(labelValues, "\xff")
+	v.lock.Lock()
+	defer v.lock.Unlock()
+	if _, ok := v.children[key]; !ok {
+		return false
+	}
+	delete(v.children, key)
+	return true
+}
+
+// weightedHistogram counts the occurrences of the values in classic buckets,
+// and in native buckets if enabled. When the native buckets exceed their max
+// number, the histogram is reset if it is older than resetAfter, otherwise
+// the resolution of its native buckets is halved.
+type weightedHistogram struct {
+	sync.Mutex
+	upperBounds []float64
+	buckets     []uint64        // not cumulative, the last one is +Inf
+	exemplars   []*dto.Exemplar // the last one of each bucket
+	count       uint64
+	sum         float64
+	created     time.Time
+
+	native                bool
+	schema, initialSchema int32
+	maxBuckets            uint32 // 0 means unlimited
+	resetAfter            time.Duration
+	zeroCount             uint64
+	positive, negative    map[int]uint64
+}
+
+func (h *weightedHistogram) observe(value float64, weight uint64, exemplar prometheus.Labels) {
+	h.Lock()
+	defer h.Unlock()
+
+	h.add(value, weight, exemplar)
+	if !h.overflows() {
+		return
+	}
+	if h.resetAfter > 0 && time.Since(h.created) >= h.resetAfter {
+		h.reset()
+		h.add(value, weight, exemplar)
+		return
+	}
+	for h.overflows() && h.schema > nativeMinSchema {
+		h.schema--
+		h.positive = halveResolution(h.positive)
+		h.negative = halveResolution(h.negative)
+	}
+}
+
+func (h *weightedHistogram) add(value float64, weight uint64, exemplar prometheus.Labels) {
+	i := sort.SearchFloat64s(h.upperBounds, value)
+	h.buckets[i] += weight
+	h.count += weight
+	h.sum += value * float64(weight)
+	if exemplar != nil {
+		h.exemplars[i] = newExemplar(value, exemplar)
+	}
+
+	if !h.native || math.IsNaN(value) {
+		return
+	}
+	switch {
+	case value > nativeZeroThreshold:
+		h.positive[nativeKey(value, h.schema)] += weight
+	case value < -nativeZeroThreshold:
+		h.negative[nativeKey(-value, h.schema)] += weight
+	default:
+		h.zeroCount += weight
+	}
+}
+
+// overflows returns whether the native buckets exceed their max number
+func (h *weightedHistogram) overflows() bool {
+	return h.native && h.maxBuckets > 0 && uint32(len(h.positive)+len(h.negative)) > h.maxBuckets
+}
+
+// reset clears the histogram, its native buckets get back their resolution
+func (h *weightedHistogram) reset() {
+	for i := range h.buckets {
+		h.buckets[i] = 0
+		h.exemplars[i] = nil
+	}
+	h.count, h.sum, h.zeroCount = 0, 0, 0
+	h.schema = h.initialSchema
+	h.positive = make(map[int]uint64)
+	h.negative = make(map[int]uint64)
+	h.created = time.Now()
+}
+
+func (h *weightedHistogram) write(out *dto.Metric) {
+	h.Lock()
+	defer h.Unlock()
+
+	his := &dto.Histogram{
+		SampleCount:      proto.Uint64(h.count),
+		SampleSum:        proto.Float64(h.sum),
+		Bucket:           make([]*dto.Bucket, len(h.upperBounds)),
+		CreatedTimestamp: timestamppb.New(h.created),
+	}
+	var cumulative uint64
+	for i, upperBound := range h.upperBounds {
+		cumulative += h.buckets[i]
+		his.Bucket[i] = &dto.Bucket{
+			CumulativeCount: proto.Uint64(cumulative),
+			UpperBound:      proto.Float64(upperBound),
+			Exemplar:        h.exemplars[i],
+		}
+	}
+	// the +Inf bucket is only written to hold its exemplar
+	if e := h.exemplars[len(h.upperBounds)]; e != nil {
+		his.Bucket = append(his.Bucket, &dto.Bucket{
+			CumulativeCount: proto.Uint64(h.count),
+			UpperBound:      proto.Float64(math.Inf(+1)),
+			Exemplar:        e,
+		})
+	}
+	if h.native {
+		his.Schema = proto.Int32(h.schema)
+		his.ZeroThreshold = proto.Float64(nativeZeroThreshold)
+		his.ZeroCount = proto.Uint64(h.zeroCount)
+		his.PositiveSpan, his.PositiveDelta = nativeSpans(h.positive)
+		his.NegativeSpan, his.NegativeDelta = nativeSpans(h.negative)
+	}
+	out.Histogram = his
+}
+
+// nativeSchema returns the schema of the native buckets growing by at most factor
+func nativeSchema(factor float64) int32 {
+	floor := math.Floor(math.Log2(math.Log2(factor)))
+	switch {
+	case floor <= -8:
+		return 8
+	case floor >= -nativeMinSchema:
+		return nativeMinSchema
+	default:
+		return -int32(floor)
+	}
+}
+
+// nativeKey returns the index of the native bucket of the positive value
+func nativeKey(value float64, schema int32) int {
+	inf := math.IsInf(value, +1)
+	if inf {
+		// the bucket above the one of MaxFloat64
+		value = math.MaxFloat64
+	}
+	frac, exp := math.Frexp(value)
+
+	var key int
+	if schema > 0 {
+		bounds := nativeBounds[schema]
+		key = sort.SearchFloat64s(bounds, frac) + (exp-1)*len(bounds)
+	} else {
+		key = exp
+		if frac == 0.5 {
+			key--
+		}
+		offset := (1 << -schema) - 1
+		key = (key + offset) >> -schema
+	}
+	if inf {
+		key++
+	}
+	return key
+}
+
+// halveResolution merges the native buckets by pairs, for the schema below
+func halveResolution(buckets map[int]uint64) map[int]uint64 {
+	merged := make(map[int]uint64, len(buckets)/2+1)
+	for key, count := range buckets {
+		merged[(key+1)>>1] += count
+	}
+	return merged
+}
+
+// nativeSpans returns the spans and the count deltas of the native buckets,
+// gaps of up to two buckets are written as empty buckets
+func nativeSpans(buckets map[int]uint64) ([]*dto.BucketSpan, []int64) {
+	if len(buckets) == 0 {
+		return nil, nil
+	}
+	keys := make([]int, 0, len(buckets))
+	for key := range buckets {
+		keys = append(keys, key)
+	}
+	sort.Ints(keys)
+
+	var spans []*dto.BucketSpan
+	var deltas []int64
+	var previous int64
+	appendDelta := func(count int64) {
+		*spans[len(spans)-1].Length++
+		deltas = append(deltas, count-previous)
+		previous = count
+	}
+
+	next := 0
+	for i, key := range keys {
+		gap := int32(key - next)
+		if i == 0 || gap > 2 {
+			spans = append(spans, &dto.BucketSpan{Offset: proto.Int32(gap), Length: proto.Uint32(0)})
+		} else {
+			for j := int32(0); j < gap; j++ {
+				appendDelta(0)
+			}
+		}
+		appendDelta(int64(buckets[key]))
+		next = key + 1
+	}
+	return spans, deltas
+}
+
+// newExemplar returns the exemplar of value, its labels have been validated
+func newExemplar(value float64, labels prometheus.Labels) *dto.Exemplar {
+	e := &dto.Exemplar{
+		Value:     proto.Float64(value),
+		Timestamp: timestamppb.Now(),
+		Label:     make([]*dto.LabelPair, 0, len(labels)),
+	}
+	for name, v := range labels {
+		e.Label = append(e.Label, &dto.LabelPair{Name: proto.String(name), Value: proto.String(v)})
+	}
+	sort.Slice(e.Label, func(i, j int) bool { return e.Label[i].GetName() < e.Label[j].GetName() })
+	return e
+}
+
+// weightedSummary counts the occurrences of the values, and estimates their
+// quantiles over a sliding window: each stream covers the last maxAge and
+// the oldest one is reset every maxAge/ageBuckets.
+type weightedSummary struct {
+	sync.Mutex
+	objectives []float64 // sorted
+	count      uint64
+	sum        float64
+	created    time.Time
+
+	streams        []*quantile.Stream // nil without objectives
+	head           int                // the stream queried
+	headExpires    time.Time
+	streamDuration time.Duration
+	buffer         quantile.Samples // merged into the streams when full or written
+	bufCap         int
+}
+
+func (s *weightedSummary) observe(value float64, weight uint64, exemplar prometheus.Labels) {
+	s.Lock()
+	defer s.Unlock()
+
+	s.count += weight
+	s.sum += value * float64(weight)
+	if s.streams == nil {
+		return
+	}
+	s.rotate(time.Now())
+	s.buffer = append(s.buffer, quantile.Sample{Value: value, Width: float64(weight)})
+	if len(s.buffer) >= s.bufCap {
+		s.flush()
+	}
+}
+
+// rotate resets the streams expired at now, after the buffered samples are
+// merged into them
+func (s *weightedSummary) rotate(now time.Time) {
+	if !now.After(s.headExpires) {
+		return
+	}
+	s.flush()
+	for now.After(s.headExpires) {
+		s.streams[s.head].Reset()
+		s.head = (s.head + 1) % len(s.streams)
+		s.headExpires = s.headExpires.Add(s.streamDuration)
+	}
+}
+
+// flush merges the buffered samples into the streams
+func (s *weightedSummary) flush() {
+	if len(s.buffer) == 0 {
+		return
+	}
+	for _, stream := range s.streams {
+		stream.Merge(s.buffer)
+	}
+	s.buffer = s.buffer[:0]
+}
+
+func (s *weightedSummary) write(out *dto.Metric) {
+	s.Lock()
+	defer s.Unlock()
+
+	sum := &dto.Summary{
+		SampleCount:      proto.Uint64(s.count),
+		SampleSum:        proto.Float64(s.sum),
+		Quantile:         make([]*dto.Quantile, 0, len(s.objectives)),
+		CreatedTimestamp: timestamppb.New(s.created),
+	}
+	if s.streams != nil {
+		s.rotate(time.Now())
+		s.flush()
+		head := s.streams[s.head]
+		for _, q := range s.objectives {
+			value := math.NaN()
+			if head.Count() > 0 {
+				value = head.Query(q)
+			}
+			sum.Quantile = append(sum.Quantile, &dto.Quantile{Quantile: proto.Float64(q), Value: proto.Float64(value)})
+		}
+	}
+	out.Summary = sum
+}
@@ -0,0 +1,211 @@
+package exporter
+
+import (
+	"math"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/frankhang/doppler/metrics"
+)
+
+// writeSeries returns the series of labelValues of the vec as written
+func writeSeries(t *testing.T, v *weightedVec, labelValues ...string) *dto.Metric {
+	v.lock.RLock()
+	m, ok := v.children[strings.Join(labelValues, "\xff")]
+	v.lock.RUnlock()
+	require.True(t, ok, "no series %v", labelValues)
+
+	out := &dto.Metric{}
+	require.NoError(t, m.Write(out))
+	return out
+}
+
+func TestWeightedHistogram(t *testing.T) {
+	v := newWeightedHistogramVec(prometheus.HistogramOpts{Name: "latency", Help: "latency", Buckets: []float64{1, 5, 10, math.Inf(+1)}}, []string{"host"})
+
+	require.NoError(t, v.observe([]string{"a"}, 0.5, 3, nil))
+	require.NoError(t, v.observe([]string{"a"}, 7, 100000, nil))
+	require.NoError(t, v.observe([]string{"a"}, 20, 2, prometheus.Labels{"trace_id": "abc"}))
+	require.NoError(t, v.observe([]string{"b"}, 1, 0, nil))
+	assert.Error(t, v.observe([]string{"a", "b"}, 1, 1, nil))
+
+	h := writeSeries(t, v, "a").GetHistogram()
+	assert.Equal(t, uint64(100005), h.GetSampleCount())
+	assert.Equal(t, 0.5*3+7*100000+20*2, h.GetSampleSum())
+
+	var bounds []float64
+	var counts []uint64
+	for _, bucket := range h.GetBucket() {
+		bounds = append(bounds, bucket.GetUpperBound())
+		counts = append(counts, bucket.GetCumulativeCount())
+	}
+	// the +Inf bucket is written for its exemplar
+	assert.Equal(t, []float64{1, 5, 10, math.Inf(+1)}, bounds)
+	assert.Equal(t, []uint64{3, 3, 100003, 100005}, counts)
+	exemplar := h.GetBucket()[3].GetExemplar()
+	require.NotNil(t, exemplar)
+	assert.Equal(t, 20.0, exemplar.GetValue())
+	assert.Equal(t, "trace_id", exemplar.GetLabel()[0].GetName())
+	assert.Nil(t, h.Schema)
+
+	// a zero weight creates the series without observation
+	assert.Equal(t, uint64(0), writeSeries(t, v, "b").GetHistogram().GetSampleCount())
+
+	assert.True(t, v.DeleteLabelValues("b"))
+	assert.False(t, v.DeleteLabelValues("b"))
+}
+
+func TestNativeKey(t *testing.T) {
+	for _, tc := range []struct {
+		value  float64
+		schema int32
+		key    int
+	}{
+		{value: 1, schema: 0, key: 0},
+		{value: 2, schema: 0, key: 1},
+		{value: 3, schema: 0, key: 2},
+		{value: 0.3, schema: 0, key: -1},
+		{value: 1, schema: 3, key: 0},
+		{value: 1.1, schema: 3, key: 2},
+		{value: 2, schema: 3, key: 8},
+		{value: 3, schema: -1, key: 1},
+		{value: 4, schema: -1, key: 1},
+		{value: 5, schema: -1, key: 2},
+		{value: math.Inf(+1), schema: 0, key: 1025},
+	} {
+		assert.Equal(t, tc.key, nativeKey(tc.value, tc.schema), "value %v schema %d", tc.value, tc.schema)
+	}
+
+	assert.Equal(t, int32(3), nativeSchema(1.1))
+	assert.Equal(t, int32(8), nativeSchema(1.0001))
+	assert.Equal(t, int32(-4), nativeSchema(1e10))
+}
+
+func TestNativeSpans(t *testing.T) {
+	spans, deltas := nativeSpans(map[int]uint64{0: 1, 1: 2, 4: 1, 10: 3})
+	require.Len(t, spans, 2)
+	assert.Equal(t, int32(0), spans[0].GetOffset())
+	assert.Equal(t, uint32(5), spans[0].GetLength())
+	assert.Equal(t, int32(5), spans[1].GetOffset())
+	assert.Equal(t, uint32(1), spans[1].GetLength())
+	assert.Equal(t, []int64{1, 1, -2, 0, 1, 2}, deltas)
+
+	spans, deltas = nativeSpans(nil)
+	assert.Nil(t, spans)
+	assert.Nil(t, deltas)
+
+	assert.Equal(t, map[int]uint64{0: 3, 1: 7, 2: 5}, halveResolution(map[int]uint64{-1: 1, 0: 2, 1: 3, 2: 4, 3: 5}))
+}
+
+func TestWeightedNativeHistogram(t *testing.T) {
+	opts := prometheus.HistogramOpts{
+		Name:                            "latency",
+		Help:                            "latency",
+		Buckets:                         []float64{1},
+		NativeHistogramBucketFactor:     1.1,
+		NativeHistogramMaxBucketNumber:  2,
+		NativeHistogramMinResetDuration: time.Hour,
+	}
+	v := newWeightedHistogramVec(opts, nil)
+
+	require.NoError(t, v.observe(nil, 1.5, 2, nil))
+	require.NoError(t, v.observe(nil, 0, 1, nil))
+	require.NoError(t, v.observe(nil, -1, 1, nil))
+	h := writeSeries(t, v).GetHistogram()
+	assert.Equal(t, int32(3), h.GetSchema())
+	assert.Equal(t, uint64(1), h.GetZeroCount())
+	assert.Equal(t, []int64{2}, h.GetPositiveDelta())
+	assert.Equal(t, []int64{1}, h.GetNegativeDelta())
+
+	// over the max number of buckets, the resolution is halved
+	require.NoError(t, v.observe(nil, 3, 1, nil))
+	h = writeSeries(t, v).GetHistogram()
+	assert.Equal(t, int32(-1), h.GetSchema())
+	assert.Equal(t, int32(1), h.GetPositiveSpan()[0].GetOffset())
+	assert.Equal(t, []int64{3}, h.GetPositiveDelta())
+	assert.Equal(t, uint64(5), h.GetSampleCount())
+
+	// unless the histogram is old enough to be reset
+	series := v.children[""].weightedSeries.(*weightedHistogram)
+	series.created = time.Now().Add(-2 * time.Hour)
+	require.NoError(t, v.observe(nil, 100, 3, nil))
+	h = writeSeries(t, v).GetHistogram()
+	assert.Equal(t, int32(3), h.GetSchema())
+	assert.Equal(t, uint64(3), h.GetSampleCount())
+	assert.Equal(t, []int64{3}, h.GetPositiveDelta())
+}
+
+func TestWeightedSummary(t *testing.T) {
+	opts := prometheus.SummaryOpts{
+		Name:       "latency",
+		Help:       "latency",
+		Objectives: map[float64]float64{0.5: 0.05, 0.99: 0.001},
+	}
+	v := newWeightedSummaryVec(opts, nil)
+
+	require.NoError(t, v.observe(nil, 1, 99, nil))
+	require.NoError(t, v.observe(nil, 100, 1, nil))
+	s := writeSeries(t, v).GetSummary()
+	assert.Equal(t, uint64(100), s.GetSampleCount())
+	assert.Equal(t, 199.0, s.GetSampleSum())
+	require.Len(t, s.GetQuantile(), 2)
+	assert.Equal(t, 0.5, s.GetQuantile()[0].GetQuantile())
+	assert.Equal(t, 1.0, s.GetQuantile()[0].GetValue())
+
+	// the quantiles are computed over max age
+	series := v.children[""].weightedSeries.(*weightedSummary)
+	series.headExpires = time.Now().Add(-time.Duration(len(series.streams)) * series.streamDuration)
+	s = writeSeries(t, v).GetSummary()
+	assert.Equal(t, uint64(100), s.GetSampleCount())
+	assert.True(t, math.IsNaN(s.GetQuantile()[0].GetValue()))
+
+	// without objectives, only the count and sum are kept
+	v = newWeightedSummaryVec(prometheus.SummaryOpts{Name: "size", Help: "size"}, nil)
+	require.NoError(t, v.observe(nil, 3, 4, nil))
+	s = writeSeries(t, v).GetSummary()
+	assert.Equal(t, uint64(4), s.GetSampleCount())
+	assert.Equal(t, 12.0, s.GetSampleSum())
+	assert.Empty(t, s.GetQuantile())
+}
+
+func TestExportWeightedSampleCount(t *testing.T) {
+	e := newTestExporter(t)
+
+	sample := &metrics.MetricSample{Name: "latency", Value: 3, Mtype: metrics.HistogramType, SampleRate: 1}
+	require.NoError(t, e.ExportWeightedSample(sample, 100000))
+	for i := 0; i < 3; i++ {
+		sampled := &metrics.MetricSample{Name: "latency", Value: 3, Mtype: metrics.HistogramType, SampleRate: 0.3}
+		require.NoError(t, e.ExportMetricSample(sampled))
+	}
+
+	families, err := e.Gatherer().Gather()
+	require.NoError(t, err)
+	var count uint64
+	for _, mf := range families {
+		if mf.GetName() == "latency" {
+			count = mf.GetMetric()[0].GetHistogram().GetSampleCount()
+		}
+	}
+	assert.Equal(t, uint64(100010), count)
+}
+
+func TestExportLowSampleRate(t *testing.T) {
+	e := newTestExporter(t)
+
+	// the weight of a value is not capped however low its rate
+	sample := &metrics.MetricSample{Name: "latency", Value: 3, Mtype: metrics.HistogramType, SampleRate: 0.0001}
+	require.NoError(t, e.ExportMetricSample(sample))
+
+	families, err := e.Gatherer().Gather()
+	require.NoError(t, err)
+	require.Len(t, families, 1)
+	h := families[0].GetMetric()[0].GetHistogram()
+	assert.Equal(t, uint64(10000), h.GetSampleCount())
+	assert.Equal(t, 30000.0, h.GetSampleSum())
+}
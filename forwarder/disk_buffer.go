@@ -0,0 +1,148 @@
+package forwarder
+
+import (
+	"encoding/json"
+	"net/http"
+	"path/filepath"
+	"regexp"
+	"time"
+
+	"github.com/frankhang/util/logutil"
+	"go.uber.org/zap"
+
+	. "github.com/frankhang/doppler/config"
+	"github.com/frankhang/doppler/util/diskqueue"
+)
+
+var unsafePathChars = regexp.MustCompile(`[^A-Za-z0-9.-]+`)
+
+// diskBufferOptions returns the options of the disk queue of the domain, nil
+// if the disk buffer is disabled
+func diskBufferOptions(domain string) *diskqueue.Options {
+	return diskqueue.OptionsFromConfig(Cfg.DiskBuffer, filepath.Join("forwarder", unsafePathChars.ReplaceAllString(domain, "_")))
+}
+
+// diskTransaction is an HTTPTransaction as written to the disk queue
+type diskTransaction struct {
+	Domain     string      `json:"domain"`
+	Endpoint   string      `json:"endpoint"`
+	Headers    http.Header `json:"headers"`
+	Payload    []byte      `json:"payload"`
+	ErrorCount int         `json:"error_count"`
+	CreatedAt  time.Time   `json:"created_at"`
+}
+
+// openDiskQueue opens the disk queue of the forwarder, the transactions
+// are only retried from memory if it can't be opened
+func (f *domainForwarder) openDiskQueue() {
+	if f.diskBuffer == nil {
+		return
+	}
+	queue, err := diskqueue.Open("forwarder_"+filepath.Base(f.diskBuffer.Dir), *f.diskBuffer)
+	if err != nil {
+		logutil.BgLogger().Error("Could not open the disk buffer of the forwarder, the transactions are retried from memory", zap.String("domain", f.domain), zap.Error(err))
+		return
+	}
+	f.diskQueue = queue
+}
+
+// closeDiskQueue writes the transactions of the retry queue to the disk queue,
+// to retry them on the next start, and closes it
+func (f *domainForwarder) closeDiskQueue() {
+	if f.diskQueue == nil {
+		return
+	}
+	for _, t := range f.retryQueue {
+		if !f.bufferTransaction(t) {
+			transactionsDropped.Add(1)
+			tlmTxDropped.Inc(f.domain)
+		}
+	}
+	if err := f.diskQueue.Close(); err != nil {
+		logutil.BgLogger().Warn("Could not close the disk buffer of the forwarder", zap.String("domain", f.domain), zap.Error(err))
+	}
+	f.diskQueue = nil
+}
+
+// bufferTransaction writes the transaction to the disk queue, it returns false
+// if there is none or if the transaction can't be written
+func (f *domainForwarder) bufferTransaction(t Transaction) bool {
+	if f.diskQueue == nil {
+		return false
+	}
+	httpTransaction, ok := t.(*HTTPTransaction)
+	if !ok {
+		return false
+	}
+	dt := diskTransaction{
+		Domain:     httpTransaction.Domain,
+		Endpoint:   httpTransaction.Endpoint,
+		Headers:    httpTransaction.Headers,
+		ErrorCount: httpTransaction.ErrorCount,
+		CreatedAt:  httpTransaction.createdAt,
+	}
+	if httpTransaction.Payload != nil {
+		dt.Payload = *httpTransaction.Payload
+	}
+	payload, err := json.Marshal(dt)
+	if err == nil {
+		err = f.diskQueue.Push(payload)
+	}
+	if err != nil {
+		logutil.BgLogger().Warn("Could not write the transaction to the disk buffer", zap.String("domain", f.domain), zap.Error(err))
+		return false
+	}
+	transactionsBuffered.Add(1)
+	tlmTxBuffered.Inc(f.domain)
+	return true
+}
+
+// retryBufferedTransactions hands the transactions of the disk queue to the
+// workers, oldest first, until the workers are busy or the endpoint of the
+// next one is blocked. A transaction leaves the disk queue once a worker has it.
+func (f *domainForwarder) retryBufferedTransactions() {
+	if f.diskQueue == nil {
+		return
+	}
+	for {
+		payload, err := f.diskQueue.Peek()
+		if err != nil {
+			logutil.BgLogger().Warn("Could not read the disk buffer", zap.String("domain", f.domain), zap.Error(err))
+			return
+		}
+		if payload == nil {
+			return
+		}
+
+		var dt diskTransaction
+		if err := json.Unmarshal(payload, &dt); err != nil {
+			logutil.BgLogger().Warn("Invalid transaction in the disk buffer, dropping it", zap.String("domain", f.domain), zap.Error(err))
+			transactionsDropped.Add(1)
+			tlmTxDropped.Inc(f.domain)
+		} else {
+			t := &HTTPTransaction{
+				Domain:     dt.Domain,
+				Endpoint:   dt.Endpoint,
+				Headers:    dt.Headers,
+				Payload:    &dt.Payload,
+				ErrorCount: dt.ErrorCount,
+				createdAt:  dt.CreatedAt,
+			}
+			if f.blockedList.isBlock(t.GetTarget()) {
+				return
+			}
+			select {
+			case f.lowPrio <- t:
+				transactionsRetried.Add(1)
+				tlmTxRetried.Inc(f.domain)
+			default:
+				return
+			}
+		}
+
+		if err := f.diskQueue.Pop(); err != nil {
+			logutil.BgLogger().Warn("Could not pop the transaction of the disk buffer", zap.String("domain", f.domain), zap.Error(err))
+			return
+		}
+	}
+}
@@ -14,6 +14,7 @@ import (
 	"time"
 
 	"github.com/frankhang/doppler/telemetry"
+	"github.com/frankhang/doppler/util/diskqueue"
 	"github.com/frankhang/util/logutil"
 )
 
@@ -24,6 +25,7 @@ var (
 	transactionsRetried  = expvar.Int{}
 	transactionsDropped  = expvar.Int{}
 	transactionsRequeued = expvar.Int{}
+	transactionsBuffered = expvar.Int{}
 
 	tlmTxRetried = telemetry.NewCounter("transactions", "retries",
 		[]string{"domain"}, "Transaction retry count")
@@ -31,12 +33,15 @@ var (
 		[]string{"domain"}, "Transaction drop count")
 	tlmTxRequeud = telemetry.NewCounter("transactions", "requeud",
 		[]string{"domain"}, "Transaction requeue count")
+	tlmTxBuffered = telemetry.NewCounter("transactions", "buffered_on_disk",
+		[]string{"domain"}, "Count of transactions written to the disk buffer")
 )
 
 func initDomainForwarderExpvars() {
 	transactionsExpvars.Set("Retried", &transactionsRetried)
 	transactionsExpvars.Set("Dropped", &transactionsDropped)
 	transactionsExpvars.Set("Requeued", &transactionsRequeued)
+	transactionsExpvars.Set("BufferedOnDisk", &transactionsBuffered)
 }
 
 // domainForwarder is in charge of sending Transactions to Datadog backend over
@@ -57,6 +62,11 @@ type domainForwarder struct {
 	m                   sync.Mutex // To control Start/Stop races
 
 	blockedList *blockedEndpoints
+
+	// the transactions the retry queue has no room for are written to the
+	// disk queue, if any, and retried from it in order
+	diskBuffer *diskqueue.Options
+	diskQueue  *diskqueue.Queue
 }
 
 func newDomainForwarder(domain string, numberOfWorkers int, retryQueueLimit int) *domainForwarder {
@@ -97,6 +107,16 @@ func (f *domainForwarder) retryTransactions(retryBefore time.Time) {
 				transactionsRetried.Add(1)
 				tlmTxRetried.Inc(f.domain)
 			default:
+				// with a disk buffer, kept to be retried first once the workers have room
+				if len(newQueue) < f.retryQueueLimit && f.diskQueue != nil {
+					newQueue = append(newQueue, t)
+					transactionsRequeued.Add(1)
+					tlmTxRequeud.Inc(f.domain)
+					continue
+				}
+				if f.bufferTransaction(t) {
+					continue
+				}
 				droppedWorkerBusy++
 				transactionsDropped.Add(1)
 				tlmTxDropped.Inc(f.domain)
@@ -105,13 +125,16 @@ func (f *domainForwarder) retryTransactions(retryBefore time.Time) {
 			newQueue = append(newQueue, t)
 			transactionsRequeued.Add(1)
 			tlmTxRequeud.Inc(f.domain)
-		} else {
+		} else if !f.bufferTransaction(t) {
 			droppedRetryQueueFull++
 			transactionsDropped.Add(1)
 			tlmTxDropped.Inc(f.domain)
 		}
 	}
 
+	// the transactions of the disk buffer are retried after the ones in memory
+	f.retryBufferedTransactions()
+
 	f.retryQueue = newQueue
 	transactionsRetryQueueSize.Set(int64(len(f.retryQueue)))
 	tlmTxRetryQueueSize.Set(float64(len(f.retryQueue)), f.domain)
@@ -165,6 +188,7 @@ func (f *domainForwarder) Start() error {
 
 	// reset internal state to purge transactions from past starts
 	f.init()
+	f.openDiskQueue()
 
 	for i := 0; i < f.numberOfWorkers; i++ {
 		w := NewWorker(f.highPrio, f.lowPrio, f.requeuedTransaction, f.blockedList)
@@ -177,7 +201,8 @@ func (f *domainForwarder) Start() error {
 	return nil
 }
 
-// Stop stops a domainForwarder, all transactions not yet flushed will be lost.
+// Stop stops a domainForwarder, all transactions not yet flushed will be lost,
+// but the ones to retry when there is a disk buffer.
 func (f *domainForwarder) Stop(purgeHighPrio bool) {
 	// Lock so we can't start a Forwarder while is stopping
 	f.m.Lock()
@@ -192,6 +217,19 @@ func (f *domainForwarder) Stop(purgeHighPrio bool) {
 	for _, w := range f.workers {
 		w.Stop(purgeHighPrio)
 	}
+	if f.diskQueue != nil {
+		// the transactions the workers failed while stopping are kept too
+	L:
+		for {
+			select {
+			case t := <-f.requeuedTransaction:
+				f.retryQueue = append(f.retryQueue, t)
+			default:
+				break L
+			}
+		}
+		f.closeDiskQueue()
+	}
 	f.workers = []*Worker{}
 	f.retryQueue = []Transaction{}
 	close(f.highPrio)
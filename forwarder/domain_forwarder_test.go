@@ -6,11 +6,15 @@
 package forwarder
 
 import (
+	"io/ioutil"
+	"os"
 	"testing"
 	"time"
 
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+
+	"github.com/frankhang/doppler/util/diskqueue"
 )
 
 func TestNewDomainForwarder(t *testing.T) {
@@ -220,3 +224,99 @@ func TestForwarderRetryLimitQueue(t *testing.T) {
 	// assert that the oldest transaction was dropped
 	assert.Equal(t, transaction2, forwarder.retryQueue[0])
 }
+
+func TestForwarderRetryDiskBuffer(t *testing.T) {
+	dir, err := ioutil.TempDir("", "forwarder")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	forwarder := newDomainForwarder("test", 1, 1)
+	forwarder.init()
+	forwarder.diskBuffer = &diskqueue.Options{Dir: dir}
+	forwarder.openDiskQueue()
+	require.NotNil(t, forwarder.diskQueue)
+	defer forwarder.diskQueue.Close()
+
+	transaction1 := NewHTTPTransaction()
+	transaction1.Domain = "https://blocked"
+	transaction1.Endpoint = "/api/v1/series"
+	transaction1.Headers.Set("Content-Type", "application/json")
+	payload := []byte(`{"series":[]}`)
+	transaction1.Payload = &payload
+	transaction1.ErrorCount = 2
+	transaction2 := NewHTTPTransaction()
+	transaction2.Domain = "https://blocked"
+	transaction2.Endpoint = "/api/v1/check_run"
+	transaction2.createdAt = transaction1.createdAt.Add(time.Minute)
+
+	forwarder.blockedList.close(transaction1.GetTarget())
+	forwarder.blockedList.close(transaction2.GetTarget())
+	forwarder.blockedList.errorPerEndpoint[transaction1.GetTarget()].until = time.Now().Add(1 * time.Minute)
+	forwarder.blockedList.errorPerEndpoint[transaction2.GetTarget()].until = time.Now().Add(1 * time.Minute)
+
+	dropped := transactionsDropped.Value()
+	forwarder.requeueTransaction(transaction1)
+	forwarder.requeueTransaction(transaction2)
+	forwarder.retryTransactions(time.Now())
+
+	// the oldest transaction is written to disk rather than dropped
+	require.Len(t, forwarder.retryQueue, 1)
+	assert.Equal(t, transaction2, forwarder.retryQueue[0])
+	assert.Equal(t, 1, forwarder.diskQueue.Len())
+	assert.Equal(t, dropped, transactionsDropped.Value())
+
+	// and retried after the retry queue once the endpoint is unblocked
+	forwarder.blockedList.errorPerEndpoint[transaction1.GetTarget()].until = time.Now().Add(-1 * time.Minute)
+	forwarder.blockedList.errorPerEndpoint[transaction2.GetTarget()].until = time.Now().Add(-1 * time.Minute)
+	forwarder.retryTransactions(time.Now())
+	assert.Equal(t, transaction2, <-forwarder.lowPrio)
+	assert.Equal(t, 0, forwarder.diskQueue.Len())
+	assert.Len(t, forwarder.retryQueue, 0)
+
+	retried := (<-forwarder.lowPrio).(*HTTPTransaction)
+	assert.Equal(t, transaction1.Domain, retried.Domain)
+	assert.Equal(t, transaction1.Endpoint, retried.Endpoint)
+	assert.Equal(t, transaction1.Headers, retried.Headers)
+	assert.Equal(t, payload, *retried.Payload)
+	assert.Equal(t, 2, retried.ErrorCount)
+	assert.True(t, transaction1.createdAt.Equal(retried.createdAt))
+}
+
+func TestForwarderRetryDiskBufferWorkersBusy(t *testing.T) {
+	dir, err := ioutil.TempDir("", "forwarder")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	forwarder := newDomainForwarder("test", 1, 1)
+	forwarder.init()
+	forwarder.diskBuffer = &diskqueue.Options{Dir: dir}
+	forwarder.openDiskQueue()
+	require.NotNil(t, forwarder.diskQueue)
+	defer forwarder.diskQueue.Close()
+	// no worker is ready
+	forwarder.lowPrio = make(chan Transaction)
+
+	transaction1 := NewHTTPTransaction()
+	transaction1.Domain = "https://busy"
+	transaction1.Endpoint = "/api/v1/series"
+	transaction2 := NewHTTPTransaction()
+	transaction2.Domain = "https://busy"
+	transaction2.Endpoint = "/api/v1/check_run"
+	require.True(t, forwarder.bufferTransaction(transaction1))
+	forwarder.requeueTransaction(transaction2)
+
+	dropped := transactionsDropped.Value()
+	forwarder.retryTransactions(time.Now())
+
+	// the transactions keep their place in the queues
+	require.Len(t, forwarder.retryQueue, 1)
+	assert.Equal(t, transaction2, forwarder.retryQueue[0])
+	assert.Equal(t, 1, forwarder.diskQueue.Len())
+	assert.Equal(t, dropped, transactionsDropped.Value())
+
+	forwarder.lowPrio = make(chan Transaction, 2)
+	forwarder.retryTransactions(time.Now())
+	assert.Equal(t, transaction2, <-forwarder.lowPrio)
+	assert.Equal(t, "/api/v1/series", (<-forwarder.lowPrio).(*HTTPTransaction).Endpoint)
+	assert.Equal(t, 0, forwarder.diskQueue.Len())
+}
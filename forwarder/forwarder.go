@@ -143,7 +143,9 @@ func NewDefaultForwarder(keysPerDomains map[string][]string) *DefaultForwarder {
 			logutil.BgLogger().Error(fmt.Sprintf("No API keys for domain '%s', dropping domain ", domain))
 		} else {
 			f.keysPerDomains[domain] = keys
-			f.domainForwarders[domain] = newDomainForwarder(domain, numWorkers, retryQueueMaxSize)
+			df := newDomainForwarder(domain, numWorkers, retryQueueMaxSize)
+			df.diskBuffer = diskBufferOptions(domain)
+			f.domainForwarders[domain] = df
 		}
 	}
 
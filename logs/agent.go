@@ -12,6 +12,7 @@ import (
 	coreConfig "github.com/frankhang/doppler/config"
 	"github.com/frankhang/doppler/status/health"
 	"github.com/frankhang/doppler/util"
+	"github.com/frankhang/doppler/util/diskqueue"
 	"github.com/frankhang/util/logutil"
 
 	"github.com/frankhang/doppler/logs/auditor"
@@ -23,6 +24,7 @@ import (
 	"github.com/frankhang/doppler/logs/input/listener"
 	"github.com/frankhang/doppler/logs/input/windowsevent"
 	"github.com/frankhang/doppler/logs/pipeline"
+	"github.com/frankhang/doppler/logs/processor"
 	"github.com/frankhang/doppler/logs/restart"
 	"github.com/frankhang/doppler/logs/service"
 )
@@ -43,23 +45,25 @@ type Agent struct {
 }
 
 // NewAgent returns a new Agent
-func NewAgent(sources *config.LogSources, services *service.Services, processingRules []*config.ProcessingRule, endpoints *config.Endpoints) *Agent {
+func NewAgent(sources *config.LogSources, services *service.Services, processingRules []*config.ProcessingRule, endpoints *config.Endpoints, metricSink *processor.MetricSink) *Agent {
 	health := health.Register("logs-agent")
 
 	// setup the auditor
 	// We pass the health handle to the auditor because it's the end of the pipeline and the most
 	// critical part. Arguably it could also be plugged to the destination.
-	auditor := auditor.New(coreConfig.Datadog.GetString("logs_config.run_path"), health)
+	auditor := auditor.New(coreConfig.Cfg.Logs.RunPath, health)
 	destinationsCtx := client.NewDestinationsContext()
 
 	// setup the pipeline provider that provides pairs of processor and sender
-	pipelineProvider := pipeline.NewProvider(config.NumberOfPipelines, auditor, processingRules, endpoints, destinationsCtx)
+	// the payloads are written ahead to the disk buffer, if enabled
+	diskBuffer := diskqueue.OptionsFromConfig(coreConfig.Cfg.DiskBuffer, "logs")
+	pipelineProvider := pipeline.NewProvider(config.NumberOfPipelines, auditor, processingRules, endpoints, destinationsCtx, metricSink, diskBuffer)
 
 	// setup the inputs
 	inputs := []restart.Restartable{
-		file.NewScanner(sources, coreConfig.Datadog.GetInt("logs_config.open_files_limit"), pipelineProvider, auditor, file.DefaultSleepDuration),
-		container.NewLauncher(coreConfig.Datadog.GetBool("logs_config.container_collect_all"), coreConfig.Datadog.GetBool("logs_config.k8s_container_use_file"), sources, services, pipelineProvider, auditor),
-		listener.NewLauncher(sources, coreConfig.Datadog.GetInt("logs_config.frame_size"), pipelineProvider),
+		file.NewScanner(sources, coreConfig.Cfg.Logs.OpenFilesLimit, pipelineProvider, auditor, file.DefaultSleepDuration),
+		container.NewLauncher(coreConfig.Cfg.Logs.ContainerCollectAll, coreConfig.Cfg.Logs.K8sContainerUseFile, sources, services, pipelineProvider, auditor),
+		listener.NewLauncher(sources, coreConfig.Cfg.Logs.FrameSize, pipelineProvider),
 		journald.NewLauncher(sources, pipelineProvider, auditor),
 		windowsevent.NewLauncher(sources, pipelineProvider),
 	}
@@ -107,7 +111,7 @@ func (a *Agent) Stop() {
 		stopper.Stop()
 		close(c)
 	}()
-	timeout := time.Duration(coreConfig.Datadog.GetInt("logs_config.stop_grace_period")) * time.Second
+	timeout := time.Duration(coreConfig.Cfg.Logs.StopGracePeriod) * time.Second
 	select {
 	case <-c:
 	case <-time.After(timeout):
@@ -34,7 +34,7 @@ type AgentTestSuite struct {
 }
 
 func (suite *AgentTestSuite) SetupTest() {
-	mockConfig := coreConfig.Mock()
+	coreConfig.Mock()
 
 	var err error
 
@@ -56,13 +56,15 @@ func (suite *AgentTestSuite) SetupTest() {
 	}
 	suite.source = config.NewLogSource("", &logConfig)
 
-	mockConfig.Set("logs_config.run_path", suite.testDir)
+	conf := coreConfig.DefaultConf
+	conf.Logs.RunPath = suite.testDir
 	// Shorter grace period for tests.
-	mockConfig.Set("logs_config.stop_grace_period", 1)
+	conf.Logs.StopGracePeriod = 1
+	coreConfig.Cfg = &conf
 }
 
 func (suite *AgentTestSuite) TearDownTest() {
-	os.Remove(suite.testDir)
+	os.RemoveAll(suite.testDir)
 
 	// Resets the metrics we check.
 	metrics.LogsDecoded.Set(0)
@@ -78,7 +80,7 @@ func createAgent(endpoints *config.Endpoints) (*Agent, *config.LogSources, *serv
 	services := service.NewServices()
 
 	// setup and start the agent
-	agent = NewAgent(sources, services, nil, endpoints)
+	agent = NewAgent(sources, services, nil, endpoints, nil)
 	return agent, sources, services
 }
 
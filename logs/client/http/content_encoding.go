@@ -8,6 +8,8 @@ package http
 import (
 	"bytes"
 	"compress/gzip"
+
+	"github.com/golang/snappy"
 )
 
 // ContentEncoding encodes the payload
@@ -71,3 +73,16 @@ func (c *GzipContentEncoding) encode(payload []byte) ([]byte, error) {
 	}
 	return compressedPayload.Bytes(), nil
 }
+
+// SnappyContentEncoding encodes the payload using the snappy block format
+var SnappyContentEncoding ContentEncoding = &snappyContentEncoding{}
+
+type snappyContentEncoding struct{}
+
+func (c *snappyContentEncoding) name() string {
+	return "snappy"
+}
+
+func (c *snappyContentEncoding) encode(payload []byte) ([]byte, error) {
+	return snappy.Encode(nil, payload), nil
+}
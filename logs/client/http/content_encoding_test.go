@@ -10,6 +10,7 @@ import (
 	"compress/gzip"
 	"testing"
 
+	"github.com/golang/snappy"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -56,3 +57,16 @@ func decompress(payload []byte) ([]byte, error) {
 
 	return buffer.Bytes(), nil
 }
+
+func TestSnappyContentEncoding(t *testing.T) {
+	payload := []byte("my payload")
+
+	encodedPayload, err := SnappyContentEncoding.encode(payload)
+	assert.Nil(t, err)
+
+	decodedPayload, err := snappy.Decode(nil, encodedPayload)
+	assert.Nil(t, err)
+
+	assert.Equal(t, payload, decodedPayload)
+	assert.Equal(t, "snappy", SnappyContentEncoding.name())
+}
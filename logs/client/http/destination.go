@@ -33,6 +33,7 @@ type Destination struct {
 	url                 string
 	contentType         string
 	contentEncoding     ContentEncoding
+	headers             map[string]string // an empty value removes the header
 	client              *http.Client
 	destinationsContext *client.DestinationsContext
 	once                sync.Once
@@ -75,6 +76,13 @@ func (d *Destination) Send(payload []byte) error {
 	}
 	req.Header.Set("Content-Type", d.contentType)
 	req.Header.Set("Content-Encoding", d.contentEncoding.name())
+	for key, value := range d.headers {
+		if value == "" {
+			req.Header.Del(key)
+		} else {
+			req.Header.Set(key, value)
+		}
+	}
 	req = req.WithContext(ctx)
 
 	resp, err := d.client.Do(req)
@@ -94,9 +102,9 @@ func (d *Destination) Send(payload []byte) error {
 		return err
 	}
 
-	if resp.StatusCode >= 500 {
+	if resp.StatusCode >= 500 || resp.StatusCode == http.StatusTooManyRequests {
 		// the server could not serve the request,
-		// most likely because of an internal error
+		// most likely because of an internal error or a rate limit
 		return client.NewRetryableError(errServer)
 	} else if resp.StatusCode >= 400 {
 		// the logs-agent is likely to be misconfigured,
@@ -0,0 +1,192 @@
+package http
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/frankhang/doppler/exporter/loki"
+	"github.com/frankhang/doppler/logs/client"
+	"github.com/frankhang/doppler/logs/config"
+	"github.com/frankhang/doppler/logs/message"
+	"github.com/frankhang/doppler/logs/metrics"
+)
+
+// ProtobufContentType is the content type of the snappy compressed push requests of Loki
+const ProtobufContentType = "application/x-protobuf"
+
+// LokiDestination pushes the payloads serialized by the LokiSerializer of
+// the endpoint to the push API of Loki, with the pusher of the Loki clients.
+type LokiDestination struct {
+	pusher              *loki.Pusher
+	contentEncoding     ContentEncoding
+	destinationsContext *client.DestinationsContext
+	once                sync.Once
+	payloadChan         chan []byte
+}
+
+// NewLokiDestination returns a new LokiDestination. The snappy compressed
+// payloads are sent in protobuf, the others in json.
+func NewLokiDestination(endpoint config.Endpoint, destinationsContext *client.DestinationsContext) *LokiDestination {
+	header := http.Header{}
+	header.Set("Content-Type", JSONContentType)
+	header.Set("User-Agent", "doppler")
+	var contentEncoding ContentEncoding = IdentityContentType
+	switch {
+	case !endpoint.UseCompression:
+		// loki rejects the identity encoding, the header is not sent
+	case endpoint.Compression == "snappy":
+		header.Set("Content-Type", ProtobufContentType)
+		contentEncoding = SnappyContentEncoding
+	default:
+		contentEncoding = NewGzipContentEncoding(endpoint.CompressionLevel)
+	}
+	if endpoint.UseCompression {
+		header.Set("Content-Encoding", contentEncoding.name())
+	}
+	if endpoint.TenantID != "" {
+		header.Set("X-Scope-OrgID", endpoint.TenantID)
+	}
+	for key, value := range endpoint.Headers {
+		header.Set(key, value)
+	}
+
+	return &LokiDestination{
+		pusher:              loki.NewPusher("logs", endpoint.URL, header, time.Second*10),
+		contentEncoding:     contentEncoding,
+		destinationsContext: destinationsContext,
+	}
+}
+
+// Send pushes a payload to Loki,
+// the error returned can be retryable and it is the responsibility of the callee to retry.
+func (d *LokiDestination) Send(payload []byte) error {
+	ctx := d.destinationsContext.Context()
+
+	encodedPayload, err := d.contentEncoding.encode(payload)
+	if err != nil {
+		return err
+	}
+	metrics.BytesSent.Add(int64(len(payload)))
+	metrics.EncodedBytesSent.Add(int64(len(encodedPayload)))
+
+	retryable, err := d.pusher.Push(ctx, encodedPayload)
+	switch {
+	case err == nil:
+		return nil
+	case ctx.Err() == context.Canceled:
+		return ctx.Err()
+	case retryable:
+		return client.NewRetryableError(err)
+	default:
+		return err
+	}
+}
+
+// SendAsync sends a payload in background.
+func (d *LokiDestination) SendAsync(payload []byte) {
+	d.once.Do(func() {
+		payloadChan := make(chan []byte, config.ChanSize)
+		d.sendInBackground(payloadChan)
+		d.payloadChan = payloadChan
+	})
+	d.payloadChan <- payload
+}
+
+// sendInBackground sends all payloads from payloadChan in background.
+func (d *LokiDestination) sendInBackground(payloadChan chan []byte) {
+	ctx := d.destinationsContext.Context()
+	go func() {
+		for {
+			select {
+			case payload := <-payloadChan:
+				d.Send(payload)
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+}
+
+// LokiSerializer transforms a batch of messages into a push request of Loki.
+// A message is a line of the stream labeled by the source, the service and
+// the status of the message, the labels of the endpoint and the tags of the
+// message written key:value.
+type LokiSerializer struct {
+	labels map[string]string
+	proto  bool
+}
+
+// NewLokiSerializer returns the serializer of the payloads sent to the endpoint.
+func NewLokiSerializer(endpoint config.Endpoint) *LokiSerializer {
+	return &LokiSerializer{
+		labels: endpoint.Labels,
+		proto:  endpoint.UseCompression && endpoint.Compression == "snappy",
+	}
+}
+
+// Serialize returns the push request of the messages. The lines are
+// timestamped with the time of the batch, a nanosecond apart to keep
+// them in order.
+func (s *LokiSerializer) Serialize(messages []*message.Message) []byte {
+	now := time.Now()
+	batch := make([]loki.Entry, 0, len(messages))
+	for i, msg := range messages {
+		batch = append(batch, loki.Entry{
+			Labels:    s.streamLabels(msg),
+			Timestamp: now.Add(time.Duration(i)),
+			Line:      string(msg.Content),
+		})
+	}
+	if s.proto {
+		return loki.EncodeProto(batch)
+	}
+	// the entries are strings only, they can't fail to marshal
+	payload, _ := loki.Encode(batch)
+	return payload
+}
+
+// streamLabels returns the labels of the stream of the message, the tags
+// named like a label already set are skipped
+func (s *LokiSerializer) streamLabels(msg *message.Message) map[string]string {
+	labels := map[string]string{
+		"job":    "doppler",
+		"kind":   "log",
+		"status": msg.GetStatus(),
+	}
+	if source := msg.Origin.Source(); source != "" {
+		labels["source"] = source
+	}
+	if service := msg.Origin.Service(); service != "" {
+		labels["service"] = service
+	}
+	for name, value := range s.labels {
+		labels[name] = value
+	}
+
+	for _, tag := range msg.Origin.Tags() {
+		pair := strings.SplitN(tag, ":", 2)
+		if len(pair) != 2 || pair[0] == "" || pair[1] == "" {
+			continue
+		}
+		name := labelName(pair[0])
+		if _, ok := labels[name]; !ok {
+			labels[name] = pair[1]
+		}
+	}
+	return labels
+}
+
+// labelName returns the tag key as a valid label name, the invalid
+// characters are replaced by underscores
+func labelName(key string) string {
+	name := []byte(key)
+	for i, c := range name {
+		if !(c == '_' || 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || i > 0 && '0' <= c && c <= '9') {
+			name[i] = '_'
+		}
+	}
+	return string(name)
+}
@@ -0,0 +1,129 @@
+package http
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/golang/snappy"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/frankhang/doppler/logs/client"
+	"github.com/frankhang/doppler/logs/config"
+	"github.com/frankhang/doppler/logs/message"
+)
+
+type lokiPush struct {
+	Streams []struct {
+		Stream map[string]string `json:"stream"`
+		Values [][2]string       `json:"values"`
+	} `json:"streams"`
+}
+
+func newLokiMessage(content string, status string, tags ...string) *message.Message {
+	source := config.NewLogSource("app", &config.LogsConfig{
+		Type:    config.FileType,
+		Service: "api",
+		Source:  "nginx",
+		Tags:    tags,
+	})
+	msg := message.NewMessageWithSource([]byte(content), status, source)
+	msg.Origin.SetTags([]string{"kube.namespace:prod", "ignored"})
+	return msg
+}
+
+func TestLokiSerializerLabels(t *testing.T) {
+	serializer := NewLokiSerializer(config.Endpoint{Labels: map[string]string{"host": "host1", "cluster": "eu"}})
+
+	payload := serializer.Serialize([]*message.Message{
+		newLokiMessage("a", message.StatusInfo, "env:prod", "job:ignored"),
+		newLokiMessage("b", message.StatusError, "env:prod"),
+		newLokiMessage("c", message.StatusInfo, "env:prod"),
+	})
+
+	var push lokiPush
+	require.NoError(t, json.Unmarshal(payload, &push))
+	require.Len(t, push.Streams, 2)
+
+	assert.Equal(t, map[string]string{
+		"job":            "doppler",
+		"kind":           "log",
+		"host":           "host1",
+		"status":         "info",
+		"source":         "nginx",
+		"service":        "api",
+		"cluster":        "eu",
+		"env":            "prod",
+		"kube_namespace": "prod",
+	}, push.Streams[0].Stream)
+	assert.Equal(t, "error", push.Streams[1].Stream["status"])
+
+	values := push.Streams[0].Values
+	require.Len(t, values, 2)
+	assert.Equal(t, "a", values[0][1])
+	assert.Equal(t, "c", values[1][1])
+	assert.True(t, values[0][0] < values[1][0])
+}
+
+func TestLokiDestinationSend(t *testing.T) {
+	var headers http.Header
+	var body []byte
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		headers = r.Header
+		body, _ = ioutil.ReadAll(r.Body)
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer ts.Close()
+
+	destCtx := client.NewDestinationsContext()
+	destCtx.Start()
+	defer destCtx.Stop()
+
+	endpoint := config.Endpoint{URL: ts.URL, TenantID: "doppler", UseCompression: true, Compression: "gzip"}
+	payload := NewLokiSerializer(endpoint).Serialize([]*message.Message{newLokiMessage("a", message.StatusInfo)})
+	assert.Nil(t, NewLokiDestination(endpoint, destCtx).Send(payload))
+	assert.Equal(t, "doppler", headers.Get("X-Scope-OrgID"))
+	assert.Equal(t, "gzip", headers.Get("Content-Encoding"))
+	assert.Equal(t, JSONContentType, headers.Get("Content-Type"))
+	decompressed, err := decompress(body)
+	require.NoError(t, err)
+	assert.Equal(t, payload, decompressed)
+
+	endpoint = config.Endpoint{URL: ts.URL, UseCompression: true, Compression: "snappy"}
+	payload = NewLokiSerializer(endpoint).Serialize([]*message.Message{newLokiMessage("a", message.StatusInfo)})
+	assert.Nil(t, NewLokiDestination(endpoint, destCtx).Send(payload))
+	assert.Equal(t, ProtobufContentType, headers.Get("Content-Type"))
+	decoded, err := snappy.Decode(nil, body)
+	require.NoError(t, err)
+	assert.Equal(t, payload, decoded)
+
+	endpoint = config.Endpoint{URL: ts.URL}
+	assert.Nil(t, NewLokiDestination(endpoint, destCtx).Send([]byte(`{"streams":[]}`)))
+	assert.Equal(t, "", headers.Get("Content-Encoding"))
+	assert.Equal(t, `{"streams":[]}`, string(body))
+}
+
+func TestLokiDestinationRetries(t *testing.T) {
+	status := http.StatusTooManyRequests
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(status)
+	}))
+	defer ts.Close()
+
+	destCtx := client.NewDestinationsContext()
+	destCtx.Start()
+	defer destCtx.Stop()
+	destination := NewLokiDestination(config.Endpoint{URL: ts.URL}, destCtx)
+
+	err := destination.Send([]byte("{}"))
+	_, ok := err.(*client.RetryableError)
+	assert.True(t, ok)
+
+	status = http.StatusBadRequest
+	err = destination.Send([]byte("{}"))
+	_, ok = err.(*client.RetryableError)
+	assert.False(t, ok)
+}
@@ -0,0 +1,245 @@
+package kafka
+
+import (
+	"context"
+	"errors"
+	"sync"
+
+	"github.com/Shopify/sarama"
+
+	"github.com/frankhang/doppler/logs/client"
+	"github.com/frankhang/doppler/logs/config"
+	"github.com/frankhang/doppler/logs/metrics"
+)
+
+// errNotKafka is returned when the endpoint is not a topic of kafka.
+var errNotKafka = errors.New("not a kafka endpoint")
+
+// permanentErrors are the errors of the brokers the records would fail with
+// again, they are dropped instead of retried.
+var permanentErrors = map[sarama.KError]bool{
+	sarama.ErrMessageSizeTooLarge:      true,
+	sarama.ErrMessageSetSizeTooLarge:   true,
+	sarama.ErrInvalidMessage:           true,
+	sarama.ErrTopicAuthorizationFailed: true,
+	sarama.ErrInvalidTopic:             true,
+}
+
+// Destination produces the payloads to a topic of Kafka. The producer
+// connects to the brokers on the first payload and is closed with the
+// destinations context.
+type Destination struct {
+	brokers             []string
+	topic               string
+	batched             bool
+	config              *sarama.Config
+	configErr           error
+	destinationsContext *client.DestinationsContext
+	mutex               sync.Mutex
+	producer            sarama.SyncProducer
+	once                sync.Once
+	payloadChan         chan []byte
+}
+
+// NewDestination returns a new Destination. When batched, the payloads are
+// the batches of records of the Serializer, otherwise a payload is produced
+// as a single record without key, which is how the payloads of the other
+// endpoints are produced when the destination is an additional one.
+func NewDestination(endpoint config.Endpoint, batched bool, destinationsContext *client.DestinationsContext) *Destination {
+	d := &Destination{
+		batched:             batched,
+		destinationsContext: destinationsContext,
+	}
+	if endpoint.Kafka == nil {
+		d.configErr = errNotKafka
+		return d
+	}
+	d.brokers = endpoint.Kafka.Brokers
+	d.topic = endpoint.Kafka.Topic
+	d.config, d.configErr = newConfig(endpoint)
+	return d
+}
+
+// Send produces the records of a payload and waits for their acks,
+// the error returned can be retryable and it is the responsibility of the callee to retry.
+// A batch is produced again as a whole when some of its records fail.
+func (d *Destination) Send(payload []byte) error {
+	if d.configErr != nil {
+		return d.configErr
+	}
+	ctx := d.destinationsContext.Context()
+
+	var messages []*sarama.ProducerMessage
+	if d.batched {
+		var err error
+		if messages, err = decodeRecords(d.topic, payload); err != nil {
+			return err
+		}
+	} else {
+		messages = []*sarama.ProducerMessage{{Topic: d.topic, Value: sarama.ByteEncoder(payload)}}
+	}
+	if len(messages) == 0 {
+		return nil
+	}
+
+	metrics.BytesSent.Add(int64(len(payload)))
+	metrics.EncodedBytesSent.Add(int64(len(payload)))
+
+	err := d.produce(ctx, messages)
+	if err == nil {
+		return nil
+	}
+	if ctx.Err() == context.Canceled {
+		return ctx.Err()
+	}
+	if isPermanent(err) {
+		// the records are rejected by the brokers, most likely because
+		// they are too large or the topic is misconfigured.
+		return err
+	}
+	// most likely a network error or a change of leader, the callee should retry.
+	return client.NewRetryableError(err)
+}
+
+// SendAsync sends a payload in background.
+func (d *Destination) SendAsync(payload []byte) {
+	d.once.Do(func() {
+		payloadChan := make(chan []byte, config.ChanSize)
+		d.sendInBackground(payloadChan)
+		d.payloadChan = payloadChan
+	})
+	d.payloadChan <- payload
+}
+
+// sendInBackground sends all payloads from payloadChan in background.
+func (d *Destination) sendInBackground(payloadChan chan []byte) {
+	ctx := d.destinationsContext.Context()
+	go func() {
+		for {
+			select {
+			case payload := <-payloadChan:
+				d.Send(payload)
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+}
+
+// produce sends the messages with the producer, which is created if needed,
+// a single batch is in flight at a time.
+func (d *Destination) produce(ctx context.Context, messages []*sarama.ProducerMessage) error {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	if d.producer == nil {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		producer, err := sarama.NewSyncProducer(d.brokers, d.config)
+		if err != nil {
+			return err
+		}
+		d.producer = producer
+		go d.closeOnDone(ctx)
+	}
+	return d.producer.SendMessages(messages)
+}
+
+// closeOnDone closes the producer once the context is done, after the batch
+// in flight if any.
+func (d *Destination) closeOnDone(ctx context.Context) {
+	<-ctx.Done()
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	if d.producer != nil {
+		d.producer.Close()
+		d.producer = nil
+	}
+}
+
+// isPermanent returns true if all the records failed with a permanent error.
+func isPermanent(err error) bool {
+	if kerr, ok := err.(sarama.KError); ok {
+		return permanentErrors[kerr]
+	}
+	producerErrors, ok := err.(sarama.ProducerErrors)
+	if !ok || len(producerErrors) == 0 {
+		return false
+	}
+	for _, producerError := range producerErrors {
+		if kerr, ok := producerError.Err.(sarama.KError); !ok || !permanentErrors[kerr] {
+			return false
+		}
+	}
+	return true
+}
+
+// newConfig returns the config of the producer of the endpoint.
+func newConfig(endpoint config.Endpoint) (*sarama.Config, error) {
+	kafka := endpoint.Kafka
+	c := sarama.NewConfig()
+	if kafka.ClientID != "" {
+		c.ClientID = kafka.ClientID
+	}
+	if kafka.Version != "" {
+		version, err := sarama.ParseKafkaVersion(kafka.Version)
+		if err != nil {
+			return nil, err
+		}
+		c.Version = version
+	}
+	if kafka.Timeout > 0 {
+		c.Net.DialTimeout = kafka.Timeout
+		c.Net.ReadTimeout = kafka.Timeout
+		c.Net.WriteTimeout = kafka.Timeout
+		c.Producer.Timeout = kafka.Timeout
+	}
+	// only the metadata of the topic is needed
+	c.Metadata.Full = false
+	c.Producer.Return.Successes = true
+
+	switch kafka.Acks {
+	case "none":
+		c.Producer.RequiredAcks = sarama.NoResponse
+	case "leader":
+		c.Producer.RequiredAcks = sarama.WaitForLocal
+	default:
+		c.Producer.RequiredAcks = sarama.WaitForAll
+	}
+
+	if endpoint.UseCompression {
+		switch endpoint.Compression {
+		case "gzip":
+			c.Producer.Compression = sarama.CompressionGZIP
+		case "snappy":
+			c.Producer.Compression = sarama.CompressionSnappy
+		case "lz4":
+			c.Producer.Compression = sarama.CompressionLZ4
+		case "zstd":
+			c.Producer.Compression = sarama.CompressionZSTD
+		}
+		if endpoint.CompressionLevel != 0 {
+			c.Producer.CompressionLevel = endpoint.CompressionLevel
+		}
+	}
+
+	if kafka.TLS != nil {
+		c.Net.TLS.Enable = true
+		c.Net.TLS.Config = kafka.TLS
+	}
+
+	if kafka.SASLMechanism != "" {
+		c.Net.SASL.Enable = true
+		c.Net.SASL.Mechanism = sarama.SASLMechanism(kafka.SASLMechanism)
+		c.Net.SASL.User = kafka.SASLUsername
+		c.Net.SASL.Password = kafka.SASLPassword
+		switch c.Net.SASL.Mechanism {
+		case sarama.SASLTypeSCRAMSHA256:
+			c.Net.SASL.SCRAMClientGeneratorFunc = func() sarama.SCRAMClient { return &scramClient{hashGenerator: scramSHA256} }
+		case sarama.SASLTypeSCRAMSHA512:
+			c.Net.SASL.SCRAMClientGeneratorFunc = func() sarama.SCRAMClient { return &scramClient{hashGenerator: scramSHA512} }
+		}
+	}
+
+	return c, c.Validate()
+}
@@ -0,0 +1,209 @@
+package kafka
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/frankhang/doppler/logs/client"
+	"github.com/frankhang/doppler/logs/config"
+	"github.com/frankhang/doppler/logs/message"
+)
+
+// newMockBroker returns a broker leading the two partitions of the logs topic,
+// answering the produce requests with the response
+func newMockBroker(t *testing.T, produceResponse *sarama.MockProduceResponse) *sarama.MockBroker {
+	broker := sarama.NewMockBroker(t, 1)
+	broker.SetHandlerByMap(map[string]sarama.MockResponse{
+		"MetadataRequest": sarama.NewMockMetadataResponse(t).
+			SetBroker(broker.Addr(), broker.BrokerID()).
+			SetLeader("logs", 0, broker.BrokerID()).
+			SetLeader("logs", 1, broker.BrokerID()),
+		"ProduceRequest": produceResponse,
+	})
+	return broker
+}
+
+// newProduceResponse returns the response to the produce requests of the
+// version of kafka 1.0.0, the default of the producer
+func newProduceResponse(t *testing.T) *sarama.MockProduceResponse {
+	return sarama.NewMockProduceResponse(t).SetVersion(3)
+}
+
+func newTestEndpoint(broker *sarama.MockBroker, acks string) config.Endpoint {
+	return config.Endpoint{
+		UseCompression: true,
+		Compression:    "snappy",
+		Kafka: &config.KafkaEndpoint{
+			Brokers:     []string{broker.Addr()},
+			Topic:       "logs",
+			PartitionBy: "source",
+			Acks:        acks,
+			Timeout:     time.Second,
+		},
+	}
+}
+
+func produceRequests(broker *sarama.MockBroker) []*sarama.ProduceRequest {
+	var requests []*sarama.ProduceRequest
+	for _, rr := range broker.History() {
+		if request, ok := rr.Request.(*sarama.ProduceRequest); ok {
+			requests = append(requests, request)
+		}
+	}
+	return requests
+}
+
+func TestDestinationSend(t *testing.T) {
+	broker := newMockBroker(t, newProduceResponse(t))
+	defer broker.Close()
+
+	destinationsContext := client.NewDestinationsContext()
+	destinationsContext.Start()
+	defer destinationsContext.Stop()
+
+	endpoint := newTestEndpoint(broker, "all")
+	destination := NewDestination(endpoint, true, destinationsContext)
+	payload := NewSerializer(endpoint).Serialize([]*message.Message{newKafkaMessage("a"), newKafkaMessage("b")})
+	assert.Nil(t, destination.Send(payload))
+	assert.Nil(t, destination.Send(payload))
+
+	// the producer may split a batch in several requests
+	requests := produceRequests(broker)
+	require.NotEmpty(t, requests)
+	assert.Equal(t, sarama.WaitForAll, requests[0].RequiredAcks)
+
+	// an empty batch is not produced
+	assert.Nil(t, destination.Send(nil))
+	assert.Len(t, produceRequests(broker), len(requests))
+}
+
+func TestDestinationSendUnbatched(t *testing.T) {
+	broker := newMockBroker(t, newProduceResponse(t))
+	defer broker.Close()
+
+	destinationsContext := client.NewDestinationsContext()
+	destinationsContext.Start()
+	defer destinationsContext.Stop()
+
+	destination := NewDestination(newTestEndpoint(broker, "leader"), false, destinationsContext)
+	// not a batch of records, produced as is
+	assert.Nil(t, destination.Send([]byte(`{"streams":[]}`)))
+
+	requests := produceRequests(broker)
+	require.Len(t, requests, 1)
+	assert.Equal(t, sarama.WaitForLocal, requests[0].RequiredAcks)
+}
+
+func TestDestinationSendErrors(t *testing.T) {
+	destinationsContext := client.NewDestinationsContext()
+	destinationsContext.Start()
+	defer destinationsContext.Stop()
+
+	// the leaders keep moving, the records are retried
+	broker := newMockBroker(t, newProduceResponse(t).
+		SetError("logs", 0, sarama.ErrNotLeaderForPartition).
+		SetError("logs", 1, sarama.ErrNotLeaderForPartition))
+	endpoint := newTestEndpoint(broker, "all")
+	payload := NewSerializer(endpoint).Serialize([]*message.Message{newKafkaMessage("a")})
+	err := NewDestination(endpoint, true, destinationsContext).Send(payload)
+	assert.IsType(t, &client.RetryableError{}, err)
+	broker.Close()
+
+	// the records are too large, they are dropped
+	broker = newMockBroker(t, newProduceResponse(t).
+		SetError("logs", 0, sarama.ErrMessageSizeTooLarge).
+		SetError("logs", 1, sarama.ErrMessageSizeTooLarge))
+	endpoint = newTestEndpoint(broker, "all")
+	err = NewDestination(endpoint, true, destinationsContext).Send(payload)
+	assert.NotNil(t, err)
+	assert.False(t, isRetryable(err))
+	broker.Close()
+
+	// the brokers are down
+	err = NewDestination(endpoint, true, destinationsContext).Send(payload)
+	assert.IsType(t, &client.RetryableError{}, err)
+
+	// not a batch of records
+	err = NewDestination(endpoint, true, destinationsContext).Send([]byte{0xff})
+	assert.Equal(t, errInvalidBatch, err)
+
+	// not a kafka endpoint
+	err = NewDestination(config.Endpoint{}, true, destinationsContext).Send(payload)
+	assert.Equal(t, errNotKafka, err)
+}
+
+func TestDestinationStopped(t *testing.T) {
+	broker := newMockBroker(t, newProduceResponse(t))
+	defer broker.Close()
+
+	destinationsContext := client.NewDestinationsContext()
+	destinationsContext.Start()
+
+	endpoint := newTestEndpoint(broker, "none")
+	destination := NewDestination(endpoint, true, destinationsContext)
+	payload := NewSerializer(endpoint).Serialize([]*message.Message{newKafkaMessage("a")})
+	assert.Nil(t, destination.Send(payload))
+
+	// the producer is closed with the context
+	destinationsContext.Stop()
+	assert.Eventually(t, func() bool {
+		destination.mutex.Lock()
+		defer destination.mutex.Unlock()
+		return destination.producer == nil
+	}, time.Second, 10*time.Millisecond)
+	assert.Equal(t, context.Canceled, destination.Send(payload))
+}
+
+func TestNewConfig(t *testing.T) {
+	endpoint := config.Endpoint{
+		UseCompression:   true,
+		Compression:      "gzip",
+		CompressionLevel: 9,
+		Kafka: &config.KafkaEndpoint{
+			Brokers:       []string{"kafka:9092"},
+			Topic:         "logs",
+			Acks:          "leader",
+			Version:       "2.1.0",
+			ClientID:      "test",
+			Timeout:       5 * time.Second,
+			SASLMechanism: sarama.SASLTypeSCRAMSHA512,
+			SASLUsername:  "user",
+			SASLPassword:  "secret",
+		},
+	}
+	c, err := newConfig(endpoint)
+	require.Nil(t, err)
+	assert.Equal(t, sarama.V2_1_0_0, c.Version)
+	assert.Equal(t, "test", c.ClientID)
+	assert.Equal(t, sarama.WaitForLocal, c.Producer.RequiredAcks)
+	assert.Equal(t, sarama.CompressionGZIP, c.Producer.Compression)
+	assert.Equal(t, 9, c.Producer.CompressionLevel)
+	assert.Equal(t, 5*time.Second, c.Net.DialTimeout)
+	assert.False(t, c.Net.TLS.Enable)
+	assert.True(t, c.Net.SASL.Enable)
+	require.NotNil(t, c.Net.SASL.SCRAMClientGeneratorFunc)
+
+	// the client of the mechanism completes the first step
+	scram := c.Net.SASL.SCRAMClientGeneratorFunc()
+	require.Nil(t, scram.Begin("user", "secret", ""))
+	first, err := scram.Step("")
+	assert.Nil(t, err)
+	assert.Contains(t, first, "n=user")
+	assert.False(t, scram.Done())
+
+	// zstd needs the brokers 2.1.0 or later
+	endpoint.Compression = "zstd"
+	endpoint.Kafka.Version = "1.0.0"
+	_, err = newConfig(endpoint)
+	assert.NotNil(t, err)
+}
+
+func isRetryable(err error) bool {
+	_, ok := err.(*client.RetryableError)
+	return ok
+}
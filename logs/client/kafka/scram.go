@@ -0,0 +1,41 @@
+package kafka
+
+import (
+	"crypto/sha256"
+	"crypto/sha512"
+	"hash"
+
+	"github.com/xdg/scram"
+)
+
+var (
+	scramSHA256 scram.HashGeneratorFcn = func() hash.Hash { return sha256.New() }
+	scramSHA512 scram.HashGeneratorFcn = func() hash.Hash { return sha512.New() }
+)
+
+// scramClient is the sarama.SCRAMClient of the SCRAM-SHA-256 and
+// SCRAM-SHA-512 mechanisms.
+type scramClient struct {
+	hashGenerator scram.HashGeneratorFcn
+	conversation  *scram.ClientConversation
+}
+
+// Begin starts the conversation with the broker.
+func (c *scramClient) Begin(userName, password, authzID string) error {
+	client, err := c.hashGenerator.NewClient(userName, password, authzID)
+	if err != nil {
+		return err
+	}
+	c.conversation = client.NewConversation()
+	return nil
+}
+
+// Step returns the response to the challenge of the broker.
+func (c *scramClient) Step(challenge string) (string, error) {
+	return c.conversation.Step(challenge)
+}
+
+// Done returns true once the conversation is over.
+func (c *scramClient) Done() bool {
+	return c.conversation.Done()
+}
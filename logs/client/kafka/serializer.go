@@ -0,0 +1,102 @@
+package kafka
+
+import (
+	"encoding/binary"
+	"errors"
+	"strings"
+
+	"github.com/Shopify/sarama"
+
+	"github.com/frankhang/doppler/logs/config"
+	"github.com/frankhang/doppler/logs/message"
+)
+
+var errInvalidBatch = errors.New("invalid batch of records")
+
+// Serializer transforms a batch of messages into a batch of records of
+// the topic, a record per message keyed by the partition_by of the
+// endpoint. A record is written as the uvarint length of its key, its key,
+// the uvarint length of its value and its value.
+type Serializer struct {
+	partitionBy string
+}
+
+// NewSerializer returns the serializer of the payloads sent to the endpoint.
+func NewSerializer(endpoint config.Endpoint) *Serializer {
+	serializer := &Serializer{}
+	if endpoint.Kafka != nil {
+		serializer.partitionBy = endpoint.Kafka.PartitionBy
+	}
+	return serializer
+}
+
+// Serialize returns the batch of records of the messages.
+func (s *Serializer) Serialize(messages []*message.Message) []byte {
+	size := 0
+	for _, msg := range messages {
+		size += 2*binary.MaxVarintLen64 + len(msg.Content)
+	}
+	payload := make([]byte, 0, size)
+	for _, msg := range messages {
+		payload = appendBytes(payload, []byte(s.key(msg)))
+		payload = appendBytes(payload, msg.Content)
+	}
+	return payload
+}
+
+// key returns the key of the record of the message, empty if the message
+// can land in any partition
+func (s *Serializer) key(msg *message.Message) string {
+	switch s.partitionBy {
+	case "":
+		return ""
+	case "source":
+		return msg.Origin.Source()
+	case "service":
+		return msg.Origin.Service()
+	}
+	prefix := s.partitionBy + ":"
+	for _, tag := range msg.Origin.Tags() {
+		if strings.HasPrefix(tag, prefix) {
+			return tag[len(prefix):]
+		}
+	}
+	return ""
+}
+
+func appendBytes(payload []byte, b []byte) []byte {
+	var length [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(length[:], uint64(len(b)))
+	return append(append(payload, length[:n]...), b...)
+}
+
+// decodeRecords returns the messages to produce to the topic of the batch
+// of records, the records without a key land in a random partition.
+func decodeRecords(topic string, payload []byte) ([]*sarama.ProducerMessage, error) {
+	var messages []*sarama.ProducerMessage
+	for len(payload) > 0 {
+		var key, value []byte
+		var err error
+		if key, payload, err = readBytes(payload); err != nil {
+			return nil, err
+		}
+		if value, payload, err = readBytes(payload); err != nil {
+			return nil, err
+		}
+		msg := &sarama.ProducerMessage{Topic: topic, Value: sarama.ByteEncoder(value)}
+		if len(key) > 0 {
+			msg.Key = sarama.ByteEncoder(key)
+		}
+		messages = append(messages, msg)
+	}
+	return messages, nil
+}
+
+func readBytes(payload []byte) ([]byte, []byte, error) {
+	length, n := binary.Uvarint(payload)
+	if n <= 0 || uint64(len(payload)-n) < length {
+		return nil, nil, errInvalidBatch
+	}
+	end := n + int(length)
+	return payload[n:end], payload[end:], nil
+}
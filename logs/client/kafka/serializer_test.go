@@ -0,0 +1,73 @@
+package kafka
+
+import (
+	"testing"
+
+	"github.com/Shopify/sarama"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/frankhang/doppler/logs/config"
+	"github.com/frankhang/doppler/logs/message"
+)
+
+func newKafkaMessage(content string, tags ...string) *message.Message {
+	source := config.NewLogSource("app", &config.LogsConfig{
+		Type:    config.FileType,
+		Service: "api",
+		Source:  "nginx",
+		Tags:    tags,
+	})
+	return message.NewMessageWithSource([]byte(content), message.StatusInfo, source)
+}
+
+func decodeBatch(t *testing.T, payload []byte) ([]string, []string) {
+	messages, err := decodeRecords("logs", payload)
+	require.Nil(t, err)
+	var keys, values []string
+	for _, msg := range messages {
+		assert.Equal(t, "logs", msg.Topic)
+		key := ""
+		if msg.Key != nil {
+			key = string(msg.Key.(sarama.ByteEncoder))
+		}
+		keys = append(keys, key)
+		values = append(values, string(msg.Value.(sarama.ByteEncoder)))
+	}
+	return keys, values
+}
+
+func TestSerializerPartitionBy(t *testing.T) {
+	messages := []*message.Message{
+		newKafkaMessage("a", "host:web1"),
+		newKafkaMessage("b", "env:prod", "host:web2"),
+		newKafkaMessage(""),
+	}
+
+	for _, test := range []struct {
+		partitionBy string
+		keys        []string
+	}{
+		{"", []string{"", "", ""}},
+		{"source", []string{"nginx", "nginx", "nginx"}},
+		{"service", []string{"api", "api", "api"}},
+		{"host", []string{"web1", "web2", ""}},
+	} {
+		serializer := NewSerializer(config.Endpoint{Kafka: &config.KafkaEndpoint{PartitionBy: test.partitionBy}})
+		keys, values := decodeBatch(t, serializer.Serialize(messages))
+		assert.Equal(t, test.keys, keys, test.partitionBy)
+		assert.Equal(t, []string{"a", "b", ""}, values, test.partitionBy)
+	}
+}
+
+func TestDecodeRecordsInvalidBatch(t *testing.T) {
+	messages, err := decodeRecords("logs", nil)
+	assert.Nil(t, err)
+	assert.Len(t, messages, 0)
+
+	payload := NewSerializer(config.Endpoint{}).Serialize([]*message.Message{newKafkaMessage("a line")})
+	_, err = decodeRecords("logs", payload[:len(payload)-1])
+	assert.Equal(t, errInvalidBatch, err)
+	_, err = decodeRecords("logs", []byte{0xff})
+	assert.Equal(t, errInvalidBatch, err)
+}
@@ -10,10 +10,12 @@ import (
 	"fmt"
 	"go.uber.org/zap"
 	"net"
+	"net/url"
 	"strconv"
 	"time"
 
 	coreConfig "github.com/frankhang/doppler/config"
+	"github.com/frankhang/doppler/util"
 	"github.com/frankhang/util/logutil"
 )
 
@@ -34,11 +36,11 @@ var logsEndpoints = map[string]int{
 	"agent-intake.logs.datad0g.eu":    443,
 }
 
-// DefaultSources returns the default log sources that can be directly set from the datadog.yaml or through environment variables.
+// DefaultSources returns the default log sources set from the logs section of the config file.
 func DefaultSources() []*LogSource {
 	var sources []*LogSource
 
-	if coreConfig.Datadog.GetBool("logs_config.container_collect_all") {
+	if coreConfig.Cfg.Logs.ContainerCollectAll {
 		// append a new source to collect all logs from all containers
 		source := NewLogSource(ContainerCollectAll, &LogsConfig{
 			Type:    DockerType,
@@ -205,7 +207,163 @@ func batchWait(config coreConfig.Config2) time.Duration {
 	return (time.Duration(batchWait) * time.Second)
 }
 
+// BuildLokiEndpoints returns the endpoint of the Loki the logs are pushed to,
+// from the logs section of the config file.
+func BuildLokiEndpoints() (*Endpoints, error) {
+	c := coreConfig.Cfg.Logs.Loki
+	if c.URL == "" {
+		return nil, fmt.Errorf("the url of loki is required")
+	}
+	u, err := url.Parse(c.URL)
+	if err != nil {
+		return nil, fmt.Errorf("could not parse the url of loki: %v", err)
+	}
+	main := Endpoint{
+		Host:             u.Hostname(),
+		UseSSL:           u.Scheme == "https",
+		URL:              c.URL,
+		TenantID:         c.TenantID,
+		Headers:          c.Headers,
+		Labels:           make(map[string]string),
+		CompressionLevel: c.CompressionLevel,
+	}
+	if hostname, err := util.GetHostname(); err == nil && hostname != "" {
+		main.Labels["host"] = hostname
+	}
+	for name, value := range c.Labels {
+		main.Labels[name] = value
+	}
+	if port := u.Port(); port != "" {
+		main.Port, _ = strconv.Atoi(port)
+	}
+	switch c.Compression {
+	case "", "none":
+	case "gzip", "snappy":
+		main.UseCompression = true
+		main.Compression = c.Compression
+	default:
+		return nil, fmt.Errorf("invalid compression `%s`, expected gzip, snappy or none", c.Compression)
+	}
+
+	endpoints := NewEndpoints(main, nil, false, false, logsBatchWait())
+	endpoints.UseLoki = true
+	return endpoints, nil
+}
+
+// BuildLogsEndpoints returns the endpoints the logs are sent to, Loki with the
+// topic of Kafka as an additional endpoint when both are configured.
+func BuildLogsEndpoints() (*Endpoints, error) {
+	c := coreConfig.Cfg.Logs
+	if len(c.Kafka.Brokers) == 0 {
+		if c.Loki.URL == "" {
+			return nil, fmt.Errorf("the url of loki or the brokers of kafka are required")
+		}
+		return BuildLokiEndpoints()
+	}
+	kafka, err := buildKafkaEndpoint(c.Kafka)
+	if err != nil {
+		return nil, err
+	}
+	if c.Loki.URL == "" {
+		endpoints := NewEndpoints(kafka, nil, false, false, logsBatchWait())
+		endpoints.UseKafka = true
+		return endpoints, nil
+	}
+	endpoints, err := BuildLokiEndpoints()
+	if err != nil {
+		return nil, err
+	}
+	endpoints.Additionals = append(endpoints.Additionals, kafka)
+	return endpoints, nil
+}
+
+// logsBatchWait returns the batch_wait of the logs, the default one if invalid
+func logsBatchWait() time.Duration {
+	batchWait := time.Duration(coreConfig.Cfg.Logs.BatchWait) * time.Second
+	if batchWait < time.Second || 10*time.Second < batchWait {
+		logutil.BgLogger().Warn(fmt.Sprintf("Invalid batch_wait: %v should be in [1, 10], fallback on %v", coreConfig.Cfg.Logs.BatchWait, coreConfig.DefaultBatchWait))
+		batchWait = coreConfig.DefaultBatchWait * time.Second
+	}
+	return batchWait
+}
+
+// ConfiguredSources returns the log sources of the config file.
+func ConfiguredSources() ([]*LogSource, error) {
+	var sources []*LogSource
+	for i, c := range coreConfig.Cfg.Logs.Sources {
+		name := c.Name
+		if name == "" {
+			name = fmt.Sprintf("source%d", i)
+		}
+		config := &LogsConfig{
+			Type:            c.Type,
+			Path:            c.Path,
+			Port:            c.Port,
+			IncludeUnits:    c.IncludeUnits,
+			ExcludeUnits:    c.ExcludeUnits,
+			Service:         c.Service,
+			Source:          c.Source,
+			SourceCategory:  c.SourceCategory,
+			Tags:            c.Tags,
+			ProcessingRules: processingRules(c.ProcessingRules),
+		}
+		if c.Parser.Type != "" {
+			config.Parser = &ParserConfig{
+				Type:            c.Parser.Type,
+				Pattern:         c.Parser.Pattern,
+				Patterns:        c.Parser.Patterns,
+				TimestampField:  c.Parser.TimestampField,
+				TimestampFormat: c.Parser.TimestampFormat,
+				StatusField:     c.Parser.StatusField,
+				MessageField:    c.Parser.MessageField,
+				Attributes:      c.Parser.Attributes,
+			}
+		}
+		if err := config.Validate(); err != nil {
+			return nil, fmt.Errorf("source %s: %v", name, err)
+		}
+		sources = append(sources, NewLogSource(name, config))
+	}
+	return sources, nil
+}
+
+// ConfiguredProcessingRules returns the processing rules of the config file
+// to apply to all logs.
+func ConfiguredProcessingRules() ([]*ProcessingRule, error) {
+	rules := processingRules(coreConfig.Cfg.Logs.ProcessingRules)
+	if err := ValidateProcessingRules(rules); err != nil {
+		return nil, err
+	}
+	if err := CompileProcessingRules(rules); err != nil {
+		return nil, err
+	}
+	return rules, nil
+}
+
+func processingRules(configs []coreConfig.LogProcessingRule) []*ProcessingRule {
+	var rules []*ProcessingRule
+	for _, c := range configs {
+		rule := &ProcessingRule{
+			Type:               c.Type,
+			Name:               c.Name,
+			Pattern:            c.Pattern,
+			ReplacePlaceholder: c.ReplacePlaceholder,
+		}
+		if c.Type == ExtractMetric {
+			rule.Metric = &MetricRule{
+				Name:  c.Metric.Name,
+				Type:  c.Metric.Type,
+				Value: c.Metric.Value,
+				Tags:  c.Metric.Tags,
+				JSON:  c.Metric.JSON,
+			}
+		}
+		rules = append(rules, rule)
+	}
+	return rules
+}
+
 // TaggerWarmupDuration is used to configure the tag providers
 func TaggerWarmupDuration() time.Duration {
-	return coreConfig.Datadog.GetDuration("logs_config.tagger_warmup_duration") * time.Second
+	return time.Duration(coreConfig.Cfg.Logs.TaggerWarmupDuration) * time.Second
 }
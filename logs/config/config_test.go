@@ -48,7 +48,9 @@ func (suite *ConfigTestSuite) TestDefaultSources() {
 	var sources []*LogSource
 	var source *LogSource
 
-	suite.config.Set("logs_config.container_collect_all", true)
+	conf := coreConfig.DefaultConf
+	conf.Logs.ContainerCollectAll = true
+	coreConfig.Cfg = &conf
 
 	sources = DefaultSources()
 	suite.Equal(1, len(sources))
@@ -127,12 +129,15 @@ func (suite *ConfigTestSuite) TestGlobalProcessingRulesShouldReturnRulesWithVali
 }
 
 func (suite *ConfigTestSuite) TestTaggerWarmupDuration() {
+	conf := coreConfig.DefaultConf
+	coreConfig.Cfg = &conf
+
 	// assert TaggerWarmupDuration is disabled by default
 	taggerWarmupDuration := TaggerWarmupDuration()
 	suite.Equal(0*time.Second, taggerWarmupDuration)
 
 	// override
-	suite.config.Set("logs_config.tagger_warmup_duration", 5)
+	conf.Logs.TaggerWarmupDuration = 5
 	taggerWarmupDuration = TaggerWarmupDuration()
 	suite.Equal(5*time.Second, taggerWarmupDuration)
 }
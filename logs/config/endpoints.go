@@ -6,6 +6,7 @@
 package config
 
 import (
+	"crypto/tls"
 	"time"
 )
 
@@ -18,6 +19,31 @@ type Endpoint struct {
 	UseCompression   bool `mapstructure:"use_compression"`
 	CompressionLevel int  `mapstructure:"compression_level"`
 	ProxyAddress     string
+
+	// Loki
+	URL         string            // of the push API
+	TenantID    string            // sent as X-Scope-OrgID, empty if none
+	Compression string            // gzip or snappy, when UseCompression is set
+	Headers     map[string]string // added to the requests
+	Labels      map[string]string // added to the labels of every stream
+
+	// Kafka, Compression is also the codec of the batches of records
+	Kafka *KafkaEndpoint // nil if the endpoint is not a topic of kafka
+}
+
+// KafkaEndpoint holds the parameters of the producer of a Kafka endpoint.
+type KafkaEndpoint struct {
+	Brokers       []string
+	Topic         string
+	PartitionBy   string // source, service or a tag key, the partitions are random if empty
+	Acks          string // none, leader or all
+	Version       string // of the brokers, the default of the client if empty
+	ClientID      string
+	Timeout       time.Duration
+	TLS           *tls.Config // nil if the connections are in plaintext
+	SASLMechanism string      // PLAIN, SCRAM-SHA-256 or SCRAM-SHA-512, empty if none
+	SASLUsername  string
+	SASLPassword  string
 }
 
 // Endpoints holds the main endpoint and additional ones to dualship logs.
@@ -26,6 +52,8 @@ type Endpoints struct {
 	Additionals []Endpoint
 	UseProto    bool
 	UseHTTP     bool
+	UseLoki     bool
+	UseKafka    bool // the main endpoint is a topic of kafka
 	BatchWait   time.Duration
 }
 
@@ -19,6 +19,13 @@ const (
 	WindowsEventType = "windows_event"
 )
 
+// Line parser types
+const (
+	JSONParser   = "json"
+	LogfmtParser = "logfmt"
+	GrokParser   = "grok"
+)
+
 // LogsConfig represents a log source config, which can be for instance
 // a file to tail or a port to listen to.
 type LogsConfig struct {
@@ -44,6 +51,21 @@ type LogsConfig struct {
 	SourceCategory  string
 	Tags            []string
 	ProcessingRules []*ProcessingRule `mapstructure:"log_processing_rules" json:"log_processing_rules"`
+	Parser          *ParserConfig     // File, Network
+}
+
+// ParserConfig configures the parsing of the lines of a source into a
+// message, a status, a timestamp and attributes. The fields are looked up
+// by their dotted path, the usual names are tried when none is set.
+type ParserConfig struct {
+	Type            string
+	Pattern         string            // Grok
+	Patterns        map[string]string // Grok, the custom patterns of the pattern
+	TimestampField  string            `mapstructure:"timestamp_field" json:"timestamp_field"`
+	TimestampFormat string            `mapstructure:"timestamp_format" json:"timestamp_format"` // rfc3339, unix, unix_ms, unix_ns or a go layout
+	StatusField     string            `mapstructure:"status_field" json:"status_field"`
+	MessageField    string            `mapstructure:"message_field" json:"message_field"`
+	Attributes      []string          // all the other fields when empty
 }
 
 // Validate returns an error if the config is misconfigured
@@ -61,9 +83,38 @@ func (c *LogsConfig) Validate() error {
 	case c.Type == UDPType && c.Port == 0:
 		return fmt.Errorf("udp source must have a port")
 	}
+	if c.Parser != nil {
+		if err := c.Parser.validate(c.Type); err != nil {
+			return err
+		}
+	}
 	err := ValidateProcessingRules(c.ProcessingRules)
 	if err != nil {
 		return err
 	}
 	return CompileProcessingRules(c.ProcessingRules)
 }
+
+// validate returns an error if the parser is misconfigured, the grok
+// patterns are only compiled with the parser
+func (c *ParserConfig) validate(sourceType string) error {
+	switch sourceType {
+	case FileType, TCPType, UDPType:
+		break
+	default:
+		return fmt.Errorf("%s source can't have a parser", sourceType)
+	}
+	switch c.Type {
+	case JSONParser, LogfmtParser:
+		break
+	case GrokParser:
+		if c.Pattern == "" {
+			return fmt.Errorf("grok parser must have a pattern")
+		}
+	case "":
+		return fmt.Errorf("a parser must have a type")
+	default:
+		return fmt.Errorf("parser type %s is not supported", c.Type)
+	}
+	return nil
+}
@@ -20,6 +20,9 @@ func TestValidateShouldSucceedWithValidConfigs(t *testing.T) {
 		{Type: UDPType, Port: 5678},
 		{Type: DockerType},
 		{Type: JournaldType, ProcessingRules: []*ProcessingRule{{Name: "foo", Type: ExcludeAtMatch, Pattern: ".*"}}},
+		{Type: FileType, Path: "/var/log/foo.log", Parser: &ParserConfig{Type: JSONParser}},
+		{Type: TCPType, Port: 1234, Parser: &ParserConfig{Type: LogfmtParser}},
+		{Type: UDPType, Port: 5678, Parser: &ParserConfig{Type: GrokParser, Pattern: "%{COMMONAPACHELOG}"}},
 	}
 
 	for _, config := range validConfigs {
@@ -41,6 +44,11 @@ func TestValidateShouldFailWithInvalidConfigs(t *testing.T) {
 		{Type: DockerType, ProcessingRules: []*ProcessingRule{{Type: ExcludeAtMatch, Pattern: ".*"}}},
 		{Type: DockerType, ProcessingRules: []*ProcessingRule{{Type: ExcludeAtMatch}}},
 		{Type: DockerType, ProcessingRules: []*ProcessingRule{{Pattern: ".*"}}},
+		{Type: FileType, Path: "/var/log/foo.log", Parser: &ParserConfig{}},
+		{Type: FileType, Path: "/var/log/foo.log", Parser: &ParserConfig{Type: "xml"}},
+		{Type: TCPType, Port: 1234, Parser: &ParserConfig{Type: GrokParser}},
+		{Type: DockerType, Parser: &ParserConfig{Type: JSONParser}},
+		{Type: JournaldType, Parser: &ParserConfig{Type: LogfmtParser}},
 	}
 
 	for _, config := range invalidConfigs {
@@ -0,0 +1,104 @@
+package config
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"time"
+
+	"github.com/Shopify/sarama"
+
+	coreConfig "github.com/frankhang/doppler/config"
+)
+
+// buildKafkaEndpoint returns the endpoint of the topic of kafka the logs are
+// produced to, the certificates are loaded here to fail at startup.
+func buildKafkaEndpoint(c coreConfig.LogsKafka) (Endpoint, error) {
+	if len(c.Brokers) == 0 {
+		return Endpoint{}, fmt.Errorf("the brokers of kafka are required")
+	}
+	if c.Topic == "" {
+		return Endpoint{}, fmt.Errorf("the topic of kafka is required")
+	}
+	kafka := &KafkaEndpoint{
+		Brokers:       c.Brokers,
+		Topic:         c.Topic,
+		PartitionBy:   c.PartitionBy,
+		Acks:          c.Acks,
+		Version:       c.Version,
+		ClientID:      c.ClientID,
+		Timeout:       time.Duration(c.Timeout) * time.Second,
+		SASLMechanism: c.SASLMechanism,
+		SASLUsername:  c.SASLUsername,
+		SASLPassword:  c.SASLPassword,
+	}
+	endpoint := Endpoint{
+		CompressionLevel: c.CompressionLevel,
+		Kafka:            kafka,
+	}
+
+	switch c.Acks {
+	case "none", "leader", "all":
+	case "":
+		kafka.Acks = "all"
+	default:
+		return Endpoint{}, fmt.Errorf("invalid acks `%s`, expected none, leader or all", c.Acks)
+	}
+	switch c.Compression {
+	case "", "none":
+	case "gzip", "snappy", "lz4", "zstd":
+		endpoint.UseCompression = true
+		endpoint.Compression = c.Compression
+	default:
+		return Endpoint{}, fmt.Errorf("invalid compression `%s`, expected gzip, snappy, lz4, zstd or none", c.Compression)
+	}
+	if c.Version != "" {
+		if _, err := sarama.ParseKafkaVersion(c.Version); err != nil {
+			return Endpoint{}, fmt.Errorf("invalid version of kafka: %v", err)
+		}
+	}
+	switch c.SASLMechanism {
+	case "":
+	case sarama.SASLTypePlaintext, sarama.SASLTypeSCRAMSHA256, sarama.SASLTypeSCRAMSHA512:
+		if c.SASLUsername == "" {
+			return Endpoint{}, fmt.Errorf("the sasl username of kafka is required with %s", c.SASLMechanism)
+		}
+	default:
+		return Endpoint{}, fmt.Errorf("invalid sasl mechanism `%s`, expected PLAIN, SCRAM-SHA-256 or SCRAM-SHA-512", c.SASLMechanism)
+	}
+
+	if c.TLS {
+		tlsConfig, err := buildKafkaTLSConfig(c)
+		if err != nil {
+			return Endpoint{}, err
+		}
+		kafka.TLS = tlsConfig
+		endpoint.UseSSL = true
+	}
+	return endpoint, nil
+}
+
+// buildKafkaTLSConfig returns the tls config of the connections to the brokers,
+// with the client certificate if any.
+func buildKafkaTLSConfig(c coreConfig.LogsKafka) (*tls.Config, error) {
+	tlsConfig := &tls.Config{InsecureSkipVerify: c.TLSSkipVerify}
+	if c.TLSCA != "" {
+		ca, err := ioutil.ReadFile(c.TLSCA)
+		if err != nil {
+			return nil, fmt.Errorf("could not read the ca of kafka: %v", err)
+		}
+		tlsConfig.RootCAs = x509.NewCertPool()
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(ca) {
+			return nil, fmt.Errorf("no certificate in the ca of kafka %s", c.TLSCA)
+		}
+	}
+	if c.TLSCert != "" || c.TLSKey != "" {
+		cert, err := tls.LoadX509KeyPair(c.TLSCert, c.TLSKey)
+		if err != nil {
+			return nil, fmt.Errorf("could not load the client certificate of kafka: %v", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	return tlsConfig, nil
+}
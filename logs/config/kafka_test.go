@@ -0,0 +1,67 @@
+package config
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	coreConfig "github.com/frankhang/doppler/config"
+)
+
+func TestBuildKafkaEndpoint(t *testing.T) {
+	endpoint, err := buildKafkaEndpoint(coreConfig.LogsKafka{
+		Brokers:       []string{"kafka1:9092", "kafka2:9092"},
+		Topic:         "logs",
+		PartitionBy:   "host",
+		Compression:   "lz4",
+		Timeout:       10,
+		SASLMechanism: "SCRAM-SHA-256",
+		SASLUsername:  "doppler",
+		SASLPassword:  "secret",
+	})
+	require.Nil(t, err)
+	assert.True(t, endpoint.UseCompression)
+	assert.Equal(t, "lz4", endpoint.Compression)
+	assert.False(t, endpoint.UseSSL)
+	require.NotNil(t, endpoint.Kafka)
+	assert.Equal(t, []string{"kafka1:9092", "kafka2:9092"}, endpoint.Kafka.Brokers)
+	assert.Equal(t, "host", endpoint.Kafka.PartitionBy)
+	assert.Equal(t, "all", endpoint.Kafka.Acks)
+	assert.Equal(t, 10*time.Second, endpoint.Kafka.Timeout)
+	assert.Nil(t, endpoint.Kafka.TLS)
+
+	endpoint, err = buildKafkaEndpoint(coreConfig.LogsKafka{Brokers: []string{"kafka:9093"}, Topic: "logs", Compression: "none", TLS: true, TLSSkipVerify: true})
+	require.Nil(t, err)
+	assert.False(t, endpoint.UseCompression)
+	assert.True(t, endpoint.UseSSL)
+	require.NotNil(t, endpoint.Kafka.TLS)
+	assert.True(t, endpoint.Kafka.TLS.InsecureSkipVerify)
+}
+
+func TestBuildKafkaEndpointInvalid(t *testing.T) {
+	ca, err := ioutil.TempFile("", "ca")
+	require.Nil(t, err)
+	defer os.Remove(ca.Name())
+	ca.WriteString("not a certificate")
+	ca.Close()
+
+	for _, c := range []coreConfig.LogsKafka{
+		{Topic: "logs"},
+		{Brokers: []string{"kafka:9092"}},
+		{Brokers: []string{"kafka:9092"}, Topic: "logs", Acks: "some"},
+		{Brokers: []string{"kafka:9092"}, Topic: "logs", Compression: "brotli"},
+		{Brokers: []string{"kafka:9092"}, Topic: "logs", Version: "latest"},
+		{Brokers: []string{"kafka:9092"}, Topic: "logs", SASLMechanism: "GSSAPI", SASLUsername: "doppler"},
+		{Brokers: []string{"kafka:9092"}, Topic: "logs", SASLMechanism: "PLAIN"},
+		{Brokers: []string{"kafka:9092"}, Topic: "logs", TLS: true, TLSCA: "/does/not/exist"},
+		{Brokers: []string{"kafka:9092"}, Topic: "logs", TLS: true, TLSCA: ca.Name()},
+		{Brokers: []string{"kafka:9092"}, Topic: "logs", TLS: true, TLSCert: ca.Name(), TLSKey: ca.Name()},
+	} {
+		_, err := buildKafkaEndpoint(c)
+		assert.NotNil(t, err, "%+v", c)
+	}
+}
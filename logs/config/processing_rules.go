@@ -16,20 +16,41 @@ const (
 	IncludeAtMatch = "include_at_match"
 	MaskSequences  = "mask_sequences"
 	MultiLine      = "multi_line"
+	ExtractMetric  = "extract_metric"
 )
 
-// ProcessingRule defines an exclusion or a masking rule to
-// be applied on log lines
+// Metric types of the extract_metric rules
+const (
+	CounterMetric   = "counter"
+	GaugeMetric     = "gauge"
+	HistogramMetric = "histogram"
+)
+
+// ProcessingRule defines an exclusion, a masking or a metric extraction
+// rule to be applied on log lines
 type ProcessingRule struct {
 	Type               string
 	Name               string
 	ReplacePlaceholder string `mapstructure:"replace_placeholder" json:"replace_placeholder"`
 	Pattern            string
+	Metric             *MetricRule
 	// TODO: should be moved out
 	Regex       *regexp.Regexp
 	Placeholder []byte
 }
 
+// MetricRule defines the metric emitted for the lines matched by an
+// extract_metric rule. The value and the tags are named captures of the
+// pattern, or dotted paths of fields when the lines are parsed as JSON,
+// the pattern then only filters the lines.
+type MetricRule struct {
+	Name  string
+	Type  string
+	Value string
+	Tags  []string
+	JSON  bool
+}
+
 // ValidateProcessingRules validates the rules and raises an error if one is misconfigured.
 // Each processing rule must have:
 // - a valid name
@@ -44,6 +65,11 @@ func ValidateProcessingRules(rules []*ProcessingRule) error {
 		switch rule.Type {
 		case ExcludeAtMatch, IncludeAtMatch, MaskSequences, MultiLine:
 			break
+		case ExtractMetric:
+			if err := validateMetricRule(rule); err != nil {
+				return err
+			}
+			continue
 		case "":
 			return fmt.Errorf("type must be set for processing rule `%s`", rule.Name)
 		default:
@@ -61,6 +87,52 @@ func ValidateProcessingRules(rules []*ProcessingRule) error {
 	return nil
 }
 
+// validateMetricRule validates the metric of an extract_metric rule, its
+// value and tags must be named captures of the pattern unless the lines are
+// parsed as JSON
+func validateMetricRule(rule *ProcessingRule) error {
+	metric := rule.Metric
+	if metric == nil || metric.Name == "" {
+		return fmt.Errorf("no metric name provided for processing rule: %s", rule.Name)
+	}
+	switch metric.Type {
+	case CounterMetric, GaugeMetric, HistogramMetric:
+		break
+	default:
+		return fmt.Errorf("metric type %s is not supported for processing rule `%s`", metric.Type, rule.Name)
+	}
+	if metric.Value == "" && metric.Type != CounterMetric {
+		return fmt.Errorf("no metric value provided for processing rule: %s", rule.Name)
+	}
+
+	if rule.Pattern == "" && !metric.JSON {
+		return fmt.Errorf("no pattern provided for processing rule: %s", rule.Name)
+	}
+	re, err := regexp.Compile(rule.Pattern)
+	if err != nil {
+		return fmt.Errorf("invalid pattern %s for processing rule: %s", rule.Pattern, rule.Name)
+	}
+	if metric.JSON {
+		return nil
+	}
+	for _, name := range append([]string{metric.Value}, metric.Tags...) {
+		if name != "" && !hasCapture(re, name) {
+			return fmt.Errorf("no capture %s in the pattern of processing rule: %s", name, rule.Name)
+		}
+	}
+	return nil
+}
+
+// hasCapture returns whether the regex has a capture group of that name
+func hasCapture(re *regexp.Regexp, name string) bool {
+	for _, subexp := range re.SubexpNames() {
+		if subexp == name {
+			return true
+		}
+	}
+	return false
+}
+
 // CompileProcessingRules compiles all processing rule regular expressions.
 func CompileProcessingRules(rules []*ProcessingRule) error {
 	for _, rule := range rules {
@@ -69,7 +141,7 @@ func CompileProcessingRules(rules []*ProcessingRule) error {
 			return err
 		}
 		switch rule.Type {
-		case ExcludeAtMatch, IncludeAtMatch:
+		case ExcludeAtMatch, IncludeAtMatch, ExtractMetric:
 			rule.Regex = re
 		case MaskSequences:
 			rule.Regex = re
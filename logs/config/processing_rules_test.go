@@ -33,3 +33,30 @@ func TestCompileShouldFailWithInvalidRules(t *testing.T) {
 		assert.Nil(t, rule.Regex)
 	}
 }
+
+func TestValidateMetricRules(t *testing.T) {
+	metric := func(typ, value string, tags ...string) *MetricRule {
+		return &MetricRule{Name: "nginx.requests", Type: typ, Value: value, Tags: tags}
+	}
+	pattern := `"(?P<method>[A-Z]+) \S+" (?P<status>\d+) (?P<duration>[\d.]+)`
+
+	validRules := []*ProcessingRule{
+		{Name: "count", Type: ExtractMetric, Pattern: pattern, Metric: metric(CounterMetric, "")},
+		{Name: "latency", Type: ExtractMetric, Pattern: pattern, Metric: metric(HistogramMetric, "duration", "status")},
+		{Name: "json", Type: ExtractMetric, Metric: &MetricRule{Name: "app.latency", Type: GaugeMetric, Value: "http.duration", JSON: true}},
+	}
+	for _, rule := range validRules {
+		assert.Nil(t, ValidateProcessingRules([]*ProcessingRule{rule}), rule.Name)
+	}
+
+	invalidRules := []*ProcessingRule{
+		{Name: "no metric", Type: ExtractMetric, Pattern: pattern},
+		{Name: "bad type", Type: ExtractMetric, Pattern: pattern, Metric: metric("set", "duration")},
+		{Name: "no value", Type: ExtractMetric, Pattern: pattern, Metric: metric(GaugeMetric, "")},
+		{Name: "no pattern", Type: ExtractMetric, Metric: metric(CounterMetric, "")},
+		{Name: "unknown capture", Type: ExtractMetric, Pattern: pattern, Metric: metric(HistogramMetric, "duration", "path")},
+	}
+	for _, rule := range invalidRules {
+		assert.NotNil(t, ValidateProcessingRules([]*ProcessingRule{rule}), rule.Name)
+	}
+}
@@ -9,6 +9,7 @@ import (
 	"bytes"
 
 	"github.com/frankhang/doppler/logs/config"
+	"github.com/frankhang/doppler/logs/message"
 	"github.com/frankhang/doppler/logs/parser"
 )
 
@@ -34,6 +35,7 @@ type Output struct {
 	Status     string
 	RawDataLen int
 	Timestamp  string
+	Fields     *parser.Fields // set by the structured parsers
 }
 
 // NewOutput returns a new output.
@@ -46,6 +48,16 @@ func NewOutput(content []byte, status string, rawDataLen int, timestamp string)
 	}
 }
 
+// NewMessage returns the message of the output, with its parsed fields
+func (o *Output) NewMessage(origin *message.Origin) *message.Message {
+	msg := message.NewMessage(o.Content, origin, o.Status)
+	if o.Fields != nil {
+		msg.Timestamp = o.Fields.Timestamp
+		msg.Attributes = o.Fields.Attributes
+	}
+	return msg
+}
+
 // Decoder splits raw data into lines and passes them to a lineHandler that emits outputs
 type Decoder struct {
 	InputChan       chan *Input
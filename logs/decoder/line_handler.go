@@ -89,7 +89,7 @@ func (h *SingleLineHandler) process(line []byte) {
 		rawLen++
 	}
 
-	content, status, timestamp, err := h.parser.Parse(line)
+	content, status, timestamp, fields, err := parse(h.parser, line)
 	if err != nil {
 		logutil.BgLogger().Debug(err.Error())
 	}
@@ -106,13 +106,15 @@ func (h *SingleLineHandler) process(line []byte) {
 		content = append(truncatedFlag, content...)
 	}
 
+	output := NewOutput(content, status, rawLen, timestamp)
+	output.Fields = fields
 	if len(content) < h.lineLimit {
-		h.outputChan <- NewOutput(content, status, rawLen, timestamp)
+		h.outputChan <- output
 	} else {
 		// the line is too long, it needs to be cut off and send,
 		// adding the truncated flag the end of the content
-		content = append(content, truncatedFlag...)
-		h.outputChan <- NewOutput(content, status, rawLen, timestamp)
+		output.Content = append(content, truncatedFlag...)
+		h.outputChan <- output
 		// make sure the following part of the line will be cut off as well
 		h.shouldTruncate = true
 	}
@@ -136,6 +138,7 @@ type MultiLineHandler struct {
 	linesLen       int
 	status         string
 	timestamp      string
+	fields         *parser.Fields
 }
 
 // NewMultiLineHandler returns a new MultiLineHandler.
@@ -210,12 +213,18 @@ func (h *MultiLineHandler) run() {
 // and that the length of the lines is properly tracked
 // so that the agent restarts tailing from the right place.
 func (h *MultiLineHandler) process(line []byte) {
-	content, status, timestamp, err := h.parser.Parse(line)
+	content, status, timestamp, fields, err := parse(h.parser, line)
 	if err != nil {
 		logutil.BgLogger().Debug(err.Error())
 	}
 
-	if h.newContentRe.Match(content) {
+	// the structured parsers lift the message out of the line, the new
+	// messages are recognized by their raw lines
+	matched := content
+	if _, ok := h.parser.(parser.StructuredParser); ok {
+		matched = line
+	}
+	if h.newContentRe.Match(matched) {
 		// the current line is part of a new message,
 		// send the buffer
 		h.sendBuffer()
@@ -234,8 +243,13 @@ func (h *MultiLineHandler) process(line []byte) {
 	// track the raw data length and the timestamp so that the agent tails
 	// from the right place at restart
 	h.linesLen += rawLen
-	h.timestamp = timestamp
-	h.status = status
+	if h.buffer.Len() == 0 || h.fields == nil {
+		// a message keeps the fields of its first line when it has some,
+		// the structured parsers usually fail on the following lines
+		h.timestamp = timestamp
+		h.status = status
+		h.fields = fields
+	}
 
 	if h.buffer.Len() > 0 {
 		// the buffer already contains some data which means that
@@ -268,6 +282,7 @@ func (h *MultiLineHandler) sendBuffer() {
 		h.buffer.Reset()
 		h.linesLen = 0
 		h.shouldTruncate = false
+		h.fields = nil
 	}()
 
 	data := bytes.TrimSpace(h.buffer.Bytes())
@@ -275,6 +290,24 @@ func (h *MultiLineHandler) sendBuffer() {
 	copy(content, data)
 
 	if len(content) > 0 {
-		h.outputChan <- NewOutput(content, h.status, h.linesLen, h.timestamp)
+		output := NewOutput(content, h.status, h.linesLen, h.timestamp)
+		output.Fields = h.fields
+		h.outputChan <- output
+	}
+}
+
+// parse parses the line with the parser, with its fields if it's a
+// structured parser
+func parse(p parser.Parser, line []byte) ([]byte, string, string, *parser.Fields, error) {
+	sp, ok := p.(parser.StructuredParser)
+	if !ok {
+		content, status, timestamp, err := p.Parse(line)
+		return content, status, timestamp, nil, err
+	}
+	content, status, fields, err := sp.ParseFields(line)
+	var timestamp string
+	if fields != nil && !fields.Timestamp.IsZero() {
+		timestamp = fields.Timestamp.Format(time.RFC3339Nano)
 	}
+	return content, status, timestamp, fields, err
 }
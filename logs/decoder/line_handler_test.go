@@ -13,6 +13,7 @@ import (
 	"testing"
 	"time"
 
+	"github.com/frankhang/doppler/logs/config"
 	"github.com/frankhang/doppler/logs/parser"
 	"github.com/stretchr/testify/assert"
 )
@@ -287,3 +288,46 @@ func TestMultiLineHandlerSendsRawInvalidMessages(t *testing.T) {
 	output = <-outputChan
 	assert.Equal(t, "1.third line\\nfourth line", string(output.Content))
 }
+
+func TestSingleLineHandlerStructuredParser(t *testing.T) {
+	p, err := parser.New(&config.ParserConfig{Type: config.LogfmtParser})
+	assert.Nil(t, err)
+	outputChan := make(chan *Output, 10)
+	h := NewSingleLineHandler(outputChan, p, 100)
+	h.Start()
+
+	h.Handle([]byte(`ts=2020-05-06T10:11:12Z level=error msg="query failed" user=42`))
+	h.Handle([]byte("not logfmt"))
+
+	output := <-outputChan
+	assert.Equal(t, "query failed", string(output.Content))
+	assert.Equal(t, "error", output.Status)
+	assert.Equal(t, "2020-05-06T10:11:12Z", output.Timestamp)
+	assert.Equal(t, map[string]interface{}{"user": "42"}, output.Fields.Attributes)
+
+	output = <-outputChan
+	assert.Equal(t, "not logfmt", string(output.Content))
+	assert.Nil(t, output.Fields)
+}
+
+func TestMultiLineHandlerStructuredParser(t *testing.T) {
+	p, err := parser.New(&config.ParserConfig{Type: config.GrokParser, Pattern: `^%{TIMESTAMP_ISO8601:time} %{LOGLEVEL:level} %{GREEDYDATA:message}`})
+	assert.Nil(t, err)
+	outputChan := make(chan *Output, 10)
+	re := regexp.MustCompile(`^\d{4}-`)
+	h := NewMultiLineHandler(outputChan, re, 10*time.Millisecond, p, 1000)
+	h.Start()
+
+	h.Handle([]byte("2020-05-06T10:11:12Z ERROR panic: boom"))
+	h.Handle([]byte("  at main.go:12"))
+	h.Handle([]byte("2020-05-06T10:11:13Z INFO restarted"))
+
+	output := <-outputChan
+	assert.Equal(t, `panic: boom\n  at main.go:12`, string(output.Content))
+	assert.Equal(t, "error", output.Status)
+	assert.Equal(t, "2020-05-06T10:11:12Z", output.Timestamp)
+
+	output = <-outputChan
+	assert.Equal(t, "restarted", string(output.Content))
+	assert.Equal(t, "info", output.Status)
+}
@@ -70,7 +70,11 @@ func NewTailer(outputChan chan *message.Message, source *config.LogSource, path
 	case config.DockerSourceType:
 		parser = docker.JSONParser
 	default:
-		parser = lineParser.NoopParser
+		var err error
+		if parser, err = lineParser.New(source.Config.Parser); err != nil {
+			logutil.BgLogger().Warn("invalid parser, the lines are sent as is", zap.String("source", source.Name), zap.Error(err))
+			parser = lineParser.NoopParser
+		}
 	}
 	var tagProvider tag.Provider
 	if source.Config.Identifier != "" {
@@ -246,7 +250,7 @@ func (t *Tailer) forwardMessages() {
 		// We don't return directly to keep the same shutdown sequence that in the
 		// normal case.
 		select {
-		case t.outputChan <- message.NewMessage(output.Content, origin, output.Status):
+		case t.outputChan <- output.NewMessage(origin):
 		case <-t.forwardContext.Done():
 		}
 	}
@@ -31,12 +31,17 @@ type Tailer struct {
 
 // NewTailer returns a new Tailer
 func NewTailer(source *config.LogSource, conn net.Conn, outputChan chan *message.Message, read func(*Tailer) ([]byte, error)) *Tailer {
+	lineParser, err := parser.New(source.Config.Parser)
+	if err != nil {
+		logutil.BgLogger().Warn("invalid parser, the lines are sent as is", zap.String("source", source.Name), zap.Error(err))
+		lineParser = parser.NoopParser
+	}
 	return &Tailer{
 		source:     source,
 		conn:       conn,
 		outputChan: outputChan,
 		read:       read,
-		decoder:    decoder.InitializeDecoder(source, parser.NoopParser),
+		decoder:    decoder.InitializeDecoder(source, lineParser),
 		stop:       make(chan struct{}, 1),
 		done:       make(chan struct{}, 1),
 	}
@@ -63,7 +68,7 @@ func (t *Tailer) forwardMessages() {
 		t.done <- struct{}{}
 	}()
 	for output := range t.decoder.OutputChan {
-		t.outputChan <- message.NewMessageWithSource(output.Content, message.StatusInfo, t.source)
+		t.outputChan <- output.NewMessage(message.NewOrigin(t.source))
 	}
 }
 
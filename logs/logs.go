@@ -8,22 +8,28 @@ package logs
 import (
 	"errors"
 	"fmt"
+	"os"
 	"sync/atomic"
 
 	"github.com/frankhang/doppler/logs/metrics"
 
 	"github.com/frankhang/util/logutil"
 
+	coreConfig "github.com/frankhang/doppler/config"
 	"github.com/frankhang/doppler/logs/config"
+	"github.com/frankhang/doppler/logs/parser"
+	"github.com/frankhang/doppler/logs/processor"
 	"github.com/frankhang/doppler/logs/scheduler"
 	"github.com/frankhang/doppler/logs/service"
 	"github.com/frankhang/doppler/logs/status"
+	coreMetrics "github.com/frankhang/doppler/metrics"
 )
 
 const (
 	// key used to display a warning message on the agent status
 	invalidProcessingRules = "invalid_global_processing_rules"
 	invalidEndpoints       = "invalid_endpoints"
+	invalidSources         = "invalid_sources"
 )
 
 var (
@@ -36,8 +42,9 @@ var (
 	adScheduler *scheduler.Scheduler
 )
 
-// Start starts logs-agent
-func Start() error {
+// Start starts logs-agent, the metrics extracted from the logs are sent in
+// batches of the sample pool to samplesOut, tagged with the hostname
+func Start(samplePool *coreMetrics.MetricSamplePool, samplesOut chan<- []coreMetrics.MetricSample, hostname string) error {
 	if IsAgentRunning() {
 		return nil
 	}
@@ -50,7 +57,7 @@ func Start() error {
 	adScheduler = scheduler.NewScheduler(sources, services)
 
 	// setup the server config
-	endpoints, err := config.BuildEndpoints()
+	endpoints, err := config.BuildLogsEndpoints()
 	if err != nil {
 		message := fmt.Sprintf("Invalid endpoints: %v", err)
 		status.AddGlobalError(invalidEndpoints, message)
@@ -61,24 +68,51 @@ func Start() error {
 	status.Init(&isRunning, endpoints, sources, metrics.LogsExpvars)
 
 	// setup global processing rules
-	processingRules, err := config.GlobalProcessingRules()
+	processingRules, err := config.ConfiguredProcessingRules()
 	if err != nil {
 		message := fmt.Sprintf("Invalid processing rules: %v", err)
 		status.AddGlobalError(invalidProcessingRules, message)
 		return errors.New(message)
 	}
 
+	// setup the sources of the config file
+	configuredSources, err := config.ConfiguredSources()
+	if err == nil {
+		// the parsers are built by the tailers, the grok patterns are
+		// only known to compile once built
+		for _, source := range configuredSources {
+			if _, parserErr := parser.New(source.Config.Parser); parserErr != nil {
+				err = fmt.Errorf("source %s: %v", source.Name, parserErr)
+				break
+			}
+		}
+	}
+	if err != nil {
+		message := fmt.Sprintf("Invalid sources: %v", err)
+		status.AddGlobalError(invalidSources, message)
+		return errors.New(message)
+	}
+
+	// the offsets of the sources are kept in the run path
+	if err = os.MkdirAll(coreConfig.Cfg.Logs.RunPath, 0755); err != nil {
+		return fmt.Errorf("could not create the run path: %v", err)
+	}
+
 	// setup and start the agent
-	agent = NewAgent(sources, services, processingRules, endpoints)
+	metricSink := &processor.MetricSink{Pool: samplePool, SamplesC: samplesOut, Hostname: hostname}
+	agent = NewAgent(sources, services, processingRules, endpoints, metricSink)
 	logutil.BgLogger().Info("Starting logs-agent...")
 	agent.Start()
 	atomic.StoreInt32(&isRunning, 1)
 	logutil.BgLogger().Info("logs-agent started")
 
-	// add the default sources
+	// add the default sources and those of the config file
 	for _, source := range config.DefaultSources() {
 		sources.AddSource(source)
 	}
+	for _, source := range configuredSources {
+		sources.AddSource(source)
+	}
 
 	return nil
 }
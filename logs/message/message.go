@@ -5,13 +5,22 @@
 
 package message
 
-import "github.com/frankhang/doppler/logs/config"
+import (
+	"time"
+
+	"github.com/frankhang/doppler/logs/config"
+)
 
 // Message represents a log line sent to datadog, with its metadata
 type Message struct {
 	Content []byte
 	Origin  *Origin
 	status  string
+
+	// the fields parsed out of the line by the parser of the source,
+	// Timestamp is zero when unknown
+	Timestamp  time.Time
+	Attributes map[string]interface{}
 }
 
 // NewMessageWithSource constructs message with content, status and log source.
@@ -51,6 +51,12 @@ var (
 	// TlmEncodedBytesSent is the total number of sent bytes after encoding if any
 	TlmEncodedBytesSent = telemetry.NewCounter("logs", "encoded_bytes_sent",
 		nil, "Total number of sent bytes after encoding if any")
+
+	// MetricsExtracted is the total number of metric samples extracted from the logs
+	MetricsExtracted = expvar.Int{}
+	// TlmMetricsExtracted is the total number of metric samples extracted from the logs
+	TlmMetricsExtracted = telemetry.NewCounter("logs", "metrics_extracted",
+		nil, "Total number of metric samples extracted from the logs")
 	// TODO: Add LogsCollected for the total number of collected logs.
 
 )
@@ -64,4 +70,5 @@ func init() {
 	LogsExpvars.Set("DestinationLogsDropped", &DestinationLogsDropped)
 	LogsExpvars.Set("BytesSent", &BytesSent)
 	LogsExpvars.Set("EncodedBytesSent", &EncodedBytesSent)
+	LogsExpvars.Set("MetricsExtracted", &MetricsExtracted)
 }
@@ -0,0 +1,167 @@
+package parser
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// grokPatterns are the patterns a grok pattern can refer to by name,
+// a subset of the logstash ones
+var grokPatterns = map[string]string{
+	"USERNAME":     `[a-zA-Z0-9._-]+`,
+	"USER":         `%{USERNAME}`,
+	"INT":          `(?:[+-]?(?:[0-9]+))`,
+	"BASE10NUM":    `(?:[+-]?(?:[0-9]+(?:\.[0-9]+)?|\.[0-9]+))`,
+	"NUMBER":       `(?:%{BASE10NUM})`,
+	"POSINT":       `\b(?:[1-9][0-9]*)\b`,
+	"NONNEGINT":    `\b(?:[0-9]+)\b`,
+	"WORD":         `\b\w+\b`,
+	"NOTSPACE":     `\S+`,
+	"SPACE":        `\s*`,
+	"DATA":         `.*?`,
+	"GREEDYDATA":   `.*`,
+	"QUOTEDSTRING": `(?:"(?:[^"\\]|\\.)*"|'(?:[^'\\]|\\.)*')`,
+	"QS":           `%{QUOTEDSTRING}`,
+	"UUID":         `[A-Fa-f0-9]{8}-(?:[A-Fa-f0-9]{4}-){3}[A-Fa-f0-9]{12}`,
+
+	"IPV4":     `(?:(?:25[0-5]|2[0-4][0-9]|1?[0-9]{1,2})\.){3}(?:25[0-5]|2[0-4][0-9]|1?[0-9]{1,2})`,
+	"IPV6":     `(?:[0-9A-Fa-f]{0,4}:){2,7}[0-9A-Fa-f]{0,4}`,
+	"IP":       `(?:%{IPV6}|%{IPV4})`,
+	"HOSTNAME": `\b(?:[0-9A-Za-z][0-9A-Za-z-]{0,62})(?:\.(?:[0-9A-Za-z][0-9A-Za-z-]{0,62}))*\.?\b`,
+	"IPORHOST": `(?:%{IP}|%{HOSTNAME})`,
+	"HOSTPORT": `%{IPORHOST}:%{POSINT}`,
+
+	"PATH":         `(?:/[^\s?]*)+`,
+	"URIPATH":      `(?:/[A-Za-z0-9$.+!*'(){},~:;=@#%&_\-]*)+`,
+	"URIPARAM":     `\?[A-Za-z0-9$.+!*'|(){},~@#%&/=:;_?\-\[\]<>]*`,
+	"URIPATHPARAM": `%{URIPATH}(?:%{URIPARAM})?`,
+
+	"MONTH":             `\b(?:[Jj]an(?:uary)?|[Ff]eb(?:ruary)?|[Mm]ar(?:ch)?|[Aa]pr(?:il)?|[Mm]ay|[Jj]un(?:e)?|[Jj]ul(?:y)?|[Aa]ug(?:ust)?|[Ss]ep(?:tember)?|[Oo]ct(?:ober)?|[Nn]ov(?:ember)?|[Dd]ec(?:ember)?)\b`,
+	"MONTHNUM":          `(?:0?[1-9]|1[0-2])`,
+	"MONTHDAY":          `(?:0[1-9]|[12][0-9]|3[01]|[1-9])`,
+	"YEAR":              `\d\d(?:\d\d)?`,
+	"HOUR":              `(?:2[0123]|[01]?[0-9])`,
+	"MINUTE":            `(?:[0-5][0-9])`,
+	"SECOND":            `(?:[0-5]?[0-9]|60)(?:[:.,][0-9]+)?`,
+	"TIME":              `%{HOUR}:%{MINUTE}(?::%{SECOND})?`,
+	"ISO8601_TIMEZONE":  `(?:Z|[+-]%{HOUR}(?::?%{MINUTE}))`,
+	"TIMESTAMP_ISO8601": `%{YEAR}-%{MONTHNUM}-%{MONTHDAY}[T ]%{HOUR}:?%{MINUTE}(?::?%{SECOND})?%{ISO8601_TIMEZONE}?`,
+	"HTTPDATE":          `%{MONTHDAY}/%{MONTH}/%{YEAR}:%{TIME} %{INT}`,
+	"SYSLOGTIMESTAMP":   `%{MONTH} +%{MONTHDAY} %{TIME}`,
+
+	"LOGLEVEL": `(?:[Aa]lert|ALERT|[Tt]race|TRACE|[Dd]ebug|DEBUG|[Nn]otice|NOTICE|[Ii]nfo|INFO|[Ww]arn(?:ing)?|WARN(?:ING)?|[Ee]rr(?:or)?|ERR(?:OR)?|[Cc]rit(?:ical)?|CRIT(?:ICAL)?|[Ff]atal|FATAL|[Ss]evere|SEVERE|[Ee]merg(?:ency)?|EMERG(?:ENCY)?)`,
+
+	"COMMONAPACHELOG":   `%{IPORHOST:client} %{NOTSPACE:ident} %{NOTSPACE:auth} \[%{HTTPDATE:timestamp}\] "(?:%{WORD:method} %{NOTSPACE:request}(?: HTTP/%{NUMBER:http_version})?|%{DATA:raw_request})" %{NUMBER:status_code:int} (?:%{NUMBER:bytes:int}|-)`,
+	"COMBINEDAPACHELOG": `%{COMMONAPACHELOG} "%{DATA:referrer}" "%{DATA:agent}"`,
+}
+
+// grokReference is a reference to a pattern: %{NAME}, %{NAME:field} or
+// %{NAME:field:type}, the type is int or float
+var grokReference = regexp.MustCompile(`%{(\w+)(?::([\w.@-]+))?(?::(int|float))?}`)
+
+// maxGrokDepth limits the nesting of the references, against the cycles
+const maxGrokDepth = 16
+
+// grok matches the lines with a regex expanded from a grok pattern
+type grok struct {
+	regex  *regexp.Regexp
+	fields map[string]grokField // by name of capture group
+}
+
+type grokField struct {
+	name      string
+	valueType string
+}
+
+// compileGrok expands the pattern with the custom and the default patterns
+func compileGrok(pattern string, custom map[string]string) (*grok, error) {
+	g := &grok{fields: make(map[string]grokField)}
+	expanded, err := g.expand(pattern, custom, 0)
+	if err != nil {
+		return nil, err
+	}
+	if g.regex, err = regexp.Compile(expanded); err != nil {
+		return nil, fmt.Errorf("invalid grok pattern %s: %v", pattern, err)
+	}
+	return g, nil
+}
+
+// expand replaces the references of the pattern by their patterns, the
+// references naming a field become capture groups named after their index
+// as the field names aren't valid group names
+func (g *grok) expand(pattern string, custom map[string]string, depth int) (string, error) {
+	if depth > maxGrokDepth {
+		return "", errors.New("grok patterns nested too deep")
+	}
+
+	var b strings.Builder
+	last := 0
+	for _, m := range grokReference.FindAllStringSubmatchIndex(pattern, -1) {
+		name := pattern[m[2]:m[3]]
+		definition, ok := custom[name]
+		if !ok {
+			definition, ok = grokPatterns[name]
+		}
+		if !ok {
+			return "", fmt.Errorf("unknown grok pattern %s", name)
+		}
+		expanded, err := g.expand(definition, custom, depth+1)
+		if err != nil {
+			return "", err
+		}
+
+		b.WriteString(pattern[last:m[0]])
+		last = m[1]
+		if m[4] < 0 {
+			b.WriteString("(?:" + expanded + ")")
+			continue
+		}
+		field := grokField{name: pattern[m[4]:m[5]]}
+		if m[6] >= 0 {
+			field.valueType = pattern[m[6]:m[7]]
+		}
+		group := "grok" + strconv.Itoa(len(g.fields))
+		g.fields[group] = field
+		b.WriteString("(?P<" + group + ">" + expanded + ")")
+	}
+	b.WriteString(pattern[last:])
+	return b.String(), nil
+}
+
+// parse returns the fields captured in the line, the empty ones are skipped.
+// The named groups of the pattern are fields too.
+func (g *grok) parse(line []byte) (map[string]interface{}, error) {
+	match := g.regex.FindSubmatch(line)
+	if match == nil {
+		return nil, errors.New("cannot parse the line, no match of the grok pattern")
+	}
+
+	values := make(map[string]interface{})
+	for i, group := range g.regex.SubexpNames() {
+		if group == "" || len(match[i]) == 0 {
+			continue
+		}
+		field, ok := g.fields[group]
+		if !ok {
+			field = grokField{name: group}
+		}
+		value := string(match[i])
+		switch field.valueType {
+		case "int":
+			if n, err := strconv.ParseInt(value, 10, 64); err == nil {
+				values[field.name] = n
+				continue
+			}
+		case "float":
+			if n, err := strconv.ParseFloat(value, 64); err == nil {
+				values[field.name] = n
+				continue
+			}
+		}
+		values[field.name] = value
+	}
+	return values, nil
+}
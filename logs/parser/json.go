@@ -0,0 +1,19 @@
+package parser
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+)
+
+// parseJSON returns the fields of a JSON object, the numbers are kept as
+// written
+func parseJSON(line []byte) (map[string]interface{}, error) {
+	decoder := json.NewDecoder(bytes.NewReader(line))
+	decoder.UseNumber()
+	var values map[string]interface{}
+	if err := decoder.Decode(&values); err != nil || values == nil {
+		return nil, fmt.Errorf("cannot parse the line, invalid JSON object: %v", err)
+	}
+	return values, nil
+}
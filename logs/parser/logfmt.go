@@ -0,0 +1,67 @@
+package parser
+
+import (
+	"errors"
+	"strconv"
+)
+
+var errNotLogfmt = errors.New("cannot parse the line, no logfmt key=value pair")
+
+// parseLogfmt returns the key=value pairs of a logfmt line, the values are
+// strings, unquoted if quoted, and the keys without value are true.
+// For example:
+// level=info msg="request done" path=/api ms=12 cached
+// returns:
+// {"level":"info","msg":"request done","path":"/api","ms":"12","cached":true}
+func parseLogfmt(line []byte) (map[string]interface{}, error) {
+	values := make(map[string]interface{})
+	pairs := 0
+	for i := 0; i < len(line); {
+		if line[i] == ' ' || line[i] == '\t' {
+			i++
+			continue
+		}
+
+		start := i
+		for i < len(line) && line[i] != '=' && line[i] != ' ' && line[i] != '\t' {
+			i++
+		}
+		key := string(line[start:i])
+		if i == len(line) || line[i] != '=' {
+			values[key] = true
+			continue
+		}
+		i++
+
+		start = i
+		if i < len(line) && line[i] == '"' {
+			for i++; i < len(line) && line[i] != '"'; i++ {
+				if line[i] == '\\' {
+					i++
+				}
+			}
+			if i >= len(line) {
+				return nil, errNotLogfmt
+			}
+			i++
+			value, err := strconv.Unquote(string(line[start:i]))
+			if err != nil {
+				return nil, errNotLogfmt
+			}
+			values[key] = value
+		} else {
+			for i < len(line) && line[i] != ' ' && line[i] != '\t' {
+				i++
+			}
+			values[key] = string(line[start:i])
+		}
+		if key != "" {
+			pairs++
+		}
+	}
+	if pairs == 0 {
+		return nil, errNotLogfmt
+	}
+	delete(values, "")
+	return values, nil
+}
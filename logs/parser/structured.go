@@ -0,0 +1,295 @@
+package parser
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/frankhang/doppler/logs/config"
+	"github.com/frankhang/doppler/logs/message"
+)
+
+// the fields tried in order when the parser names none
+var (
+	timestampFields = []string{"timestamp", "time", "ts", "@timestamp"}
+	statusFields    = []string{"level", "status", "severity", "lvl"}
+	messageFields   = []string{"message", "msg", "@message"}
+)
+
+// the layouts tried in order when the parser has no timestamp format
+var timestampLayouts = []string{
+	time.RFC3339Nano,
+	"2006-01-02 15:04:05.999999999Z07:00",
+	"2006-01-02 15:04:05.999999999",
+	"2006-01-02T15:04:05.999999999",
+	"02/Jan/2006:15:04:05 -0700",
+	time.RFC1123Z,
+	time.RFC1123,
+}
+
+// Fields are the structured fields a StructuredParser lifts out of a line
+type Fields struct {
+	Timestamp  time.Time
+	Attributes map[string]interface{}
+}
+
+// StructuredParser parses the lines into a message, a status and fields,
+// the decoders use ParseFields rather than Parse
+type StructuredParser interface {
+	Parser
+	ParseFields([]byte) ([]byte, string, *Fields, error)
+}
+
+// New returns the parser of the config, NoopParser if there is none
+func New(c *config.ParserConfig) (Parser, error) {
+	if c == nil {
+		return NoopParser, nil
+	}
+	p := &structuredParser{
+		timestampFields: fieldOrDefaults(c.TimestampField, timestampFields),
+		timestampFormat: c.TimestampFormat,
+		statusFields:    fieldOrDefaults(c.StatusField, statusFields),
+		messageFields:   fieldOrDefaults(c.MessageField, messageFields),
+		attributes:      c.Attributes,
+	}
+	switch c.Type {
+	case config.JSONParser:
+		p.parse = parseJSON
+	case config.LogfmtParser:
+		p.parse = parseLogfmt
+	case config.GrokParser:
+		grok, err := compileGrok(c.Pattern, c.Patterns)
+		if err != nil {
+			return nil, err
+		}
+		p.parse = grok.parse
+	default:
+		return nil, fmt.Errorf("parser type %s is not supported", c.Type)
+	}
+	return p, nil
+}
+
+func fieldOrDefaults(field string, defaults []string) []string {
+	if field != "" {
+		return []string{field}
+	}
+	return defaults
+}
+
+// structuredParser lifts the timestamp, the status, the message and the
+// attributes out of the fields of the lines
+type structuredParser struct {
+	parse func([]byte) (map[string]interface{}, error)
+
+	timestampFields []string
+	timestampFormat string
+	statusFields    []string
+	messageFields   []string
+	attributes      []string
+}
+
+// Parse returns the message, the status and the timestamp of the line
+func (p *structuredParser) Parse(line []byte) ([]byte, string, string, error) {
+	content, status, fields, err := p.ParseFields(line)
+	var timestamp string
+	if fields != nil && !fields.Timestamp.IsZero() {
+		timestamp = fields.Timestamp.Format(time.RFC3339Nano)
+	}
+	return content, status, timestamp, err
+}
+
+// ParseFields returns the message, the status and the fields of the line,
+// the line is the message when it has no message field. The line is
+// returned as is when it can't be parsed.
+// For example, parsed as json:
+// {"ts":"2020-05-06T10:11:12Z","level":"warn","msg":"slow query","ms":1250}
+// returns:
+// "slow query", "warn", {2020-05-06 10:11:12 +0000 UTC, {"ms":1250}}, nil
+func (p *structuredParser) ParseFields(line []byte) ([]byte, string, *Fields, error) {
+	values, err := p.parse(line)
+	if err != nil {
+		return line, "", nil, err
+	}
+
+	fields := &Fields{}
+	if value := take(values, p.timestampFields); value != nil {
+		fields.Timestamp, _ = toTimestamp(value, p.timestampFormat)
+	}
+	var status string
+	if value := take(values, p.statusFields); value != nil {
+		status = toStatus(value)
+	}
+	content := line
+	if value := take(values, p.messageFields); value != nil {
+		content = []byte(toString(value))
+	}
+
+	if len(p.attributes) == 0 {
+		if len(values) > 0 {
+			fields.Attributes = values
+		}
+		return content, status, fields, nil
+	}
+	for _, path := range p.attributes {
+		if value := lookup(values, path); value != nil {
+			if fields.Attributes == nil {
+				fields.Attributes = make(map[string]interface{})
+			}
+			fields.Attributes[path] = value
+		}
+	}
+	return content, status, fields, nil
+}
+
+// take removes and returns the first field of the paths found in the values
+func take(values map[string]interface{}, paths []string) interface{} {
+	for _, path := range paths {
+		parent, key := values, path
+		if i := strings.LastIndexByte(path, '.'); i > 0 {
+			if object, ok := lookup(values, path[:i]).(map[string]interface{}); ok {
+				parent, key = object, path[i+1:]
+			}
+		}
+		if value, ok := parent[key]; ok && value != nil {
+			delete(parent, key)
+			return value
+		}
+	}
+	return nil
+}
+
+// lookup returns the field of the dotted path, nil if there is none
+func lookup(values map[string]interface{}, path string) interface{} {
+	if value, ok := values[path]; ok {
+		return value
+	}
+	var field interface{} = values
+	for _, key := range strings.Split(path, ".") {
+		object, ok := field.(map[string]interface{})
+		if !ok {
+			return nil
+		}
+		field = object[key]
+	}
+	return field
+}
+
+// toStatus returns the status of a level, of its name or of its number
+// as logged by bunyan and pino, empty if unknown
+func toStatus(level interface{}) string {
+	if n, ok := toNumber(level); ok {
+		switch {
+		case n >= 60:
+			return message.StatusCritical
+		case n >= 50:
+			return message.StatusError
+		case n >= 40:
+			return message.StatusWarning
+		case n >= 30:
+			return message.StatusInfo
+		case n >= 10:
+			return message.StatusDebug
+		}
+		return ""
+	}
+	switch strings.ToLower(toString(level)) {
+	case "emerg", "emergency", "panic":
+		return message.StatusEmergency
+	case "alert":
+		return message.StatusAlert
+	case "crit", "critical", "fatal", "severe":
+		return message.StatusCritical
+	case "err", "error", "eror":
+		return message.StatusError
+	case "warn", "warning":
+		return message.StatusWarning
+	case "notice":
+		return message.StatusNotice
+	case "info", "informational", "information":
+		return message.StatusInfo
+	case "debug", "dbug", "trace":
+		return message.StatusDebug
+	}
+	return ""
+}
+
+// toTimestamp returns the time of the value in the format. When there is
+// none, the numbers are seconds, milliseconds, microseconds or nanoseconds
+// since the epoch, by magnitude, and the strings are tried with the usual
+// layouts
+func toTimestamp(value interface{}, format string) (time.Time, bool) {
+	switch format {
+	case "":
+		if n, ok := toNumber(value); ok {
+			return epoch(n), true
+		}
+		s := toString(value)
+		for _, layout := range timestampLayouts {
+			if t, err := time.Parse(layout, s); err == nil {
+				return t, true
+			}
+		}
+		return time.Time{}, false
+	case "unix", "unix_ms", "unix_ns":
+		n, ok := toNumber(value)
+		if !ok {
+			return time.Time{}, false
+		}
+		switch format {
+		case "unix_ms":
+			n *= 1e6
+		case "unix":
+			n *= 1e9
+		}
+		return time.Unix(0, int64(n)), true
+	case "rfc3339":
+		format = time.RFC3339Nano
+	}
+	t, err := time.Parse(format, toString(value))
+	return t, err == nil
+}
+
+// epoch returns the time of a number of seconds, milliseconds, microseconds
+// or nanoseconds since the epoch
+func epoch(n float64) time.Time {
+	switch {
+	case math.Abs(n) < 1e11:
+		n *= 1e9
+	case math.Abs(n) < 1e14:
+		n *= 1e6
+	case math.Abs(n) < 1e17:
+		n *= 1e3
+	}
+	return time.Unix(0, int64(n))
+}
+
+func toNumber(value interface{}) (float64, bool) {
+	switch v := value.(type) {
+	case float64:
+		return v, true
+	case int64:
+		return float64(v), true
+	case json.Number:
+		n, err := v.Float64()
+		return n, err == nil
+	case string:
+		n, err := strconv.ParseFloat(v, 64)
+		return n, err == nil
+	}
+	return 0, false
+}
+
+func toString(value interface{}) string {
+	switch v := value.(type) {
+	case string:
+		return v
+	case json.Number:
+		return v.String()
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	}
+	return fmt.Sprint(value)
+}
@@ -0,0 +1,142 @@
+package parser
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/frankhang/doppler/logs/config"
+)
+
+func TestNewWithoutConfig(t *testing.T) {
+	parser, err := New(nil)
+	assert.Nil(t, err)
+	assert.Equal(t, NoopParser, parser)
+
+	_, err = New(&config.ParserConfig{Type: "xml"})
+	assert.NotNil(t, err)
+}
+
+func TestJSONParser(t *testing.T) {
+	parser, err := New(&config.ParserConfig{Type: config.JSONParser})
+	assert.Nil(t, err)
+	structured := parser.(StructuredParser)
+
+	content, status, fields, err := structured.ParseFields([]byte(`{"ts":"2020-05-06T10:11:12Z","level":"warn","msg":"slow query","ms":1250,"db":{"name":"users"}}`))
+	assert.Nil(t, err)
+	assert.Equal(t, "slow query", string(content))
+	assert.Equal(t, "warn", status)
+	assert.Equal(t, time.Date(2020, 5, 6, 10, 11, 12, 0, time.UTC), fields.Timestamp)
+	assert.Equal(t, map[string]interface{}{"ms": json.Number("1250"), "db": map[string]interface{}{"name": "users"}}, fields.Attributes)
+
+	content, status, timestamp, err := parser.Parse([]byte(`{"time":1588759872000,"level":50,"user":"bob"}`))
+	assert.Nil(t, err)
+	assert.Equal(t, `{"time":1588759872000,"level":50,"user":"bob"}`, string(content))
+	assert.Equal(t, "error", status)
+	parsed, err := time.Parse(time.RFC3339Nano, timestamp)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(1588759872), parsed.Unix())
+
+	content, _, fields, err = structured.ParseFields([]byte("not json"))
+	assert.NotNil(t, err)
+	assert.Equal(t, "not json", string(content))
+	assert.Nil(t, fields)
+}
+
+func TestJSONParserWithFields(t *testing.T) {
+	parser, err := New(&config.ParserConfig{
+		Type:            config.JSONParser,
+		TimestampField:  "event.created",
+		TimestampFormat: "unix",
+		StatusField:     "severity_text",
+		MessageField:    "body",
+		Attributes:      []string{"http.status", "user"},
+	})
+	assert.Nil(t, err)
+
+	content, status, fields, err := parser.(StructuredParser).ParseFields([]byte(`{"event":{"created":1588759872},"severity_text":"INFO","body":"done","http":{"status":200,"method":"GET"},"other":1}`))
+	assert.Nil(t, err)
+	assert.Equal(t, "done", string(content))
+	assert.Equal(t, "info", status)
+	assert.Equal(t, int64(1588759872), fields.Timestamp.Unix())
+	assert.Equal(t, map[string]interface{}{"http.status": json.Number("200")}, fields.Attributes)
+}
+
+func TestLogfmtParser(t *testing.T) {
+	parser, err := New(&config.ParserConfig{Type: config.LogfmtParser})
+	assert.Nil(t, err)
+	structured := parser.(StructuredParser)
+
+	content, status, fields, err := structured.ParseFields([]byte(`time="2020-05-06 10:11:12" level=error msg="request failed: \"timeout\"" path=/api cached`))
+	assert.Nil(t, err)
+	assert.Equal(t, `request failed: "timeout"`, string(content))
+	assert.Equal(t, "error", status)
+	assert.Equal(t, time.Date(2020, 5, 6, 10, 11, 12, 0, time.UTC), fields.Timestamp)
+	assert.Equal(t, map[string]interface{}{"path": "/api", "cached": true}, fields.Attributes)
+
+	content, _, _, err = structured.ParseFields([]byte(`msg="unterminated`))
+	assert.NotNil(t, err)
+	assert.Equal(t, `msg="unterminated`, string(content))
+
+	_, _, _, err = structured.ParseFields([]byte("plain text line"))
+	assert.NotNil(t, err)
+}
+
+func TestGrokParser(t *testing.T) {
+	parser, err := New(&config.ParserConfig{Type: config.GrokParser, Pattern: "%{COMBINEDAPACHELOG}"})
+	assert.Nil(t, err)
+	structured := parser.(StructuredParser)
+
+	line := `127.0.0.1 - frank [10/Oct/2000:13:55:36 -0700] "GET /apache_pb.gif HTTP/1.0" 200 2326 "http://www.example.com/start.html" "Mozilla/4.08"`
+	content, _, fields, err := structured.ParseFields([]byte(line))
+	assert.Nil(t, err)
+	assert.Equal(t, line, string(content))
+	assert.Equal(t, time.Date(2000, 10, 10, 20, 55, 36, 0, time.UTC), fields.Timestamp.UTC())
+	assert.Equal(t, "127.0.0.1", fields.Attributes["client"])
+	assert.Equal(t, "frank", fields.Attributes["auth"])
+	assert.Equal(t, "GET", fields.Attributes["method"])
+	assert.Equal(t, "/apache_pb.gif", fields.Attributes["request"])
+	assert.Equal(t, int64(200), fields.Attributes["status_code"])
+	assert.Equal(t, int64(2326), fields.Attributes["bytes"])
+	assert.Equal(t, "Mozilla/4.08", fields.Attributes["agent"])
+
+	_, _, _, err = structured.ParseFields([]byte("not an access log"))
+	assert.NotNil(t, err)
+}
+
+func TestGrokParserWithCustomPatterns(t *testing.T) {
+	parser, err := New(&config.ParserConfig{
+		Type:     config.GrokParser,
+		Pattern:  `^%{TIMESTAMP_ISO8601:time} \[%{LOGLEVEL:level}\] %{REQUEST_ID:request_id} %{NUMBER:duration:float}ms (?P<message>.*)$`,
+		Patterns: map[string]string{"REQUEST_ID": `req-%{INT}`},
+	})
+	assert.Nil(t, err)
+
+	content, status, fields, err := parser.(StructuredParser).ParseFields([]byte("2020-05-06T10:11:12Z [WARN] req-42 12.5ms slow answer"))
+	assert.Nil(t, err)
+	assert.Equal(t, "slow answer", string(content))
+	assert.Equal(t, "warn", status)
+	assert.Equal(t, time.Date(2020, 5, 6, 10, 11, 12, 0, time.UTC), fields.Timestamp)
+	assert.Equal(t, map[string]interface{}{"request_id": "req-42", "duration": 12.5}, fields.Attributes)
+}
+
+func TestGrokParserInvalidPatterns(t *testing.T) {
+	_, err := New(&config.ParserConfig{Type: config.GrokParser, Pattern: "%{UNKNOWN:field}"})
+	assert.NotNil(t, err)
+
+	_, err = New(&config.ParserConfig{Type: config.GrokParser, Pattern: "%{LOOP}", Patterns: map[string]string{"LOOP": "%{LOOP}"}})
+	assert.NotNil(t, err)
+
+	_, err = New(&config.ParserConfig{Type: config.GrokParser, Pattern: "%{WORD:word}("})
+	assert.NotNil(t, err)
+}
+
+func TestToStatus(t *testing.T) {
+	assert.Equal(t, "critical", toStatus("FATAL"))
+	assert.Equal(t, "warn", toStatus("Warning"))
+	assert.Equal(t, "info", toStatus(json.Number("30")))
+	assert.Equal(t, "debug", toStatus(float64(20)))
+	assert.Equal(t, "", toStatus("verbose"))
+}
@@ -8,11 +8,13 @@ package pipeline
 import (
 	"github.com/frankhang/doppler/logs/client"
 	"github.com/frankhang/doppler/logs/client/http"
+	"github.com/frankhang/doppler/logs/client/kafka"
 	"github.com/frankhang/doppler/logs/client/tcp"
 	"github.com/frankhang/doppler/logs/config"
 	"github.com/frankhang/doppler/logs/message"
 	"github.com/frankhang/doppler/logs/processor"
 	"github.com/frankhang/doppler/logs/sender"
+	"github.com/frankhang/doppler/util/diskqueue"
 )
 
 // Pipeline processes and sends messages to the backend
@@ -22,10 +24,30 @@ type Pipeline struct {
 	sender    *sender.Sender
 }
 
-// NewPipeline returns a new Pipeline
-func NewPipeline(outputChan chan *message.Message, processingRules []*config.ProcessingRule, endpoints *config.Endpoints, destinationsContext *client.DestinationsContext) *Pipeline {
+// NewPipeline returns a new Pipeline, its payloads are written ahead to the
+// queue if any
+func NewPipeline(outputChan chan *message.Message, processingRules []*config.ProcessingRule, endpoints *config.Endpoints, destinationsContext *client.DestinationsContext, metricSink *processor.MetricSink, queue *diskqueue.Queue) *Pipeline {
 	var destinations *client.Destinations
-	if endpoints.UseHTTP {
+	if endpoints.UseKafka {
+		main := kafka.NewDestination(endpoints.Main, true, destinationsContext)
+		additionals := []client.Destination{}
+		for _, endpoint := range endpoints.Additionals {
+			additionals = append(additionals, kafka.NewDestination(endpoint, true, destinationsContext))
+		}
+		destinations = client.NewDestinations(main, additionals)
+	} else if endpoints.UseLoki {
+		main := http.NewLokiDestination(endpoints.Main, destinationsContext)
+		additionals := []client.Destination{}
+		for _, endpoint := range endpoints.Additionals {
+			if endpoint.Kafka != nil {
+				// the push requests of loki are produced as is
+				additionals = append(additionals, kafka.NewDestination(endpoint, false, destinationsContext))
+				continue
+			}
+			additionals = append(additionals, http.NewLokiDestination(endpoint, destinationsContext))
+		}
+		destinations = client.NewDestinations(main, additionals)
+	} else if endpoints.UseHTTP {
 		main := http.NewDestination(endpoints.Main, http.JSONContentType, destinationsContext)
 		additionals := []client.Destination{}
 		for _, endpoint := range endpoints.Additionals {
@@ -44,15 +66,21 @@ func NewPipeline(outputChan chan *message.Message, processingRules []*config.Pro
 	senderChan := make(chan *message.Message, config.ChanSize)
 
 	var strategy sender.Strategy
-	if endpoints.UseHTTP {
+	if endpoints.UseKafka {
+		strategy = sender.NewBatchStrategy(kafka.NewSerializer(endpoints.Main), endpoints.BatchWait)
+	} else if endpoints.UseLoki {
+		strategy = sender.NewBatchStrategy(http.NewLokiSerializer(endpoints.Main), endpoints.BatchWait)
+	} else if endpoints.UseHTTP {
 		strategy = sender.NewBatchStrategy(sender.ArraySerializer, endpoints.BatchWait)
 	} else {
 		strategy = sender.StreamStrategy
 	}
-	sender := sender.NewSender(senderChan, outputChan, destinations, strategy)
+	sender := sender.NewSender(senderChan, outputChan, destinations, strategy, queue)
 
 	var encoder processor.Encoder
-	if endpoints.UseHTTP {
+	if endpoints.UseLoki {
+		encoder = processor.LineEncoder
+	} else if endpoints.UseHTTP || endpoints.UseKafka {
 		encoder = processor.JSONEncoder
 	} else if endpoints.UseProto {
 		encoder = processor.ProtoEncoder
@@ -61,7 +89,7 @@ func NewPipeline(outputChan chan *message.Message, processingRules []*config.Pro
 	}
 
 	inputChan := make(chan *message.Message, config.ChanSize)
-	processor := processor.New(inputChan, senderChan, processingRules, encoder)
+	processor := processor.New(inputChan, senderChan, processingRules, encoder, metricSink)
 
 	return &Pipeline{
 		InputChan: inputChan,
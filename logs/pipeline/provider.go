@@ -6,13 +6,20 @@
 package pipeline
 
 import (
+	"path/filepath"
+	"strconv"
 	"sync/atomic"
 
+	"github.com/frankhang/util/logutil"
+	"go.uber.org/zap"
+
 	"github.com/frankhang/doppler/logs/auditor"
 	"github.com/frankhang/doppler/logs/client"
 	"github.com/frankhang/doppler/logs/config"
 	"github.com/frankhang/doppler/logs/message"
+	"github.com/frankhang/doppler/logs/processor"
 	"github.com/frankhang/doppler/logs/restart"
+	"github.com/frankhang/doppler/util/diskqueue"
 )
 
 // Provider provides message channels
@@ -33,10 +40,13 @@ type provider struct {
 	pipelines            []*Pipeline
 	currentPipelineIndex int32
 	destinationsContext  *client.DestinationsContext
+	metricSink           *processor.MetricSink
+	diskBuffer           *diskqueue.Options
 }
 
-// NewProvider returns a new Provider
-func NewProvider(numberOfPipelines int, auditor *auditor.Auditor, processingRules []*config.ProcessingRule, endpoints *config.Endpoints, destinationsContext *client.DestinationsContext) Provider {
+// NewProvider returns a new Provider, the payloads of each pipeline are
+// written ahead to a queue of the disk buffer if any
+func NewProvider(numberOfPipelines int, auditor *auditor.Auditor, processingRules []*config.ProcessingRule, endpoints *config.Endpoints, destinationsContext *client.DestinationsContext, metricSink *processor.MetricSink, diskBuffer *diskqueue.Options) Provider {
 	return &provider{
 		numberOfPipelines:   numberOfPipelines,
 		auditor:             auditor,
@@ -44,6 +54,8 @@ func NewProvider(numberOfPipelines int, auditor *auditor.Auditor, processingRule
 		endpoints:           endpoints,
 		pipelines:           []*Pipeline{},
 		destinationsContext: destinationsContext,
+		metricSink:          metricSink,
+		diskBuffer:          diskBuffer,
 	}
 }
 
@@ -53,12 +65,28 @@ func (p *provider) Start() {
 	p.outputChan = p.auditor.Channel()
 
 	for i := 0; i < p.numberOfPipelines; i++ {
-		pipeline := NewPipeline(p.outputChan, p.processingRules, p.endpoints, p.destinationsContext)
+		pipeline := NewPipeline(p.outputChan, p.processingRules, p.endpoints, p.destinationsContext, p.metricSink, p.openQueue(i))
 		pipeline.Start()
 		p.pipelines = append(p.pipelines, pipeline)
 	}
 }
 
+// openQueue returns the disk queue of the pipeline, nil if there is no disk
+// buffer or if the queue can't be opened
+func (p *provider) openQueue(i int) *diskqueue.Queue {
+	if p.diskBuffer == nil {
+		return nil
+	}
+	options := *p.diskBuffer
+	options.Dir = filepath.Join(options.Dir, strconv.Itoa(i))
+	queue, err := diskqueue.Open("logs_"+strconv.Itoa(i), options)
+	if err != nil {
+		logutil.BgLogger().Error("Could not open the disk buffer of the pipeline, its payloads are sent from memory", zap.Error(err))
+		return nil
+	}
+	return queue
+}
+
 // Stop stops all pipelines in parallel,
 // this call blocks until all pipelines are stopped
 func (p *provider) Stop() {
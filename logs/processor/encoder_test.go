@@ -7,18 +7,28 @@ package processor
 
 import (
 	"encoding/json"
+	"os"
 	"testing"
 
 	"strings"
 
 	"time"
 
+	coreConfig "github.com/frankhang/doppler/config"
 	"github.com/frankhang/doppler/logs/config"
 	"github.com/frankhang/doppler/logs/message"
 	"github.com/frankhang/doppler/logs/pb"
 	"github.com/stretchr/testify/assert"
 )
 
+func TestMain(m *testing.M) {
+	// the encoders read the hostname of the config
+	cfg := coreConfig.DefaultConf
+	cfg.HostName = "test-host"
+	coreConfig.Cfg = &cfg
+	os.Exit(m.Run())
+}
+
 func TestRawEncoder(t *testing.T) {
 
 	logsConfig := &config.LogsConfig{
@@ -221,6 +231,49 @@ func TestJsonEncoder(t *testing.T) {
 	assert.NotEmpty(t, log.Timestamp)
 }
 
+func TestLineEncoder(t *testing.T) {
+	source := config.NewLogSource("", &config.LogsConfig{Service: "Service"})
+	msg := newMessage([]byte("message"), source, message.StatusError)
+
+	line, err := LineEncoder.Encode(msg, []byte("redacted\xfe"))
+	assert.Nil(t, err)
+	assert.Equal(t, "redacted\uFFFD", string(line))
+}
+
+func TestJsonEncoderAttributes(t *testing.T) {
+	source := config.NewLogSource("", &config.LogsConfig{Service: "Service"})
+	msg := newMessage([]byte("message"), source, message.StatusInfo)
+	msg.Timestamp = time.Date(2020, 5, 6, 10, 11, 12, 0, time.UTC)
+	msg.Attributes = map[string]interface{}{"user": "bob", "ms": json.Number("1250")}
+
+	jsonMessage, err := JSONEncoder.Encode(msg, []byte("message"))
+	assert.Nil(t, err)
+
+	log := &jsonPayload{}
+	err = json.Unmarshal(jsonMessage, log)
+	assert.Nil(t, err)
+	assert.Equal(t, msg.Timestamp.UnixNano()/int64(time.Millisecond), log.Timestamp)
+	assert.Equal(t, "test-host", log.Hostname)
+	assert.Equal(t, map[string]interface{}{"user": "bob", "ms": float64(1250)}, log.Attributes)
+}
+
+func TestLineEncoderAttributes(t *testing.T) {
+	source := config.NewLogSource("", &config.LogsConfig{Service: "Service"})
+	msg := newMessage([]byte("message"), source, message.StatusInfo)
+	msg.Attributes = map[string]interface{}{
+		"user":   "bob",
+		"query":  "select 1",
+		"empty":  "",
+		"ms":     json.Number("1250"),
+		"cached": true,
+		"db":     map[string]interface{}{"name": "users"},
+	}
+
+	line, err := LineEncoder.Encode(msg, []byte("slow query"))
+	assert.Nil(t, err)
+	assert.Equal(t, `slow query cached=true db="{\"name\":\"users\"}" empty="" ms=1250 query="select 1" user=bob`, string(line))
+}
+
 func TestEncoderToValidUTF8(t *testing.T) {
 	assert.Equal(t, "a�z", toValidUtf8([]byte("a\xfez")))
 	assert.Equal(t, "a��z", toValidUtf8([]byte("a\xc0\xafz")))
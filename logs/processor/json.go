@@ -29,17 +29,25 @@ type jsonPayload struct {
 	Service   string `json:"service"`
 	Source    string `json:"ddsource"`
 	Tags      string `json:"ddtags"`
+
+	Attributes map[string]interface{} `json:"attributes,omitempty"`
 }
 
-// Encode encodes a message into a JSON byte array.
+// Encode encodes a message into a JSON byte array, timestamped with the
+// time parsed out of the message if any.
 func (j *jsonEncoder) Encode(msg *message.Message, redactedMsg []byte) ([]byte, error) {
+	timestamp := msg.Timestamp
+	if timestamp.IsZero() {
+		timestamp = time.Now()
+	}
 	return json.Marshal(jsonPayload{
-		Message:   toValidUtf8(redactedMsg),
-		Status:    msg.GetStatus(),
-		Timestamp: time.Now().UTC().UnixNano() / nanoToMillis,
-		Hostname:  getHostname(),
-		Service:   msg.Origin.Service(),
-		Source:    msg.Origin.Source(),
-		Tags:      msg.Origin.TagsToString(),
+		Message:    toValidUtf8(redactedMsg),
+		Status:     msg.GetStatus(),
+		Timestamp:  timestamp.UTC().UnixNano() / nanoToMillis,
+		Hostname:   getHostname(),
+		Service:    msg.Origin.Service(),
+		Source:     msg.Origin.Source(),
+		Tags:       msg.Origin.TagsToString(),
+		Attributes: msg.Attributes,
 	})
 }
@@ -0,0 +1,69 @@
+package processor
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/frankhang/doppler/logs/message"
+)
+
+// LineEncoder is a shared line encoder.
+var LineEncoder Encoder = &lineEncoder{}
+
+// lineEncoder keeps the content of a message as its line, the metadata of the
+// message are sent aside, e.g. as the labels of a Loki stream.
+type lineEncoder struct{}
+
+// Encode returns the redacted content of the message as valid UTF-8, followed
+// by the attributes parsed out of the message as logfmt key=value pairs.
+func (l *lineEncoder) Encode(msg *message.Message, redactedMsg []byte) ([]byte, error) {
+	if len(msg.Attributes) == 0 {
+		return []byte(toValidUtf8(redactedMsg)), nil
+	}
+
+	keys := make([]string, 0, len(msg.Attributes))
+	for key := range msg.Attributes {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	var b strings.Builder
+	b.WriteString(toValidUtf8(redactedMsg))
+	for _, key := range keys {
+		b.WriteByte(' ')
+		b.WriteString(key)
+		b.WriteByte('=')
+		b.WriteString(logfmtValue(msg.Attributes[key]))
+	}
+	return []byte(b.String()), nil
+}
+
+// logfmtValue returns the value written in logfmt, quoted when needed, the
+// objects and the arrays are written in JSON
+func logfmtValue(value interface{}) string {
+	var s string
+	switch v := value.(type) {
+	case string:
+		s = v
+	case map[string]interface{}, []interface{}:
+		b, err := json.Marshal(v)
+		if err != nil {
+			return `""`
+		}
+		s = string(b)
+	default:
+		s = fmt.Sprint(v)
+	}
+	if s == "" || strings.IndexFunc(s, needsQuote) >= 0 {
+		return strconv.Quote(s)
+	}
+	return s
+}
+
+func needsQuote(r rune) bool {
+	return r <= ' ' || r == '=' || r == '"' || r == utf8.RuneError
+}
@@ -0,0 +1,201 @@
+package processor
+
+import (
+	"encoding/json"
+	"strconv"
+	"strings"
+
+	"github.com/frankhang/util/logutil"
+	"go.uber.org/zap"
+
+	"github.com/frankhang/doppler/logs/config"
+	"github.com/frankhang/doppler/logs/message"
+	"github.com/frankhang/doppler/logs/metrics"
+	coreMetrics "github.com/frankhang/doppler/metrics"
+)
+
+// MetricSink receives the metric samples extracted from the logs by the
+// extract_metric rules, in batches taken from its pool
+type MetricSink struct {
+	Pool     *coreMetrics.MetricSamplePool
+	SamplesC chan<- []coreMetrics.MetricSample
+	Hostname string
+}
+
+// extractMetric adds the sample of the metric rule if the content matches it
+func (p *Processor) extractMetric(rule *config.ProcessingRule, content []byte, msg *message.Message) {
+	if p.sink == nil || !rule.Regex.Match(content) {
+		return
+	}
+
+	var value float64
+	var tags []string
+	var ok bool
+	if rule.Metric.JSON {
+		value, tags, ok = extractJSON(rule.Metric, content, msg.Attributes)
+	} else {
+		value, tags, ok = extractCaptures(rule, content)
+	}
+	if !ok {
+		logutil.BgLogger().Debug("unable to extract metric", zap.String("rule", rule.Name))
+		return
+	}
+
+	sample := coreMetrics.MetricSample{
+		Name:       rule.Metric.Name,
+		Value:      value,
+		Mtype:      metricType(rule.Metric.Type),
+		Tags:       append(tags, msg.Origin.LogSource.Config.Tags...),
+		Host:       p.sink.Hostname,
+		SampleRate: 1,
+	}
+	p.addSample(sample)
+	metrics.MetricsExtracted.Add(1)
+	metrics.TlmMetricsExtracted.Inc()
+}
+
+// extractCaptures returns the value and the tags of the named captures of
+// the pattern, the tags are all the captures but the value when the rule
+// lists none
+func extractCaptures(rule *config.ProcessingRule, content []byte) (float64, []string, bool) {
+	match := rule.Regex.FindSubmatch(content)
+	if match == nil {
+		return 0, nil, false
+	}
+
+	value := float64(1)
+	var tags []string
+	for i, name := range rule.Regex.SubexpNames() {
+		if name == "" {
+			continue
+		}
+		if name == rule.Metric.Value {
+			v, err := strconv.ParseFloat(string(match[i]), 64)
+			if err != nil {
+				return 0, nil, false
+			}
+			value = v
+			continue
+		}
+		if len(match[i]) > 0 && (len(rule.Metric.Tags) == 0 || contains(rule.Metric.Tags, name)) {
+			tags = append(tags, name+":"+string(match[i]))
+		}
+	}
+	return value, tags, true
+}
+
+// extractJSON returns the value and the tags of the fields of the JSON line,
+// or of the attributes parsed out of the line by the parser of its source
+func extractJSON(metric *config.MetricRule, content []byte, attributes map[string]interface{}) (float64, []string, bool) {
+	fields := attributes
+	if fields == nil {
+		if err := json.Unmarshal(content, &fields); err != nil {
+			return 0, nil, false
+		}
+	}
+
+	value := float64(1)
+	if metric.Value != "" {
+		var s string
+		switch v := lookup(fields, metric.Value).(type) {
+		case float64:
+			value = v
+		case int64:
+			value = float64(v)
+		case json.Number:
+			s = v.String()
+		case string:
+			s = v
+		default:
+			return 0, nil, false
+		}
+		if s != "" {
+			parsed, err := strconv.ParseFloat(s, 64)
+			if err != nil {
+				return 0, nil, false
+			}
+			value = parsed
+		}
+	}
+
+	var tags []string
+	for _, path := range metric.Tags {
+		var tag string
+		switch v := lookup(fields, path).(type) {
+		case string:
+			tag = v
+		case float64:
+			tag = strconv.FormatFloat(v, 'f', -1, 64)
+		case int64:
+			tag = strconv.FormatInt(v, 10)
+		case json.Number:
+			tag = v.String()
+		case bool:
+			tag = strconv.FormatBool(v)
+		}
+		if tag != "" {
+			tags = append(tags, path+":"+tag)
+		}
+	}
+	return value, tags, true
+}
+
+// lookup returns the field named path or at the dotted path, nil if there
+// is none
+func lookup(fields map[string]interface{}, path string) interface{} {
+	if field, ok := fields[path]; ok {
+		return field
+	}
+	var field interface{} = fields
+	for _, key := range strings.Split(path, ".") {
+		object, ok := field.(map[string]interface{})
+		if !ok {
+			return nil
+		}
+		field = object[key]
+	}
+	return field
+}
+
+func metricType(t string) coreMetrics.MetricType {
+	switch t {
+	case config.GaugeMetric:
+		return coreMetrics.GaugeType
+	case config.HistogramMetric:
+		return coreMetrics.HistogramType
+	default:
+		return coreMetrics.CounterType
+	}
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// addSample adds the sample to the current batch, sent once full
+func (p *Processor) addSample(sample coreMetrics.MetricSample) {
+	if p.samples == nil {
+		p.samples = p.sink.Pool.GetBatch()
+		p.samplesCount = 0
+	}
+	p.samples[p.samplesCount] = sample
+	p.samplesCount++
+	if p.samplesCount == len(p.samples) {
+		p.flushSamples()
+	}
+}
+
+// flushSamples sends the current batch of samples to the sink
+func (p *Processor) flushSamples() {
+	if p.samplesCount == 0 {
+		return
+	}
+	p.sink.SamplesC <- p.samples[:p.samplesCount]
+	p.samples = nil
+	p.samplesCount = 0
+}
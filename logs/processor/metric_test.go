@@ -0,0 +1,121 @@
+package processor
+
+import (
+	"regexp"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/frankhang/doppler/logs/config"
+	"github.com/frankhang/doppler/logs/message"
+	coreMetrics "github.com/frankhang/doppler/metrics"
+)
+
+func newMetricProcessor(rules ...*config.ProcessingRule) (*Processor, chan []coreMetrics.MetricSample) {
+	samplesC := make(chan []coreMetrics.MetricSample, 10)
+	p := &Processor{
+		processingRules: rules,
+		sink:            &MetricSink{Pool: coreMetrics.NewMetricSamplePool(2), SamplesC: samplesC, Hostname: "host1"},
+	}
+	return p, samplesC
+}
+
+func newMetricRule(pattern string, metric *config.MetricRule) *config.ProcessingRule {
+	return &config.ProcessingRule{
+		Type:    config.ExtractMetric,
+		Name:    "test",
+		Pattern: pattern,
+		Metric:  metric,
+		Regex:   regexp.MustCompile(pattern),
+	}
+}
+
+func TestExtractMetricCaptures(t *testing.T) {
+	pattern := `"(?P<method>[A-Z]+) \S+ HTTP/[\d.]+" (?P<status>\d+)`
+	p, samplesC := newMetricProcessor(
+		newMetricRule(pattern, &config.MetricRule{Name: "nginx.requests", Type: config.CounterMetric}),
+		newMetricRule(pattern+` (?P<duration>[\d.]+)`, &config.MetricRule{Name: "nginx.latency", Type: config.HistogramMetric, Value: "duration", Tags: []string{"status"}}),
+	)
+	source := config.NewLogSource("", &config.LogsConfig{Tags: []string{"env:prod"}})
+
+	shouldProcess, _ := p.applyRedactingRules(newMessage([]byte(`10.0.0.1 "GET /api HTTP/1.1" 200 0.125`), source, ""))
+	assert.True(t, shouldProcess)
+	p.applyRedactingRules(newMessage([]byte(`unrelated line`), source, ""))
+	p.applyRedactingRules(newMessage([]byte(`10.0.0.1 "POST /api HTTP/1.1" 500 1.2.3`), source, ""))
+	p.flushSamples()
+
+	// the batches are as large as the samples of the pool
+	samples := append(<-samplesC, <-samplesC...)
+	require.Len(t, samples, 3)
+	assert.Equal(t, coreMetrics.MetricSample{
+		Name:       "nginx.requests",
+		Value:      1,
+		Mtype:      coreMetrics.CounterType,
+		Tags:       []string{"method:GET", "status:200", "env:prod"},
+		Host:       "host1",
+		SampleRate: 1,
+	}, samples[0])
+	assert.Equal(t, "nginx.latency", samples[1].Name)
+	assert.Equal(t, coreMetrics.HistogramType, samples[1].Mtype)
+	assert.Equal(t, 0.125, samples[1].Value)
+	assert.Equal(t, []string{"status:200", "env:prod"}, samples[1].Tags)
+	// the latency of the last line isn't a number
+	assert.Equal(t, "nginx.requests", samples[2].Name)
+	assert.Equal(t, []string{"method:POST", "status:500", "env:prod"}, samples[2].Tags)
+	assert.Len(t, samplesC, 0)
+}
+
+func TestExtractMetricJSON(t *testing.T) {
+	p, samplesC := newMetricProcessor(newMetricRule(`"level":"info"`, &config.MetricRule{
+		Name:  "app.latency",
+		Type:  config.GaugeMetric,
+		Value: "http.duration",
+		Tags:  []string{"http.route", "http.status", "missing"},
+		JSON:  true,
+	}))
+	source := config.NewLogSource("", &config.LogsConfig{})
+
+	p.applyRedactingRules(newMessage([]byte(`{"level":"info","http":{"route":"/api","status":200,"duration":"42.5"}}`), source, ""))
+	p.applyRedactingRules(newMessage([]byte(`{"level":"debug","http":{"route":"/api","status":200,"duration":1}}`), source, ""))
+	p.applyRedactingRules(newMessage([]byte(`{"level":"info","http":{"route":"/api"}}`), source, ""))
+	p.applyRedactingRules(newMessage([]byte(`"level":"info" not json`), source, ""))
+	p.flushSamples()
+
+	samples := <-samplesC
+	require.Len(t, samples, 1)
+	assert.Equal(t, "app.latency", samples[0].Name)
+	assert.Equal(t, coreMetrics.GaugeType, samples[0].Mtype)
+	assert.Equal(t, 42.5, samples[0].Value)
+	assert.Equal(t, []string{"http.route:/api", "http.status:200"}, samples[0].Tags)
+}
+
+func TestExtractMetricWithoutSink(t *testing.T) {
+	p := &Processor{processingRules: []*config.ProcessingRule{
+		newMetricRule(`(?P<status>\d+)`, &config.MetricRule{Name: "requests", Type: config.CounterMetric}),
+	}}
+	source := config.NewLogSource("", &config.LogsConfig{})
+
+	shouldProcess, redactedMessage := p.applyRedactingRules(newMessage([]byte("200"), source, ""))
+	assert.True(t, shouldProcess)
+	assert.Equal(t, []byte("200"), redactedMessage)
+	p.flushSamples()
+}
+
+func TestProcessorFlushesSamples(t *testing.T) {
+	inputChan := make(chan *message.Message, 10)
+	outputChan := make(chan *message.Message, 10)
+	samplesC := make(chan []coreMetrics.MetricSample, 10)
+	rule := newMetricRule(`(?P<status>\d+)`, &config.MetricRule{Name: "requests", Type: config.CounterMetric})
+	sink := &MetricSink{Pool: coreMetrics.NewMetricSamplePool(32), SamplesC: samplesC}
+	p := New(inputChan, outputChan, []*config.ProcessingRule{rule}, LineEncoder, sink)
+	p.Start()
+
+	source := config.NewLogSource("", &config.LogsConfig{})
+	inputChan <- newMessage([]byte("200"), source, "")
+	samples := <-samplesC
+	require.Len(t, samples, 1)
+	assert.Equal(t, []string{"status:200"}, samples[0].Tags)
+	<-outputChan
+	p.Stop()
+}
@@ -12,6 +12,7 @@ import (
 	"github.com/frankhang/doppler/logs/config"
 	"github.com/frankhang/doppler/logs/message"
 	"github.com/frankhang/doppler/logs/metrics"
+	coreMetrics "github.com/frankhang/doppler/metrics"
 )
 
 // A Processor updates messages from an inputChan and pushes
@@ -22,16 +23,22 @@ type Processor struct {
 	processingRules []*config.ProcessingRule
 	encoder         Encoder
 	done            chan struct{}
+
+	sink         *MetricSink
+	samples      []coreMetrics.MetricSample // batch of the extracted samples
+	samplesCount int
 }
 
-// New returns an initialized Processor.
-func New(inputChan, outputChan chan *message.Message, processingRules []*config.ProcessingRule, encoder Encoder) *Processor {
+// New returns an initialized Processor, the metrics extracted from the logs
+// are sent to the sink, dropped if nil.
+func New(inputChan, outputChan chan *message.Message, processingRules []*config.ProcessingRule, encoder Encoder, sink *MetricSink) *Processor {
 	return &Processor{
 		inputChan:       inputChan,
 		outputChan:      outputChan,
 		processingRules: processingRules,
 		encoder:         encoder,
 		done:            make(chan struct{}),
+		sink:            sink,
 	}
 }
 
@@ -50,12 +57,18 @@ func (p *Processor) Stop() {
 // run starts the processing of the inputChan
 func (p *Processor) run() {
 	defer func() {
+		p.flushSamples()
 		p.done <- struct{}{}
 	}()
 	for msg := range p.inputChan {
 		metrics.LogsDecoded.Add(1)
 		metrics.TlmLogsDecoded.Inc()
-		if shouldProcess, redactedMsg := p.applyRedactingRules(msg); shouldProcess {
+		shouldProcess, redactedMsg := p.applyRedactingRules(msg)
+		// the samples are sent in batches while the logs keep coming
+		if len(p.inputChan) == 0 {
+			p.flushSamples()
+		}
+		if shouldProcess {
 			metrics.LogsProcessed.Add(1)
 			metrics.TlmLogsProcessed.Inc()
 
@@ -88,7 +101,32 @@ func (p *Processor) applyRedactingRules(msg *message.Message) (bool, []byte) {
 			}
 		case config.MaskSequences:
 			content = rule.Regex.ReplaceAll(content, rule.Placeholder)
+			maskAttributes(msg.Attributes, rule)
+		case config.ExtractMetric:
+			p.extractMetric(rule, content, msg)
 		}
 	}
 	return true, content
 }
+
+// maskAttributes masks the sequences of the string attributes of a message
+// matching the rule, as in its content
+func maskAttributes(attributes map[string]interface{}, rule *config.ProcessingRule) {
+	for key, value := range attributes {
+		attributes[key] = maskValue(value, rule)
+	}
+}
+
+func maskValue(value interface{}, rule *config.ProcessingRule) interface{} {
+	switch v := value.(type) {
+	case string:
+		return string(rule.Regex.ReplaceAll([]byte(v), rule.Placeholder))
+	case map[string]interface{}:
+		maskAttributes(v, rule)
+	case []interface{}:
+		for i := range v {
+			v[i] = maskValue(v[i], rule)
+		}
+	}
+	return value
+}
@@ -128,6 +128,26 @@ func TestMask(t *testing.T) {
 	assert.Equal(t, []byte("New data added to data_values= on prod"), redactedMessage)
 }
 
+func TestMaskAttributes(t *testing.T) {
+	p := &Processor{}
+
+	source := newSource("mask_sequences", "[masked_token]", "tok_\\w+")
+	msg := newMessage([]byte("login with tok_abc"), &source, "")
+	msg.Attributes = map[string]interface{}{
+		"token":   "tok_def",
+		"request": map[string]interface{}{"headers": []interface{}{"Bearer tok_ghi", "gzip"}},
+		"ms":      int64(12),
+	}
+	shouldProcess, redactedMessage := p.applyRedactingRules(msg)
+	assert.Equal(t, true, shouldProcess)
+	assert.Equal(t, []byte("login with [masked_token]"), redactedMessage)
+	assert.Equal(t, map[string]interface{}{
+		"token":   "[masked_token]",
+		"request": map[string]interface{}{"headers": []interface{}{"Bearer [masked_token]", "gzip"}},
+		"ms":      int64(12),
+	}, msg.Attributes)
+}
+
 func TestTruncate(t *testing.T) {
 	p := &Processor{}
 
@@ -7,10 +7,21 @@ package sender
 
 import (
 	"context"
+	"time"
+
+	"github.com/frankhang/util/logutil"
+	"go.uber.org/zap"
 
 	"github.com/frankhang/doppler/logs/client"
 	"github.com/frankhang/doppler/logs/message"
 	"github.com/frankhang/doppler/logs/metrics"
+	"github.com/frankhang/doppler/util/diskqueue"
+)
+
+// the delays between the attempts to send a payload of the disk queue
+const (
+	minDrainBackoff = 100 * time.Millisecond
+	maxDrainBackoff = 30 * time.Second
 )
 
 // Strategy should contain all logic to send logs to a remote destination
@@ -26,29 +37,48 @@ type Sender struct {
 	destinations *client.Destinations
 	strategy     Strategy
 	done         chan struct{}
+
+	queue     *diskqueue.Queue // the payloads are written ahead to, nil if none
+	stopDrain chan struct{}
+	drained   chan struct{}
 }
 
-// NewSender returns a new sender.
-func NewSender(inputChan chan *message.Message, outputChan chan *message.Message, destinations *client.Destinations, strategy Strategy) *Sender {
+// NewSender returns a new sender, the payloads are written ahead to the
+// queue when there is one and sent from it.
+func NewSender(inputChan chan *message.Message, outputChan chan *message.Message, destinations *client.Destinations, strategy Strategy, queue *diskqueue.Queue) *Sender {
 	return &Sender{
 		inputChan:    inputChan,
 		outputChan:   outputChan,
 		destinations: destinations,
 		strategy:     strategy,
 		done:         make(chan struct{}),
+		queue:        queue,
+		stopDrain:    make(chan struct{}),
+		drained:      make(chan struct{}),
 	}
 }
 
 // Start starts the sender.
 func (s *Sender) Start() {
 	go s.run()
+	if s.queue != nil {
+		go s.drain()
+	}
 }
 
 // Stop stops the sender,
-// this call blocks until inputChan is flushed
+// this call blocks until inputChan is flushed,
+// the payloads of the queue not sent yet are kept for the next start.
 func (s *Sender) Stop() {
 	close(s.inputChan)
 	<-s.done
+	if s.queue != nil {
+		close(s.stopDrain)
+		<-s.drained
+		if err := s.queue.Close(); err != nil {
+			logutil.BgLogger().Warn("Could not close the disk queue", zap.Error(err))
+		}
+	}
 }
 
 func (s *Sender) run() {
@@ -58,10 +88,22 @@ func (s *Sender) run() {
 	s.strategy.Send(s.inputChan, s.outputChan, s.send)
 }
 
-// send sends a payload to multiple destinations,
+// send writes a payload to the queue if any, or sends it right away
+func (s *Sender) send(payload []byte) error {
+	if s.queue != nil {
+		err := s.queue.Push(payload)
+		if err == nil {
+			return nil
+		}
+		logutil.BgLogger().Warn("Could not write the payload to the disk queue, sending it now", zap.Error(err))
+	}
+	return s.sendNow(payload)
+}
+
+// sendNow sends a payload to multiple destinations,
 // it will forever retry for the main destination unless the error is not retryable
 // and only try once for additionnal destinations.
-func (s *Sender) send(payload []byte) error {
+func (s *Sender) sendNow(payload []byte) error {
 	for {
 		err := s.destinations.Main.Send(payload)
 		if err != nil {
@@ -77,13 +119,83 @@ func (s *Sender) send(payload []byte) error {
 		break
 	}
 
+	s.sendAdditionals(payload)
+	return nil
+}
+
+func (s *Sender) sendAdditionals(payload []byte) {
 	for _, destination := range s.destinations.Additionals {
 		// send in the background so that the agent does not fall behind
 		// for the main destination
 		destination.SendAsync(payload)
 	}
+}
 
-	return nil
+// drain sends the payloads of the queue in order until the sender stops. A
+// payload is popped once sent to the main destination or rejected by it, the
+// retryable errors are retried with a backoff.
+func (s *Sender) drain() {
+	defer close(s.drained)
+
+	backoff := minDrainBackoff
+	retry := func(err error) bool {
+		logutil.BgLogger().Debug("Could not send the payload of the disk queue, retrying", zap.Duration("backoff", backoff), zap.Error(err))
+		select {
+		case <-time.After(backoff):
+		case <-s.stopDrain:
+			return false
+		}
+		if backoff *= 2; backoff > maxDrainBackoff {
+			backoff = maxDrainBackoff
+		}
+		return true
+	}
+
+	for {
+		select {
+		case <-s.stopDrain:
+			return
+		default:
+		}
+
+		payload, err := s.queue.Peek()
+		if err != nil {
+			if retry(err) {
+				continue
+			}
+			return
+		}
+		if payload == nil {
+			select {
+			case <-s.queue.Pushed():
+				continue
+			case <-s.stopDrain:
+				return
+			}
+		}
+
+		err = s.destinations.Main.Send(payload)
+		if err != nil {
+			metrics.DestinationErrors.Add(1)
+			metrics.TlmDestinationErrors.Inc()
+			if shouldStopSending(err) {
+				return
+			}
+			if _, ok := err.(*client.RetryableError); ok {
+				if retry(err) {
+					continue
+				}
+				return
+			}
+			logutil.BgLogger().Warn("Could not send payload", zap.Error(err))
+		} else {
+			s.sendAdditionals(payload)
+		}
+		backoff = minDrainBackoff
+		if err := s.queue.Pop(); err != nil {
+			logutil.BgLogger().Warn("Could not pop the payload of the disk queue", zap.Error(err))
+		}
+	}
 }
 
 // shouldStopSending returns true if a component should stop sending logs.
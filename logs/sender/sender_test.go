@@ -6,15 +6,21 @@
 package sender
 
 import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"sync"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 
 	"github.com/frankhang/doppler/logs/client"
 	"github.com/frankhang/doppler/logs/client/mock"
 	"github.com/frankhang/doppler/logs/client/tcp"
 	"github.com/frankhang/doppler/logs/config"
 	"github.com/frankhang/doppler/logs/message"
+	"github.com/frankhang/doppler/util/diskqueue"
 )
 
 func newMessage(content []byte, source *config.LogSource, status string) *message.Message {
@@ -36,7 +42,7 @@ func TestSender(t *testing.T) {
 	destination := tcp.AddrToDestination(l.Addr(), destinationsCtx)
 	destinations := client.NewDestinations(destination, nil)
 
-	sender := NewSender(input, output, destinations, StreamStrategy)
+	sender := NewSender(input, output, destinations, StreamStrategy, nil)
 	sender.Start()
 
 	expectedMessage := newMessage([]byte("fake line"), source, "")
@@ -69,7 +75,7 @@ func TestSenderNotBlockedByAdditional(t *testing.T) {
 	additionalDestination := tcp.NewDestination(config.Endpoint{Host: "dont.exist.local", Port: 0}, true, destinationsCtx)
 	destinations := client.NewDestinations(mainDestination, []client.Destination{additionalDestination})
 
-	sender := NewSender(input, output, destinations, StreamStrategy)
+	sender := NewSender(input, output, destinations, StreamStrategy, nil)
 	sender.Start()
 
 	expectedMessage1 := newMessage([]byte("fake line"), source, "")
@@ -87,3 +93,70 @@ func TestSenderNotBlockedByAdditional(t *testing.T) {
 	sender.Stop()
 	destinationsCtx.Stop()
 }
+
+// flakyDestination fails the payloads while it is down
+type flakyDestination struct {
+	sync.Mutex
+	down     bool
+	payloads []string
+	sent     chan struct{}
+}
+
+func (d *flakyDestination) Send(payload []byte) error {
+	d.Lock()
+	defer d.Unlock()
+	if d.down {
+		return client.NewRetryableError(errors.New("down"))
+	}
+	d.payloads = append(d.payloads, string(payload))
+	d.sent <- struct{}{}
+	return nil
+}
+
+func (d *flakyDestination) SendAsync(payload []byte) {}
+
+func (d *flakyDestination) setDown(down bool) {
+	d.Lock()
+	defer d.Unlock()
+	d.down = down
+}
+
+func TestSenderWithDiskQueue(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sender")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	source := config.NewLogSource("", &config.LogsConfig{})
+	destination := &flakyDestination{down: true, sent: make(chan struct{}, 10)}
+	destinations := client.NewDestinations(destination, nil)
+
+	// the messages are acknowledged once on disk while the destination is down
+	queue, err := diskqueue.Open("test", diskqueue.Options{Dir: dir})
+	require.Nil(t, err)
+	input := make(chan *message.Message, 1)
+	output := make(chan *message.Message, 1)
+	sender := NewSender(input, output, destinations, StreamStrategy, queue)
+	sender.Start()
+	for _, line := range []string{"line 1", "line 2"} {
+		input <- newMessage([]byte(line), source, "")
+		<-output
+	}
+	sender.Stop()
+	assert.Empty(t, destination.payloads)
+
+	// and sent in order once it's back, after a restart
+	destination.setDown(false)
+	queue, err = diskqueue.Open("test", diskqueue.Options{Dir: dir})
+	require.Nil(t, err)
+	assert.Equal(t, 2, queue.Len())
+	input = make(chan *message.Message, 1)
+	sender = NewSender(input, output, destinations, StreamStrategy, queue)
+	sender.Start()
+	input <- newMessage([]byte("line 3"), source, "")
+	<-output
+	for i := 0; i < 3; i++ {
+		<-destination.sent
+	}
+	sender.Stop()
+	assert.Equal(t, []string{"line 1", "line 2", "line 3"}, destination.payloads)
+}
@@ -69,6 +69,12 @@ func (b *Builder) formatEndpoint(endpoint config.Endpoint, prefix string) string
 	if endpoint.UseCompression {
 		compression = "compressed"
 	}
+	if endpoint.Kafka != nil {
+		return fmt.Sprintf("%sProducing %s logs to the Kafka topic %s at %s", prefix, compression, endpoint.Kafka.Topic, strings.Join(endpoint.Kafka.Brokers, ","))
+	}
+	if b.endpoints.UseLoki {
+		return fmt.Sprintf("%sSending %s logs to Loki at %s", prefix, compression, endpoint.URL)
+	}
 	var protocol string
 	if b.endpoints.UseHTTP {
 		if endpoint.UseSSL {
@@ -0,0 +1,128 @@
+package mapper
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/frankhang/doppler/config"
+)
+
+// Prometheus types a mapping can export a metric as
+const (
+	ExportTypeGauge     = "gauge"
+	ExportTypeCounter   = "counter"
+	ExportTypeHistogram = "histogram"
+	ExportTypeSummary   = "summary"
+)
+
+// tagActions are the changes of a mapping to the tags of a metric,
+// applied in order: drop, rename, rewrite
+type tagActions struct {
+	drop     map[string]struct{}
+	rename   map[string]string
+	rewrites []tagRewrite
+}
+
+type tagRewrite struct {
+	tag         string
+	regex       *regexp.Regexp
+	replacement string
+}
+
+// ExportMeta is how a mapped metric is exported to prometheus,
+// the zero values keep the defaults
+type ExportMeta struct {
+	Type    string
+	Help    string
+	Buckets []float64
+}
+
+func newTagActions(mapping config.MetricMapping) (*tagActions, error) {
+	if len(mapping.DropTags) == 0 && len(mapping.RenameTags) == 0 && len(mapping.RewriteTags) == 0 {
+		return nil, nil
+	}
+
+	actions := &tagActions{
+		drop:   make(map[string]struct{}, len(mapping.DropTags)),
+		rename: mapping.RenameTags,
+	}
+	for _, tag := range mapping.DropTags {
+		actions.drop[tag] = struct{}{}
+	}
+	for name, newName := range mapping.RenameTags {
+		if name == "" || newName == "" {
+			return nil, fmt.Errorf("rename_tags: tag names can't be empty")
+		}
+	}
+	for i, rw := range mapping.RewriteTags {
+		if rw.Tag == "" {
+			return nil, fmt.Errorf("rewrite_tags num %d: tag is required", i)
+		}
+		regex, err := regexp.Compile(rw.Regex)
+		if err != nil {
+			return nil, fmt.Errorf("rewrite_tags num %d: cannot compile regex: %v", i, err)
+		}
+		actions.rewrites = append(actions.rewrites, tagRewrite{tag: rw.Tag, regex: regex, replacement: rw.Replacement})
+	}
+	return actions, nil
+}
+
+func newExportMeta(mapping config.MetricMapping) (*ExportMeta, error) {
+	if mapping.Type == "" && mapping.Help == "" && len(mapping.Buckets) == 0 {
+		return nil, nil
+	}
+
+	switch mapping.Type {
+	case "", ExportTypeGauge, ExportTypeCounter, ExportTypeHistogram, ExportTypeSummary:
+	default:
+		return nil, fmt.Errorf("invalid type `%s`, must be `gauge`, `counter`, `histogram` or `summary`", mapping.Type)
+	}
+	for i := 1; i < len(mapping.Buckets); i++ {
+		if mapping.Buckets[i] <= mapping.Buckets[i-1] {
+			return nil, fmt.Errorf("buckets must be in increasing order")
+		}
+	}
+	return &ExportMeta{Type: mapping.Type, Help: mapping.Help, Buckets: mapping.Buckets}, nil
+}
+
+// MapTags applies the tag actions of the mapping to tags, in place
+func (r *MapResult) MapTags(tags []string) []string {
+	if r.tagActions == nil {
+		return tags
+	}
+	return r.tagActions.apply(tags)
+}
+
+func (a *tagActions) apply(tags []string) []string {
+	result := tags[:0]
+	for _, tag := range tags {
+		name, value := tag, ""
+		hasValue := false
+		if i := strings.IndexByte(tag, ':'); i >= 0 {
+			name, value, hasValue = tag[:i], tag[i+1:], true
+		}
+
+		if _, ok := a.drop[name]; ok {
+			continue
+		}
+		changed := false
+		if newName, ok := a.rename[name]; ok {
+			name, changed = newName, true
+		}
+		for _, rw := range a.rewrites {
+			if rw.tag == name && rw.regex.MatchString(value) {
+				value, hasValue, changed = rw.regex.ReplaceAllString(value, rw.replacement), true, true
+			}
+		}
+
+		if changed {
+			tag = name
+			if hasValue {
+				tag += ":" + value
+			}
+		}
+		result = append(result, tag)
+	}
+	return result
+}
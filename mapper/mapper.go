@@ -38,16 +38,22 @@ type MappingProfile struct {
 
 // MetricMapping represent one mapping rule
 type MetricMapping struct {
-	name  string
-	tags  map[string]string
-	regex *regexp.Regexp
+	name       string
+	tags       map[string]string
+	regex      *regexp.Regexp
+	drop       bool
+	tagActions *tagActions // nil if the tags are kept as is
+	export     *ExportMeta // nil if exported by default
 }
 
 // MapResult represent the outcome of the mapping
 type MapResult struct {
-	Name    string
-	Tags    []string
-	matched bool
+	Name       string
+	Tags       []string
+	Drop       bool        // the metric must be dropped
+	Export     *ExportMeta // nil if exported by default
+	tagActions *tagActions
+	matched    bool
 }
 
 // NewMetricMapper creates, validates, prepares a new MetricMapper
@@ -79,7 +85,22 @@ func NewMetricMapper(configProfiles []config.MappingProfile, cacheSize int) (*Me
 			if err != nil {
 				return nil, err
 			}
-			profile.Mappings = append(profile.Mappings, &MetricMapping{name: currentMapping.Name, tags: currentMapping.Tags, regex: regex})
+			actions, err := newTagActions(currentMapping)
+			if err != nil {
+				return nil, fmt.Errorf("profile: %s, mapping num %d: %v", profile.Name, i, err)
+			}
+			export, err := newExportMeta(currentMapping)
+			if err != nil {
+				return nil, fmt.Errorf("profile: %s, mapping num %d: %v", profile.Name, i, err)
+			}
+			profile.Mappings = append(profile.Mappings, &MetricMapping{
+				name:       currentMapping.Name,
+				tags:       currentMapping.Tags,
+				regex:      regex,
+				drop:       currentMapping.Drop,
+				tagActions: actions,
+				export:     export,
+			})
 		}
 		profiles = append(profiles, profile)
 	}
@@ -90,6 +111,18 @@ func NewMetricMapper(configProfiles []config.MappingProfile, cacheSize int) (*Me
 	return &MetricMapper{Profiles: profiles, cache: cache}, nil
 }
 
+// BuildMatchRegex compiles a `wildcard` or `regex` match pattern with the
+// same syntax as the mappings
+func BuildMatchRegex(match string, matchType string) (*regexp.Regexp, error) {
+	if matchType == "" {
+		matchType = matchTypeWildcard
+	}
+	if matchType != matchTypeWildcard && matchType != matchTypeRegex {
+		return nil, fmt.Errorf("invalid match type `%s`, must be `wildcard` or `regex`", matchType)
+	}
+	return buildRegex(match, matchType)
+}
+
 func buildRegex(matchRe string, matchType string) (*regexp.Regexp, error) {
 	if matchType == matchTypeWildcard {
 		if !allowedWildcardMatchPattern.MatchString(matchRe) {
@@ -140,7 +173,8 @@ func (m *MetricMapper) Map(metricName string) *MapResult {
 				tags = append(tags, tagKey+":"+tagValue)
 			}
 
-			mapResult := &MapResult{Name: name, matched: true, Tags: tags}
+			mapResult := &MapResult{Name: name, matched: true, Tags: tags,
+				Drop: mapping.drop, Export: mapping.export, tagActions: mapping.tagActions}
 			m.cache.add(metricName, mapResult)
 			return mapResult
 		}
@@ -527,3 +527,76 @@ func getMapper(configString string) (*MetricMapper, error) {
 	}
 	return mapper, err
 }
+
+func TestMappingActions(t *testing.T) {
+	profiles := []config.MappingProfile{
+		{
+			Name:   "test",
+			Prefix: "test.",
+			Mappings: []config.MetricMapping{
+				{Match: "test.debug.*", Name: "test.debug", Drop: true},
+				{
+					Match:      "test.job.*",
+					Name:       "test.job",
+					Tags:       map[string]string{"job": "$1"},
+					DropTags:   []string{"pod"},
+					RenameTags: map[string]string{"svc": "service"},
+					RewriteTags: []config.TagRewrite{
+						{Tag: "path", Regex: `^/users/\d+`, Replacement: "/users/:id"},
+					},
+					Type:    "gauge",
+					Help:    "jobs",
+					Buckets: []float64{1, 2},
+				},
+			},
+		},
+	}
+	mapper, err := NewMetricMapper(profiles, 1000)
+	require.NoError(t, err)
+
+	result := mapper.Map("test.debug.foo")
+	require.NotNil(t, result)
+	assert.True(t, result.Drop)
+
+	result = mapper.Map("test.job.build")
+	require.NotNil(t, result)
+	assert.Equal(t, "test.job", result.Name)
+	assert.False(t, result.Drop)
+	assert.Equal(t, &ExportMeta{Type: "gauge", Help: "jobs", Buckets: []float64{1, 2}}, result.Export)
+
+	tags := append([]string{"pod:p1", "svc:api", "path:/users/42/orders", "env"}, result.Tags...)
+	assert.Equal(t, []string{"service:api", "path:/users/:id/orders", "env", "job:build"}, result.MapTags(tags))
+}
+
+func TestMappingActionsErrors(t *testing.T) {
+	scenarios := []struct {
+		name          string
+		mapping       config.MetricMapping
+		expectedError string
+	}{
+		{
+			name:          "Invalid type",
+			mapping:       config.MetricMapping{Match: "test.a", Name: "a", Type: "timer"},
+			expectedError: "invalid type",
+		},
+		{
+			name:          "Unordered buckets",
+			mapping:       config.MetricMapping{Match: "test.a", Name: "a", Buckets: []float64{2, 1}},
+			expectedError: "increasing order",
+		},
+		{
+			name:          "Invalid rewrite regex",
+			mapping:       config.MetricMapping{Match: "test.a", Name: "a", RewriteTags: []config.TagRewrite{{Tag: "path", Regex: "("}}},
+			expectedError: "cannot compile regex",
+		},
+	}
+
+	for _, scenario := range scenarios {
+		t.Run(scenario.name, func(t *testing.T) {
+			profiles := []config.MappingProfile{{Name: "test", Prefix: "test.", Mappings: []config.MetricMapping{scenario.mapping}}}
+			_, err := NewMetricMapper(profiles, 1000)
+			require.Error(t, err)
+			require.Contains(t, err.Error(), scenario.expectedError)
+		})
+	}
+}
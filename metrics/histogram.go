@@ -18,7 +18,7 @@ import (
 // weightSample represent a sample with its weight in the histogram (deduce from SampleRate)
 type weightSample struct {
 	value  float64
-	weight int64
+	weight float64
 }
 
 type weightSamples []weightSample
@@ -34,7 +34,7 @@ type Histogram struct {
 	interval    int64    // interval over which the `count` value is normalized (bucket interval for Dogstatsd, 1 otherwise)
 	samples     weightSamples
 	sum         float64
-	count       int64
+	count       float64 // weighted, fractional when sampled at a rate like 0.3
 }
 
 const (
@@ -75,6 +75,22 @@ func (h *histogramPercentilesConfig) percentiles() []int {
 	return res
 }
 
+// DefaultHistogramAggregates are the aggregates of the histograms when they
+// are not configured
+var DefaultHistogramAggregates = []string{maxAgg, medianAgg, avgAgg, countAgg}
+
+// DefaultHistogramPercentiles are the percentiles of the histograms when they
+// are not configured
+var DefaultHistogramPercentiles = []int{95}
+
+// SetHistogramDefaults sets the aggregates and the percentiles of the
+// histograms created from now on, instead of reading them from the config
+func SetHistogramDefaults(aggregates []string, percentiles []int) {
+	defaultAggregates = aggregates
+	defaultPercentiles = append([]int(nil), percentiles...)
+	sort.Ints(defaultPercentiles)
+}
+
 // NewHistogram returns a newly initialized histogram
 func NewHistogram(interval int64) *Histogram {
 	// we initialize default value on the first histogram creation
@@ -111,9 +127,9 @@ func (h *Histogram) addSample(sample *MetricSample, timestamp float64) {
 		rate = 1
 	}
 
-	h.samples = append(h.samples, weightSample{sample.Value, int64(1 / rate)}) // add value and its weight
+	h.samples = append(h.samples, weightSample{sample.Value, 1 / rate}) // add value and its weight
 	h.sum += sample.Value * (1 / rate)
-	h.count += int64(1 / rate)
+	h.count += 1 / rate
 }
 
 func (h *Histogram) flush(timestamp float64) ([]*Serie, error) {
@@ -135,7 +151,7 @@ func (h *Histogram) flush(timestamp float64) ([]*Serie, error) {
 		case minAgg:
 			value = h.samples[0].value
 		case medianAgg:
-			weight := int64(0)
+			weight := 0.0
 			target := (h.count - 1) / 2
 			for _, s := range h.samples {
 				weight += s.weight
@@ -145,11 +161,11 @@ func (h *Histogram) flush(timestamp float64) ([]*Serie, error) {
 				}
 			}
 		case avgAgg:
-			value = h.sum / float64(h.count)
+			value = h.sum / h.count
 		case sumAgg:
 			value = h.sum
 		case countAgg:
-			value = float64(h.count) / float64(h.interval)
+			value = h.count / float64(h.interval)
 			mType = APIRateType
 		default:
 			logutil.BgLogger().Info(fmt.Sprintf("Configured aggregate '%s' is not implemented, skipping", aggregate))
@@ -164,13 +180,13 @@ func (h *Histogram) flush(timestamp float64) ([]*Serie, error) {
 	}
 
 	// Compute percentiles
-	var target []int64
+	var target []float64
 	for _, percentile := range h.percentiles {
-		target = append(target, (int64(percentile)*h.count-1)/100)
+		target = append(target, (float64(percentile)*h.count-1)/100)
 	}
 
 	if len(target) > 0 {
-		weight := int64(0)
+		weight := 0.0
 		idx := 0
 		for _, s := range h.samples {
 			weight += s.weight
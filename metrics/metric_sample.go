@@ -5,6 +5,8 @@
 
 package metrics
 
+import "github.com/frankhang/doppler/mapper"
+
 // MetricType is the representation of an aggregator metric type
 type MetricType int
 
@@ -70,6 +72,7 @@ type MetricSample struct {
 	Host       string
 	SampleRate float64
 	Timestamp  float64
+	Export     *mapper.ExportMeta // how a mapping exports the metric, nil by default
 }
 
 // Implement the MetricSampleContext interface
@@ -0,0 +1,71 @@
+package metrics
+
+import (
+	"sort"
+
+	"github.com/frankhang/doppler/aggregator/ckey"
+)
+
+// WeightedSample is a value flushed out of a ContextMetrics for export, along
+// with the number of occurrences it stands for (deduced from SampleRate).
+// Unlike Series, histograms are not reduced to aggregates: every distinct
+// value is flushed once, weighted by its occurrences, so it can be observed
+// by a Prometheus histogram.
+type WeightedSample struct {
+	ContextKey ckey.ContextKey
+	Mtype      MetricType
+	NameSuffix string
+	Value      float64
+	Weight     float64
+}
+
+// FlushWeighted flushes every metrics in the ContextMetrics as weighted samples.
+// Counters are flushed as their total over the interval (not as a rate),
+// unless it is 0, sets as their cardinality.
+// Returns the slice of samples and a map of errors by context key.
+func (m ContextMetrics) FlushWeighted(timestamp float64) ([]WeightedSample, map[ckey.ContextKey]error) {
+	var samples []WeightedSample
+	errors := make(map[ckey.ContextKey]error)
+
+	for contextKey, metric := range m {
+		switch metric := metric.(type) {
+		case *Histogram:
+			sort.Sort(metric.samples)
+			for i, s := range metric.samples {
+				if i > 0 && s.value == metric.samples[i-1].value {
+					samples[len(samples)-1].Weight += s.weight
+					continue
+				}
+				samples = append(samples, WeightedSample{ContextKey: contextKey, Mtype: HistogramType, Value: s.value, Weight: s.weight})
+			}
+			metric.samples = weightSamples{}
+			metric.sum = 0
+			metric.count = 0
+		case *Counter:
+			// an idle counter is sampled with 0 to keep its context alive
+			if metric.sampled && metric.value != 0 {
+				samples = append(samples, WeightedSample{ContextKey: contextKey, Mtype: CounterType, Value: metric.value, Weight: 1})
+			}
+			metric.value, metric.sampled = 0, false
+		default:
+			series, err := metric.flush(timestamp)
+			if err != nil {
+				if _, ok := err.(NoSerieError); !ok {
+					errors[contextKey] = err
+				}
+				continue
+			}
+			for _, serie := range series {
+				mtype := GaugeType
+				if serie.MType == APICountType {
+					mtype = CountType
+				}
+				for _, point := range serie.Points {
+					samples = append(samples, WeightedSample{ContextKey: contextKey, Mtype: mtype, NameSuffix: serie.NameSuffix, Value: point.Value, Weight: 1})
+				}
+			}
+		}
+	}
+
+	return samples, errors
+}
@@ -0,0 +1,63 @@
+package metrics
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/frankhang/doppler/aggregator/ckey"
+)
+
+func TestFlushWeightedHistogramMergesValues(t *testing.T) {
+	SetHistogramDefaults(DefaultHistogramAggregates, DefaultHistogramPercentiles)
+	defer SetHistogramDefaults(nil, nil)
+
+	metrics := MakeContextMetrics()
+	contextKey := ckey.ContextKey{1, 2}
+	for _, s := range []MetricSample{
+		{Value: 5, Mtype: HistogramType, SampleRate: 1},
+		{Value: 2, Mtype: HistogramType, SampleRate: 0.5},
+		{Value: 5, Mtype: HistogramType, SampleRate: 0.25},
+		{Value: 2, Mtype: HistogramType, SampleRate: 1},
+	} {
+		s := s
+		metrics.AddSample(contextKey, &s, 1, 10)
+	}
+
+	samples, errs := metrics.FlushWeighted(12345)
+	assert.Len(t, errs, 0)
+	require.Len(t, samples, 2)
+	assert.Equal(t, WeightedSample{ContextKey: contextKey, Mtype: HistogramType, Value: 2, Weight: 3}, samples[0])
+	assert.Equal(t, WeightedSample{ContextKey: contextKey, Mtype: HistogramType, Value: 5, Weight: 5}, samples[1])
+
+	// the histogram is reset
+	samples, _ = metrics.FlushWeighted(12355)
+	assert.Len(t, samples, 0)
+}
+
+func TestFlushWeightedFractionalWeights(t *testing.T) {
+	SetHistogramDefaults(DefaultHistogramAggregates, DefaultHistogramPercentiles)
+	defer SetHistogramDefaults(nil, nil)
+
+	metrics := MakeContextMetrics()
+	contextKey := ckey.ContextKey{1, 2}
+	for i := 0; i < 3; i++ {
+		metrics.AddSample(contextKey, &MetricSample{Value: 1, Mtype: HistogramType, SampleRate: 0.3}, 1, 10)
+	}
+
+	samples, _ := metrics.FlushWeighted(12345)
+	require.Len(t, samples, 1)
+	assert.InDelta(t, 10, samples[0].Weight, 1e-9)
+}
+
+func TestFlushWeightedSkipsZeroCounters(t *testing.T) {
+	metrics := MakeContextMetrics()
+	idle, active := ckey.ContextKey{1}, ckey.ContextKey{2}
+	metrics.AddSample(idle, &MetricSample{Value: 0, Mtype: CounterType, SampleRate: 1}, 1, 10)
+	metrics.AddSample(active, &MetricSample{Value: 2, Mtype: CounterType, SampleRate: 0.5}, 1, 10)
+
+	samples, _ := metrics.FlushWeighted(12345)
+	require.Len(t, samples, 1)
+	assert.Equal(t, WeightedSample{ContextKey: active, Mtype: CounterType, Value: 4, Weight: 1}, samples[0])
+}
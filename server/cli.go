@@ -0,0 +1,325 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/frankhang/doppler/agent"
+	apiutil "github.com/frankhang/doppler/api/util"
+	. "github.com/frankhang/doppler/config"
+	"github.com/frankhang/doppler/status/render"
+)
+
+// command queries the running instance over its admin API and prints the result
+type command struct {
+	usage string
+	run   func(args []string) error
+}
+
+var commands = map[string]command{
+	"status":          {"print the status of the running instance", statusCommand},
+	"health":          {"print the health of the running instance, exits with 1 if unhealthy", healthCommand},
+	"config":          {"print the effective config of the running instance, secrets redacted", configCommand},
+	"dogstatsd-stats": {"print the most received metrics, [enable|disable] toggles their collection", dogstatsdStatsCommand},
+	"capture":         {"print the status of the packets capture, [start|stop] starts or stops it", captureCommand},
+}
+
+// offlineCommands run on their own, without the admin API
+var offlineCommands = map[string]command{
+	"replay": {"send the packets of a capture file to a server", replayCommand},
+}
+
+// errUnhealthy makes the health command exit with 1 without printing an error
+var errUnhealthy = fmt.Errorf("unhealthy")
+
+// runCommand runs the subcommand name and returns the exit code of the process.
+// The flags may follow the subcommand, e.g. `doppler status -config doppler.toml`.
+func runCommand(name string, args []string) int {
+	cmd, ok := commands[name]
+	offline, isOffline := offlineCommands[name]
+	if !ok && !isOffline {
+		fmt.Fprintf(os.Stderr, "unknown command %q\n\n", name)
+		printCommands(os.Stderr)
+		return 2
+	}
+	if err := flag.CommandLine.Parse(args); err != nil {
+		return 2
+	}
+
+	configWarning := loadConfig()
+	overrideConfig(Cfg)
+	if configWarning != "" {
+		fmt.Fprintln(os.Stderr, configWarning)
+	}
+	if isOffline {
+		return runOffline(offline, flag.Args())
+	}
+	if Cfg.AdminPort == 0 {
+		fmt.Fprintln(os.Stderr, "the admin API is disabled, set admin_port in the config of the running instance")
+		return 1
+	}
+	if err := apiutil.SetAuthToken(); err != nil {
+		fmt.Fprintln(os.Stderr, "unable to read the auth token:", err)
+		return 1
+	}
+
+	if err := cmd.run(flag.Args()); err != nil {
+		if err != errUnhealthy {
+			fmt.Fprintln(os.Stderr, "error:", err)
+		}
+		return 1
+	}
+	return 0
+}
+
+func runOffline(cmd command, args []string) int {
+	if err := cmd.run(args); err != nil {
+		fmt.Fprintln(os.Stderr, "error:", err)
+		return 1
+	}
+	return 0
+}
+
+func usage() {
+	w := flag.CommandLine.Output()
+	fmt.Fprintf(w, "Usage: %s [command] [flags]\n\n", os.Args[0])
+	printCommands(w)
+	fmt.Fprintln(w, "\nWithout command, runs the server. Flags:")
+	flag.PrintDefaults()
+}
+
+func printCommands(w io.Writer) {
+	fmt.Fprintln(w, "Commands, querying the running instance:")
+	printCommandList(w, commands)
+	fmt.Fprintln(w, "\nOffline commands:")
+	printCommandList(w, offlineCommands)
+}
+
+func printCommandList(w io.Writer, commands map[string]command) {
+	names := make([]string, 0, len(commands))
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		fmt.Fprintf(w, "  %-16s %s\n", name, commands[name].usage)
+	}
+}
+
+func adminURL(path string) string {
+	return "https://" + net.JoinHostPort(Cfg.AdminHost, strconv.Itoa(Cfg.AdminPort)) + path
+}
+
+// adminGet gets an endpoint of the admin API and decodes its json response
+func adminGet(path string, v interface{}) error {
+	body, err := apiutil.DoGet(apiutil.GetClient(false), adminURL(path))
+	if err != nil {
+		return apiError(err)
+	}
+	return json.Unmarshal(body, v)
+}
+
+func adminPost(path string) error {
+	return adminPostResult(path, nil)
+}
+
+// adminPostResult posts to an endpoint of the admin API and decodes its json
+// response into v, unless v is nil
+func adminPostResult(path string, v interface{}) error {
+	body, err := apiutil.DoPost(apiutil.GetClient(false), adminURL(path), "application/json", nil)
+	if err != nil || v == nil {
+		return apiError(err)
+	}
+	return json.Unmarshal(body, v)
+}
+
+// apiError unwraps the error message of the admin API responses
+func apiError(err error) error {
+	if err == nil {
+		return nil
+	}
+	var body map[string]string
+	if json.Unmarshal([]byte(err.Error()), &body) == nil && body["error"] != "" {
+		return fmt.Errorf("%s", body["error"])
+	}
+	return fmt.Errorf("could not reach the admin API at %s: %v",
+		net.JoinHostPort(Cfg.AdminHost, strconv.Itoa(Cfg.AdminPort)), err)
+}
+
+func statusCommand(args []string) error {
+	var stats map[string]interface{}
+	if err := adminGet("/agent/status", &stats); err != nil {
+		return err
+	}
+	out, err := render.FormatStatus(stats)
+	if err != nil {
+		return err
+	}
+	fmt.Print(out)
+	return nil
+}
+
+func healthCommand(args []string) error {
+	var stats struct {
+		Health struct {
+			Healthy   []string
+			Unhealthy []string
+			Error     string `json:"error"`
+		} `json:"health"`
+	}
+	if err := adminGet("/agent/status", &stats); err != nil {
+		return err
+	}
+	h := stats.Health
+	if h.Error != "" {
+		return fmt.Errorf("%s", h.Error)
+	}
+
+	fmt.Printf("Healthy:   %s\n", strings.Join(h.Healthy, ", "))
+	fmt.Printf("Unhealthy: %s\n", strings.Join(h.Unhealthy, ", "))
+	if len(h.Unhealthy) > 0 {
+		return errUnhealthy
+	}
+	return nil
+}
+
+func configCommand(args []string) error {
+	var conf json.RawMessage
+	if err := adminGet("/agent/config", &conf); err != nil {
+		return err
+	}
+	var out bytes.Buffer
+	if err := json.Indent(&out, conf, "", "  "); err != nil {
+		return err
+	}
+	fmt.Println(out.String())
+	return nil
+}
+
+func dogstatsdStatsCommand(args []string) error {
+	if len(args) > 0 {
+		switch args[0] {
+		case "enable", "disable":
+			if err := adminPost("/agent/metrics-stats/" + args[0]); err != nil {
+				return err
+			}
+			fmt.Printf("Metrics stats %sd\n", args[0])
+			return nil
+		default:
+			return fmt.Errorf("unknown argument %q, expected enable or disable", args[0])
+		}
+	}
+
+	var stats struct {
+		Enabled bool            `json:"enabled"`
+		Metrics json.RawMessage `json:"metrics"`
+	}
+	if err := adminGet("/agent/metrics-stats", &stats); err != nil {
+		return err
+	}
+	if !stats.Enabled {
+		fmt.Println("Metrics stats are disabled, enable them with `doppler dogstatsd-stats enable`.")
+		return nil
+	}
+
+	out, err := agent.FormatDebugStats(stats.Metrics)
+	if err != nil {
+		return err
+	}
+	fmt.Println(topLines(out, *statsTop))
+	return nil
+}
+
+func captureCommand(args []string) error {
+	var status agent.CaptureStatus
+	if len(args) > 0 {
+		switch args[0] {
+		case "start":
+			query := url.Values{}
+			if *captureDuration > 0 {
+				query.Set("duration", strconv.Itoa(*captureDuration))
+			}
+			if *captureSize > 0 {
+				query.Set("max_size", strconv.FormatInt(*captureSize, 10))
+			}
+			if err := adminPostResult("/agent/capture/start?"+query.Encode(), &status); err != nil {
+				return err
+			}
+		case "stop":
+			if err := adminPostResult("/agent/capture/stop", &status); err != nil {
+				return err
+			}
+		default:
+			return fmt.Errorf("unknown argument %q, expected start or stop", args[0])
+		}
+	} else if err := adminGet("/agent/capture", &status); err != nil {
+		return err
+	}
+	printCaptureStatus(status)
+	return nil
+}
+
+func printCaptureStatus(status agent.CaptureStatus) {
+	if status.Path == "" {
+		fmt.Println("No capture, start one with `doppler capture start`.")
+		return
+	}
+	if status.Running {
+		fmt.Printf("Capturing to %s until %s or %d bytes\n", status.Path, status.Until.Format(time.RFC3339), status.MaxSize)
+	} else {
+		fmt.Printf("Captured to %s\n", status.Path)
+	}
+	fmt.Printf("  Packets: %d\n  Bytes: %d\n", status.Packets, status.Bytes)
+	if status.Error != "" {
+		fmt.Printf("  Error: %s\n", status.Error)
+	}
+}
+
+func replayCommand(args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("expected the path of a capture file")
+	}
+	address := *replayAddr
+	if address == "" {
+		address = "udp://" + net.JoinHostPort("127.0.0.1", strconv.Itoa(int(Cfg.Port)))
+	}
+
+	f, err := os.Open(args[0])
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	r, err := agent.NewCaptureReader(f)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Replaying the capture of %s to %s\n", r.Start.Format(time.RFC3339), address)
+	stats, err := agent.Replay(r, address, *replaySpeed)
+	fmt.Printf("Replayed %d packets (%d bytes) in %s", stats.Packets, stats.Bytes, stats.Duration.Round(time.Millisecond))
+	if stats.Errors > 0 {
+		fmt.Printf(", %d failed", stats.Errors)
+	}
+	fmt.Println()
+	return err
+}
+
+// topLines keeps the header and the n first metrics of the debug stats
+func topLines(stats string, n int) string {
+	lines := strings.Split(strings.TrimRight(stats, "\n"), "\n")
+	if n <= 0 || len(lines) <= n+2 {
+		return strings.Join(lines, "\n")
+	}
+	return strings.Join(lines[:n+2], "\n") + fmt.Sprintf("\n... %d more", len(lines)-n-2)
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	. "github.com/frankhang/doppler/config"
+)
+
+// newTestAdminAPI serves the responses by path as the admin API of the config
+func newTestAdminAPI(t *testing.T, responses map[string]string) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, ok := responses[r.Method+" "+r.URL.Path]
+		if !ok {
+			http.Error(w, `{"error": "not found"}`, http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(w, body)
+	}))
+	t.Cleanup(server.Close)
+
+	host, port, err := net.SplitHostPort(server.Listener.Addr().String())
+	require.NoError(t, err)
+	conf := DefaultConf
+	conf.AdminHost = host
+	conf.AdminPort, err = strconv.Atoi(port)
+	require.NoError(t, err)
+	Cfg = &conf
+}
+
+// captureStdout returns what run prints to the standard output
+func captureStdout(t *testing.T, run func() error) (string, error) {
+	r, w, err := os.Pipe()
+	require.NoError(t, err)
+	stdout := os.Stdout
+	os.Stdout = w
+	defer func() { os.Stdout = stdout }()
+
+	done := make(chan string)
+	go func() {
+		var b bytes.Buffer
+		io.Copy(&b, r)
+		done <- b.String()
+	}()
+	err = run()
+	w.Close()
+	return <-done, err
+}
+
+func TestStatusCommand(t *testing.T) {
+	newTestAdminAPI(t, map[string]string{
+		"GET /agent/status": `{"version": "1.2.0", "pid": 12, "health": {"Healthy": ["agent"]}, "expvars": {"agent": {"Packets": 3}}}`,
+	})
+
+	out, err := captureStdout(t, func() error { return statusCommand(nil) })
+	require.NoError(t, err)
+	assert.Contains(t, out, "Doppler (v1.2.0)")
+	assert.Contains(t, out, "  Pid: 12\n")
+	assert.Contains(t, out, "  Healthy: agent\n")
+	assert.Contains(t, out, "=====\nAgent\n=====\n  Packets: 3\n")
+}
+
+func TestHealthCommand(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		health string
+		out    string
+		err    error
+	}{
+		{name: "healthy", health: `{"Healthy": ["agent", "forwarder"]}`, out: "Healthy:   agent, forwarder\nUnhealthy: \n"},
+		{name: "unhealthy", health: `{"Healthy": ["agent"], "Unhealthy": ["forwarder"]}`, out: "Healthy:   agent\nUnhealthy: forwarder\n", err: errUnhealthy},
+		{name: "error", health: `{"error": "timeout"}`, err: fmt.Errorf("timeout")},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			newTestAdminAPI(t, map[string]string{"GET /agent/status": `{"health": ` + tc.health + `}`})
+
+			out, err := captureStdout(t, func() error { return healthCommand(nil) })
+			assert.Equal(t, tc.err, err)
+			assert.Equal(t, tc.out, out)
+		})
+	}
+}
+
+func TestConfigCommand(t *testing.T) {
+	newTestAdminAPI(t, map[string]string{"GET /agent/config": `{"api_key":"********","port":8125}`})
+
+	out, err := captureStdout(t, func() error { return configCommand(nil) })
+	require.NoError(t, err)
+	assert.Equal(t, "{\n  \"api_key\": \"********\",\n  \"port\": 8125\n}\n", out)
+}
+
+func TestDogstatsdStatsCommand(t *testing.T) {
+	newTestAdminAPI(t, map[string]string{
+		"GET /agent/metrics-stats":         `{"enabled": false}`,
+		"POST /agent/metrics-stats/enable": `{}`,
+	})
+
+	out, err := captureStdout(t, func() error { return dogstatsdStatsCommand(nil) })
+	require.NoError(t, err)
+	assert.Contains(t, out, "Metrics stats are disabled")
+
+	out, err = captureStdout(t, func() error { return dogstatsdStatsCommand([]string{"enable"}) })
+	require.NoError(t, err)
+	assert.Equal(t, "Metrics stats enabled\n", out)
+
+	_, err = captureStdout(t, func() error { return dogstatsdStatsCommand([]string{"disable"}) })
+	assert.EqualError(t, err, "not found")
+
+	_, err = captureStdout(t, func() error { return dogstatsdStatsCommand([]string{"toggle"}) })
+	assert.Error(t, err)
+}
+
+func TestCaptureCommand(t *testing.T) {
+	newTestAdminAPI(t, map[string]string{
+		"GET /agent/capture":       `{}`,
+		"POST /agent/capture/stop": `{"path": "/tmp/doppler.cap", "packets": 2, "bytes": 10}`,
+	})
+
+	out, err := captureStdout(t, func() error { return captureCommand(nil) })
+	require.NoError(t, err)
+	assert.Equal(t, "No capture, start one with `doppler capture start`.\n", out)
+
+	out, err = captureStdout(t, func() error { return captureCommand([]string{"stop"}) })
+	require.NoError(t, err)
+	assert.Equal(t, "Captured to /tmp/doppler.cap\n  Packets: 2\n  Bytes: 10\n", out)
+
+	_, err = captureStdout(t, func() error { return captureCommand([]string{"pause"}) })
+	assert.Error(t, err)
+}
+
+func TestAPIError(t *testing.T) {
+	conf := DefaultConf
+	conf.AdminHost = "127.0.0.1"
+	conf.AdminPort = 5001
+	Cfg = &conf
+
+	assert.Nil(t, apiError(nil))
+	assert.EqualError(t, apiError(fmt.Errorf(`{"error": "forbidden"}`)), "forbidden")
+	assert.EqualError(t, apiError(fmt.Errorf("connection refused")),
+		"could not reach the admin API at 127.0.0.1:5001: connection refused")
+}
+
+func TestTopLines(t *testing.T) {
+	stats := "Metric | Tags | Count\n-------\na | | 3\nb | | 2\nc | | 1\n"
+
+	assert.Equal(t, "Metric | Tags | Count\n-------\na | | 3\n... 2 more", topLines(stats, 1))
+	assert.Equal(t, "Metric | Tags | Count\n-------\na | | 3\nb | | 2\nc | | 1", topLines(stats, 3))
+	assert.Equal(t, "Metric | Tags | Count\n-------\na | | 3\nb | | 2\nc | | 1", topLines(stats, 0))
+}
+
+func TestPrintCommands(t *testing.T) {
+	var b bytes.Buffer
+	printCommands(&b)
+
+	out := b.String()
+	for name := range commands {
+		assert.Contains(t, out, "  "+name+" ")
+	}
+	assert.Contains(t, out, "\nOffline commands:\n  replay ")
+}
@@ -6,10 +6,14 @@ import (
 	"fmt"
 	"github.com/frankhang/doppler/agent"
 	"github.com/frankhang/doppler/aggregator"
+	"github.com/frankhang/doppler/api/admin"
 	"github.com/frankhang/doppler/api/healthprobe"
 	. "github.com/frankhang/doppler/config"
 	e "github.com/frankhang/doppler/exporter"
+	"github.com/frankhang/doppler/exporter/loki"
+	"github.com/frankhang/doppler/exporter/remotewrite"
 	"github.com/frankhang/doppler/forwarder"
+	"github.com/frankhang/doppler/logs"
 	"github.com/frankhang/doppler/metadata"
 	"github.com/frankhang/doppler/metrics"
 	"github.com/frankhang/doppler/serializer"
@@ -18,12 +22,13 @@ import (
 	"github.com/frankhang/doppler/util"
 	"github.com/frankhang/util/config"
 	"github.com/frankhang/util/logutil"
-	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/frankhang/doppler/telemetry"
 	"net/http"
 
 	"go.uber.org/automaxprocs/maxprocs"
 	"os"
 	"os/signal"
+	"path/filepath"
 	"runtime"
 	"strconv"
 	"strings"
@@ -41,7 +46,6 @@ import (
 	"github.com/frankhang/util/systimemon"
 	"github.com/opentracing/opentracing-go"
 
-	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/push"
 	"github.com/struCoder/pidusage"
 	_ "go.uber.org/automaxprocs"
@@ -65,6 +69,11 @@ const (
 	nmMetricsInterval  = "metrics-interval"
 	nmTokenLimit       = "token-limit"
 	nmAffinityCPU                = "affinity-cpus"
+	nmStatsTop         = "top"
+	nmCaptureDuration  = "capture-duration"
+	nmCaptureSize      = "capture-size"
+	nmReplayAddr       = "replay-addr"
+	nmReplaySpeed      = "replay-speed"
 )
 
 var (
@@ -91,8 +100,17 @@ var (
 	metricsAddr     = flag.String(nmMetricsAddr, "", "prometheus pushgateway address, leaves it empty will disable prometheus push.")
 	metricsInterval = flag.Uint(nmMetricsInterval, 15, "prometheus client push interval in second, set \"0\" to disable prometheus push.")
 
+	// Commands
+	statsTop        = flag.Int(nmStatsTop, 20, "number of metrics printed by dogstatsd-stats, set \"0\" to print them all.")
+	captureDuration = flag.Int(nmCaptureDuration, 0, "seconds captured by capture start, \"0\" for the max_duration of the capture config.")
+	captureSize     = flag.Int64(nmCaptureSize, 0, "max bytes captured by capture start, \"0\" for the max_size of the capture config.")
+	replayAddr      = flag.String(nmReplayAddr, "", "udp://, tcp://, unix:// or unixgram:// address replayed to, the udp port of the config by default.")
+	replaySpeed     = flag.Float64(nmReplaySpeed, 1, "speed of the replay relative to the capture, \"0\" to replay as fast as possible.")
+
 	metaScheduler *metadata.Scheduler
 	statsd        *agent.Server
+	remoteWriter  *remotewrite.Sender
+	eventsLoki    *loki.Client
 
 )
 
@@ -105,15 +123,19 @@ var (
 // hotReloadConfigItems lists all config items which support hot-reload.
 
 func main() {
+	flag.Usage = usage
 	flag.Parse()
 	if *version {
 		//fmt.Println(printer.Get...Info())
 		os.Exit(0)
 	}
+	if flag.NArg() > 0 {
+		os.Exit(runCommand(flag.Arg(0), flag.Args()[1:]))
+	}
 
 	registerMetrics()
 	configWarning := loadConfig()
-	overrideConfig()
+	overrideConfig(Cfg)
 	if err := Cfg.Valid(); err != nil {
 		fmt.Fprintln(os.Stderr, "invalidx config", err)
 		errors.MustNil(errors.Trace(err))
@@ -146,17 +168,80 @@ func main() {
 func runExporter() {
 
 	logutil.BgLogger().Info("runExporter...")
-	e.Exporter = e.NewPromExporter()
+	exporter, err := e.NewPromExporter()
+	errors.MustNil(errors.Trace(err))
+	e.Exporter = exporter
 	addr := fmt.Sprintf(":%d", Cfg.PromScrapePort)
 	logutil.BgLogger().Warn(fmt.Sprintf("Listening on %s for prom graspe...", addr))
 
-	http.Handle("/metrics", promhttp.Handler())
+	http.Handle("/metrics", exporter.Handler())
+	http.Handle("/telemetry", telemetry.Handler())
 
 	go func() {
 		err := http.ListenAndServe(addr, nil)
 		errors.MustNil(errors.Trace(err))
 	}()
 
+	if Cfg.RemoteWrite.URL != "" {
+		runRemoteWrite()
+	}
+	if Cfg.EventsLoki.URL != "" {
+		runEventsLoki()
+	}
+}
+
+// runRemoteWrite pushes the exported series to the remote write endpoint
+func runRemoteWrite() {
+	rw := Cfg.RemoteWrite
+	opts := remotewrite.Options{
+		URL:               rw.URL,
+		Interval:          time.Duration(rw.Interval) * time.Second,
+		Timeout:           time.Duration(rw.Timeout) * time.Second,
+		Shards:            rw.Shards,
+		QueueCapacity:     rw.QueueCapacity,
+		MaxSamplesPerSend: rw.MaxSamplesPerSend,
+		BatchSendDeadline: time.Duration(rw.BatchSendDeadline) * time.Millisecond,
+		MaxRetries:        rw.MaxRetries,
+		MinBackoff:        time.Duration(rw.MinBackoff) * time.Millisecond,
+		MaxBackoff:        time.Duration(rw.MaxBackoff) * time.Millisecond,
+		Headers:           rw.Headers,
+		BasicAuthUser:     rw.BasicAuthUser,
+		BasicAuthPassword: rw.BasicAuthPassword,
+		BearerToken:       rw.BearerToken,
+	}
+
+	var err error
+	remoteWriter, err = remotewrite.NewSender(e.Exporter.Gatherer(), opts)
+	errors.MustNil(errors.Trace(err))
+	remoteWriter.Start()
+}
+
+// runEventsLoki forwards the events to Loki as log lines
+func runEventsLoki() {
+	var err error
+	eventsLoki, err = loki.NewClient(lokiOptions("events", Cfg.EventsLoki))
+	errors.MustNil(errors.Trace(err))
+	eventsLoki.Start()
+	e.Exporter.ForwardEvents(eventsLoki)
+}
+
+func lokiOptions(name string, c Loki) loki.Options {
+	return loki.Options{
+		Name:              name,
+		URL:               c.URL,
+		TenantID:          c.TenantID,
+		Timeout:           time.Duration(c.Timeout) * time.Second,
+		QueueCapacity:     c.QueueCapacity,
+		BatchSize:         c.BatchSize,
+		BatchWait:         time.Duration(c.BatchWait) * time.Millisecond,
+		MaxRetries:        c.MaxRetries,
+		MinBackoff:        time.Duration(c.MinBackoff) * time.Millisecond,
+		MaxBackoff:        time.Duration(c.MaxBackoff) * time.Millisecond,
+		Headers:           c.Headers,
+		BasicAuthUser:     c.BasicAuthUser,
+		BasicAuthPassword: c.BasicAuthPassword,
+		BearerToken:       c.BearerToken,
+	}
 }
 
 func exit() {
@@ -217,7 +302,7 @@ func prometheusPushClient(addr string, interval time.Duration) {
 	// TODO: do not have uniq name, so we use host+port to compose a name.
 	job := "iot"
 	pusher := push.New(addr, job)
-	pusher = pusher.Gatherer(prometheus.DefaultGatherer)
+	pusher = pusher.Gatherer(telemetry.Gatherer())
 	pusher = pusher.Grouping("instance", instanceName())
 	for {
 		err := pusher.Push()
@@ -358,7 +443,8 @@ func isDeprecatedConfigItem(items []string) bool {
 }
 
 
-func overrideConfig() {
+// overrideConfig overrides the config c with the flags set on the command line
+func overrideConfig(c *Config) {
 	actualFlags := make(map[string]bool)
 	flag.Visit(func(f *flag.Flag) {
 		actualFlags[f.Name] = true
@@ -366,49 +452,54 @@ func overrideConfig() {
 
 	// Base
 	if actualFlags[nmHost] {
-		Cfg.Host = *host
+		c.Host = *host
 	}
-	if len(Cfg.AdvertiseAddress) == 0 {
-		Cfg.AdvertiseAddress = Cfg.Host
+	if len(c.AdvertiseAddress) == 0 {
+		c.AdvertiseAddress = c.Host
 	}
 	var err error
 	if actualFlags[nmPort] {
 		var p int
 		p, err = strconv.Atoi(*port)
 		errors.MustNil(errors.Trace(err))
-		Cfg.Port = uint(p)
+		c.Port = uint(p)
 	}
 
 	if actualFlags[nmTokenLimit] {
-		Cfg.TokenLimit = uint(*tokenLimit)
+		c.TokenLimit = uint(*tokenLimit)
 	}
 
 	// Log
 	if actualFlags[nmLogLevel] {
-		Cfg.Log.Level = *logLevel
+		c.Log.Level = *logLevel
 	}
 	if actualFlags[nmLogFile] {
-		Cfg.Log.File.Filename = *logFile
+		c.Log.File.Filename = *logFile
 	}
 
 	// Status
 	if actualFlags[nmReportStatus] {
-		Cfg.Status.ReportStatus = *reportStatus
+		c.Status.ReportStatus = *reportStatus
 	}
 	if actualFlags[nmStatusHost] {
-		Cfg.Status.StatusHost = *statusHost
+		c.Status.StatusHost = *statusHost
 	}
 	if actualFlags[nmStatusPort] {
 		var p int
 		p, err = strconv.Atoi(*statusPort)
 		errors.MustNil(errors.Trace(err))
-		Cfg.Status.StatusPort = uint(p)
+		c.Status.StatusPort = uint(p)
 	}
 	if actualFlags[nmMetricsAddr] {
-		Cfg.Status.MetricsAddr = *metricsAddr
+		c.Status.MetricsAddr = *metricsAddr
 	}
 	if actualFlags[nmMetricsInterval] {
-		Cfg.Status.MetricsInterval = *metricsInterval
+		c.Status.MetricsInterval = *metricsInterval
+	}
+
+	// Admin API, the auth token is next to the config file by default
+	if c.AdminAuthTokenFile == "" && *configPath != "" {
+		c.AdminAuthTokenFile = filepath.Join(filepath.Dir(*configPath), "auth_token")
 	}
 
 
@@ -417,11 +508,9 @@ func overrideConfig() {
 
 
 func loadConfig() string {
-	Cfg = GetGlobalConfig()
+	Cfg = NewDefaultConfig()
+	StoreGlobalConfig(Cfg)
 	if *configPath != "" {
-		// Not all config items are supported now.
-		config.SetConfReloader(*configPath, reloadConfig, HotReloadConfigItems...)
-
 		err := Cfg.Load(*configPath)
 		if err == nil {
 			return ""
@@ -453,19 +542,6 @@ func loadConfig() string {
 }
 
 
-func reloadConfig(nc, c *config.Config) {
-	// Just a part of config items need to be reload explicitly.
-	// Some of them like OOMAction are always used by getting from global config directly
-	// like config.GetGlobalConfig().OOMAction.
-	// These config items will become available naturally after the global config pointer
-	// is updated in function ReloadGlobalConfig.
-	if nc.Performance.MaxMemory != c.Performance.MaxMemory {
-		//
-	}
-
-}
-
-
 func runServer() {
 
 	logutil.BgLogger().Info("runServer...")
@@ -473,10 +549,23 @@ func runServer() {
 	errors.MustNil(errors.Trace(err))
 	// Setup a channel to catch OS signals
 	signalCh := make(chan os.Signal, 1)
-	signal.Notify(signalCh, os.Interrupt, syscall.SIGTERM)
+	signal.Notify(signalCh, os.Interrupt, syscall.SIGTERM, syscall.SIGHUP)
+
+	if *configPath != "" {
+		go watchConfig(mainCtx, *configPath)
+	}
 
-	// Block here until we receive the interrupt signal
-	<-signalCh
+	// Block here until we receive the interrupt signal, SIGHUP reloads the config
+	for sig := range signalCh {
+		if sig != syscall.SIGHUP {
+			break
+		}
+		if *configPath == "" {
+			logutil.BgLogger().Warn("SIGHUP ignored, no config file specified")
+			continue
+		}
+		reloadConfig()
+	}
 
 	stopAgent(mainCtx, mainCtxCancel)
 
@@ -539,14 +628,42 @@ func runAgent() (mainCtx context.Context, mainCtxCancel context.CancelFunc, err
 		tagger.Init()
 	}
 
+	// the histogram aggregates are not configured in doppler.toml
+	metrics.SetHistogramDefaults(metrics.DefaultHistogramAggregates, metrics.DefaultHistogramPercentiles)
 	metricSamplePool := metrics.NewMetricSamplePool(32)
-	aggregatorInstance := aggregator.InitAggregator(s, metricSamplePool, hname, "agent")
+	var aggregatorInstance *aggregator.BufferedAggregator
+	if Cfg.ExportAggregation {
+		flushInterval := time.Duration(Cfg.ExportAggregationInterval) * time.Second
+		if flushInterval < time.Second {
+			flushInterval = aggregator.DefaultFlushInterval
+		}
+		aggregatorInstance = aggregator.InitAggregatorWithFlushInterval(s, metricSamplePool, hname, "agent", flushInterval)
+	} else {
+		aggregatorInstance = aggregator.InitAggregator(s, metricSamplePool, hname, "agent")
+	}
 	sampleC, eventC, serviceCheckC := aggregatorInstance.GetBufferedChannels()
 	statsd, err = agent.NewServer(metricSamplePool, sampleC, eventC, serviceCheckC)
 	if err != nil {
 		logutil.BgLogger().Error("Unable to start agent")
 		return nil, nil, errors.Trace(err)
 	}
+
+	if Cfg.Logs.Enabled {
+		if err = logs.Start(metricSamplePool, sampleC, hname); err != nil {
+			logutil.BgLogger().Error("Unable to start logs agent")
+			return nil, nil, errors.Trace(err)
+		}
+	}
+
+	// Setup the admin API
+	if Cfg.AdminPort > 0 {
+		err = admin.Serve(mainCtx, Cfg.AdminHost, Cfg.AdminPort, statsd)
+		if err != nil {
+			err = errors.Trace(err)
+			return
+		}
+		logutil.BgLogger().Info("Admin API listening...", zap.String("host", Cfg.AdminHost), zap.Int("port", Cfg.AdminPort))
+	}
 	return
 }
 
@@ -565,6 +682,13 @@ func stopAgent(ctx context.Context, cancel context.CancelFunc) {
 
 	metaScheduler.Stop()
 	statsd.Stop()
+	logs.Stop()
+	if remoteWriter != nil {
+		remoteWriter.Stop()
+	}
+	if eventsLoki != nil {
+		eventsLoki.Stop()
+	}
 	logutil.BgLogger().Info("See ya!")
 	//log.Flush()
 	return
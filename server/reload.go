@@ -0,0 +1,179 @@
+package main
+
+import (
+	"context"
+	"expvar"
+	"fmt"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/frankhang/util/config"
+	"github.com/frankhang/util/logutil"
+	l "github.com/sirupsen/logrus"
+	"go.uber.org/zap"
+
+	. "github.com/frankhang/doppler/config"
+	e "github.com/frankhang/doppler/exporter"
+	"github.com/frankhang/doppler/telemetry"
+)
+
+var (
+	reloadLock sync.Mutex
+
+	reloadExpvars         = expvar.NewMap("config")
+	reloadSuccesses       = expvar.Int{}
+	reloadErrors          = expvar.Int{}
+	reloadLastSuccess     = expvar.String{}
+	reloadLastError       = expvar.String{}
+	reloadLastErrorTime   = expvar.String{}
+	reloadLastChangeItems = expvar.String{}
+
+	tlmReloads = telemetry.NewCounter("config", "reloads",
+		[]string{"result"}, "Count of config reloads by result")
+	tlmLastReloadSuccessful = telemetry.NewGauge("config", "last_reload_successful",
+		[]string{}, "Whether the last config reload succeeded")
+)
+
+func init() {
+	reloadExpvars.Set("Reloads", &reloadSuccesses)
+	reloadExpvars.Set("ReloadErrors", &reloadErrors)
+	reloadExpvars.Set("LastReload", &reloadLastSuccess)
+	reloadExpvars.Set("LastReloadChanges", &reloadLastChangeItems)
+	reloadExpvars.Set("LastReloadError", &reloadLastError)
+	reloadExpvars.Set("LastReloadErrorTime", &reloadLastErrorTime)
+}
+
+// reloadConfig loads the config file again, and applies the changed items to the
+// running components when they all are in HotReloadConfigItems. The config
+// returned by GetGlobalConfig is swapped with the reloaded one, Cfg keeps the
+// config of the startup. Nothing is applied on error, the result is reported
+// in the status and the telemetry.
+func reloadConfig() error {
+	reloadLock.Lock()
+	defer reloadLock.Unlock()
+
+	items, err := applyConfigFile()
+	now := time.Now().Format(time.RFC3339)
+	if err != nil {
+		reloadErrors.Add(1)
+		reloadLastError.Set(err.Error())
+		reloadLastErrorTime.Set(now)
+		tlmReloads.Inc("error")
+		tlmLastReloadSuccessful.Set(0)
+		logutil.BgLogger().Error("reloadConfig: config not reloaded", zap.String("path", *configPath), zap.Error(err))
+		return err
+	}
+	if len(items) == 0 {
+		return nil
+	}
+
+	reloadSuccesses.Add(1)
+	reloadLastSuccess.Set(now)
+	reloadLastChangeItems.Set(fmt.Sprint(items))
+	tlmReloads.Inc("success")
+	tlmLastReloadSuccessful.Set(1)
+	logutil.BgLogger().Info("reloadConfig: config reloaded", zap.String("path", *configPath), zap.Strings("items", items))
+	return nil
+}
+
+// applyConfigFile returns the items changed in the config file, once applied
+func applyConfigFile() ([]string, error) {
+	nc := NewDefaultConfig()
+	if err := nc.Load(*configPath); err != nil {
+		// unused items are only warned about, like at startup
+		if _, ok := err.(*config.ErrConfigValidationFailed); !ok || *configStrict {
+			return nil, err
+		}
+		logutil.BgLogger().Warn("reloadConfig: unused config items", zap.Error(err))
+	}
+	overrideConfig(nc)
+	if err := nc.Valid(); err != nil {
+		return nil, err
+	}
+
+	current := GetGlobalConfig()
+	diff := CollectsDiff(nc, current)
+	if len(diff) == 0 {
+		return nil, nil
+	}
+	if err := CheckHotReload(diff); err != nil {
+		return nil, err
+	}
+	items := make([]string, 0, len(diff))
+	for item := range diff {
+		items = append(items, item)
+	}
+	sort.Strings(items)
+
+	// validate and prepare everything before swapping anything, nothing
+	// below the preparation can fail
+	level, err := l.ParseLevel(nc.Log.Level)
+	if err != nil {
+		return nil, err
+	}
+	if err = e.CheckSeriesOverflow(nc.ExportSeriesOverflow); err != nil {
+		return nil, err
+	}
+	applyStatsd := func() {}
+	if statsd != nil {
+		if applyStatsd, err = statsd.PrepareReload(nc); err != nil {
+			return nil, err
+		}
+	}
+
+	// the running config is swapped whole, its readers never see it half copied
+	next := *current
+	CopyItems(&next, nc, items)
+
+	applyStatsd()
+	if e.Exporter != nil {
+		ttl := time.Duration(nc.ExportSeriesTTL) * time.Second
+		if err = e.Exporter.SetSeriesLimits(nc.ExportMaxSeriesPerMetric, nc.ExportMaxSeries, nc.ExportSeriesOverflow, ttl); err != nil {
+			// unreachable, the overflow is checked above
+			logutil.BgLogger().Error("reloadConfig: series limits not applied", zap.Error(err))
+		}
+	}
+	logutil.SetLevel(nc.Log.Level)
+	l.SetLevel(level)
+	StoreGlobalConfig(&next)
+	return items, nil
+}
+
+// watchConfig reloads the config when the config file changes, until ctx is done
+func watchConfig(ctx context.Context, path string) {
+	last, _ := os.Stat(path)
+	for {
+		interval := configReloadInterval()
+		wait := interval
+		if wait <= 0 {
+			// not watching, until the interval is set by a SIGHUP
+			wait = time.Minute
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(wait):
+		}
+		if interval <= 0 {
+			continue
+		}
+
+		info, err := os.Stat(path)
+		if err != nil {
+			logutil.BgLogger().Warn("watchConfig: unable to stat the config file", zap.String("path", path), zap.Error(err))
+			continue
+		}
+		if last != nil && info.ModTime().Equal(last.ModTime()) && info.Size() == last.Size() {
+			continue
+		}
+		last = info
+		reloadConfig()
+	}
+}
+
+// configReloadInterval returns the interval of the config file checks, 0 when not watching
+func configReloadInterval() time.Duration {
+	return time.Duration(GetGlobalConfig().ConfigReloadInterval) * time.Second
+}
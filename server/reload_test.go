@@ -0,0 +1,119 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/frankhang/util/logutil"
+	l "github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	. "github.com/frankhang/doppler/config"
+)
+
+// setupReload starts from the default config, as overridden at startup, and
+// returns the path of a config file with the given contents
+func setupReload(t *testing.T, contents string) string {
+	dir, err := ioutil.TempDir("", "reload")
+	require.NoError(t, err)
+	path := filepath.Join(dir, "doppler.toml")
+	require.NoError(t, ioutil.WriteFile(path, []byte(contents), 0600))
+
+	previousPath := *configPath
+	*configPath = path
+	Cfg = NewDefaultConfig()
+	overrideConfig(Cfg)
+	StoreGlobalConfig(Cfg)
+	t.Cleanup(func() {
+		*configPath = previousPath
+		logutil.SetLevel(DefaultConf.Log.Level)
+		l.SetLevel(l.InfoLevel)
+		os.RemoveAll(dir)
+	})
+	return path
+}
+
+func TestApplyConfigFile(t *testing.T) {
+	setupReload(t, "export_max_series = 10\nconfig_reload_interval = 30\n[log]\nlevel = \"debug\"\n")
+	startup := Cfg
+
+	items, err := applyConfigFile()
+	require.NoError(t, err)
+	assert.Equal(t, []string{"Config.Log.Level", "ConfigReloadInterval", "ExportMaxSeries"}, items)
+
+	reloaded := GetGlobalConfig()
+	assert.Equal(t, 10, reloaded.ExportMaxSeries)
+	assert.Equal(t, "debug", reloaded.Log.Level)
+	assert.Equal(t, 30*time.Second, configReloadInterval())
+	assert.Equal(t, l.DebugLevel, l.GetLevel())
+	// the startup config is not written to
+	assert.Equal(t, 0, startup.ExportMaxSeries)
+	assert.Equal(t, DefaultConf.Log.Level, startup.Log.Level)
+
+	// nothing changed since the last reload
+	items, err = applyConfigFile()
+	require.NoError(t, err)
+	assert.Empty(t, items)
+	assert.True(t, reloaded == GetGlobalConfig())
+}
+
+func TestApplyConfigFileErrors(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		contents string
+		err      string
+	}{
+		{name: "not reloadable", contents: "export_max_series = 10\nadmin_port = 5001\n", err: "reloading config [AdminPort] is not supported"},
+		{name: "invalid overflow", contents: "export_max_series = 10\nexport_series_overflow = \"block\"\n", err: "invalid series overflow"},
+		{name: "invalid level", contents: "export_max_series = 10\n[log]\nlevel = \"loud\"\n", err: "not a valid logrus Level"},
+		{name: "invalid file", contents: "export_max_series = \n", err: "export_max_series"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			setupReload(t, tc.contents)
+			current := GetGlobalConfig()
+
+			_, err := applyConfigFile()
+			if assert.Error(t, err) {
+				assert.Contains(t, err.Error(), tc.err)
+			}
+			// nothing is applied
+			assert.True(t, current == GetGlobalConfig())
+			assert.Equal(t, 0, current.ExportMaxSeries)
+		})
+	}
+}
+
+func TestApplyConfigFileConcurrentReads(t *testing.T) {
+	path := setupReload(t, "")
+
+	var wg sync.WaitGroup
+	stop := make(chan struct{})
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+				// the readers see either config, never a config being copied
+				c := GetGlobalConfig()
+				_ = c.ExportMaxSeries + len(c.AgentTags)
+			}
+		}
+	}()
+
+	for _, contents := range []string{"export_max_series = 10\n", "agent_tags = [\"env:prod\"]\n", ""} {
+		require.NoError(t, ioutil.WriteFile(path, []byte(contents), 0600))
+		_, err := applyConfigFile()
+		require.NoError(t, err)
+	}
+	close(stop)
+	wg.Wait()
+	assert.Equal(t, 0, GetGlobalConfig().ExportMaxSeries)
+}
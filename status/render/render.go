@@ -0,0 +1,114 @@
+// Package render renders the status served by the admin API as text. It
+// doesn't depend on the status package, whose templates need the Datadog
+// agent distribution.
+package render
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"text/template"
+)
+
+var statusTemplate = template.Must(template.New("status").Funcs(template.FuncMap{"scalar": formatScalar}).Parse(`===============
+Doppler (v{{.version}})
+===============
+
+  Status date: {{.time}}
+  Agent start: {{.agent_start}} (uptime {{.uptime}})
+  Pid: {{scalar .pid}}
+  Go Version: {{.go_version}}
+  Arch: {{.build_arch}}
+  Hostname: {{.hostname}}
+
+======
+Health
+======
+{{- with .health}}{{if .error}}
+  Error: {{.error}}
+{{- else}}
+  Healthy: {{range $i, $c := .Healthy}}{{if $i}}, {{end}}{{$c}}{{end}}
+  Unhealthy: {{range $i, $c := .Unhealthy}}{{if $i}}, {{end}}{{$c}}{{end}}
+{{- end}}{{end}}
+`))
+
+// FormatStatus renders the status returned by the admin API: the header,
+// the health, then a section per expvar of the components
+func FormatStatus(stats map[string]interface{}) (string, error) {
+	var b bytes.Buffer
+	if err := statusTemplate.Execute(&b, stats); err != nil {
+		return "", err
+	}
+
+	expvars, _ := stats["expvars"].(map[string]interface{})
+	for _, name := range sortedKeys(expvars) {
+		title := strings.Title(name)
+		fmt.Fprintf(&b, "\n%s\n%s\n%s\n", strings.Repeat("=", len(title)), title, strings.Repeat("=", len(title)))
+		renderValue(&b, "  ", expvars[name])
+	}
+	return b.String(), nil
+}
+
+func renderValue(w io.Writer, indent string, value interface{}) {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		if len(v) == 0 {
+			fmt.Fprintf(w, "%s-\n", indent)
+		}
+		for _, key := range sortedKeys(v) {
+			switch child := v[key].(type) {
+			case []interface{}:
+				if scalars, ok := inlineScalars(child); ok {
+					fmt.Fprintf(w, "%s%s: [%s]\n", indent, key, scalars)
+					continue
+				}
+				fmt.Fprintf(w, "%s%s:\n", indent, key)
+				renderValue(w, indent+"  ", child)
+			case map[string]interface{}:
+				fmt.Fprintf(w, "%s%s:\n", indent, key)
+				renderValue(w, indent+"  ", child)
+			default:
+				fmt.Fprintf(w, "%s%s: %v\n", indent, key, formatScalar(child))
+			}
+		}
+	case []interface{}:
+		for _, child := range v {
+			fmt.Fprintf(w, "%s- %v\n", indent, formatScalar(child))
+		}
+	default:
+		fmt.Fprintf(w, "%s%v\n", indent, formatScalar(v))
+	}
+}
+
+// inlineScalars joins a list of scalars, like the flush times, on a single line
+func inlineScalars(values []interface{}) (string, bool) {
+	parts := make([]string, len(values))
+	for i, value := range values {
+		switch value.(type) {
+		case map[string]interface{}, []interface{}:
+			return "", false
+		}
+		parts[i] = fmt.Sprint(formatScalar(value))
+	}
+	return strings.Join(parts, " "), true
+}
+
+// formatScalar prints the integers decoded as float64 without exponent
+func formatScalar(v interface{}) interface{} {
+	if f, ok := v.(float64); ok {
+		return strconv.FormatFloat(f, 'f', -1, 64)
+	}
+	return v
+}
+
+func sortedKeys(m map[string]interface{}) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,70 @@
+package render
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFormatStatus(t *testing.T) {
+	var stats map[string]interface{}
+	require.NoError(t, json.Unmarshal([]byte(`{
+		"version": "1.2.0",
+		"time": "2026-10-17 10:00:00.000000 UTC",
+		"agent_start": "2026-10-17 09:00:00.000000 UTC",
+		"uptime": "1h0m0s",
+		"pid": 1234567,
+		"go_version": "go1.13",
+		"build_arch": "amd64",
+		"hostname": "host",
+		"health": {"Healthy": ["agent", "aggregator"], "Unhealthy": []},
+		"expvars": {
+			"aggregator": {"Flush": {"Series": {"LastFlush": 12}}, "FlushTimes": [1.5, 2]},
+			"dogstatsd": {"Errors": [{"a": 1}], "Empty": {}}
+		}
+	}`), &stats))
+
+	out, err := FormatStatus(stats)
+	require.NoError(t, err)
+	assert.Equal(t, `===============
+Doppler (v1.2.0)
+===============
+
+  Status date: 2026-10-17 10:00:00.000000 UTC
+  Agent start: 2026-10-17 09:00:00.000000 UTC (uptime 1h0m0s)
+  Pid: 1234567
+  Go Version: go1.13
+  Arch: amd64
+  Hostname: host
+
+======
+Health
+======
+  Healthy: agent, aggregator
+  Unhealthy: 
+
+==========
+Aggregator
+==========
+  Flush:
+    Series:
+      LastFlush: 12
+  FlushTimes: [1.5 2]
+
+=========
+Dogstatsd
+=========
+  Empty:
+    -
+  Errors:
+    - map[a:1]
+`, out)
+}
+
+func TestFormatStatusHealthError(t *testing.T) {
+	out, err := FormatStatus(map[string]interface{}{"health": map[string]interface{}{"error": "timeout"}})
+	require.NoError(t, err)
+	assert.Contains(t, out, "======\nHealth\n======\n  Error: timeout\n")
+}
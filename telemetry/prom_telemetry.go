@@ -4,6 +4,7 @@ import (
 	"net/http"
 
 	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
 
@@ -16,9 +17,20 @@ var (
 func init() {
 	telemetryRegistry.MustRegister(prometheus.NewProcessCollector(prometheus.ProcessCollectorOpts{}))
 	telemetryRegistry.MustRegister(prometheus.NewGoCollector())
+
+	// the default registry still holds the metrics of the util packages,
+	// its runtime collectors would be duplicates of the ones above
+	prometheus.Unregister(collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}))
+	prometheus.Unregister(collectors.NewGoCollector())
+}
+
+// Gatherer returns the gatherer of the internal metrics: the telemetry
+// and the metrics of the default registry.
+func Gatherer() prometheus.Gatherer {
+	return prometheus.Gatherers{telemetryGatherer, prometheus.DefaultGatherer}
 }
 
 // Handler serves the HTTP route containing the prometheus metrics.
 func Handler() http.Handler {
-	return promhttp.HandlerFor(telemetryRegistry, promhttp.HandlerOpts{})
+	return promhttp.HandlerFor(Gatherer(), promhttp.HandlerOpts{})
 }
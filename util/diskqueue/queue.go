@@ -0,0 +1,495 @@
+// Package diskqueue implements a FIFO of payloads written ahead to disk, so
+// that the payloads not yet delivered survive the outages of their
+// destination and the restarts of the agent.
+package diskqueue
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/frankhang/doppler/config"
+	"github.com/frankhang/doppler/telemetry"
+)
+
+const (
+	// headerSize is the size of the header of a record: the length and the
+	// checksum of its payload, and the time it was pushed at
+	headerSize = 16
+
+	segmentExt         = ".seg"
+	cursorFile         = "cursor"
+	defaultSegmentSize = 16 << 20
+)
+
+var (
+	tlmDepth = telemetry.NewGauge("disk_queue", "depth",
+		[]string{"queue"}, "Number of payloads in the disk queue")
+	tlmBytes = telemetry.NewGauge("disk_queue", "bytes",
+		[]string{"queue"}, "Size of the files of the disk queue")
+	tlmDropped = telemetry.NewCounter("disk_queue", "dropped",
+		[]string{"queue", "reason"}, "Count of payloads dropped from the disk queue")
+)
+
+var (
+	errClosed    = errors.New("the disk queue is closed")
+	errCorrupted = errors.New("corrupted record")
+)
+
+// Options configure a queue
+type Options struct {
+	// Dir is the directory of the files of the queue.
+	Dir string
+	// MaxSize is the size of the files beyond which the oldest payloads are
+	// dropped, 0 for no limit.
+	MaxSize int64
+	// MaxAge is the age beyond which the payloads are dropped, 0 for no limit.
+	MaxAge time.Duration
+	// SegmentSize is the size of the files the queue is split into, the
+	// payloads are dropped a file at a time.
+	SegmentSize int64
+}
+
+// OptionsFromConfig returns the options of the queues in the directory dir of
+// the disk buffer, nil if the disk buffer is disabled
+func OptionsFromConfig(c config.DiskBuffer, dir string) *Options {
+	if c.Path == "" {
+		return nil
+	}
+	return &Options{
+		Dir:         filepath.Join(c.Path, dir),
+		MaxSize:     c.MaxSize,
+		MaxAge:      time.Duration(c.MaxAge) * time.Second,
+		SegmentSize: c.SegmentSize,
+	}
+}
+
+// segment is a file of the queue, the records are appended to the last one
+// and read from the first one
+type segment struct {
+	id     uint64
+	size   int64     // of the file
+	count  int       // of the unread records
+	newest time.Time // of the last record
+}
+
+// Queue is a FIFO of payloads appended to segment files. The position of the
+// oldest payload is kept in a cursor file, the payloads are delivered at least
+// once across the restarts.
+type Queue struct {
+	name string
+	opts Options
+
+	m          sync.Mutex
+	segments   []*segment // oldest first
+	writer     *os.File   // of the last segment
+	reader     *os.File   // of the first segment, opened when read
+	readOffset int64      // in the first segment
+	peeked     int64      // size of the record returned by Peek, 0 if none
+	cursor     *os.File
+	count      int
+	size       int64
+	closed     bool
+
+	pushed chan struct{}
+}
+
+// Open opens the queue in the directory of the options, with the payloads left
+// by the previous runs. The name of the queue tags its telemetry.
+func Open(name string, opts Options) (*Queue, error) {
+	if opts.SegmentSize <= 0 {
+		opts.SegmentSize = defaultSegmentSize
+	}
+	if opts.MaxSize > 0 && opts.SegmentSize > opts.MaxSize/4 {
+		// the size is capped by dropping whole segments, keep a few of them
+		opts.SegmentSize = opts.MaxSize / 4
+	}
+	if err := os.MkdirAll(opts.Dir, 0700); err != nil {
+		return nil, err
+	}
+
+	q := &Queue{
+		name:   name,
+		opts:   opts,
+		pushed: make(chan struct{}, 1),
+	}
+	if err := q.load(); err != nil {
+		q.closeFiles()
+		return nil, fmt.Errorf("could not open the disk queue %s: %v", name, err)
+	}
+	q.updateTelemetry()
+	return q, nil
+}
+
+// load scans the segments from the cursor on, and opens the last one for
+// writing, its torn last record, if any, is truncated
+func (q *Queue) load() error {
+	var err error
+	q.cursor, err = os.OpenFile(filepath.Join(q.opts.Dir, cursorFile), os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	cursorID, cursorOffset := uint64(1), int64(0)
+	buf := make([]byte, 16)
+	if _, err := q.cursor.ReadAt(buf, 0); err == nil {
+		cursorID = binary.BigEndian.Uint64(buf[:8])
+		cursorOffset = int64(binary.BigEndian.Uint64(buf[8:]))
+	}
+
+	ids, err := listSegments(q.opts.Dir)
+	if err != nil {
+		return err
+	}
+	var validSize int64
+	for _, id := range ids {
+		if id < cursorID {
+			// read before the last stop
+			os.Remove(q.segmentPath(id))
+			continue
+		}
+		var from int64
+		if id == cursorID {
+			from = cursorOffset
+		}
+		seg := &segment{id: id}
+		validSize, err = q.scan(seg, from)
+		if err != nil {
+			return err
+		}
+		if len(q.segments) == 0 {
+			q.readOffset = from
+		}
+		q.segments = append(q.segments, seg)
+		q.count += seg.count
+		q.size += seg.size
+	}
+
+	if len(q.segments) == 0 {
+		return q.createSegment(cursorID)
+	}
+	last := q.segments[len(q.segments)-1]
+	q.writer, err = os.OpenFile(q.segmentPath(last.id), os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	if validSize < last.size {
+		if err := q.writer.Truncate(validSize); err != nil {
+			return err
+		}
+		q.size -= last.size - validSize
+		last.size = validSize
+	}
+	return nil
+}
+
+// scan counts the valid records of the segment from the offset, and returns
+// the offset of the end of the last one
+func (q *Queue) scan(seg *segment, from int64) (int64, error) {
+	f, err := os.Open(q.segmentPath(seg.id))
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return 0, err
+	}
+	seg.size = info.Size()
+
+	offset := from
+	for offset < seg.size {
+		_, pushedAt, n, err := readRecord(f, offset, seg.size)
+		if err != nil {
+			break
+		}
+		offset += n
+		seg.count++
+		seg.newest = pushedAt
+	}
+	return offset, nil
+}
+
+// Push appends the payload to the queue, the oldest payloads are dropped when
+// the queue is too large
+func (q *Queue) Push(payload []byte) error {
+	q.m.Lock()
+	defer q.m.Unlock()
+	if q.closed {
+		return errClosed
+	}
+
+	now := time.Now()
+	n := int64(headerSize + len(payload))
+	last := q.segments[len(q.segments)-1]
+	if last.size > 0 && last.size+n > q.opts.SegmentSize {
+		if err := q.createSegment(last.id + 1); err != nil {
+			return err
+		}
+		last = q.segments[len(q.segments)-1]
+	}
+
+	record := make([]byte, n)
+	binary.BigEndian.PutUint32(record[0:4], uint32(len(payload)))
+	binary.BigEndian.PutUint32(record[4:8], crc32.ChecksumIEEE(payload))
+	binary.BigEndian.PutUint64(record[8:16], uint64(now.UnixNano()))
+	copy(record[headerSize:], payload)
+	if _, err := q.writer.Write(record); err != nil {
+		// don't leave a torn record behind
+		q.writer.Truncate(last.size)
+		return err
+	}
+	last.size += n
+	last.count++
+	last.newest = now
+	q.size += n
+	q.count++
+
+	q.dropOldSegments()
+	q.updateTelemetry()
+	select {
+	case q.pushed <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// dropOldSegments drops the oldest segments while the queue is too large or
+// they only hold too old payloads, the last segment is kept
+func (q *Queue) dropOldSegments() {
+	for len(q.segments) > 1 {
+		first := q.segments[0]
+		switch {
+		case q.opts.MaxSize > 0 && q.size > q.opts.MaxSize:
+			q.drop(first.count, "max_size")
+		case q.opts.MaxAge > 0 && time.Since(first.newest) > q.opts.MaxAge:
+			q.drop(first.count, "max_age")
+		default:
+			return
+		}
+		q.removeFirstSegment()
+	}
+}
+
+// Peek returns the oldest payload of the queue, nil if it is empty. The payload
+// stays in the queue until it is popped.
+func (q *Queue) Peek() ([]byte, error) {
+	q.m.Lock()
+	defer q.m.Unlock()
+	if q.closed {
+		return nil, errClosed
+	}
+
+	for {
+		first := q.segments[0]
+		if q.readOffset >= first.size {
+			if len(q.segments) == 1 {
+				return nil, nil
+			}
+			q.removeFirstSegment()
+			continue
+		}
+
+		if q.reader == nil {
+			reader, err := os.Open(q.segmentPath(first.id))
+			if err != nil {
+				return nil, err
+			}
+			q.reader = reader
+		}
+		payload, pushedAt, n, err := readRecord(q.reader, q.readOffset, first.size)
+		if err != nil {
+			// skip the rest of the segment
+			q.drop(first.count, "corrupted")
+			q.count -= first.count
+			first.count = 0
+			q.readOffset = first.size
+			q.updateTelemetry()
+			continue
+		}
+		if q.opts.MaxAge > 0 && time.Since(pushedAt) > q.opts.MaxAge {
+			q.drop(1, "max_age")
+			q.advance(n)
+			continue
+		}
+		q.peeked = n
+		return payload, nil
+	}
+}
+
+// Pop removes the payload returned by the last Peek from the queue, unless it
+// was dropped since
+func (q *Queue) Pop() error {
+	q.m.Lock()
+	defer q.m.Unlock()
+	if q.closed {
+		return errClosed
+	}
+	if q.peeked == 0 {
+		return nil
+	}
+	return q.advance(q.peeked)
+}
+
+// advance moves the cursor past the first record of n bytes
+func (q *Queue) advance(n int64) error {
+	first := q.segments[0]
+	q.readOffset += n
+	q.peeked = 0
+	first.count--
+	q.count--
+	q.updateTelemetry()
+	return q.writeCursor(first.id, q.readOffset)
+}
+
+// Pushed returns a channel signaled when payloads are pushed
+func (q *Queue) Pushed() <-chan struct{} {
+	return q.pushed
+}
+
+// Len returns the number of payloads in the queue
+func (q *Queue) Len() int {
+	q.m.Lock()
+	defer q.m.Unlock()
+	return q.count
+}
+
+// Size returns the size of the files of the queue
+func (q *Queue) Size() int64 {
+	q.m.Lock()
+	defer q.m.Unlock()
+	return q.size
+}
+
+// Close closes the files of the queue, its payloads are read again once it
+// is opened
+func (q *Queue) Close() error {
+	q.m.Lock()
+	defer q.m.Unlock()
+	if q.closed {
+		return nil
+	}
+	q.closed = true
+	err := q.writer.Sync()
+	q.closeFiles()
+	return err
+}
+
+func (q *Queue) closeFiles() {
+	for _, f := range []*os.File{q.writer, q.reader, q.cursor} {
+		if f != nil {
+			f.Close()
+		}
+	}
+}
+
+// createSegment creates the segment and makes it the one written to
+func (q *Queue) createSegment(id uint64) error {
+	f, err := os.OpenFile(q.segmentPath(id), os.O_WRONLY|os.O_APPEND|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	if q.writer != nil {
+		q.writer.Sync()
+		q.writer.Close()
+	}
+	q.writer = f
+	q.segments = append(q.segments, &segment{id: id})
+	return nil
+}
+
+// removeFirstSegment deletes the first segment, its unread records must have
+// been accounted for
+func (q *Queue) removeFirstSegment() {
+	first := q.segments[0]
+	if q.reader != nil {
+		q.reader.Close()
+		q.reader = nil
+	}
+	os.Remove(q.segmentPath(first.id))
+	q.segments = q.segments[1:]
+	q.count -= first.count
+	q.size -= first.size
+	q.readOffset = 0
+	q.peeked = 0
+	q.writeCursor(q.segments[0].id, 0)
+	q.updateTelemetry()
+}
+
+func (q *Queue) drop(count int, reason string) {
+	if count > 0 {
+		tlmDropped.Add(float64(count), q.name, reason)
+	}
+}
+
+func (q *Queue) writeCursor(id uint64, offset int64) error {
+	buf := make([]byte, 16)
+	binary.BigEndian.PutUint64(buf[:8], id)
+	binary.BigEndian.PutUint64(buf[8:], uint64(offset))
+	_, err := q.cursor.WriteAt(buf, 0)
+	return err
+}
+
+func (q *Queue) updateTelemetry() {
+	tlmDepth.Set(float64(q.count), q.name)
+	tlmBytes.Set(float64(q.size), q.name)
+}
+
+func (q *Queue) segmentPath(id uint64) string {
+	return filepath.Join(q.opts.Dir, fmt.Sprintf("%020d%s", id, segmentExt))
+}
+
+// readRecord returns the payload, the push time and the size of the record at
+// the offset, which must end before end
+func readRecord(r io.ReaderAt, offset int64, end int64) ([]byte, time.Time, int64, error) {
+	header := make([]byte, headerSize)
+	if offset+headerSize > end {
+		return nil, time.Time{}, 0, errCorrupted
+	}
+	if _, err := r.ReadAt(header, offset); err != nil {
+		return nil, time.Time{}, 0, errCorrupted
+	}
+	length := int64(binary.BigEndian.Uint32(header[0:4]))
+	if offset+headerSize+length > end {
+		return nil, time.Time{}, 0, errCorrupted
+	}
+	payload := make([]byte, length)
+	if _, err := r.ReadAt(payload, offset+headerSize); err != nil {
+		return nil, time.Time{}, 0, errCorrupted
+	}
+	if crc32.ChecksumIEEE(payload) != binary.BigEndian.Uint32(header[4:8]) {
+		return nil, time.Time{}, 0, errCorrupted
+	}
+	pushedAt := time.Unix(0, int64(binary.BigEndian.Uint64(header[8:16])))
+	return payload, pushedAt, int64(headerSize + len(payload)), nil
+}
+
+// listSegments returns the ids of the segments of the directory, in order
+func listSegments(dir string) ([]uint64, error) {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var ids []uint64
+	for _, file := range files {
+		if !strings.HasSuffix(file.Name(), segmentExt) {
+			continue
+		}
+		id, err := strconv.ParseUint(strings.TrimSuffix(file.Name(), segmentExt), 10, 64)
+		if err != nil {
+			continue
+		}
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	return ids, nil
+}
@@ -0,0 +1,192 @@
+package diskqueue
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestQueue(t *testing.T, opts Options) *Queue {
+	q, err := Open("test", opts)
+	require.Nil(t, err)
+	return q
+}
+
+func pop(t *testing.T, q *Queue) string {
+	payload, err := q.Peek()
+	require.Nil(t, err)
+	require.Nil(t, q.Pop())
+	return string(payload)
+}
+
+func TestQueuePushPop(t *testing.T) {
+	dir, err := ioutil.TempDir("", "diskqueue")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	q := newTestQueue(t, Options{Dir: dir, SegmentSize: 64})
+	defer q.Close()
+
+	payload, err := q.Peek()
+	assert.Nil(t, err)
+	assert.Nil(t, payload)
+
+	for i := 0; i < 10; i++ {
+		assert.Nil(t, q.Push([]byte(fmt.Sprintf("payload %d", i))))
+	}
+	assert.Equal(t, 10, q.Len())
+	assert.Equal(t, int64(10*(headerSize+len("payload 0"))), q.Size())
+	select {
+	case <-q.Pushed():
+	default:
+		assert.Fail(t, "the push should be signaled")
+	}
+
+	// a payload stays in the queue until popped
+	payload, err = q.Peek()
+	assert.Nil(t, err)
+	assert.Equal(t, "payload 0", string(payload))
+	payload, err = q.Peek()
+	assert.Nil(t, err)
+	assert.Equal(t, "payload 0", string(payload))
+
+	for i := 0; i < 10; i++ {
+		assert.Equal(t, fmt.Sprintf("payload %d", i), pop(t, q))
+	}
+	payload, err = q.Peek()
+	assert.Nil(t, err)
+	assert.Nil(t, payload)
+	assert.Equal(t, 0, q.Len())
+
+	// the read segments are deleted
+	segments, err := filepath.Glob(filepath.Join(dir, "*"+segmentExt))
+	assert.Nil(t, err)
+	assert.Len(t, segments, 1)
+}
+
+func TestQueueSurvivesRestarts(t *testing.T) {
+	dir, err := ioutil.TempDir("", "diskqueue")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	q := newTestQueue(t, Options{Dir: dir, SegmentSize: 64})
+	for i := 0; i < 10; i++ {
+		assert.Nil(t, q.Push([]byte(fmt.Sprintf("payload %d", i))))
+	}
+	assert.Equal(t, "payload 0", pop(t, q))
+	assert.Equal(t, "payload 1", pop(t, q))
+	// peeked but not popped, sent again after the restart
+	_, err = q.Peek()
+	assert.Nil(t, err)
+	assert.Nil(t, q.Close())
+
+	q = newTestQueue(t, Options{Dir: dir, SegmentSize: 64})
+	assert.Equal(t, 8, q.Len())
+	assert.Nil(t, q.Push([]byte("payload 10")))
+	for i := 2; i <= 10; i++ {
+		assert.Equal(t, fmt.Sprintf("payload %d", i), pop(t, q))
+	}
+	assert.Nil(t, q.Close())
+
+	q = newTestQueue(t, Options{Dir: dir, SegmentSize: 64})
+	defer q.Close()
+	assert.Equal(t, 0, q.Len())
+	payload, err := q.Peek()
+	assert.Nil(t, err)
+	assert.Nil(t, payload)
+}
+
+func TestQueueTruncatesTornRecords(t *testing.T) {
+	dir, err := ioutil.TempDir("", "diskqueue")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	q := newTestQueue(t, Options{Dir: dir})
+	assert.Nil(t, q.Push([]byte("complete")))
+	assert.Nil(t, q.Close())
+
+	// a crash in the middle of a write
+	f, err := os.OpenFile(q.segmentPath(1), os.O_WRONLY|os.O_APPEND, 0600)
+	require.Nil(t, err)
+	_, err = f.Write([]byte{0, 0, 0, 42, 1, 2})
+	require.Nil(t, err)
+	f.Close()
+
+	q = newTestQueue(t, Options{Dir: dir})
+	defer q.Close()
+	assert.Equal(t, 1, q.Len())
+	assert.Nil(t, q.Push([]byte("next")))
+	assert.Equal(t, "complete", pop(t, q))
+	assert.Equal(t, "next", pop(t, q))
+}
+
+func TestQueueMaxSize(t *testing.T) {
+	dir, err := ioutil.TempDir("", "diskqueue")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	// 4 records of 26 bytes per segment
+	q := newTestQueue(t, Options{Dir: dir, MaxSize: 416, SegmentSize: 104})
+	defer q.Close()
+	for i := 0; i < 40; i++ {
+		assert.Nil(t, q.Push([]byte(fmt.Sprintf("payload %d", i))))
+		assert.True(t, q.Size() <= 416)
+	}
+
+	// the oldest segments were dropped
+	assert.Equal(t, 16, q.Len())
+	assert.Equal(t, "payload 24", pop(t, q))
+}
+
+func TestQueueMaxSizeDropsPeekedPayload(t *testing.T) {
+	dir, err := ioutil.TempDir("", "diskqueue")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	q := newTestQueue(t, Options{Dir: dir, MaxSize: 416, SegmentSize: 104})
+	defer q.Close()
+	assert.Nil(t, q.Push([]byte("payload 00")))
+	payload, err := q.Peek()
+	assert.Nil(t, err)
+	assert.Equal(t, "payload 00", string(payload))
+
+	for i := 1; i < 20; i++ {
+		assert.Nil(t, q.Push([]byte(fmt.Sprintf("payload %02d", i))))
+	}
+	// the peeked payload was dropped, the pop must not skip the next one
+	assert.Nil(t, q.Pop())
+	assert.Equal(t, "payload 04", pop(t, q))
+}
+
+func TestQueueMaxAge(t *testing.T) {
+	dir, err := ioutil.TempDir("", "diskqueue")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	q := newTestQueue(t, Options{Dir: dir, MaxAge: 50 * time.Millisecond})
+	defer q.Close()
+	assert.Nil(t, q.Push([]byte("old")))
+	time.Sleep(100 * time.Millisecond)
+	assert.Nil(t, q.Push([]byte("new")))
+
+	assert.Equal(t, "new", pop(t, q))
+	assert.Equal(t, 0, q.Len())
+}
+
+func TestQueueClosed(t *testing.T) {
+	dir, err := ioutil.TempDir("", "diskqueue")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	q := newTestQueue(t, Options{Dir: dir})
+	assert.Nil(t, q.Close())
+	assert.NotNil(t, q.Push([]byte("payload")))
+	_, err = q.Peek()
+	assert.NotNil(t, err)
+}